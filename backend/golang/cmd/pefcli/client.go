@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// client talks to the records JSON API of a server.
+type client struct {
+	baseURL string
+	token   string
+	http    *http.Client
+}
+
+func newClient(baseURL, token string, httpClient *http.Client) *client {
+	return &client{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		token:   token,
+		http:    httpClient,
+	}
+}
+
+// apiError is the error payload of the API.
+type apiError struct {
+	StatusCode int    `json:"-"`
+	Status     string `json:"status"`
+	ErrorText  string `json:"error"`
+}
+
+func (e *apiError) Error() string {
+	if e.ErrorText == "" {
+		return fmt.Sprintf("server answered %d %s", e.StatusCode, e.Status)
+	}
+	return fmt.Sprintf("server answered %d %s: %s", e.StatusCode, e.Status, e.ErrorText)
+}
+
+// CreateRecord posts a new record and returns it as stored by the server.
+func (c *client) CreateRecord(ctx context.Context, record *models.Record) (*models.Record, error) {
+	created := &models.Record{}
+	err := c.do(ctx, http.MethodPost, "/records", record, created)
+	if err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+// ListRecords returns all records of the server.
+func (c *client) ListRecords(ctx context.Context) ([]*models.Record, error) {
+	var records []*models.Record
+	err := c.do(ctx, http.MethodGet, "/records", nil, &records)
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+func (c *client) do(ctx context.Context, method, path string, body, result any) error {
+	var payload io.Reader
+	if body != nil {
+		content, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		payload = bytes.NewReader(content)
+	}
+
+	r, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, payload)
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Accept", "application/json")
+	if body != nil {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		r.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	rs, err := c.http.Do(r)
+	if err != nil {
+		return err
+	}
+	defer rs.Body.Close()
+
+	if rs.StatusCode >= http.StatusBadRequest {
+		apiErr := &apiError{StatusCode: rs.StatusCode, Status: http.StatusText(rs.StatusCode)}
+		_ = json.NewDecoder(rs.Body).Decode(apiErr) // not every error has a payload
+		return apiErr
+	}
+
+	err = json.NewDecoder(rs.Body).Decode(result)
+	if err != nil {
+		return fmt.Errorf("decoding %s %s response: %w", method, path, err)
+	}
+	return nil
+}
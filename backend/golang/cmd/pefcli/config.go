@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+const envConfigFile = "PEFCLI_CONFIG"
+
+// cliConfig is the YAML config file of the client.
+type cliConfig struct {
+	// URL of the server, like https://peakflow.example
+	URL string `yaml:"url"`
+	// Token is sent as bearer token, if set.
+	Token string `yaml:"token"`
+}
+
+// defaultConfigFile is pefcli/config.yaml in the user config directory.
+func defaultConfigFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "pefcli", "config.yaml")
+}
+
+// loadConfig reads path, or PEFCLI_CONFIG, or the default file. Only a
+// missing default file is fine, the server may be given with flags then.
+func loadConfig(path string, lookupEnv func(string) (string, bool)) (*cliConfig, error) {
+	cfg := &cliConfig{}
+
+	explicit := true
+	if path == "" {
+		path, _ = lookupEnv(envConfigFile)
+	}
+	if path == "" {
+		path, explicit = defaultConfigFile(), false
+	}
+	if path == "" {
+		return cfg, nil
+	}
+
+	content, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) && !explicit {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("config: %w", err)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	err = decoder.Decode(cfg)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("config: %s: %w", path, err)
+	}
+	return cfg, nil
+}
@@ -0,0 +1,354 @@
+// Command pefcli logs and queries peak flow readings of a server over its
+// JSON API.
+//
+//	pefcli add 480 --context morning
+//	pefcli list --since 7d
+//	pefcli stats
+//	pefcli export --format csv
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const usage = `Usage: pefcli <command> [arguments] [flags]
+
+Commands:
+  add VALUE    log a reading, flags --context, --at and --tz
+  list         list readings, newest first, flag --since
+  stats        summarize readings, flag --since
+  export       write readings as CSV or JSON, flags --format, --since and --out
+
+Common flags:
+  --config FILE    config file with url and token, or set PEFCLI_CONFIG
+  --url URL        server URL, overrides the config file
+  --token TOKEN    API token, overrides the config file
+  -o, --output     table or json
+
+--since takes a duration like 7d or 12h, or a date like 2024-03-01.
+`
+
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+
+	formatCSV  = "csv"
+	formatJSON = "json"
+)
+
+// dateTimeLayout is used for --at, in local time unless --tz is given, and
+// for the table output, on the clock where readings were taken.
+const dateTimeLayout = "2006-01-02T15:04"
+
+type cli struct {
+	stdout, stderr io.Writer
+	lookupEnv      func(string) (string, bool)
+	httpClient     *http.Client
+	now            func() time.Time
+}
+
+// commonFlags are accepted by every command.
+type commonFlags struct {
+	config, url, token, output string
+}
+
+func main() {
+	c := &cli{
+		stdout:     os.Stdout,
+		stderr:     os.Stderr,
+		lookupEnv:  os.LookupEnv,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+		now:        time.Now,
+	}
+	os.Exit(c.run(context.Background(), os.Args[1:]))
+}
+
+// run executes the command of args and returns the exit code.
+func (c *cli) run(ctx context.Context, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(c.stderr, usage)
+		return 2
+	}
+
+	var err error
+	switch args[0] {
+	case "add":
+		err = c.add(ctx, args[1:])
+	case "list":
+		err = c.list(ctx, args[1:])
+	case "stats":
+		err = c.stats(ctx, args[1:])
+	case "export":
+		err = c.export(ctx, args[1:])
+	case "help", "-h", "--help":
+		fmt.Fprint(c.stdout, usage)
+		return 0
+	default:
+		fmt.Fprintf(c.stderr, "pefcli: unknown command %q\n\n%s", args[0], usage)
+		return 2
+	}
+
+	var usageErr *usageError
+	switch {
+	case errors.Is(err, flag.ErrHelp):
+		return 0
+	case errors.As(err, &usageErr):
+		fmt.Fprintf(c.stderr, "pefcli %s: %v\n", args[0], err)
+		return 2
+	case err != nil:
+		fmt.Fprintf(c.stderr, "pefcli %s: %v\n", args[0], err)
+		return 1
+	}
+	return 0
+}
+
+// usageError is a mistake in the command line, as opposed to a failed request.
+type usageError struct {
+	err error
+}
+
+func (e *usageError) Error() string {
+	return e.err.Error()
+}
+
+func newUsageError(format string, args ...any) error {
+	return &usageError{err: fmt.Errorf(format, args...)}
+}
+
+func (c *cli) newFlagSet(name string, common *commonFlags) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(c.stderr)
+	flags.StringVar(&common.config, "config", "", "config file with url and token, or set "+envConfigFile)
+	flags.StringVar(&common.url, "url", "", "server URL, overrides the config file")
+	flags.StringVar(&common.token, "token", "", "API token, overrides the config file")
+	flags.StringVar(&common.output, "output", outputTable, "output as table or json")
+	flags.StringVar(&common.output, "o", outputTable, "shorthand for --output")
+	return flags
+}
+
+// parse parses flags placed before, between or after the positional
+// arguments, which are returned.
+func parse(flags *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		err := flags.Parse(args)
+		if errors.Is(err, flag.ErrHelp) {
+			return nil, err
+		}
+		if err != nil {
+			return nil, &usageError{err: err}
+		}
+		if flags.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+}
+
+// client connects to the server of the config file, unless flags override it.
+func (c *cli) client(common *commonFlags) (*client, error) {
+	if common.output != outputTable && common.output != outputJSON {
+		return nil, newUsageError("unknown output %q, want table or json", common.output)
+	}
+
+	cfg, err := loadConfig(common.config, c.lookupEnv)
+	if err != nil {
+		return nil, err
+	}
+	if common.url != "" {
+		cfg.URL = common.url
+	}
+	if common.token != "" {
+		cfg.Token = common.token
+	}
+	if cfg.URL == "" {
+		return nil, newUsageError("no server URL, set url in %s or use --url", defaultConfigFile())
+	}
+
+	return newClient(cfg.URL, cfg.Token, c.httpClient), nil
+}
+
+func (c *cli) add(ctx context.Context, args []string) error {
+	common := &commonFlags{}
+	flags := c.newFlagSet("add", common)
+	readingContext := flags.String("context", "", "context of the reading, like morning or after inhaler")
+	at := flags.String("at", "", "time of the reading as "+dateTimeLayout+", now by default")
+	tz := flags.String("tz", "", "time zone the reading is taken in, like Asia/Tokyo or +09:00, the one of the user on the server by default")
+
+	positional, err := parse(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return newUsageError("want exactly one VALUE, got %d arguments", len(positional))
+	}
+
+	value, err := strconv.ParseFloat(positional[0], 32)
+	if err != nil || value <= 0 {
+		return newUsageError("VALUE must be a positive number, got %q", positional[0])
+	}
+
+	location := time.Local
+	if *tz != "" {
+		location, err = models.LoadTimezone(*tz)
+		if err != nil {
+			return newUsageError("--tz: %v", err)
+		}
+	}
+
+	createdAt := c.now()
+	if *at != "" {
+		createdAt, err = time.ParseInLocation(dateTimeLayout, *at, location)
+		if err != nil {
+			return newUsageError("--at must look like %s, got %q", dateTimeLayout, *at)
+		}
+	}
+
+	api, err := c.client(common)
+	if err != nil {
+		return err
+	}
+
+	record, err := api.CreateRecord(ctx, &models.Record{
+		CreatedAt: createdAt,
+		Value:     float32(value),
+		Context:   *readingContext,
+		Timezone:  *tz,
+	})
+	if err != nil {
+		return err
+	}
+
+	return c.printRecords(common.output, []*models.Record{record})
+}
+
+func (c *cli) list(ctx context.Context, args []string) error {
+	common := &commonFlags{}
+	flags := c.newFlagSet("list", common)
+	since := flags.String("since", "", "only readings since a duration ago like 7d, or a date")
+
+	records, err := c.fetch(ctx, flags, common, since, args)
+	if err != nil {
+		return err
+	}
+	return c.printRecords(common.output, records)
+}
+
+func (c *cli) stats(ctx context.Context, args []string) error {
+	common := &commonFlags{}
+	flags := c.newFlagSet("stats", common)
+	since := flags.String("since", "", "only readings since a duration ago like 7d, or a date")
+
+	records, err := c.fetch(ctx, flags, common, since, args)
+	if err != nil {
+		return err
+	}
+	return c.printStats(common.output, newStats(records))
+}
+
+func (c *cli) export(ctx context.Context, args []string) error {
+	common := &commonFlags{}
+	flags := c.newFlagSet("export", common)
+	since := flags.String("since", "", "only readings since a duration ago like 7d, or a date")
+	format := flags.String("format", formatCSV, "csv or json")
+	out := flags.String("out", "", "file to write, stdout by default")
+
+	records, err := c.fetch(ctx, flags, common, since, args)
+	if err != nil {
+		return err
+	}
+
+	var write func(io.Writer, []*models.Record) error
+	switch *format {
+	case formatCSV:
+		write = writeCSV
+	case formatJSON:
+		write = func(w io.Writer, records []*models.Record) error { return writeJSON(w, records) }
+	default:
+		return newUsageError("unknown format %q, want csv or json", *format)
+	}
+
+	if *out == "" {
+		return write(c.stdout, records)
+	}
+
+	file, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	err = write(file, records)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// fetch parses the flags of a query command and returns the matching
+// records, newest first.
+func (c *cli) fetch(ctx context.Context, flags *flag.FlagSet, common *commonFlags, since *string, args []string) ([]*models.Record, error) {
+	positional, err := parse(flags, args)
+	if err != nil {
+		return nil, err
+	}
+	if len(positional) > 0 {
+		return nil, newUsageError("unexpected arguments %v", positional)
+	}
+
+	var from time.Time
+	if *since != "" {
+		from, err = parseSince(*since, c.now())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	api, err := c.client(common)
+	if err != nil {
+		return nil, err
+	}
+
+	records, err := api.ListRecords(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	filtered := records[:0]
+	for _, record := range records {
+		if !record.CreatedAt.Before(from) {
+			filtered = append(filtered, record)
+		}
+	}
+	sort.SliceStable(filtered, func(i, j int) bool {
+		return filtered[i].CreatedAt.After(filtered[j].CreatedAt)
+	})
+	return filtered, nil
+}
+
+// parseSince reads a duration back from now, with d for days, or a date.
+func parseSince(since string, now time.Time) (time.Time, error) {
+	if days, ok := strings.CutSuffix(since, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err == nil && n >= 0 {
+			return now.AddDate(0, 0, -n), nil
+		}
+	}
+	if duration, err := time.ParseDuration(since); err == nil && duration >= 0 {
+		return now.Add(-duration), nil
+	}
+	if date, err := time.ParseInLocation("2006-01-02", since, time.Local); err == nil {
+		return date, nil
+	}
+	return time.Time{}, newUsageError("--since must be a duration like 7d or 12h, or a date like 2024-03-01, got %q", since)
+}
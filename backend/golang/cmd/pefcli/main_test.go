@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testToken = "secret-token"
+
+var testNow = time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+
+// newTestServer serves the records API of the server for a fixture,
+// records created by POST are collected in created.
+func newTestServer(t *testing.T, created *[]*models.Record) *httptest.Server {
+	fixture := []*models.Record{
+		{ID: "1", CreatedAt: testNow.AddDate(0, 0, -10), Value: 300, Context: "evening", Rev: 1},
+		{ID: "2", CreatedAt: testNow.AddDate(0, 0, -3), Value: 450, Context: "morning", Rev: 1},
+		{ID: "3", CreatedAt: testNow.Add(-time.Hour), Value: 500, Rev: 2},
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Header.Get("Authorization") != "Bearer "+testToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"status":"Unauthorized","error":"invalid token"}`))
+			return
+		}
+
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/records":
+			json.NewEncoder(w).Encode(fixture)
+		case r.Method == http.MethodPost && r.URL.Path == "/records":
+			record := &models.Record{}
+			if err := json.NewDecoder(r.Body).Decode(record); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			record.ID = "new"
+			*created = append(*created, record)
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(record)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func newTestCLI(t *testing.T, serverURL string) (*cli, *bytes.Buffer, *bytes.Buffer) {
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(configFile, []byte("url: "+serverURL+"\ntoken: "+testToken+"\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	return &cli{
+		stdout: stdout,
+		stderr: stderr,
+		lookupEnv: func(key string) (string, bool) {
+			if key == envConfigFile {
+				return configFile, true
+			}
+			return "", false
+		},
+		httpClient: http.DefaultClient,
+		now:        func() time.Time { return testNow },
+	}, stdout, stderr
+}
+
+func TestCommands(t *testing.T) {
+	tests := []struct {
+		name       string
+		args       []string
+		wantCode   int
+		wantOut    []string
+		notWantOut []string
+		wantErr    string
+	}{
+		{
+			name:     "list",
+			args:     []string{"list"},
+			wantOut:  []string{"ID  TIME", "3   2024-03", "morning", "evening"},
+			wantCode: 0,
+		},
+		{
+			name:       "list since days",
+			args:       []string{"list", "--since", "7d"},
+			wantOut:    []string{"morning"},
+			notWantOut: []string{"evening"},
+		},
+		{
+			name:       "list since date as json",
+			args:       []string{"list", "-o", "json", "--since", "2024-03-09"},
+			wantOut:    []string{`"id": "3"`, `"value": 500`},
+			notWantOut: []string{`"id": "2"`},
+		},
+		{
+			name:    "stats",
+			args:    []string{"stats"},
+			wantOut: []string{"readings  3", "min       300", "max       500", "mean      416.7", "last      500 (green)", "green 2, yellow 1, red 0"},
+		},
+		{
+			name:    "stats as json",
+			args:    []string{"stats", "--since", "96h", "--output", "json"},
+			wantOut: []string{`"count": 2`, `"min": 450`, `"personal_best": 500`},
+		},
+		{
+			name:    "export csv",
+			args:    []string{"export", "--format", "csv"},
+			wantOut: []string{"id,created_at,value,context,rev\n3,2024-03-10T11:00:00Z,500,,2\n2,2024-03-07T12:00:00Z,450,morning,1\n"},
+		},
+		{
+			name:    "export json",
+			args:    []string{"export", "--format", "json", "--since", "1d"},
+			wantOut: []string{`"created_at": "2024-03-10T11:00:00Z"`},
+		},
+		{
+			name:     "add",
+			args:     []string{"add", "480", "--context", "morning"},
+			wantOut:  []string{"new", "480", "morning"},
+			wantCode: 0,
+		},
+		{
+			name:     "wrong token",
+			args:     []string{"list", "--token", "wrong"},
+			wantCode: 1,
+			wantErr:  "server answered 401 Unauthorized: invalid token",
+		},
+		{
+			name:     "invalid value",
+			args:     []string{"add", "lots"},
+			wantCode: 2,
+			wantErr:  "VALUE must be a positive number",
+		},
+		{
+			name:     "invalid since",
+			args:     []string{"list", "--since", "last week"},
+			wantCode: 2,
+			wantErr:  "--since must be a duration",
+		},
+		{
+			name:     "unknown format",
+			args:     []string{"export", "--format", "xml"},
+			wantCode: 2,
+			wantErr:  `unknown format "xml"`,
+		},
+		{
+			name:     "unknown command",
+			args:     []string{"delete"},
+			wantCode: 2,
+			wantErr:  `unknown command "delete"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			//given
+			var created []*models.Record
+			ts := newTestServer(t, &created)
+			c, stdout, stderr := newTestCLI(t, ts.URL)
+
+			//when
+			code := c.run(context.Background(), tt.args)
+
+			//then
+			if code != tt.wantCode {
+				t.Fatalf("want exit code %d; got %d, stderr: %s", tt.wantCode, code, stderr)
+			}
+			for _, want := range tt.wantOut {
+				if !strings.Contains(stdout.String(), want) {
+					t.Errorf("want output to contain %q:\n%s", want, stdout)
+				}
+			}
+			for _, notWant := range tt.notWantOut {
+				if strings.Contains(stdout.String(), notWant) {
+					t.Errorf("want output without %q:\n%s", notWant, stdout)
+				}
+			}
+			if !strings.Contains(stderr.String(), tt.wantErr) {
+				t.Errorf("want error %q, got %q", tt.wantErr, stderr)
+			}
+		})
+	}
+}
+
+func TestAddSendsRecord(t *testing.T) {
+	//given
+	var created []*models.Record
+	ts := newTestServer(t, &created)
+	c, _, stderr := newTestCLI(t, ts.URL)
+
+	//when
+	code := c.run(context.Background(), []string{"add", "--at", "2024-03-01T08:30", "512.5", "--context", "after inhaler"})
+
+	//then
+	if code != 0 {
+		t.Fatalf("want exit code 0; got %d, stderr: %s", code, stderr)
+	}
+	if len(created) != 1 {
+		t.Fatalf("want one record created, got %d", len(created))
+	}
+	want := time.Date(2024, 3, 1, 8, 30, 0, 0, time.Local)
+	if record := created[0]; record.Value != 512.5 || record.Context != "after inhaler" || !record.CreatedAt.Equal(want) {
+		t.Errorf("want the given record, got %+v", record)
+	}
+}
+
+func TestAddInTimezone(t *testing.T) {
+	//given
+	var created []*models.Record
+	ts := newTestServer(t, &created)
+	c, _, stderr := newTestCLI(t, ts.URL)
+
+	//when
+	code := c.run(context.Background(), []string{"add", "--at", "2024-03-01T08:30", "--tz", "Asia/Tokyo", "480"})
+
+	//then
+	if code != 0 {
+		t.Fatalf("want exit code 0; got %d, stderr: %s", code, stderr)
+	}
+	want := time.Date(2024, 2, 29, 23, 30, 0, 0, time.UTC)
+	if record := created[0]; record.Timezone != "Asia/Tokyo" || !record.CreatedAt.Equal(want) {
+		t.Errorf("want the reading at 08:30 in Tokyo, got %+v", record)
+	}
+
+	//when
+	code = c.run(context.Background(), []string{"add", "--tz", "Local", "480"})
+
+	//then
+	if code != 2 {
+		t.Errorf("want exit code 2 for an invalid time zone; got %d", code)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	noEnv := func(string) (string, bool) { return "", false }
+
+	t.Run("flags override the file", func(t *testing.T) {
+		var created []*models.Record
+		ts := newTestServer(t, &created)
+		c, _, stderr := newTestCLI(t, "http://unused.example")
+
+		code := c.run(context.Background(), []string{"list", "--url", ts.URL + "/"})
+
+		if code != 0 {
+			t.Errorf("want exit code 0; got %d, stderr: %s", code, stderr)
+		}
+	})
+
+	t.Run("missing explicit file", func(t *testing.T) {
+		_, err := loadConfig(filepath.Join(t.TempDir(), "missing.yaml"), noEnv)
+
+		if err == nil {
+			t.Error("want an error for a missing config file")
+		}
+	})
+
+	t.Run("unknown key", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		os.WriteFile(path, []byte("server: http://localhost\n"), 0o600)
+
+		_, err := loadConfig(path, noEnv)
+
+		if err == nil || !strings.Contains(err.Error(), "server") {
+			t.Errorf("want an error for the unknown key, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/services"
+	"io"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// stats summarizes readings, zones are relative to the best of them.
+type stats struct {
+	Count        int            `json:"count"`
+	Min          float32        `json:"min,omitempty"`
+	Max          float32        `json:"max,omitempty"`
+	Mean         float32        `json:"mean,omitempty"`
+	First        *time.Time     `json:"first,omitempty"`
+	Last         *time.Time     `json:"last,omitempty"`
+	LastValue    float32        `json:"last_value,omitempty"`
+	LastZone     services.Zone  `json:"last_zone,omitempty"`
+	Zones        map[string]int `json:"zones"`
+	PersonalBest float32        `json:"personal_best,omitempty"`
+}
+
+// newStats summarizes records, given newest first.
+func newStats(records []*models.Record) *stats {
+	s := &stats{Count: len(records), Zones: map[string]int{}}
+	if len(records) == 0 {
+		return s
+	}
+
+	zones := services.NewZonesService(0)
+	s.PersonalBest = zones.PersonalBest(records)
+
+	s.Min, s.Max = records[0].Value, records[0].Value
+	var sum float64
+	for _, record := range records {
+		sum += float64(record.Value)
+		s.Min = min(s.Min, record.Value)
+		s.Max = max(s.Max, record.Value)
+		s.Zones[string(zones.Zone(record.Value, s.PersonalBest))]++
+	}
+	s.Mean = float32(sum / float64(len(records)))
+
+	first, last := records[len(records)-1].CreatedAt, records[0].CreatedAt
+	s.First, s.Last = &first, &last
+	s.LastValue = records[0].Value
+	s.LastZone = zones.Zone(records[0].Value, s.PersonalBest)
+
+	return s
+}
+
+func (c *cli) printRecords(output string, records []*models.Record) error {
+	if output == outputJSON {
+		return writeJSON(c.stdout, records)
+	}
+
+	table := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "ID\tTIME\tVALUE\tCONTEXT")
+	for _, record := range records {
+		fmt.Fprintf(table, "%s\t%s\t%g\t%s\n",
+			record.ID, record.LocalTime(time.Local).Format(dateTimeLayout), record.Value, record.Context)
+	}
+	return table.Flush()
+}
+
+func (c *cli) printStats(output string, s *stats) error {
+	if output == outputJSON {
+		return writeJSON(c.stdout, s)
+	}
+
+	table := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(table, "readings\t%d\n", s.Count)
+	if s.Count > 0 {
+		fmt.Fprintf(table, "period\t%s - %s\n",
+			s.First.Local().Format(dateTimeLayout), s.Last.Local().Format(dateTimeLayout))
+		fmt.Fprintf(table, "min\t%g\n", s.Min)
+		fmt.Fprintf(table, "max\t%g\n", s.Max)
+		fmt.Fprintf(table, "mean\t%.1f\n", s.Mean)
+		fmt.Fprintf(table, "last\t%g (%s)\n", s.LastValue, s.LastZone)
+		fmt.Fprintf(table, "zones\tgreen %d, yellow %d, red %d\n",
+			s.Zones[string(services.ZoneGreen)], s.Zones[string(services.ZoneYellow)], s.Zones[string(services.ZoneRed)])
+	}
+	return table.Flush()
+}
+
+func writeJSON(w io.Writer, v any) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// writeCSV writes records with a header row, times in RFC 3339.
+func writeCSV(w io.Writer, records []*models.Record) error {
+	out := csv.NewWriter(w)
+	_ = out.Write([]string{"id", "created_at", "value", "context", "rev"})
+	for _, record := range records {
+		_ = out.Write([]string{
+			record.ID,
+			record.CreatedAt.Format(time.RFC3339),
+			strconv.FormatFloat(float64(record.Value), 'f', -1, 32),
+			record.Context,
+			strconv.Itoa(record.Rev),
+		})
+	}
+	out.Flush()
+	return out.Error()
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/services"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// planBody is a plan effective from daysAgo with green from 500 and yellow
+// from 300 L/min.
+func planBody(daysAgo int, version int) string {
+	from := time.Now().AddDate(0, 0, -daysAgo).UTC().Format(time.RFC3339)
+	return fmt.Sprintf(`{"name": "winter", "version": %d, "effective_from": %q,
+		"green_from": 500, "yellow_from": 300,
+		"instructions": {"green": "controller daily", "yellow": "add reliever", "red": "call the doctor"}}`,
+		version, from)
+}
+
+func serveActionPlan(t *testing.T, handler http.Handler, r *http.Request, wantCode int) *ActionPlanResponse {
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, r)
+	if rr.Code != wantCode {
+		t.Fatalf("want %d; got %d: %s", wantCode, rr.Code, rr.Body)
+	}
+	if wantCode >= http.StatusBadRequest {
+		return nil
+	}
+
+	response := &ActionPlanResponse{}
+	err := json.NewDecoder(rr.Body).Decode(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func TestActionPlanVersions(t *testing.T) {
+	//given
+	app := newOpenTestApplication(t)
+	handler := app.routes()
+	created := serveActionPlan(t, handler, newRequest(t, http.MethodPost, "/action-plans", planBody(30, 0)), http.StatusCreated)
+
+	//when
+	updated := serveActionPlan(t, handler,
+		newRequest(t, http.MethodPut, "/action-plans/"+created.ID, `{"version": 1, "green_from": 450, "yellow_from": 250}`),
+		http.StatusOK)
+	serveActionPlan(t, handler,
+		newRequest(t, http.MethodPut, "/action-plans/"+created.ID, `{"version": 1, "green_from": 400, "yellow_from": 200}`),
+		http.StatusConflict)
+
+	//then
+	if created.Version != 1 || updated.Version != 2 || updated.ID != created.ID {
+		t.Fatalf("want versions 1 and 2 of one plan, got %+v and %+v", created.ActionPlan, updated.ActionPlan)
+	}
+	if updated.GreenFrom != 450 || updated.Instructions.Red != "call the doctor" || updated.Name != "winter" {
+		t.Errorf("want new thresholds over the prior plan, got %+v", updated.ActionPlan)
+	}
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, newGetRequest(t, "/action-plans/"+created.ID+"/versions"))
+	var versions []*ActionPlanResponse
+	if err := json.NewDecoder(rr.Body).Decode(&versions); err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || versions[0].GreenFrom != 500 || versions[1].GreenFrom != 450 {
+		t.Errorf("want both versions oldest first, got %d", len(versions))
+	}
+
+	latest := serveActionPlan(t, handler, newGetRequest(t, "/action-plans/"+created.ID), http.StatusOK)
+	if latest.Version != 2 {
+		t.Errorf("want the latest version, got %d", latest.Version)
+	}
+}
+
+func TestCreateActionPlanInvalid(t *testing.T) {
+	from := time.Now().UTC().Format(time.RFC3339)
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"green below yellow", fmt.Sprintf(`{"effective_from": %q, "green_from": 200, "yellow_from": 300}`, from)},
+		{"no yellow", fmt.Sprintf(`{"effective_from": %q, "green_from": 200}`, from)},
+		{"no effective from", `{"green_from": 500, "yellow_from": 300}`},
+		{"until before from", fmt.Sprintf(`{"effective_from": %q, "effective_until": "2020-01-01T00:00:00Z", "green_from": 500, "yellow_from": 300}`, from)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			//given
+			app := newOpenTestApplication(t)
+
+			//when
+			serveActionPlan(t, app.routes(), newRequest(t, http.MethodPost, "/action-plans", tt.body), http.StatusBadRequest)
+		})
+	}
+}
+
+func TestActiveActionPlan(t *testing.T) {
+	//given
+	app := newOpenTestApplication(t)
+	handler := app.routes()
+	old := serveActionPlan(t, handler, newRequest(t, http.MethodPost, "/action-plans", planBody(30, 0)), http.StatusCreated)
+	current := serveActionPlan(t, handler, newRequest(t, http.MethodPost, "/action-plans", planBody(3, 0)), http.StatusCreated)
+	before := time.Now().AddDate(0, 0, -40).UTC().Format(time.RFC3339)
+	between := time.Now().AddDate(0, 0, -10).UTC().Format(time.RFC3339)
+
+	//when
+	now := serveActionPlan(t, handler, newGetRequest(t, "/action-plans/active"), http.StatusOK)
+	then := serveActionPlan(t, handler, newGetRequest(t, "/action-plans/active?at="+between), http.StatusOK)
+	serveActionPlan(t, handler, newGetRequest(t, "/action-plans/active?at="+before), http.StatusNotFound)
+	serveActionPlan(t, handler, newGetRequest(t, "/action-plans/active?at=yesterday"), http.StatusBadRequest)
+
+	//then
+	if now.ID != current.ID {
+		t.Errorf("want the plan which took effect last, got %+v", now.ActionPlan)
+	}
+	if then.ID != old.ID {
+		t.Errorf("want the plan in effect then, got %+v", then.ActionPlan)
+	}
+}
+
+func TestRecordZoneByActionPlan(t *testing.T) {
+	//given
+	app := newOpenTestApplication(t)
+	handler := app.routes()
+	plan := serveActionPlan(t, handler, newRequest(t, http.MethodPost, "/action-plans", planBody(30, 0)), http.StatusCreated)
+	takenAt := time.Now().AddDate(0, 0, -1).UTC().Format(time.RFC3339)
+
+	tests := []struct {
+		value            int
+		wantZone         services.Zone
+		wantInstructions string
+	}{
+		{520, services.ZoneGreen, "controller daily"},
+		{450, services.ZoneYellow, "add reliever"},
+		{250, services.ZoneRed, "call the doctor"},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.wantZone), func(t *testing.T) {
+			//when
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, newRequest(t, http.MethodPost, "/records", fmt.Sprintf(`{"value": %d, "created_at": %q}`, tt.value, takenAt)))
+
+			//then
+			response := &RecordResponse{}
+			if err := json.NewDecoder(rr.Body).Decode(response); err != nil {
+				t.Fatal(err)
+			}
+			if response.ZoneAdvice == nil || response.Zone != tt.wantZone || response.Instructions != tt.wantInstructions {
+				t.Fatalf("want %s zone with %q, got %+v", tt.wantZone, tt.wantInstructions, response.ZoneAdvice)
+			}
+			if response.PlanID != plan.ID || response.PlanVersion != 1 {
+				t.Errorf("want the plan with the zone, got %+v", response.ZoneAdvice)
+			}
+		})
+	}
+}
+
+func TestRecordZoneWithoutActionPlan(t *testing.T) {
+	//given
+	app := newOpenTestApplication(t)
+	app.zones = services.NewZonesService(600)
+	app.actionPlanService = services.NewActionPlanService(app.actionPlans, app.records, app.zones)
+	handler := app.routes()
+	// effective only after the fixture readings were taken
+	serveActionPlan(t, handler, newRequest(t, http.MethodPost, "/action-plans", planBody(0, 0)), http.StatusCreated)
+
+	//when
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, newGetRequest(t, "/records/1"))
+
+	//then
+	response := &RecordResponse{}
+	if err := json.NewDecoder(rr.Body).Decode(response); err != nil {
+		t.Fatal(err)
+	}
+	// 505 is 84% of the personal best of 600
+	if response.ZoneAdvice == nil || response.Zone != services.ZoneGreen || response.PlanID != "" || response.Instructions != "" {
+		t.Errorf("want the green zone by the personal best, got %+v", response.ZoneAdvice)
+	}
+}
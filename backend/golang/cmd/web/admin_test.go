@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/policy"
+	"net/http"
+	"testing"
+)
+
+// createAdmin lets the admin of token in, like ADMIN_TOKEN does.
+// testAdminToken is the token of the admin of the tests.
+const testAdminToken = "admin token of the test"
+
+func createAdmin(t *testing.T, app *application, token string) *CreatedUserResponse {
+	admin, err := app.userService.EnsureAdmin(context.Background(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &CreatedUserResponse{User: admin, Token: token}
+}
+
+func TestAdminUsers(t *testing.T) {
+	//given
+	app := newTestApplication(t)
+	handler := app.routes()
+	admin := createAdmin(t, app, testAdminToken)
+	user := &CreatedUserResponse{}
+	serveJSON(t, handler, authorized(newRequest(t, http.MethodPost, "/users", `{"name": "Parent", "role": "admin"}`), admin),
+		http.StatusCreated, user)
+	prefix := "/admin/users/" + user.ID
+
+	//when
+	var users []*UserResponse
+	serveJSON(t, handler, authorized(newGetRequest(t, "/admin/users"), admin), http.StatusOK, &users)
+
+	reset := &CreatedUserResponse{}
+	serveJSON(t, handler, authorized(newRequest(t, http.MethodPost, prefix+"/token", ""), admin), http.StatusOK, reset)
+	serveJSON(t, handler, authorized(newGetRequest(t, "/users/me"), user), http.StatusUnauthorized, nil)
+	serveJSON(t, handler, authorized(newGetRequest(t, "/users/me"), reset), http.StatusOK, nil)
+
+	disabled := &UserResponse{}
+	serveJSON(t, handler, authorized(newRequest(t, http.MethodPost, prefix+"/disable", ""), admin), http.StatusOK, disabled)
+	serveJSON(t, handler, authorized(newGetRequest(t, "/users/me"), reset), http.StatusUnauthorized, nil)
+	serveJSON(t, handler, authorized(newRequest(t, http.MethodPost, prefix+"/enable", ""), admin), http.StatusOK, nil)
+	serveJSON(t, handler, authorized(newGetRequest(t, "/users/me"), reset), http.StatusOK, nil)
+
+	serveJSON(t, handler, authorized(newRequest(t, http.MethodPost, "/admin/users/"+admin.ID+"/disable", ""), admin),
+		http.StatusConflict, nil)
+	serveJSON(t, handler, authorized(newGetRequest(t, "/admin/users"), reset), http.StatusForbidden, nil)
+
+	//then
+	roles := map[string]string{}
+	for _, listed := range users {
+		roles[listed.ID] = listed.Role
+	}
+	if len(users) != 2 || roles[admin.ID] != string(policy.RoleAdmin) || roles[user.ID] != string(policy.RoleUser) {
+		t.Errorf("want the admin and the user signed up as a user, got %v", roles)
+	}
+	if reset.Token == "" || reset.Token == user.Token {
+		t.Errorf("want a new token, got %q", reset.Token)
+	}
+	if disabled.DisabledAt == nil {
+		t.Errorf("want the user disabled, got %+v", disabled.User)
+	}
+}
+
+func TestAdminStats(t *testing.T) {
+	//given
+	app := newTestApplication(t)
+	handler := app.routes()
+	admin := createAdmin(t, app, testAdminToken)
+	parent := createUser(t, app, handler, "Parent")
+	createUser(t, app, handler, "Other")
+	patient := createPatient(t, handler, parent, nil)
+	serveJSON(t, handler, authorized(newRequest(t, http.MethodPost, "/patients/"+patient.ID+"/records",
+		`{"value": 300}`), parent), http.StatusCreated, nil)
+
+	//when
+	stats := &StatsResponse{}
+	serveJSON(t, handler, authorized(newGetRequest(t, "/admin/stats"), admin), http.StatusOK, stats)
+
+	//then
+	if stats.Users != 3 || stats.Admins != 1 || stats.DisabledUsers != 0 {
+		t.Errorf("want 3 users, 1 admin and none disabled, got %+v", stats.SystemStats)
+	}
+	// the fixture records and the one of the patient
+	if stats.Patients != 1 || stats.Memberships != 1 || stats.Records != 7 {
+		t.Errorf("want a patient with an owner and 7 records, got %+v", stats.SystemStats)
+	}
+}
+
+func TestAdminAuthorizedIP(t *testing.T) {
+	//given
+	app := newTestApplication(t)
+	app.authorizedIp = "192.0.2.1"
+	handler := app.routes()
+	admin := createAdmin(t, app, testAdminToken)
+
+	tests := []struct {
+		remoteAddr string
+		want       int
+	}{
+		{"192.0.2.1:51234", http.StatusOK},
+		{"[::ffff:192.0.2.1]:51234", http.StatusOK},
+		{"198.51.100.7:51234", http.StatusForbidden},
+		{"192.0.2.10:51234", http.StatusForbidden},
+		{"10.192.0.2.1:51234", http.StatusForbidden},
+		{"[2001:db8::192.0.2.1]:51234", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.remoteAddr, func(t *testing.T) {
+			//when
+			r := authorized(newGetRequest(t, "/admin/stats"), admin)
+			r.RemoteAddr = tt.remoteAddr
+
+			//then
+			serveJSON(t, handler, r, tt.want, nil)
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/config"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newCorsTestApplication(t *testing.T, origins []string, credentials bool) *application {
+	app := newOpenTestApplication(t)
+	app.cors = config.Default().CORS
+	app.cors.AllowedOrigins = origins
+	app.cors.AllowCredentials = credentials
+	return app
+}
+
+func newPreflightRequest(t *testing.T, path, origin, method, headers string) *http.Request {
+	r := newRequest(t, http.MethodOptions, path, "")
+	r.Header.Set("Origin", origin)
+	r.Header.Set("Access-Control-Request-Method", method)
+	if headers != "" {
+		r.Header.Set("Access-Control-Request-Headers", headers)
+	}
+	return r
+}
+
+func TestCorsPreflight(t *testing.T) {
+	origins := []string{"https://app.example.com", "https://*.peakflow.example"}
+
+	tests := []struct {
+		name    string
+		path    string
+		origin  string
+		method  string
+		headers string
+		allowed bool
+	}{
+		{"exact origin", "/records/", "https://app.example.com", "POST", "Content-Type, Idempotency-Key", true},
+		{"exact origin, record", "/records/1", "https://app.example.com", "PUT", "Content-Type", true},
+		{"subdomain", "/records/1", "https://phone.peakflow.example", "DELETE", "", true},
+		{"nested subdomain", "/records/batch", "https://a.b.peakflow.example", "POST", "", true},
+		{"case insensitive host", "/records/", "https://APP.example.com", "GET", "", true},
+		{"wildcard excludes apex", "/records/", "https://peakflow.example", "POST", "", false},
+		{"other scheme", "/records/", "http://app.example.com", "POST", "", false},
+		{"other port", "/records/", "https://app.example.com:8443", "POST", "", false},
+		{"suffix attack", "/records/", "https://app.example.com.evil.com", "POST", "", false},
+		{"label suffix attack", "/records/", "https://evilpeakflow.example", "POST", "", false},
+		{"unknown origin", "/records/", "https://evil.com", "GET", "", false},
+		{"null origin", "/records/", "null", "GET", "", false},
+		{"method not allowed", "/records/1", "https://app.example.com", "PATCH", "", false},
+		{"header not allowed", "/records/", "https://app.example.com", "POST", "X-Evil", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			//given
+			app := newCorsTestApplication(t, origins, true)
+			rr := httptest.NewRecorder()
+
+			//when
+			app.routes().ServeHTTP(rr, newPreflightRequest(t, tt.path, tt.origin, tt.method, tt.headers))
+
+			//then
+			allowOrigin := rr.Header().Get("Access-Control-Allow-Origin")
+			if !tt.allowed {
+				if allowOrigin != "" {
+					t.Errorf("want origin rejected, got Access-Control-Allow-Origin %q", allowOrigin)
+				}
+				return
+			}
+
+			if allowOrigin != tt.origin {
+				t.Errorf("want Access-Control-Allow-Origin %q, got %q", tt.origin, allowOrigin)
+			}
+			if rr.Header().Get("Access-Control-Allow-Credentials") != "true" {
+				t.Errorf("want credentials allowed")
+			}
+			if !strings.Contains(rr.Header().Get("Access-Control-Allow-Methods"), tt.method) {
+				t.Errorf("want %s allowed, got %q", tt.method, rr.Header().Get("Access-Control-Allow-Methods"))
+			}
+			if rr.Header().Get("Access-Control-Max-Age") != "300" {
+				t.Errorf("want max age 300, got %q", rr.Header().Get("Access-Control-Max-Age"))
+			}
+			if !strings.Contains(strings.Join(rr.Header().Values("Vary"), ","), "Origin") {
+				t.Errorf("want responses to vary by origin")
+			}
+		})
+	}
+}
+
+func TestCorsActualRequest(t *testing.T) {
+	app := newCorsTestApplication(t, []string{"https://*.peakflow.example"}, true)
+	handler := app.routes()
+
+	tests := []struct {
+		origin     string
+		wantOrigin string
+	}{
+		{"https://phone.peakflow.example", "https://phone.peakflow.example"},
+		{"https://evil.com", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.origin, func(t *testing.T) {
+			r := newGetRequest(t, "/records/1")
+			r.Header.Set("Origin", tt.origin)
+			rr := httptest.NewRecorder()
+
+			handler.ServeHTTP(rr, r)
+
+			if rr.Code != http.StatusOK {
+				t.Fatalf("want %d; got %d", http.StatusOK, rr.Code)
+			}
+			if got := rr.Header().Get("Access-Control-Allow-Origin"); got != tt.wantOrigin {
+				t.Errorf("want Access-Control-Allow-Origin %q, got %q", tt.wantOrigin, got)
+			}
+			if tt.wantOrigin != "" && !strings.Contains(rr.Header().Get("Access-Control-Expose-Headers"), "Idempotent-Replayed") {
+				t.Errorf("want exposed headers, got %q", rr.Header().Get("Access-Control-Expose-Headers"))
+			}
+		})
+	}
+}
+
+func TestCorsAnyOriginWithoutCredentials(t *testing.T) {
+	app := newCorsTestApplication(t, []string{"*"}, false)
+	rr := httptest.NewRecorder()
+
+	app.routes().ServeHTTP(rr, newPreflightRequest(t, "/records/", "https://anywhere.example", "POST", ""))
+
+	if got := rr.Header().Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("want Access-Control-Allow-Origin *, got %q", got)
+	}
+	if rr.Header().Get("Access-Control-Allow-Credentials") != "" {
+		t.Errorf("want no credentials for any origin")
+	}
+}
+
+func TestCorsNoOriginsByDefault(t *testing.T) {
+	app := newTestApplication(t)
+	rr := httptest.NewRecorder()
+
+	app.routes().ServeHTTP(rr, newPreflightRequest(t, "/records/", "https://app.example.com", "POST", ""))
+
+	if got := rr.Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("want cross-origin requests rejected by default, got %q", got)
+	}
+}
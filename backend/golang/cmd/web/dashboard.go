@@ -0,0 +1,274 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/services"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// dashboardReadings is the number of most recent readings on the dashboard.
+const dashboardReadings = 50
+
+const (
+	chartWidth   = 720
+	chartHeight  = 240
+	chartPadding = 30
+)
+
+// dashboardPage is the view model of the dashboard template.
+type dashboardPage struct {
+	CSRFToken    string
+	UserName     string // of a logged in browser
+	PersonalBest float32
+	Plan         *models.ActionPlan   // in effect now
+	Advice       *services.ZoneAdvice // of the latest reading
+	Readings     []*dashboardReading
+	Chart        *dashboardChart
+	Form         *RecordForm
+	Error        string
+}
+
+type dashboardReading struct {
+	*models.Record
+	// TakenAt is the time on the clock where the reading was taken.
+	TakenAt time.Time
+	Zone    services.Zone
+}
+
+// dashboardChart is an SVG line chart of the readings, oldest first, over the
+// zones of the personal best.
+type dashboardChart struct {
+	Width, Height int
+	Line          string
+	Points        []*chartPoint
+	Zones         []*chartZone
+}
+
+type chartPoint struct {
+	X, Y  float64
+	Title string
+	Zone  services.Zone
+}
+
+type chartZone struct {
+	Y, Height float64
+	Zone      services.Zone
+}
+
+// Dashboard shows the recent readings with a chart and a form for adding a
+// reading, or editing the one given by the edit query parameter.
+func (app *application) Dashboard(w http.ResponseWriter, r *http.Request) {
+	form := &RecordForm{}
+
+	if id := r.URL.Query().Get("edit"); id != "" {
+		record, err := app.records.Get(r.Context(), id)
+		if errors.Is(err, models.ErrNoRecord) {
+			app.renderDashboard(w, r, http.StatusNotFound, form, errors.New("the reading doesn't exist anymore"))
+			return
+		}
+		if err != nil {
+			app.renderDashboard(w, r, http.StatusInternalServerError, form, err)
+			return
+		}
+		form = NewRecordForm(record, app.recordsService.Location())
+	}
+
+	app.renderDashboard(w, r, http.StatusOK, form, nil)
+}
+
+// DashboardCreateRecord adds a reading submitted with the dashboard form.
+func (app *application) DashboardCreateRecord(w http.ResponseWriter, r *http.Request) {
+	form := ParseRecordForm(r)
+
+	record := app.recordsService.NewRecordByValue(0)
+	err := form.Apply(record, app.recordsService.Location())
+	if err != nil {
+		app.renderDashboard(w, r, http.StatusUnprocessableEntity, form, err)
+		return
+	}
+
+	_, err = app.records.Update(r.Context(), record)
+	if err != nil {
+		app.renderDashboard(w, r, http.StatusInternalServerError, form, err)
+		return
+	}
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// DashboardUpdateRecord changes a reading edited with the dashboard form.
+func (app *application) DashboardUpdateRecord(w http.ResponseWriter, r *http.Request) {
+	form := ParseRecordForm(r)
+	form.ID = chi.URLParam(r, "RecordID")
+
+	record, err := app.records.Get(r.Context(), form.ID)
+	if errors.Is(err, models.ErrNoRecord) {
+		app.renderDashboard(w, r, http.StatusNotFound, &RecordForm{}, errors.New("the reading doesn't exist anymore"))
+		return
+	}
+	if err != nil {
+		app.renderDashboard(w, r, http.StatusInternalServerError, form, err)
+		return
+	}
+
+	err = form.Apply(record, app.recordsService.Location())
+	if err != nil {
+		app.renderDashboard(w, r, http.StatusUnprocessableEntity, form, err)
+		return
+	}
+
+	_, err = app.records.Update(r.Context(), record)
+	if err != nil {
+		app.renderDashboard(w, r, http.StatusInternalServerError, form, err)
+		return
+	}
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// DashboardDeleteRecord removes a reading from the dashboard.
+func (app *application) DashboardDeleteRecord(w http.ResponseWriter, r *http.Request) {
+	_, err := app.records.Remove(r.Context(), chi.URLParam(r, "RecordID"))
+	if err != nil {
+		app.renderDashboard(w, r, http.StatusInternalServerError, &RecordForm{}, err)
+		return
+	}
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func (app *application) renderDashboard(w http.ResponseWriter, r *http.Request, status int, form *RecordForm, formErr error) {
+	page := &dashboardPage{
+		CSRFToken: r.Context().Value(ContextKeyCSRFToken).(string),
+		Form:      form,
+	}
+	if user, ok := r.Context().Value(ContextKeyUser).(*models.User); ok {
+		page.UserName = user.Name
+	}
+	if formErr != nil {
+		page.Error = formErr.Error()
+		if status == http.StatusInternalServerError {
+			app.requestLogger(r).Error("dashboard request failed", "error", formErr)
+			page.Error = "Something went wrong, please try again."
+		}
+	}
+
+	records, err := app.records.GetAll(r.Context())
+	if err != nil {
+		app.requestLogger(r).Error("loading dashboard readings failed", "error", err)
+		status = http.StatusInternalServerError
+		page.Error = "The readings can't be loaded right now."
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].CreatedAt.After(records[j].CreatedAt)
+	})
+	page.PersonalBest = app.zones.PersonalBest(records)
+	if len(records) > dashboardReadings {
+		records = records[:dashboardReadings]
+	}
+
+	thresholds := app.zones.Thresholds(page.PersonalBest)
+	plans, err := app.actionPlans.GetAll(r.Context())
+	if err != nil {
+		app.requestLogger(r).Error("loading action plans failed", "error", err)
+	} else if page.Plan = services.ActivePlan(plans, time.Now()); page.Plan != nil {
+		thresholds = services.PlanThresholds(page.Plan)
+	}
+
+	advice := app.advise(r, records...)
+	for index, record := range records {
+		if advice[index] == nil {
+			advice[index] = &services.ZoneAdvice{Zone: app.zones.Zone(record.Value, page.PersonalBest)}
+		}
+		page.Readings = append(page.Readings, &dashboardReading{
+			Record:  record,
+			TakenAt: record.LocalTime(app.recordsService.Location()),
+			Zone:    advice[index].Zone,
+		})
+	}
+	if len(advice) > 0 {
+		page.Advice = advice[0]
+	}
+	page.Chart = newDashboardChart(page.Readings, page.PersonalBest, thresholds)
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	err = dashboardTemplate.Execute(w, page)
+	if err != nil {
+		app.requestLogger(r).Error("rendering dashboard failed", "error", err)
+	}
+}
+
+// newDashboardChart lays out readings, given newest first, left to right,
+// over bands of the zones by thresholds.
+func newDashboardChart(readings []*dashboardReading, personalBest float32, thresholds services.Thresholds) *dashboardChart {
+	chart := &dashboardChart{Width: chartWidth, Height: chartHeight}
+	if len(readings) == 0 {
+		return chart
+	}
+
+	top := max(personalBest, thresholds.GreenFrom)
+	for _, reading := range readings {
+		if reading.Value > top {
+			top = reading.Value
+		}
+	}
+	top *= 1.1
+
+	plotHeight := float64(chartHeight - 2*chartPadding)
+	y := func(value float32) float64 {
+		return float64(chartPadding) + plotHeight*(1-float64(value/top))
+	}
+
+	if thresholds.GreenFrom > 0 {
+		bands := []struct {
+			from, to float32
+			zone     services.Zone
+		}{
+			{thresholds.GreenFrom, top, services.ZoneGreen},
+			{thresholds.YellowFrom, thresholds.GreenFrom, services.ZoneYellow},
+			{0, thresholds.YellowFrom, services.ZoneRed},
+		}
+		for _, band := range bands {
+			chart.Zones = append(chart.Zones, &chartZone{
+				Y:      y(band.to),
+				Height: y(band.from) - y(band.to),
+				Zone:   band.zone,
+			})
+		}
+	}
+
+	first := readings[len(readings)-1].CreatedAt
+	span := readings[0].CreatedAt.Sub(first).Seconds()
+	plotWidth := float64(chartWidth - 2*chartPadding)
+
+	var line []string
+	for i := len(readings) - 1; i >= 0; i-- {
+		reading := readings[i]
+
+		x := float64(chartPadding) + plotWidth/2
+		if span > 0 {
+			x = float64(chartPadding) + plotWidth*reading.CreatedAt.Sub(first).Seconds()/span
+		}
+		point := &chartPoint{
+			X:     x,
+			Y:     y(reading.Value),
+			Title: fmt.Sprintf("%s: %g L/min", reading.TakenAt.Format("2006-01-02 15:04 MST"), reading.Value),
+			Zone:  reading.Zone,
+		}
+
+		chart.Points = append(chart.Points, point)
+		line = append(line, fmt.Sprintf("%.1f,%.1f", point.X, point.Y))
+	}
+	chart.Line = strings.Join(line, " ")
+
+	return chart
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/services"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+var csrfTokenPattern = regexp.MustCompile(`name="csrf_token" value="([^"]+)"`)
+
+// openDashboard loads a page like a browser, with the session cookie of
+// logIn, returning its CSRF cookie and the form token.
+func openDashboard(t *testing.T, handler http.Handler, path string, session *http.Cookie) (*httptest.ResponseRecorder, *http.Cookie, string) {
+	r := newGetRequest(t, path)
+	if session != nil {
+		r.AddCookie(session)
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, r)
+
+	cookie := findCookie(rr, cookieCSRF)
+	if cookie == nil {
+		t.Fatalf("want a CSRF cookie, got %d: %s", rr.Code, rr.Body)
+	}
+
+	match := csrfTokenPattern.FindStringSubmatch(rr.Body.String())
+	if match == nil {
+		t.Fatal("want a CSRF token in the forms")
+	}
+	return rr, cookie, match[1]
+}
+
+// logIn logs in to the pages like a browser with token, returning the
+// session cookie.
+func logIn(t *testing.T, handler http.Handler, token string) *http.Cookie {
+	_, cookie, csrfToken := openDashboard(t, handler, "/login", nil)
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, newFormRequest(t, "/login", url.Values{"csrf_token": {csrfToken}, "token": {token}}, cookie))
+	if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/" {
+		t.Fatalf("want sent to the dashboard, got %d: %s", rr.Code, rr.Body)
+	}
+
+	session := findCookie(rr, cookieSession)
+	if session == nil {
+		t.Fatal("want a session cookie")
+	}
+	return session
+}
+
+func findCookie(rr *httptest.ResponseRecorder, name string) *http.Cookie {
+	for _, cookie := range rr.Result().Cookies() {
+		if cookie.Name == name {
+			return cookie
+		}
+	}
+	return nil
+}
+
+func newFormRequest(t *testing.T, path string, form url.Values, cookies ...*http.Cookie) *http.Request {
+	r := newRequest(t, http.MethodPost, path, form.Encode())
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, cookie := range cookies {
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+	}
+	return r
+}
+
+func TestDashboard(t *testing.T) {
+	//given
+	app := newTestApplication(t)
+	app.zones = services.NewZonesService(900)
+	app.actionPlanService = services.NewActionPlanService(app.actionPlans, app.records, app.zones)
+
+	handler := app.routes()
+	createAdmin(t, app, testAdminToken)
+	session := logIn(t, handler, testAdminToken)
+
+	//when
+	rr, cookie, _ := openDashboard(t, handler, "/", session)
+
+	//then
+	if rr.Code != http.StatusOK {
+		t.Fatalf("want %d; got %d", http.StatusOK, rr.Code)
+	}
+	if !strings.HasPrefix(rr.Header().Get("Content-Type"), "text/html") {
+		t.Errorf("want html, got %q", rr.Header().Get("Content-Type"))
+	}
+	if !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode {
+		t.Errorf("want an http only, same site CSRF cookie, got %+v", cookie)
+	}
+
+	body := rr.Body.String()
+	for _, want := range []string{
+		"Personal best: 900 L/min",
+		`<tr class="zone-yellow">`, // 505 of 900
+		"<polyline points=",
+		`<a href="/?edit=1">Edit</a>`,
+		`action="/dashboard/records"`,
+		"Logged in as admin",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("want dashboard to contain %q", want)
+		}
+	}
+	if strings.Contains(body, "<script") {
+		t.Errorf("the dashboard must work without JavaScript")
+	}
+}
+
+func TestDashboardZones(t *testing.T) {
+	zones := services.NewZonesService(500)
+
+	tests := []struct {
+		value float32
+		want  services.Zone
+	}{
+		{500, services.ZoneGreen},
+		{400, services.ZoneGreen},
+		{399, services.ZoneYellow},
+		{250, services.ZoneYellow},
+		{249, services.ZoneRed},
+	}
+
+	for _, tt := range tests {
+		if got := zones.Zone(tt.value, zones.PersonalBest(nil)); got != tt.want {
+			t.Errorf("zone of %v: want %s, got %s", tt.value, tt.want, got)
+		}
+	}
+}
+
+func TestDashboardCreateRecord(t *testing.T) {
+	//given
+	app := newTestApplication(t)
+	handler := app.routes()
+	createAdmin(t, app, testAdminToken)
+	session := logIn(t, handler, testAdminToken)
+	_, cookie, token := openDashboard(t, handler, "/", session)
+
+	before, _ := app.records.GetAll(context.Background())
+
+	form := url.Values{
+		"csrf_token": {token},
+		"value":      {"512.5"},
+		"created_at": {"2024-03-01T08:30"},
+		"context":    {"after inhaler"},
+	}
+	rr := httptest.NewRecorder()
+
+	//when
+	handler.ServeHTTP(rr, newFormRequest(t, "/dashboard/records", form, cookie, session))
+
+	//then
+	if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/" {
+		t.Fatalf("want redirect to the dashboard, got %d %q", rr.Code, rr.Header().Get("Location"))
+	}
+
+	after, _ := app.records.GetAll(context.Background())
+	if len(after) != len(before)+1 {
+		t.Fatalf("want one more record, got %d", len(after)-len(before))
+	}
+
+	var created *models.Record
+	for _, record := range after {
+		if record.Context == "after inhaler" {
+			created = record
+		}
+	}
+	if created == nil || created.Value != 512.5 || created.Timezone != "UTC" || created.LocalTime(time.UTC).Format(formDateTimeLayout) != "2024-03-01T08:30" {
+		t.Errorf("want the submitted record, got %+v", created)
+	}
+}
+
+func TestDashboardCSRF(t *testing.T) {
+	app := newTestApplication(t)
+	handler := app.routes()
+	createAdmin(t, app, testAdminToken)
+	session := logIn(t, handler, testAdminToken)
+	_, cookie, token := openDashboard(t, handler, "/", session)
+	_, otherCookie, _ := openDashboard(t, handler, "/", session)
+
+	tests := []struct {
+		name   string
+		token  string
+		cookie *http.Cookie
+	}{
+		{"no token", "", cookie},
+		{"no cookie", token, nil},
+		{"forged token", "forged", cookie},
+		{"token of another cookie", token, otherCookie},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before, _ := app.records.GetAll(context.Background())
+			form := url.Values{"csrf_token": {tt.token}, "value": {"400"}}
+			rr := httptest.NewRecorder()
+
+			handler.ServeHTTP(rr, newFormRequest(t, "/dashboard/records", form, tt.cookie, session))
+
+			if rr.Code != http.StatusForbidden {
+				t.Errorf("want %d; got %d", http.StatusForbidden, rr.Code)
+			}
+			after, _ := app.records.GetAll(context.Background())
+			if len(after) != len(before) {
+				t.Errorf("want no record added")
+			}
+		})
+	}
+
+	t.Run("token header", func(t *testing.T) {
+		r := newFormRequest(t, "/dashboard/records", url.Values{"value": {"400"}}, cookie, session)
+		r.Header.Set(headerCSRFToken, token)
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, r)
+
+		if rr.Code != http.StatusSeeOther {
+			t.Errorf("want %d; got %d", http.StatusSeeOther, rr.Code)
+		}
+	})
+}
+
+func TestDashboardInvalidForm(t *testing.T) {
+	//given
+	app := newTestApplication(t)
+	handler := app.routes()
+	createAdmin(t, app, testAdminToken)
+	session := logIn(t, handler, testAdminToken)
+	_, cookie, token := openDashboard(t, handler, "/", session)
+
+	form := url.Values{"csrf_token": {token}, "value": {"-5"}, "context": {"evening"}}
+	rr := httptest.NewRecorder()
+
+	//when
+	handler.ServeHTTP(rr, newFormRequest(t, "/dashboard/records", form, cookie, session))
+
+	//then
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("want %d; got %d", http.StatusUnprocessableEntity, rr.Code)
+	}
+	body := rr.Body.String()
+	if !strings.Contains(body, "value must be positive") || !strings.Contains(body, `value="evening"`) {
+		t.Errorf("want the error and the submitted values shown:\n%s", body)
+	}
+}
+
+func TestDashboardEditAndDeleteRecord(t *testing.T) {
+	//given
+	app := newTestApplication(t)
+	handler := app.routes()
+	createAdmin(t, app, testAdminToken)
+	session := logIn(t, handler, testAdminToken)
+	rr, cookie, token := openDashboard(t, handler, "/?edit=1", session)
+
+	if !strings.Contains(rr.Body.String(), `action="/dashboard/records/1"`) ||
+		!strings.Contains(rr.Body.String(), `value="505"`) {
+		t.Fatalf("want the edit form of record 1:\n%s", rr.Body.String())
+	}
+
+	//when
+	edit := url.Values{"csrf_token": {token}, "value": {"550"}, "context": {"morning"}}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, newFormRequest(t, "/dashboard/records/1", edit, cookie, session))
+
+	//then
+	if rr.Code != http.StatusSeeOther {
+		t.Fatalf("want %d; got %d", http.StatusSeeOther, rr.Code)
+	}
+	record, err := app.records.Get(context.Background(), "1")
+	if err != nil || record.Value != 550 || record.Context != "morning" || record.Rev != 2 {
+		t.Errorf("want record 1 updated, got %+v", record)
+	}
+
+	//when
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, newFormRequest(t, "/dashboard/records/1/delete", url.Values{"csrf_token": {token}}, cookie, session))
+
+	//then
+	if rr.Code != http.StatusSeeOther {
+		t.Fatalf("want %d; got %d", http.StatusSeeOther, rr.Code)
+	}
+	_, err = app.records.Get(context.Background(), "1")
+	if !errors.Is(err, models.ErrNoRecord) {
+		t.Errorf("want record 1 removed, got %v", err)
+	}
+}
+
+func TestDashboardEditRecordInItsTimezone(t *testing.T) {
+	//given
+	app := newTestApplication(t)
+	handler := app.routes()
+	app.records.Update(context.Background(), &models.Record{
+		ID: "tokyo", CreatedAt: time.Date(2024, 4, 1, 21, 0, 0, 0, time.UTC), Value: 410, Timezone: "Asia/Tokyo"})
+
+	createAdmin(t, app, testAdminToken)
+	session := logIn(t, handler, testAdminToken)
+
+	rr, cookie, token := openDashboard(t, handler, "/?edit=tokyo", session)
+	if !strings.Contains(rr.Body.String(), `value="2024-04-02T06:00"`) {
+		t.Fatalf("want the time on the clock in Tokyo in the form:\n%s", rr.Body.String())
+	}
+
+	//when
+	edit := url.Values{"csrf_token": {token}, "value": {"410"}, "created_at": {"2024-04-02T06:30"}}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, newFormRequest(t, "/dashboard/records/tokyo", edit, cookie, session))
+
+	//then
+	if rr.Code != http.StatusSeeOther {
+		t.Fatalf("want %d; got %d", http.StatusSeeOther, rr.Code)
+	}
+	record, _ := app.records.Get(context.Background(), "tokyo")
+	if record.Timezone != "Asia/Tokyo" || !record.CreatedAt.Equal(time.Date(2024, 4, 1, 21, 30, 0, 0, time.UTC)) {
+		t.Errorf("want the time read in Tokyo, got %+v", record)
+	}
+}
@@ -1,47 +1,736 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/health"
 	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/services"
+	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/render"
 	"github.com/google/uuid"
 	"net/http"
+	"strings"
+	"time"
 )
 
 const ContextKeyRecord = "record"
 const ContextKeyNewRecordValue = "newRecordValue"
+const ContextKeyRevision = "revision"
+const ContextKeyQuickLink = "quickLink"
+const ContextKeyCSRFToken = "csrfToken"
+const ContextKeyActionPlan = "actionPlan"
+const ContextKeyMedication = "medication"
+const ContextKeyShare = "share"
+const ContextKeyUser = "user"
+const ContextKeyPatient = "patient"
+const ContextKeyMembership = "membership"
+const ContextKeyRole = "role"
+const ContextKeyAccount = "account"
 
 // SimpleCreateRecord persists the Record and returns it
 // back to the client as an acknowledgement.
+//
+// Deprecated: it changes state on a GET request, QuickCreateRecord replaces it.
 func (app *application) SimpleCreateRecord(w http.ResponseWriter, r *http.Request) {
 	newRecordValue := r.Context().Value(ContextKeyNewRecordValue).(float32)
 
+	w.Header().Set("Deprecation", "true")
+	w.Header().Set("Link", `</records/quick>; rel="successor-version"`)
+
 	record := app.recordsService.NewRecordByValue(newRecordValue)
 
-	_, err := app.records.Update(record.ID, record.CreatedAt, record.Value)
+	_, err := app.records.Update(r.Context(), record)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	render.Status(r, http.StatusCreated)
+	render.Render(w, r, NewRecordResponse(record, app.advise(r, record)[0]))
+}
+
+// QuickCreateRecord persists a Record sent as a form or as a plain
+// text value and returns it back to the client as an acknowledgement.
+func (app *application) QuickCreateRecord(w http.ResponseWriter, r *http.Request) {
+	app.quickCreateRecord(w, r, "")
+}
+
+// QuickLinkCreateRecord works like QuickCreateRecord for a quick-add link,
+// the context of the link is used unless the request sets one.
+func (app *application) QuickLinkCreateRecord(w http.ResponseWriter, r *http.Request) {
+	link := r.Context().Value(ContextKeyQuickLink).(*models.QuickLink)
+
+	app.quickCreateRecord(w, r, link.Context)
+}
+
+func (app *application) quickCreateRecord(w http.ResponseWriter, r *http.Request, defaultContext string) {
+	data, err := ParseQuickRecordRequest(r)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	record := app.recordsService.NewRecordByValue(data.Value)
+	if !data.CreatedAt.IsZero() {
+		record.CreatedAt = data.CreatedAt
+	}
+	record.Context = data.Context
+	if record.Context == "" {
+		record.Context = defaultContext
+	}
+	if data.Timezone != "" {
+		record.Timezone = data.Timezone
+	}
+
+	_, err = app.records.Update(r.Context(), record)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	render.Status(r, http.StatusCreated)
+	render.Render(w, r, NewRecordResponse(record, app.advise(r, record)[0]))
+}
+
+// CreateQuickLink issues a signed, expiring quick-add link for the patient
+// of the route, which is safe to bookmark as opening it only shows a form.
+// The link works as long as the caller may add readings of the patient.
+func (app *application) CreateQuickLink(w http.ResponseWriter, r *http.Request) {
+	data := &QuickLinkRequest{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	link := &models.QuickLink{
+		PatientID: models.PatientID(r.Context()),
+		Context:   data.Context,
+	}
+	if user, ok := r.Context().Value(ContextKeyUser).(*models.User); ok {
+		link.IssuerID = user.ID
+	}
+	_, err := app.quickLinkService.Issue(r.Context(), link)
+	if err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+	app.requestLogger(r).Info("quick-add link issued", "quick_link_id", link.ID,
+		"patient_id", link.PatientID, "expires_at", link.ExpiresAt)
+
+	render.Status(r, http.StatusCreated)
+	app.renderQuickLink(w, r, link)
+}
+
+// ListQuickLinks returns the quick-add links of the patient of the route,
+// the latest issued first, revoked and expired ones included.
+func (app *application) ListQuickLinks(w http.ResponseWriter, r *http.Request) {
+	links, err := app.quickLinks.GetAll(r.Context(), models.PatientID(r.Context()))
+	if err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+
+	list := []render.Renderer{}
+	for _, link := range links {
+		response, err := app.newQuickLinkResponse(r, link)
+		if err != nil {
+			render.Render(w, r, ErrRender(err))
+			return
+		}
+		list = append(list, response)
+	}
+	render.RenderList(w, r, list)
+}
+
+// RevokeQuickLink stops a quick-add link from working before it expires.
+func (app *application) RevokeQuickLink(w http.ResponseWriter, r *http.Request) {
+	link := r.Context().Value(ContextKeyQuickLink).(*models.QuickLink)
+
+	err := app.quickLinkService.Revoke(r.Context(), link)
+	if err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+	app.requestLogger(r).Info("quick-add link revoked", "quick_link_id", link.ID)
+
+	app.renderQuickLink(w, r, link)
+}
+
+func (app *application) renderQuickLink(w http.ResponseWriter, r *http.Request, link *models.QuickLink) {
+	response, err := app.newQuickLinkResponse(r, link)
+	if err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+	render.Render(w, r, response)
+}
+
+// newQuickLinkResponse adds the URL of link, its token is derived from the
+// link, so it is the same every time.
+func (app *application) newQuickLinkResponse(r *http.Request, link *models.QuickLink) (*QuickLinkResponse, error) {
+	token, err := app.quickLinkService.Token(link)
+	if err != nil {
+		return nil, err
+	}
+	return NewQuickLinkResponse(link, GetBaseURL(r)+"/records/quick/"+token, token), nil
+}
+
+// QuickLinkForm shows the form for adding a Record through a quick-add link.
+func (app *application) QuickLinkForm(w http.ResponseWriter, r *http.Request) {
+	link := r.Context().Value(ContextKeyQuickLink).(*models.QuickLink)
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	err := quickLinkFormTemplate.Execute(w, link)
+	if err != nil {
+		app.requestLogger(r).Error("rendering quick-add form failed", "error", err)
+	}
+}
+
+// CreateRecord persists the Record and returns it
+// back to the client as an acknowledgement.
+func (app *application) CreateRecord(w http.ResponseWriter, r *http.Request) {
+	data := &RecordRequest{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	record := data.Record
+	record.ID = uuid.New().String()
+	app.recordsService.Localize(record)
+	_, err := app.records.Update(r.Context(), record)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	render.Status(r, http.StatusCreated)
+	render.Render(w, r, NewRecordResponse(record, app.advise(r, record)[0]))
+}
+
+// BatchRecords creates, updates and deletes many Records at once and returns
+// a result per operation. An aborted atomic batch is answered with 409.
+func (app *application) BatchRecords(w http.ResponseWriter, r *http.Request) {
+	data := &BatchRequest{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	errs := make([]error, len(data.Operations))
+	var ops []*models.BulkOperation
+	var opIndexes []int
+	for index, op := range data.Operations {
+		if errs[index] = op.validate(); errs[index] != nil {
+			if op == nil {
+				data.Operations[index] = &BatchOperation{}
+			}
+			continue
+		}
+
+		bulkOp := &models.BulkOperation{Record: op.Record}
+		switch op.Op {
+		case BatchOpCreate:
+			bulkOp.Kind = models.BulkCreate
+			op.Record.ID = uuid.New().String()
+			if op.Record.CreatedAt.IsZero() {
+				op.Record.CreatedAt = time.Now()
+			}
+			app.recordsService.Localize(op.Record)
+		case BatchOpUpdate:
+			bulkOp.Kind = models.BulkUpdate
+			op.Record.ID = op.ID
+			app.recordsService.Localize(op.Record)
+		case BatchOpDelete:
+			bulkOp.Kind = models.BulkRemove
+			bulkOp.Record = &models.Record{ID: op.ID}
+		}
+		op.ID = bulkOp.Record.ID
+
+		ops = append(ops, bulkOp)
+		opIndexes = append(opIndexes, index)
+	}
+
+	applied := !(data.Atomic && models.AbortBatch(errs))
+	if applied && len(ops) > 0 {
+		bulkErrs, err := app.records.BulkWrite(r.Context(), ops, data.Atomic)
+		if err != nil {
+			render.Render(w, r, ErrInvalidRequest(err))
+			return
+		}
+
+		for index, err := range bulkErrs {
+			errs[opIndexes[index]] = err
+		}
+		applied = !(data.Atomic && models.AbortBatch(errs))
+	}
+
+	response := &BatchResponse{Atomic: data.Atomic, Applied: applied}
+	for index, op := range data.Operations {
+		response.Results = append(response.Results, NewBatchResult(op, errs[index]))
+	}
+
+	if !applied {
+		render.Status(r, http.StatusConflict)
+	}
+	render.Render(w, r, response)
+}
+
+// RecordsTrend returns moving averages, the slope and the early warning
+// signal of the daily best readings.
+func (app *application) RecordsTrend(w http.ResponseWriter, r *http.Request) {
+	trend, err := app.trends.Trend(r.Context())
+	if err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+
+	render.Render(w, r, &TrendResponse{Trend: trend})
+}
+
+// RecordsCorrelation returns how readings correlate with the temperature,
+// humidity, air quality and pollen count at the time they were taken.
+func (app *application) RecordsCorrelation(w http.ResponseWriter, r *http.Request) {
+	report, err := app.environment.Correlation(r.Context())
+	if err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+
+	render.Render(w, r, &CorrelationResponse{EnvironmentReport: report})
+}
+
+// AggregateRecords summarizes the Records per day, week or month of their
+// local days, buckets start at midnight in the time zone given by the tz
+// parameter, the one of the user by default.
+func (app *application) AggregateRecords(w http.ResponseWriter, r *http.Request) {
+	query, err := ParseAggregateQuery(r, app.recordsService.Location())
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	buckets, err := app.records.Aggregate(r.Context(), query)
+	if err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+
+	render.Render(w, r, &AggregateResponse{
+		Bucket:   query.Bucket,
+		Timezone: query.Location.String(),
+		Buckets:  buckets,
+	})
+}
+
+// AdherenceReport returns per week the share of scheduled controller doses
+// taken, the reliever use and the mean peak flow, for the number of weeks
+// given by the weeks parameter up to the current one.
+func (app *application) AdherenceReport(w http.ResponseWriter, r *http.Request) {
+	weeks, location, err := ParseAdherenceQuery(r, app.recordsService.Location())
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	report, err := app.reports.Adherence(r.Context(), weeks, location)
+	if err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+
+	render.Render(w, r, &AdherenceResponse{Adherence: report})
+}
+
+// ListShares returns every share, the latest created first, revoked and
+// expired ones included.
+func (app *application) ListShares(w http.ResponseWriter, r *http.Request) {
+	shares, err := app.shares.GetAll(r.Context())
+	if err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+
+	list := []render.Renderer{}
+	for _, share := range shares {
+		response, err := app.newShareResponse(r, share)
+		if err != nil {
+			render.Render(w, r, ErrRender(err))
+			return
+		}
+		list = append(list, response)
+	}
+	render.RenderList(w, r, list)
+}
+
+// CreateShare creates a read-only link to the resources of a date range,
+// signed and expiring, for someone without an account like a doctor.
+func (app *application) CreateShare(w http.ResponseWriter, r *http.Request) {
+	data := &ShareRequest{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	share := data.Share
+	_, err := app.shareService.Create(r.Context(), share)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	app.requestLogger(r).Info("share created", "share_id", share.ID,
+		"resources", share.Resources, "expires_at", share.ExpiresAt)
+
+	render.Status(r, http.StatusCreated)
+	app.renderShare(w, r, share)
+}
+
+// GetShare returns a share with the URL of its link.
+func (app *application) GetShare(w http.ResponseWriter, r *http.Request) {
+	share := r.Context().Value(ContextKeyShare).(*models.Share)
+
+	app.renderShare(w, r, share)
+}
+
+// RevokeShare stops the link of a share from working, the share is kept
+// for its access log.
+func (app *application) RevokeShare(w http.ResponseWriter, r *http.Request) {
+	share := r.Context().Value(ContextKeyShare).(*models.Share)
+
+	err := app.shareService.Revoke(r.Context(), share)
+	if err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+	app.requestLogger(r).Info("share revoked", "share_id", share.ID)
+
+	app.renderShare(w, r, share)
+}
+
+// ListShareAccesses returns the access log of a share, oldest first.
+func (app *application) ListShareAccesses(w http.ResponseWriter, r *http.Request) {
+	share := r.Context().Value(ContextKeyShare).(*models.Share)
+
+	accesses, err := app.shares.Accesses(r.Context(), share.ID)
+	if err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+
+	render.RenderList(w, r, NewShareAccessListResponse(accesses))
+}
+
+func (app *application) renderShare(w http.ResponseWriter, r *http.Request, share *models.Share) {
+	response, err := app.newShareResponse(r, share)
+	if err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+	render.Render(w, r, response)
+}
+
+// newShareResponse adds the URL of the link of share, its token is
+// derived from the share, so it is the same every time.
+func (app *application) newShareResponse(r *http.Request, share *models.Share) (*ShareResponse, error) {
+	token, err := app.shareService.Token(share)
+	if err != nil {
+		return nil, err
+	}
+	return NewShareResponse(share, GetBaseURL(r)+"/shared/"+token), nil
+}
+
+// CreateUser creates an account and returns it with its bearer token,
+// which is shown this once only.
+func (app *application) CreateUser(w http.ResponseWriter, r *http.Request) {
+	data := &UserRequest{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	user, token, err := app.userService.Create(r.Context(), data.Name)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	app.requestLogger(r).Info("user created", "user_id", user.ID)
+
+	render.Status(r, http.StatusCreated)
+	render.Render(w, r, &CreatedUserResponse{User: user, Token: token})
+}
+
+// GetCurrentUser returns the user of the bearer token.
+func (app *application) GetCurrentUser(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(ContextKeyUser).(*models.User)
+
+	render.Render(w, r, &UserResponse{User: user})
+}
+
+// ListPatients returns the patients the user has access to with the role
+// of the user, in the order access was granted.
+func (app *application) ListPatients(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(ContextKeyUser).(*models.User)
+
+	memberships, err := app.patients.MembershipsOf(r.Context(), user.ID)
+	if err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+
+	list := []render.Renderer{}
+	for _, membership := range memberships {
+		patient, err := app.patients.Get(r.Context(), membership.PatientID)
+		if errors.Is(err, models.ErrNoPatient) {
+			continue
+		}
+		if err != nil {
+			render.Render(w, r, ErrRender(err))
+			return
+		}
+		list = append(list, &PatientResponse{Patient: patient, Role: membership.Role})
+	}
+	render.RenderList(w, r, list)
+}
+
+// CreatePatient creates a patient, the user is its owner.
+func (app *application) CreatePatient(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(ContextKeyUser).(*models.User)
+
+	data := &PatientRequest{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	patient := data.Patient
+	err := app.patientService.Create(r.Context(), patient, user)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	app.requestLogger(r).Info("patient created", "patient_id", patient.ID, "user_id", user.ID)
+
+	render.Status(r, http.StatusCreated)
+	render.Render(w, r, &PatientResponse{Patient: patient, Role: models.RoleOwner})
+}
+
+// GetPatient returns a patient with the role of the user.
+func (app *application) GetPatient(w http.ResponseWriter, r *http.Request) {
+	patient := r.Context().Value(ContextKeyPatient).(*models.Patient)
+	membership := r.Context().Value(ContextKeyMembership).(*models.Membership)
+
+	render.Render(w, r, &PatientResponse{Patient: patient, Role: membership.Role})
+}
+
+// UpdatePatient renames a patient.
+func (app *application) UpdatePatient(w http.ResponseWriter, r *http.Request) {
+	patient := r.Context().Value(ContextKeyPatient).(*models.Patient)
+	membership := r.Context().Value(ContextKeyMembership).(*models.Membership)
+
+	data := &PatientRequest{Patient: patient}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	patient = data.Patient
+	patient.Name = strings.TrimSpace(patient.Name)
+
+	err := app.patients.Update(r.Context(), patient)
+	if err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+
+	render.Render(w, r, &PatientResponse{Patient: patient, Role: membership.Role})
+}
+
+// ListMembers returns who has access to a patient, in the order access was
+// granted.
+func (app *application) ListMembers(w http.ResponseWriter, r *http.Request) {
+	patient := r.Context().Value(ContextKeyPatient).(*models.Patient)
+
+	memberships, err := app.patients.Memberships(r.Context(), patient.ID)
+	if err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+
+	render.RenderList(w, r, NewMembershipListResponse(memberships))
+}
+
+// SetMember grants the user of the UserID URL parameter a role for the
+// patient, replacing the one it had. Taking the role of the last owner is
+// answered with 409.
+func (app *application) SetMember(w http.ResponseWriter, r *http.Request) {
+	patient := r.Context().Value(ContextKeyPatient).(*models.Patient)
+
+	data := &MembershipRequest{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	membership, err := app.patientService.Grant(r.Context(), patient.ID, chi.URLParam(r, "UserID"), data.Role)
+	switch {
+	case errors.Is(err, models.ErrNoUser):
+		render.Render(w, r, ErrNotFound)
+		return
+	case errors.Is(err, services.ErrLastOwner):
+		render.Render(w, r, ErrConflict(err))
+		return
+	case err != nil:
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+	app.requestLogger(r).Info("patient access granted", "patient_id", patient.ID,
+		"user_id", membership.UserID, "role", membership.Role)
+
+	render.Render(w, r, &MembershipResponse{Membership: membership})
+}
+
+// RemoveMember takes the access to the patient from the user of the UserID
+// URL parameter. Removing the last owner is answered with 409.
+func (app *application) RemoveMember(w http.ResponseWriter, r *http.Request) {
+	patient := r.Context().Value(ContextKeyPatient).(*models.Patient)
+	membership, err := app.patientService.Revoke(r.Context(), patient.ID, chi.URLParam(r, "UserID"))
+	switch {
+	case errors.Is(err, models.ErrNoMembership):
+		render.Render(w, r, ErrNotFound)
+		return
+	case errors.Is(err, services.ErrLastOwner):
+		render.Render(w, r, ErrConflict(err))
+		return
+	case err != nil:
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+	app.requestLogger(r).Info("patient access revoked", "patient_id", patient.ID, "user_id", membership.UserID)
+
+	render.Render(w, r, &MembershipResponse{Membership: membership})
+}
+
+// ListUsers returns every account, oldest first, disabled ones included.
+func (app *application) ListUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := app.users.GetAll(r.Context())
+	if err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+
+	list := []render.Renderer{}
+	for _, user := range users {
+		list = append(list, &UserResponse{User: user})
+	}
+	render.RenderList(w, r, list)
+}
+
+// GetUser returns the account of the UserID URL parameter.
+func (app *application) GetUser(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(ContextKeyAccount).(*models.User)
+
+	render.Render(w, r, &UserResponse{User: user})
+}
+
+// ResetUserToken gives an account a new token, for a user who lost theirs,
+// and returns it this once only. The previous token stops working.
+func (app *application) ResetUserToken(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(ContextKeyAccount).(*models.User)
+
+	token, err := app.userService.ResetToken(r.Context(), user)
+	if err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+	app.requestLogger(r).Info("user token reset", "account_id", user.ID)
+
+	render.Render(w, r, &CreatedUserResponse{User: user, Token: token})
+}
+
+// DisableUser keeps an account from authenticating, its data is kept.
+// Admins disabling their own account get a 409.
+func (app *application) DisableUser(w http.ResponseWriter, r *http.Request) {
+	caller := r.Context().Value(ContextKeyUser).(*models.User)
+	user := r.Context().Value(ContextKeyAccount).(*models.User)
+
+	if user.ID == caller.ID {
+		render.Render(w, r, ErrConflict(errors.New("admins can't disable their own account")))
+		return
+	}
+
+	err := app.userService.Disable(r.Context(), user)
+	if err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+	app.requestLogger(r).Info("user disabled", "account_id", user.ID)
+
+	render.Render(w, r, &UserResponse{User: user})
+}
+
+// EnableUser lets a disabled account authenticate again.
+func (app *application) EnableUser(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(ContextKeyAccount).(*models.User)
+
+	err := app.userService.Enable(r.Context(), user)
+	if err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+	app.requestLogger(r).Info("user enabled", "account_id", user.ID)
+
+	render.Render(w, r, &UserResponse{User: user})
+}
+
+// SystemStats returns counts of the accounts, patients, records and shares
+// of the server.
+func (app *application) SystemStats(w http.ResponseWriter, r *http.Request) {
+	stats, err := app.stats.Stats(r.Context())
+	if err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+
+	render.Render(w, r, &StatsResponse{SystemStats: stats})
+}
+
+// PullChanges returns the changes of Records after the cursor given by the
+// since parameter, all changes without it, tombstones of removed ones included.
+func (app *application) PullChanges(w http.ResponseWriter, r *http.Request) {
+	limit, err := ParseSyncLimit(r)
 	if err != nil {
 		render.Render(w, r, ErrInvalidRequest(err))
 		return
 	}
 
-	render.Status(r, http.StatusCreated)
-	render.Render(w, r, NewRecordResponse(record))
+	set, err := app.sync.Changes(r.Context(), r.URL.Query().Get("since"), limit)
+	if errors.Is(err, services.ErrInvalidCursor) {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	if err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+
+	render.Render(w, r, NewChangesResponse(set))
 }
 
-// CreateRecord persists the Record and returns it
-// back to the client as an acknowledgement.
-func (app *application) CreateRecord(w http.ResponseWriter, r *http.Request) {
-	data := &RecordRequest{}
+// PushChanges applies the changes a client made offline, in order, and
+// returns what became of each. Neither conflicts nor changes failing to be
+// stored fail the request.
+func (app *application) PushChanges(w http.ResponseWriter, r *http.Request) {
+	data := &SyncRequest{}
 	if err := render.Bind(r, data); err != nil {
 		render.Render(w, r, ErrInvalidRequest(err))
 		return
 	}
 
-	record := data.Record
-	record.ID = uuid.New().String()
-	app.records.Update(record.ID, record.CreatedAt, record.Value)
+	results := app.sync.Push(r.Context(), data.Changes)
 
-	render.Status(r, http.StatusCreated)
-	render.Render(w, r, NewRecordResponse(record))
+	render.Render(w, r, &SyncResponse{Results: results})
 }
 
 // GetRecord returns the specific Record. You'll notice it just
@@ -54,20 +743,20 @@ func (app *application) GetRecord(w http.ResponseWriter, r *http.Request) {
 	// middleware. The worst case, the recoverer middleware will save us.
 	record := r.Context().Value(ContextKeyRecord).(*models.Record)
 
-	if err := render.Render(w, r, NewRecordResponse(record)); err != nil {
+	if err := render.Render(w, r, NewRecordResponse(record, app.advise(r, record)[0])); err != nil {
 		render.Render(w, r, ErrRender(err))
 		return
 	}
 }
 
 func (app *application) ListRecords(w http.ResponseWriter, r *http.Request) {
-	records, err := app.records.GetAll()
+	records, err := app.records.GetAll(r.Context())
 	if err != nil {
 		render.Render(w, r, ErrRender(err))
 		return
 	}
 
-	if err := render.RenderList(w, r, NewRecordListResponse(records)); err != nil {
+	if err := render.RenderList(w, r, NewRecordListResponse(records, app.advise(r, records...))); err != nil {
 		render.Render(w, r, ErrRender(err))
 		return
 	}
@@ -83,9 +772,25 @@ func (app *application) UpdateRecord(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	record = data.Record
-	app.records.Update(record.ID, record.CreatedAt, record.Value)
+	app.recordsService.Localize(record)
+	if _, err := app.records.Update(r.Context(), record); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	render.Render(w, r, NewRecordResponse(record, app.advise(r, record)[0]))
+}
 
-	render.Render(w, r, NewRecordResponse(record))
+// advise returns the zone and the instructions of the action plan of every
+// record. They are left out if the plans can't be loaded, the record is
+// worth returning without them, and for other patients than the default one.
+func (app *application) advise(r *http.Request, records ...*models.Record) []*services.ZoneAdvice {
+	advice, err := app.actionPlanService.Advise(r.Context(), records)
+	if err != nil {
+		app.requestLogger(r).Error("loading the zones of records failed", "error", err)
+		return make([]*services.ZoneAdvice, len(records))
+	}
+	return advice
 }
 
 // DeleteRecord removes an existing Record from our persistent store.
@@ -97,11 +802,409 @@ func (app *application) DeleteRecord(w http.ResponseWriter, r *http.Request) {
 	// middleware. The worst case, the recoverer middleware will save us.
 	record := r.Context().Value(ContextKeyRecord).(*models.Record)
 
-	_, err = app.records.Remove(record.ID)
+	_, err = app.records.Remove(r.Context(), record.ID)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	render.Render(w, r, NewRecordResponse(record, nil))
+}
+
+// Healthz reports that the process is up, without checking dependencies.
+func (app *application) Healthz(w http.ResponseWriter, r *http.Request) {
+	render.JSON(w, r, &health.Report{Status: health.StatusUp, Checks: map[string]*health.CheckResult{}})
+}
+
+// Readyz checks every registered dependency, answering 503 if any is down.
+func (app *application) Readyz(w http.ResponseWriter, r *http.Request) {
+	report := app.health.Check(r.Context())
+	if report.Status != health.StatusUp {
+		app.requestLogger(r).Warn("readiness check failed", "checks", report.Checks)
+		render.Status(r, http.StatusServiceUnavailable)
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	render.JSON(w, r, report)
+}
+
+// ListRecordHistory returns all prior versions of an existing Record.
+func (app *application) ListRecordHistory(w http.ResponseWriter, r *http.Request) {
+	record := r.Context().Value(ContextKeyRecord).(*models.Record)
+
+	revisions, err := app.records.History(r.Context(), record.ID)
+	if err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+
+	if err := render.RenderList(w, r, NewRevisionListResponse(revisions)); err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+}
+
+// RevertRecord restores an existing Record to one of its prior versions.
+func (app *application) RevertRecord(w http.ResponseWriter, r *http.Request) {
+	record := r.Context().Value(ContextKeyRecord).(*models.Record)
+	rev := r.Context().Value(ContextKeyRevision).(int)
+
+	record, err := app.records.Revert(r.Context(), record.ID, rev)
+	if errors.Is(err, models.ErrNoRevision) {
+		render.Render(w, r, ErrNotFound)
+		return
+	}
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	render.Render(w, r, NewRecordResponse(record, app.advise(r, record)[0]))
+}
+
+// ListActionPlans returns the latest version of every action plan.
+func (app *application) ListActionPlans(w http.ResponseWriter, r *http.Request) {
+	plans, err := app.actionPlans.GetAll(r.Context())
+	if err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+
+	if err := render.RenderList(w, r, NewActionPlanListResponse(plans)); err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+}
+
+// CreateActionPlan saves the first version of a new action plan.
+func (app *application) CreateActionPlan(w http.ResponseWriter, r *http.Request) {
+	data := &ActionPlanRequest{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	plan := data.ActionPlan
+	plan.ID = uuid.New().String()
+	plan.Version = 0
+	plan.UpdatedAt = time.Now()
+	err := app.actionPlans.Save(r.Context(), plan)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	render.Status(r, http.StatusCreated)
+	render.Render(w, r, NewActionPlanResponse(plan))
+}
+
+// ActiveActionPlan returns the action plan in effect at the time given by
+// the at parameter, now by default.
+func (app *application) ActiveActionPlan(w http.ResponseWriter, r *http.Request) {
+	at := time.Now()
+	if value := r.URL.Query().Get("at"); value != "" {
+		var err error
+		at, err = time.Parse(time.RFC3339, value)
+		if err != nil {
+			render.Render(w, r, ErrInvalidRequest(fmt.Errorf("invalid at %q, must be RFC 3339", value)))
+			return
+		}
+	}
+
+	plans, err := app.actionPlans.GetAll(r.Context())
+	if err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+
+	plan := services.ActivePlan(plans, at)
+	if plan == nil {
+		render.Render(w, r, ErrNotFound)
+		return
+	}
+	render.Render(w, r, NewActionPlanResponse(plan))
+}
+
+// GetActionPlan returns the latest version of an action plan.
+func (app *application) GetActionPlan(w http.ResponseWriter, r *http.Request) {
+	plan := r.Context().Value(ContextKeyActionPlan).(*models.ActionPlan)
+
+	render.Render(w, r, NewActionPlanResponse(plan))
+}
+
+// UpdateActionPlan saves the next version of an action plan. Fields left out
+// keep their values, a version sent must be the latest one.
+func (app *application) UpdateActionPlan(w http.ResponseWriter, r *http.Request) {
+	plan := r.Context().Value(ContextKeyActionPlan).(*models.ActionPlan)
+	id := plan.ID
+
+	data := &ActionPlanRequest{ActionPlan: plan}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	plan = data.ActionPlan
+	plan.ID = id
+	plan.UpdatedAt = time.Now()
+	err := app.actionPlans.Save(r.Context(), plan)
+	if errors.Is(err, models.ErrVersionConflict) {
+		render.Render(w, r, ErrConflict(err))
+		return
+	}
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	render.Render(w, r, NewActionPlanResponse(plan))
+}
+
+// DeleteActionPlan removes an action plan with all its versions.
+func (app *application) DeleteActionPlan(w http.ResponseWriter, r *http.Request) {
+	plan := r.Context().Value(ContextKeyActionPlan).(*models.ActionPlan)
+
+	err := app.actionPlans.Remove(r.Context(), plan.ID)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	render.Render(w, r, NewActionPlanResponse(plan))
+}
+
+// ListActionPlanVersions returns every version of an action plan, oldest first.
+func (app *application) ListActionPlanVersions(w http.ResponseWriter, r *http.Request) {
+	plan := r.Context().Value(ContextKeyActionPlan).(*models.ActionPlan)
+
+	versions, err := app.actionPlans.Versions(r.Context(), plan.ID)
+	if err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+
+	if err := render.RenderList(w, r, NewActionPlanListResponse(versions)); err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+}
+
+// RecordContext returns a Record with the doses of medications taken
+// around it, by default from 6 hours before until 2 hours after.
+func (app *application) RecordContext(w http.ResponseWriter, r *http.Request) {
+	record := r.Context().Value(ContextKeyRecord).(*models.Record)
+
+	before, after, err := ParseDosesWindow(r)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	doses, err := app.medicationService.DosesAround(r.Context(), record, before, after)
+	if err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+
+	response := NewRecordResponse(record, app.advise(r, record)[0])
+	render.Render(w, r, NewRecordContextResponse(response, doses))
+}
+
+// ListMedications returns every medication with what is left in its inhaler.
+func (app *application) ListMedications(w http.ResponseWriter, r *http.Request) {
+	medications, err := app.medications.GetAll(r.Context())
+	if err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+
+	list := []render.Renderer{}
+	for _, medication := range medications {
+		inventory, err := app.medicationService.Inventory(r.Context(), medication)
+		if err != nil {
+			render.Render(w, r, ErrRender(err))
+			return
+		}
+		list = append(list, NewMedicationResponse(medication, inventory))
+	}
+
+	if err := render.RenderList(w, r, list); err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+}
+
+// CreateMedication adds an inhaler, a full one unless refilled_at tells
+// since when it is in use. Without reorder_below it is DefaultReorderBelow,
+// without started_at the schedule starts when the inhaler was.
+func (app *application) CreateMedication(w http.ResponseWriter, r *http.Request) {
+	data := &MedicationRequest{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	medication := data.Medication
+	medication.ID = uuid.New().String()
+	if medication.ReorderBelow == 0 {
+		medication.ReorderBelow = services.DefaultReorderBelow
+	}
+	if medication.RefilledAt.IsZero() {
+		medication.RefilledAt = time.Now()
+	}
+	if medication.StartedAt.IsZero() {
+		medication.StartedAt = medication.RefilledAt
+	}
+	err := app.medications.Update(r.Context(), medication)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	render.Status(r, http.StatusCreated)
+	app.renderMedication(w, r, medication)
+}
+
+// GetMedication returns a medication with what is left in its inhaler.
+func (app *application) GetMedication(w http.ResponseWriter, r *http.Request) {
+	medication := r.Context().Value(ContextKeyMedication).(*models.Medication)
+
+	app.renderMedication(w, r, medication)
+}
+
+// UpdateMedication changes a medication, fields left out keep their values.
+func (app *application) UpdateMedication(w http.ResponseWriter, r *http.Request) {
+	medication := r.Context().Value(ContextKeyMedication).(*models.Medication)
+	id := medication.ID
+
+	data := &MedicationRequest{Medication: medication}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	medication = data.Medication
+	medication.ID = id
+	err := app.medications.Update(r.Context(), medication)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	app.renderMedication(w, r, medication)
+}
+
+// DeleteMedication removes a medication with all its doses.
+func (app *application) DeleteMedication(w http.ResponseWriter, r *http.Request) {
+	medication := r.Context().Value(ContextKeyMedication).(*models.Medication)
+
+	err := app.medications.Remove(r.Context(), medication.ID)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	render.Render(w, r, NewMedicationResponse(medication, nil))
+}
+
+// RefillMedication starts a new inhaler of a medication, doses taken
+// before don't count against it.
+func (app *application) RefillMedication(w http.ResponseWriter, r *http.Request) {
+	medication := r.Context().Value(ContextKeyMedication).(*models.Medication)
+
+	medication.RefilledAt = time.Now()
+	err := app.medications.Update(r.Context(), medication)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	app.renderMedication(w, r, medication)
+}
+
+func (app *application) renderMedication(w http.ResponseWriter, r *http.Request, medication *models.Medication) {
+	inventory, err := app.medicationService.Inventory(r.Context(), medication)
+	if err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+
+	render.Render(w, r, NewMedicationResponse(medication, inventory))
+}
+
+// ListDoses returns the doses of a medication, oldest first, optionally
+// taken from and until the times of the from and until parameters.
+func (app *application) ListDoses(w http.ResponseWriter, r *http.Request) {
+	medication := r.Context().Value(ContextKeyMedication).(*models.Medication)
+
+	query, err := ParseDoseQuery(r, medication.ID)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	doses, err := app.medications.Doses(r.Context(), query)
+	if err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+
+	if err := render.RenderList(w, r, NewDoseListResponse(doses)); err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+}
+
+// LogDose saves a dose of a medication and returns it with the inventory
+// after it. The dose which makes the inventory run low raises a reorder alert.
+func (app *application) LogDose(w http.ResponseWriter, r *http.Request) {
+	medication := r.Context().Value(ContextKeyMedication).(*models.Medication)
+
+	data := &DoseRequest{Dose: &models.Dose{}}
+	if r.ContentLength != 0 { // the body is optional
+		if err := render.Bind(r, data); err != nil {
+			render.Render(w, r, ErrInvalidRequest(err))
+			return
+		}
+	}
+
+	dose := data.Dose
+	dose.ID = uuid.New().String()
+	dose.MedicationID = medication.ID
+	if dose.Puffs == 0 {
+		dose.Puffs = medication.PuffsPerDose
+	}
+	if dose.TakenAt.IsZero() {
+		dose.TakenAt = time.Now()
+	}
+
+	inventory, alert, err := app.medicationService.LogDose(r.Context(), medication, dose)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	if alert {
+		app.requestLogger(r).Warn("medication running low, time to reorder",
+			"medication", medication.Name, "doses_left", inventory.DosesLeft)
+	}
+
+	render.Status(r, http.StatusCreated)
+	render.Render(w, r, &DoseResponse{Dose: dose, Inventory: inventory, ReorderAlert: alert})
+}
+
+// DeleteDose removes a dose logged by mistake.
+func (app *application) DeleteDose(w http.ResponseWriter, r *http.Request) {
+	medication := r.Context().Value(ContextKeyMedication).(*models.Medication)
+
+	dose, err := app.medications.RemoveDose(r.Context(), medication.ID, chi.URLParam(r, "DoseID"))
+	if errors.Is(err, models.ErrNoDose) {
+		render.Render(w, r, ErrNotFound)
+		return
+	}
 	if err != nil {
 		render.Render(w, r, ErrInvalidRequest(err))
 		return
 	}
 
-	render.Render(w, r, NewRecordResponse(record))
+	render.Render(w, r, NewDoseResponse(dose))
 }
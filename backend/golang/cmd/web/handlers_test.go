@@ -1,18 +1,31 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/analytics"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/health"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/logging"
 	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
 	"github.com/romanthekat/simple-peak-flowmeter/pkg/models/mock"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/services"
+	"io"
 	"log"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestGetRecord(t *testing.T) {
 	//given
-	app := newTestApplication(t)
+	app := newOpenTestApplication(t)
 
 	ts := httptest.NewServer(app.routes())
 	defer ts.Close()
@@ -45,7 +58,7 @@ func TestGetRecord(t *testing.T) {
 }
 func TestGetAllRecord(t *testing.T) {
 	//given
-	app := newTestApplication(t)
+	app := newOpenTestApplication(t)
 
 	ts := httptest.NewServer(app.routes())
 	defer ts.Close()
@@ -86,3 +99,889 @@ func isSameRecords(expected, actual *models.Record) bool {
 		expected.Value == actual.Value &&
 		expected.CreatedAt.Equal(actual.CreatedAt) //time.Time doesn't work with reflect.DeepEqual
 }
+
+func TestRecordHistoryAndRevert(t *testing.T) {
+	//given
+	app := newOpenTestApplication(t)
+
+	ts := httptest.NewServer(app.routes())
+	defer ts.Close()
+
+	r := newRequest(t, http.MethodPut, ts.URL+"/records/1", `{"value": 400}`)
+	rs, err := ts.Client().Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rs.StatusCode != http.StatusOK {
+		t.Fatalf("want %d; got %d", http.StatusOK, rs.StatusCode)
+	}
+
+	//when
+	rs, err = ts.Client().Do(newGetRequest(t, ts.URL+"/records/1/history"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//then
+	if rs.StatusCode != http.StatusOK {
+		t.Fatalf("want %d; got %d", http.StatusOK, rs.StatusCode)
+	}
+
+	var revisions []*models.Revision
+	err = json.NewDecoder(rs.Body).Decode(&revisions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(revisions) != 1 || !isSameRecords(revisions[0].Record, mock.Records[1]) {
+		t.Fatalf("want single revision with mock record, got %+v", revisions)
+	}
+
+	//when
+	rs, err = ts.Client().Do(newRequest(t, http.MethodPost,
+		ts.URL+"/records/1/revert/"+strconv.Itoa(revisions[0].Rev), ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//then
+	if rs.StatusCode != http.StatusOK {
+		t.Fatalf("want %d; got %d", http.StatusOK, rs.StatusCode)
+	}
+
+	var record *models.Record
+	err = json.NewDecoder(rs.Body).Decode(&record)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !isSameRecords(record, mock.Records[1]) {
+		t.Errorf("want reverted record to match mock record, got %+v", record)
+	}
+}
+
+func TestRevertUnknownRevision(t *testing.T) {
+	//given
+	app := newOpenTestApplication(t)
+
+	ts := httptest.NewServer(app.routes())
+	defer ts.Close()
+
+	//when
+	rs, err := ts.Client().Do(newRequest(t, http.MethodPost, ts.URL+"/records/1/revert/42", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//then
+	if rs.StatusCode != http.StatusNotFound {
+		t.Fatalf("want %d; got %d", http.StatusNotFound, rs.StatusCode)
+	}
+}
+
+func TestBatchRecords(t *testing.T) {
+	//given
+	app := newOpenTestApplication(t)
+
+	ts := httptest.NewServer(app.routes())
+	defer ts.Close()
+
+	body := `{"operations": [
+		{"op": "create", "record": {"value": 410}},
+		{"op": "update", "id": "1", "record": {"value": 415, "created_at": "2020-01-02T08:00:00Z"}},
+		{"op": "delete", "id": "2"},
+		{"op": "delete", "id": "missing"}
+	]}`
+
+	//when
+	rs, err := ts.Client().Do(newRequest(t, http.MethodPost, ts.URL+"/records/batch", body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//then
+	if rs.StatusCode != http.StatusOK {
+		t.Fatalf("want %d; got %d", http.StatusOK, rs.StatusCode)
+	}
+
+	var response BatchResponse
+	err = json.NewDecoder(rs.Body).Decode(&response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantStatuses := []int{http.StatusCreated, http.StatusOK, http.StatusOK, http.StatusNotFound}
+	for index, result := range response.Results {
+		if result.Status != wantStatuses[index] {
+			t.Errorf("operation %d: want status %d; got %+v", index, wantStatuses[index], result)
+		}
+	}
+
+	records, _ := app.records.GetAll(context.Background())
+	if len(records) != len(mock.Records) {
+		t.Errorf("want %d records after batch, got %d", len(mock.Records), len(records))
+	}
+}
+
+func TestBatchRecordsAtomicAbort(t *testing.T) {
+	//given
+	app := newOpenTestApplication(t)
+
+	ts := httptest.NewServer(app.routes())
+	defer ts.Close()
+
+	body := `{"atomic": true, "operations": [
+		{"op": "delete", "id": "1"},
+		{"op": "update", "id": "missing", "record": {"value": 415, "created_at": "2020-01-02T08:00:00Z"}}
+	]}`
+
+	//when
+	rs, err := ts.Client().Do(newRequest(t, http.MethodPost, ts.URL+"/records/batch", body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//then
+	if rs.StatusCode != http.StatusConflict {
+		t.Fatalf("want %d; got %d", http.StatusConflict, rs.StatusCode)
+	}
+
+	var response BatchResponse
+	err = json.NewDecoder(rs.Body).Decode(&response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if response.Applied ||
+		response.Results[0].Status != http.StatusFailedDependency ||
+		response.Results[1].Status != http.StatusNotFound {
+		t.Errorf("want aborted batch, got %+v", response)
+	}
+
+	if _, err := app.records.Get(context.Background(), "1"); err != nil {
+		t.Errorf("want record 1 to survive aborted batch, got %v", err)
+	}
+}
+
+func TestCreateRecordIdempotencyKey(t *testing.T) {
+	//given
+	app := newOpenTestApplication(t)
+
+	ts := httptest.NewServer(app.routes())
+	defer ts.Close()
+
+	body := `{"value": 470, "created_at": "2020-01-02T08:00:00Z"}`
+
+	//when
+	const retries = 5
+	ids := make(chan string, retries)
+	var wg sync.WaitGroup
+	for i := 0; i < retries; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			r := newRequest(t, http.MethodPost, ts.URL+"/records", body)
+			r.Header.Set("Idempotency-Key", "retried-key")
+			rs, err := ts.Client().Do(r)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer rs.Body.Close()
+
+			if rs.StatusCode != http.StatusCreated {
+				t.Errorf("want %d; got %d", http.StatusCreated, rs.StatusCode)
+			}
+
+			var record *models.Record
+			if err := json.NewDecoder(rs.Body).Decode(&record); err != nil {
+				t.Error(err)
+				return
+			}
+			ids <- record.ID
+		}()
+	}
+	wg.Wait()
+	close(ids)
+
+	//then
+	var firstID string
+	for id := range ids {
+		if firstID == "" {
+			firstID = id
+		}
+		if id != firstID {
+			t.Errorf("want same record for every retry, got %s and %s", firstID, id)
+		}
+	}
+
+	records, _ := app.records.GetAll(context.Background())
+	if len(records) != len(mock.Records)+1 {
+		t.Errorf("want exactly one created record, got %d records", len(records))
+	}
+}
+
+func TestIdempotencyKeyReusedForOtherRequest(t *testing.T) {
+	//given
+	app := newOpenTestApplication(t)
+
+	ts := httptest.NewServer(app.routes())
+	defer ts.Close()
+
+	//when
+	first := newRequest(t, http.MethodPost, ts.URL+"/records", `{"value": 470}`)
+	first.Header.Set("Idempotency-Key", "reused-key")
+	rs, err := ts.Client().Do(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rs.StatusCode != http.StatusCreated {
+		t.Fatalf("want %d; got %d", http.StatusCreated, rs.StatusCode)
+	}
+
+	second := newRequest(t, http.MethodPost, ts.URL+"/records", `{"value": 480}`)
+	second.Header.Set("Idempotency-Key", "reused-key")
+	rs, err = ts.Client().Do(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//then
+	if rs.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("want %d; got %d", http.StatusUnprocessableEntity, rs.StatusCode)
+	}
+}
+
+func TestIdempotencyWaitCanceled(t *testing.T) {
+	//given
+	app := newTestApplication(t)
+	first, err := app.idempotency.Begin(context.Background(), "stuck-key", "fingerprint")
+	if first != nil || err != nil {
+		t.Fatalf("want the key reserved, got %v, %v", first, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	//when
+	_, err = app.idempotency.Begin(ctx, "stuck-key", "fingerprint")
+
+	//then
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("want the wait for the first request to end with the context, got %v", err)
+	}
+}
+
+func TestIdempotencyKeyScopedToCaller(t *testing.T) {
+	//given
+	app := newTestApplication(t)
+	handler := app.routes()
+	parent := createUser(t, app, handler, "Parent")
+	other := createUser(t, app, handler, "Other")
+	patient := createPatient(t, handler, parent, nil)
+	sibling := createPatient(t, handler, parent, nil)
+	otherPatient := createPatient(t, handler, other, nil)
+
+	//when
+	var created []*RecordResponse
+	for _, tt := range []struct {
+		user    *CreatedUserResponse
+		patient *PatientResponse
+	}{{parent, patient}, {parent, sibling}, {other, otherPatient}} {
+		r := authorized(newRequest(t, http.MethodPost, "/patients/"+tt.patient.ID+"/records", `{"value": 470}`), tt.user)
+		r.Header.Set("Idempotency-Key", "shared-key")
+		record := &RecordResponse{}
+		serveJSON(t, handler, r, http.StatusCreated, record)
+		created = append(created, record)
+	}
+
+	//then
+	for i, record := range created {
+		for _, earlier := range created[:i] {
+			if record.ID == earlier.ID {
+				t.Errorf("want a record per caller and patient, got %s replayed", record.ID)
+			}
+		}
+	}
+}
+
+func TestQuickCreateRecord(t *testing.T) {
+	tests := []struct {
+		name        string
+		url         string
+		contentType string
+		body        string
+		wantStatus  int
+		wantValue   float32
+		wantContext string
+	}{
+		{"plain text", "/records/quick", "text/plain", "480", http.StatusCreated, 480, ""},
+		{"plain text with query", "/records/quick?context=evening&created_at=2020-01-02T20:00:00Z",
+			"text/plain; charset=utf-8", " 455\n", http.StatusCreated, 455, "evening"},
+		{"form", "/records/quick", "application/x-www-form-urlencoded",
+			"value=470&context=morning", http.StatusCreated, 470, "morning"},
+		{"not a number", "/records/quick", "text/plain", "much", http.StatusBadRequest, 0, ""},
+		{"negative", "/records/quick", "text/plain", "-5", http.StatusBadRequest, 0, ""},
+		{"bad timestamp", "/records/quick?created_at=yesterday", "text/plain", "480", http.StatusBadRequest, 0, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			//given
+			app := newOpenTestApplication(t)
+
+			ts := httptest.NewServer(app.routes())
+			defer ts.Close()
+
+			r := newRequest(t, http.MethodPost, ts.URL+tt.url, tt.body)
+			r.Header.Set("Content-Type", tt.contentType)
+
+			//when
+			rs, err := ts.Client().Do(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			//then
+			if rs.StatusCode != tt.wantStatus {
+				t.Fatalf("want %d; got %d", tt.wantStatus, rs.StatusCode)
+			}
+			if tt.wantStatus != http.StatusCreated {
+				return
+			}
+
+			var record *models.Record
+			err = json.NewDecoder(rs.Body).Decode(&record)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			stored, err := app.records.Get(context.Background(), record.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored.Value != tt.wantValue || stored.Context != tt.wantContext {
+				t.Errorf("want value %v with context %q, got %+v", tt.wantValue, tt.wantContext, stored)
+			}
+		})
+	}
+}
+
+func TestQuickLink(t *testing.T) {
+	//given
+	app := newOpenTestApplication(t)
+
+	ts := httptest.NewServer(app.routes())
+	defer ts.Close()
+
+	rs, err := ts.Client().Do(newRequest(t, http.MethodPost, ts.URL+"/records/quick-links", `{"context": "morning"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rs.StatusCode != http.StatusCreated {
+		t.Fatalf("want %d; got %d", http.StatusCreated, rs.StatusCode)
+	}
+
+	var link QuickLinkResponse
+	err = json.NewDecoder(rs.Body).Decode(&link)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//when
+	rs, err = ts.Client().Do(newGetRequest(t, link.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//then
+	if rs.StatusCode != http.StatusOK {
+		t.Fatalf("want %d; got %d", http.StatusOK, rs.StatusCode)
+	}
+	if records, _ := app.records.GetAll(context.Background()); len(records) != len(mock.Records) {
+		t.Fatalf("want opening a quick-add link to add nothing, got %d records", len(records))
+	}
+
+	//when
+	r := newRequest(t, http.MethodPost, link.URL, "value=490")
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rs, err = ts.Client().Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//then
+	if rs.StatusCode != http.StatusCreated {
+		t.Fatalf("want %d; got %d", http.StatusCreated, rs.StatusCode)
+	}
+
+	var record *models.Record
+	err = json.NewDecoder(rs.Body).Decode(&record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Value != 490 || record.Context != "morning" {
+		t.Errorf("want record with link context, got %+v", record)
+	}
+
+	//when
+	rs, err = ts.Client().Do(newGetRequest(t, link.URL+"x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//then
+	if rs.StatusCode != http.StatusNotFound {
+		t.Errorf("want %d for tampered link; got %d", http.StatusNotFound, rs.StatusCode)
+	}
+}
+
+// newQuickRequest posts value as plain text to a quick-add path.
+func newQuickRequest(t *testing.T, path, value string) *http.Request {
+	r := newRequest(t, http.MethodPost, path, value)
+	r.Header.Set("Content-Type", "text/plain")
+	return r
+}
+
+func TestQuickLinkRevoked(t *testing.T) {
+	//given
+	app := newOpenTestApplication(t)
+	handler := app.routes()
+
+	link := &QuickLinkResponse{}
+	serveJSON(t, handler, newRequest(t, http.MethodPost, "/records/quick-links", `{}`), http.StatusCreated, link)
+	path := "/records/quick/" + link.Token
+
+	//when
+	revoked := &QuickLinkResponse{}
+	serveJSON(t, handler, newRequest(t, http.MethodDelete, "/records/quick-links/"+link.ID, ""), http.StatusOK, revoked)
+
+	//then
+	if revoked.RevokedAt == nil || revoked.Active {
+		t.Errorf("want the link revoked, got %+v", revoked)
+	}
+	serveJSON(t, handler, newGetRequest(t, path), http.StatusGone, nil)
+	serveJSON(t, handler, newQuickRequest(t, path, "490"), http.StatusGone, nil)
+
+	var links []*QuickLinkResponse
+	serveJSON(t, handler, newGetRequest(t, "/records/quick-links"), http.StatusOK, &links)
+	if len(links) != 1 || links[0].ID != link.ID || links[0].Active {
+		t.Errorf("want the revoked link listed, got %+v", links)
+	}
+	serveJSON(t, handler, newRequest(t, http.MethodDelete, "/records/quick-links/0", ""), http.StatusNotFound, nil)
+}
+
+func TestSimpleAddDisabledByDefault(t *testing.T) {
+	//given
+	app := newTestApplication(t)
+
+	ts := httptest.NewServer(app.routes())
+	defer ts.Close()
+
+	//when
+	rs, err := ts.Client().Do(newGetRequest(t, ts.URL+"/records/simple-add/480"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//then
+	if rs.StatusCode == http.StatusCreated {
+		t.Fatalf("want legacy simple-add route to be disabled, got %d", rs.StatusCode)
+	}
+	if records, _ := app.records.GetAll(context.Background()); len(records) != len(mock.Records) {
+		t.Errorf("want no record added, got %d records", len(records))
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	//given
+	app := newOpenTestApplication(t)
+	admin := createAdmin(t, app, testAdminToken)
+
+	ts := httptest.NewServer(app.routes())
+	defer ts.Close()
+
+	_, err := ts.Client().Do(newGetRequest(t, ts.URL+"/records/1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//when
+	rs, err := ts.Client().Do(authorized(newGetRequest(t, ts.URL+"/metrics"), admin))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//then
+	if rs.StatusCode != http.StatusOK {
+		t.Fatalf("want %d; got %d", http.StatusOK, rs.StatusCode)
+	}
+
+	body, err := io.ReadAll(rs.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		`peakflow_http_request_duration_seconds_count{method="GET",route="/records/{RecordID}",status="200"} 1`,
+		`peakflow_storage_operation_duration_seconds_count{operation="Get"} 1`,
+		`peakflow_latest_reading_liters_per_minute 520`,
+		`peakflow_readings_last_24h 2`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("want metrics to contain %s", want)
+		}
+	}
+}
+
+func TestRequestLogging(t *testing.T) {
+	//given
+	app := newOpenTestApplication(t)
+
+	var logs bytes.Buffer
+	app.logger = logging.New(&logs, slog.LevelInfo)
+
+	ts := httptest.NewServer(app.routes())
+	defer ts.Close()
+
+	//when
+	rs, err := ts.Client().Do(newGetRequest(t, ts.URL+"/records/1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs.Body.Close()
+
+	//then
+	var line struct {
+		Msg       string  `json:"msg"`
+		RequestID string  `json:"request_id"`
+		Route     string  `json:"route"`
+		Status    int     `json:"status"`
+		LatencyMs float64 `json:"latency_ms"`
+	}
+	err = json.Unmarshal(logs.Bytes(), &line)
+	if err != nil {
+		t.Fatalf("want a JSON log line, got %q: %v", logs.String(), err)
+	}
+
+	if line.Msg != "request" || line.RequestID == "" ||
+		line.Route != "/records/{RecordID}" || line.Status != http.StatusOK {
+		t.Errorf("want request log line with request ID, route and status, got %+v", line)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	tests := []struct {
+		name       string
+		check      func(ctx context.Context) error
+		wantStatus int
+		wantReport string
+	}{
+		{"up", func(ctx context.Context) error { return nil }, http.StatusOK, health.StatusUp},
+		{"down", func(ctx context.Context) error { return errors.New("connection refused") },
+			http.StatusServiceUnavailable, health.StatusDown},
+		{"timeout", func(ctx context.Context) error { <-ctx.Done(); return ctx.Err() },
+			http.StatusServiceUnavailable, health.StatusDown},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			//given
+			app := newTestApplication(t)
+			app.health = health.NewRegistry(50 * time.Millisecond)
+			app.health.Register(health.CheckerFunc("storage", tt.check))
+
+			ts := httptest.NewServer(app.routes())
+			defer ts.Close()
+
+			//when
+			rs, err := ts.Client().Do(newGetRequest(t, ts.URL+"/readyz"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			//then
+			if rs.StatusCode != tt.wantStatus {
+				t.Fatalf("want %d; got %d", tt.wantStatus, rs.StatusCode)
+			}
+
+			var report health.Report
+			err = json.NewDecoder(rs.Body).Decode(&report)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if report.Status != tt.wantReport || report.Checks["storage"] == nil ||
+				report.Checks["storage"].Status != tt.wantReport {
+				t.Errorf("want storage check %s, got %+v", tt.wantReport, report)
+			}
+		})
+	}
+}
+
+func TestRecordsTrend(t *testing.T) {
+	//given
+	app := newOpenTestApplication(t)
+	rr := httptest.NewRecorder()
+
+	//when
+	app.routes().ServeHTTP(rr, newGetRequest(t, "/records/stats/trend"))
+
+	//then
+	if rr.Code != http.StatusOK {
+		t.Fatalf("want %d; got %d", http.StatusOK, rr.Code)
+	}
+
+	var trend analytics.Trend
+	err := json.NewDecoder(rr.Body).Decode(&trend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trend.Days) < 3 || trend.Baseline == 0 || trend.Warning {
+		t.Errorf("want the trend of the fixture readings, got %+v", trend)
+	}
+	if trend.Params != analytics.DefaultTrendParams() {
+		t.Errorf("want the server parameters, got %+v", trend.Params)
+	}
+}
+
+// stubEnvironment observes the pollen count of the hour of the day and
+// nothing else.
+type stubEnvironment struct{}
+
+func (stubEnvironment) Observe(ctx context.Context, location string, t time.Time) (*models.Observation, error) {
+	pollen := float64(t.Hour())
+	return &models.Observation{Location: location, Time: t, Pollen: &pollen}, nil
+}
+
+// failingEnvironment fails every lookup, like a provider that is down.
+type failingEnvironment struct {
+	lookups *int
+}
+
+func (f failingEnvironment) Observe(ctx context.Context, location string, t time.Time) (*models.Observation, error) {
+	*f.lookups++
+	return nil, errors.New("provider is down")
+}
+
+func TestRecordsCorrelation(t *testing.T) {
+	tests := []struct {
+		name         string
+		provider     bool
+		wantObserved int
+	}{
+		{"without a provider", false, 0},
+		{"with a provider", true, 6},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			//given
+			app := newOpenTestApplication(t)
+			if tt.provider {
+				app.environment = services.NewEnvironmentService(app.records, stubEnvironment{}, "Berlin", app.logger)
+			}
+			rr := httptest.NewRecorder()
+
+			//when
+			app.routes().ServeHTTP(rr, newGetRequest(t, "/records/stats/correlation"))
+
+			//then
+			if rr.Code != http.StatusOK {
+				t.Fatalf("want %d; got %d", http.StatusOK, rr.Code)
+			}
+			var report analytics.EnvironmentReport
+			err := json.NewDecoder(rr.Body).Decode(&report)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Readings != 6 || report.Observed != tt.wantObserved || len(report.Correlations) != 4 {
+				t.Fatalf("want %d of 6 readings observed, got %+v", tt.wantObserved, report)
+			}
+			for _, correlation := range report.Correlations {
+				wantPairs := 0
+				if correlation.Variable == "pollen" {
+					wantPairs = tt.wantObserved
+				}
+				if correlation.Pairs != wantPairs {
+					t.Errorf("%s: want %d pairs, got %d", correlation.Variable, wantPairs, correlation.Pairs)
+				}
+			}
+
+			record, _ := app.records.Get(context.Background(), "1")
+			if record.Environment != nil {
+				t.Errorf("want stored readings left unchanged, got %+v", record.Environment)
+			}
+		})
+	}
+}
+
+func TestRecordsCorrelationProviderDown(t *testing.T) {
+	//given
+	app := newOpenTestApplication(t)
+	lookups := 0
+	app.environment = services.NewEnvironmentService(app.records, failingEnvironment{&lookups}, "Berlin", app.logger)
+	rr := httptest.NewRecorder()
+
+	//when
+	app.routes().ServeHTTP(rr, newGetRequest(t, "/records/stats/correlation"))
+
+	//then
+	if rr.Code != http.StatusOK {
+		t.Fatalf("want %d; got %d", http.StatusOK, rr.Code)
+	}
+	var report analytics.EnvironmentReport
+	err := json.NewDecoder(rr.Body).Decode(&report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Readings != 6 || report.Observed != 0 {
+		t.Errorf("want 6 readings none observed, got %+v", report)
+	}
+	if lookups != 1 {
+		t.Errorf("want the lookups to stop after a failure, got %d", lookups)
+	}
+}
+
+func TestAggregateRecords(t *testing.T) {
+	//given
+	app := newOpenTestApplication(t)
+	rr := httptest.NewRecorder()
+
+	//when
+	app.routes().ServeHTTP(rr, newGetRequest(t, "/records/aggregate?bucket=week&tz=Europe/Berlin"))
+
+	//then
+	if rr.Code != http.StatusOK {
+		t.Fatalf("want %d; got %d: %s", http.StatusOK, rr.Code, rr.Body)
+	}
+
+	response := &AggregateResponse{}
+	err := json.NewDecoder(rr.Body).Decode(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Bucket != models.BucketWeek || response.Timezone != "Europe/Berlin" {
+		t.Errorf("want the query returned, got %s in %s", response.Bucket, response.Timezone)
+	}
+
+	count := 0
+	for _, bucket := range response.Buckets {
+		if bucket.Start.Weekday() != time.Monday || bucket.Min > bucket.Mean || bucket.Mean > bucket.Max {
+			t.Errorf("want weekly summaries from Monday, got %+v", bucket)
+		}
+		count += bucket.Count
+	}
+	if count != 6 {
+		t.Errorf("want every reading counted once, got %d", count)
+	}
+}
+
+func TestAggregateRecordsInvalidParameters(t *testing.T) {
+	app := newOpenTestApplication(t)
+
+	for _, query := range []string{"?bucket=year", "?tz=Mars/Olympus", "?tz=Local"} {
+		rr := httptest.NewRecorder()
+
+		app.routes().ServeHTTP(rr, newGetRequest(t, "/records/aggregate"+query))
+
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: want %d; got %d", query, http.StatusBadRequest, rr.Code)
+		}
+	}
+}
+
+func TestCreateRecordTimezone(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantTz     string
+	}{
+		{"IANA time zone", `{"value": 470, "created_at": "2024-04-01T21:00:00Z", "tz": "Asia/Tokyo"}`, http.StatusCreated, "Asia/Tokyo"},
+		{"UTC offset", `{"value": 470, "created_at": "2024-04-01T21:00:00Z", "tz": "+09:00"}`, http.StatusCreated, "+09:00"},
+		{"time zone of the user", `{"value": 470, "created_at": "2024-04-01T21:00:00Z"}`, http.StatusCreated, "UTC"},
+		{"invalid time zone", `{"value": 470, "created_at": "2024-04-01T21:00:00Z", "tz": "Asia/Atlantis"}`, http.StatusBadRequest, ""},
+		{"time zone of the server", `{"value": 470, "created_at": "2024-04-01T21:00:00Z", "tz": "Local"}`, http.StatusBadRequest, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			//given
+			app := newOpenTestApplication(t)
+			rr := httptest.NewRecorder()
+
+			//when
+			app.routes().ServeHTTP(rr, newRequest(t, http.MethodPost, "/records", tt.body))
+
+			//then
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("want %d; got %d: %s", tt.wantStatus, rr.Code, rr.Body)
+			}
+			if tt.wantStatus != http.StatusCreated {
+				return
+			}
+
+			record := &models.Record{}
+			err := json.NewDecoder(rr.Body).Decode(record)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stored, _ := app.records.Get(context.Background(), record.ID)
+			if record.Timezone != tt.wantTz || stored == nil || stored.Timezone != tt.wantTz {
+				t.Errorf("want time zone %s stored, got %+v", tt.wantTz, stored)
+			}
+		})
+	}
+}
+
+func TestUpdateRecordTimezone(t *testing.T) {
+	//given
+	app := newOpenTestApplication(t)
+	rr := httptest.NewRecorder()
+
+	//when
+	// the fixture records were stored without a time zone
+	app.routes().ServeHTTP(rr, newRequest(t, http.MethodPut, "/records/1", `{"value": 300}`))
+
+	//then
+	if rr.Code != http.StatusOK {
+		t.Fatalf("want %d; got %d: %s", http.StatusOK, rr.Code, rr.Body)
+	}
+	stored, _ := app.records.Get(context.Background(), "1")
+	if stored == nil || stored.Timezone != "UTC" {
+		t.Errorf("want the time zone of the user stored, got %+v", stored)
+	}
+}
+
+func TestAggregateRecordsOnLocalDays(t *testing.T) {
+	//given
+	app := newOpenTestApplication(t)
+	handler := app.routes()
+
+	// 06:00 on April 2nd in Tokyo, still April 1st in Berlin and UTC
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, newRequest(t, http.MethodPost, "/records",
+		`{"value": 410, "created_at": "2024-04-01T21:00:00Z", "tz": "Asia/Tokyo"}`))
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("want %d; got %d", http.StatusCreated, rr.Code)
+	}
+
+	for _, tz := range []string{"Europe/Berlin", "UTC", "-04:00"} {
+		//when
+		rr = httptest.NewRecorder()
+		handler.ServeHTTP(rr, newGetRequest(t, "/records/aggregate?tz="+tz))
+
+		//then
+		response := &AggregateResponse{}
+		err := json.NewDecoder(rr.Body).Decode(response)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		bucket := response.Buckets[0]
+		if bucket.Start.Format("2006-01-02") != "2024-04-02" || bucket.MorningMean == nil || *bucket.MorningMean != 410 {
+			t.Errorf("%s: want a morning reading on April 2nd, got %+v", tz, bucket)
+		}
+	}
+}
@@ -2,9 +2,20 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/analytics"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/logging"
 	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/services"
 	"github.com/go-chi/render"
+	"io"
+	"log/slog"
+	"mime"
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 )
 
 //--
@@ -48,7 +59,53 @@ func ErrRender(err error) render.Renderer {
 	}
 }
 
+func ErrConflict(err error) render.Renderer {
+	return &ErrResponse{
+		Err:            err,
+		HTTPStatusCode: 409,
+		StatusText:     "Conflict",
+		ErrorText:      err.Error(),
+	}
+}
+
+func ErrUnprocessable(err error) render.Renderer {
+	return &ErrResponse{
+		Err:            err,
+		HTTPStatusCode: 422,
+		StatusText:     "Unprocessable request",
+		ErrorText:      err.Error(),
+	}
+}
+
+func ErrGone(err error) render.Renderer {
+	return &ErrResponse{
+		Err:            err,
+		HTTPStatusCode: 410,
+		StatusText:     "Resource gone",
+		ErrorText:      err.Error(),
+	}
+}
+
+func ErrUnauthorized(err error) render.Renderer {
+	return &ErrResponse{
+		Err:            err,
+		HTTPStatusCode: 401,
+		StatusText:     "Unauthorized",
+		ErrorText:      err.Error(),
+	}
+}
+
+func ErrPermission(err error) render.Renderer {
+	return &ErrResponse{
+		Err:            err,
+		HTTPStatusCode: 403,
+		StatusText:     "Forbidden",
+		ErrorText:      err.Error(),
+	}
+}
+
 var ErrNotFound = &ErrResponse{HTTPStatusCode: 404, StatusText: "Resource not found"}
+var ErrForbidden = &ErrResponse{HTTPStatusCode: 403, StatusText: "Forbidden"}
 
 //--
 // Request and Response payloads for the REST api.
@@ -71,7 +128,8 @@ var ErrNotFound = &ErrResponse{HTTPStatusCode: 404, StatusText: "Resource not fo
 type RecordRequest struct {
 	*models.Record
 
-	ProtectedID string `json:"id"` // override 'id' json to have more control
+	ProtectedID        string `json:"id"`         // override 'id' json to have more control
+	ProtectedPatientID string `json:"patient_id"` // the patient is the one of the route
 }
 
 func (a *RecordRequest) Bind(r *http.Request) error {
@@ -85,23 +143,41 @@ func (a *RecordRequest) Bind(r *http.Request) error {
 	// this won't cause a panic, but checks in this Bind method may be required if
 	// a.User or futher nested fields like a.User.Name are accessed elsewhere.
 
+	if err := validateTimezone(a.Timezone); err != nil {
+		return err
+	}
+
 	// just a post-process after a decode..
 	a.ProtectedID = "" // unset the protected ID
+	a.ProtectedPatientID = ""
 	return nil
 }
 
+// validateTimezone checks the time zone sent with a Record, Records sent
+// without one get the time zone of the user.
+func validateTimezone(tz string) error {
+	if tz == "" {
+		return nil
+	}
+	_, err := models.LoadTimezone(tz)
+	return err
+}
+
 // RecordResponse is the response payload for the Record data model.
 // See NOTE above in RecordRequest as well.
 //
 // In the RecordResponse object, first a Render() is called on itself,
 // then the next field, and so on, all the way down the tree.
 // Render is called in top-down order, like a http handler middleware chain.
+//
+// The zone of the reading and what to do in it are included, if known.
 type RecordResponse struct {
 	*models.Record
+	*services.ZoneAdvice
 }
 
-func NewRecordResponse(Record *models.Record) *RecordResponse {
-	resp := &RecordResponse{Record: Record}
+func NewRecordResponse(Record *models.Record, advice *services.ZoneAdvice) *RecordResponse {
+	resp := &RecordResponse{Record: Record, ZoneAdvice: advice}
 
 	return resp
 }
@@ -111,14 +187,941 @@ func (rd *RecordResponse) Render(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
-func NewRecordListResponse(Records []*models.Record) []render.Renderer {
+func NewRecordListResponse(Records []*models.Record, advice []*services.ZoneAdvice) []render.Renderer {
+	list := []render.Renderer{}
+	for index, Record := range Records {
+		list = append(list, NewRecordResponse(Record, advice[index]))
+	}
+	return list
+}
+
+// RevisionResponse is the response payload for the Revision data model.
+type RevisionResponse struct {
+	*models.Revision
+}
+
+func NewRevisionResponse(revision *models.Revision) *RevisionResponse {
+	return &RevisionResponse{Revision: revision}
+}
+
+func (rd *RevisionResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+func NewRevisionListResponse(revisions []*models.Revision) []render.Renderer {
+	list := []render.Renderer{}
+	for _, revision := range revisions {
+		list = append(list, NewRevisionResponse(revision))
+	}
+	return list
+}
+
+const maxActionPlanNameLength = 64
+const maxInstructionsLength = 2000
+
+// ActionPlanRequest is the request payload for the ActionPlan data model.
+// Creating a plan saves its first version, updating it the next one, the
+// version sent is the one the update applies to.
+type ActionPlanRequest struct {
+	*models.ActionPlan
+
+	ProtectedID        string    `json:"id"`
+	ProtectedUpdatedAt time.Time `json:"updated_at"`
+}
+
+func (a *ActionPlanRequest) Bind(r *http.Request) error {
+	if a.ActionPlan == nil {
+		return errors.New("missing required ActionPlan fields")
+	}
+
+	switch {
+	case a.YellowFrom <= 0:
+		return errors.New("yellow_from must be positive")
+	case a.GreenFrom <= a.YellowFrom:
+		return errors.New("green_from must be above yellow_from")
+	case a.EffectiveFrom.IsZero():
+		return errors.New("missing effective_from")
+	case a.EffectiveUntil != nil && !a.EffectiveUntil.After(a.EffectiveFrom):
+		return errors.New("effective_until must be after effective_from")
+	case a.Version < 0:
+		return errors.New("version must not be negative")
+	case len(a.Name) > maxActionPlanNameLength:
+		return fmt.Errorf("name must be at most %d characters", maxActionPlanNameLength)
+	}
+	for _, instructions := range []string{a.Instructions.Green, a.Instructions.Yellow, a.Instructions.Red} {
+		if len(instructions) > maxInstructionsLength {
+			return fmt.Errorf("instructions must be at most %d characters per zone", maxInstructionsLength)
+		}
+	}
+
+	a.ProtectedID = ""
+	a.ProtectedUpdatedAt = time.Time{}
+	return nil
+}
+
+// ActionPlanResponse is the response payload for the ActionPlan data model.
+type ActionPlanResponse struct {
+	*models.ActionPlan
+}
+
+func NewActionPlanResponse(plan *models.ActionPlan) *ActionPlanResponse {
+	return &ActionPlanResponse{ActionPlan: plan}
+}
+
+func (rd *ActionPlanResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+func NewActionPlanListResponse(plans []*models.ActionPlan) []render.Renderer {
+	list := []render.Renderer{}
+	for _, plan := range plans {
+		list = append(list, NewActionPlanResponse(plan))
+	}
+	return list
+}
+
+const maxMedicationNameLength = 64
+const maxPuffsPerDose = 20
+const maxDosesPerDay = 12
+
+// MedicationRequest is the request payload for the Medication data model.
+type MedicationRequest struct {
+	*models.Medication
+
+	ProtectedID string `json:"id"`
+}
+
+func (a *MedicationRequest) Bind(r *http.Request) error {
+	if a.Medication == nil {
+		return errors.New("missing required Medication fields")
+	}
+
+	switch {
+	case a.Name == "":
+		return errors.New("missing name")
+	case len(a.Name) > maxMedicationNameLength:
+		return fmt.Errorf("name must be at most %d characters", maxMedicationNameLength)
+	case a.Type != models.MedicationReliever && a.Type != models.MedicationController:
+		return fmt.Errorf("type must be %s or %s", models.MedicationReliever, models.MedicationController)
+	case a.PuffsPerDose < 1 || a.PuffsPerDose > maxPuffsPerDose:
+		return fmt.Errorf("puffs_per_dose must be from 1 to %d", maxPuffsPerDose)
+	case a.Capacity < a.PuffsPerDose:
+		return errors.New("capacity must hold at least one dose")
+	case a.ReorderBelow < 0:
+		return errors.New("reorder_below must not be negative")
+	case a.DosesPerDay < 0 || a.DosesPerDay > maxDosesPerDay:
+		return fmt.Errorf("doses_per_day must be at most %d", maxDosesPerDay)
+	case a.DosesPerDay > 0 && a.Type != models.MedicationController:
+		return errors.New("only controllers are taken doses_per_day")
+	}
+
+	a.ProtectedID = ""
+	return nil
+}
+
+// MedicationResponse is the response payload for the Medication data model,
+// with what is left in its current inhaler.
+type MedicationResponse struct {
+	*models.Medication
+	Inventory *services.Inventory `json:"inventory,omitempty"`
+}
+
+func NewMedicationResponse(medication *models.Medication, inventory *services.Inventory) *MedicationResponse {
+	return &MedicationResponse{Medication: medication, Inventory: inventory}
+}
+
+func (rd *MedicationResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+// DoseRequest is the request payload for the Dose data model. The puffs
+// of a dose of the medication and the current time are used if left out.
+type DoseRequest struct {
+	*models.Dose
+
+	ProtectedID           string `json:"id"`
+	ProtectedMedicationID string `json:"medication_id"`
+}
+
+func (a *DoseRequest) Bind(r *http.Request) error {
+	if a.Dose == nil {
+		return errors.New("missing required Dose fields")
+	}
+	if a.Puffs < 0 || a.Puffs > maxPuffsPerDose {
+		return fmt.Errorf("puffs must be at most %d", maxPuffsPerDose)
+	}
+
+	a.ProtectedID = ""
+	a.ProtectedMedicationID = ""
+	return nil
+}
+
+// DoseResponse is the response payload for the Dose data model. A dose
+// just logged comes with the inventory after it, ReorderAlert is set if
+// it is the one which made the inventory run low.
+type DoseResponse struct {
+	*models.Dose
+	Inventory    *services.Inventory `json:"inventory,omitempty"`
+	ReorderAlert bool                `json:"reorder_alert,omitempty"`
+}
+
+func NewDoseResponse(dose *models.Dose) *DoseResponse {
+	return &DoseResponse{Dose: dose}
+}
+
+func (rd *DoseResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+func NewDoseListResponse(doses []*models.Dose) []render.Renderer {
+	list := []render.Renderer{}
+	for _, dose := range doses {
+		list = append(list, NewDoseResponse(dose))
+	}
+	return list
+}
+
+// RecordContextResponse is a Record with the doses taken around it.
+// RelieverBefore is set if a reliever was taken ahead of the reading,
+// which then likely is higher than without.
+type RecordContextResponse struct {
+	Record         *RecordResponse             `json:"record"`
+	Doses          []*services.DoseNearReading `json:"doses"`
+	RelieverBefore bool                        `json:"reliever_before"`
+}
+
+func NewRecordContextResponse(record *RecordResponse, doses []*services.DoseNearReading) *RecordContextResponse {
+	resp := &RecordContextResponse{Record: record, Doses: doses}
+	for _, dose := range doses {
+		if dose.MedicationType == models.MedicationReliever && dose.MinutesFromReading <= 0 {
+			resp.RelieverBefore = true
+		}
+	}
+	return resp
+}
+
+func (rd *RecordContextResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+// Default and longest windows of doses shown around a reading.
+const (
+	defaultDosesBefore = 6 * time.Hour
+	defaultDosesAfter  = 2 * time.Hour
+	maxDosesWindow     = 7 * 24 * time.Hour
+)
+
+// ParseDosesWindow reads how long before and after a reading doses are
+// shown from the before and after query parameters, Go durations like 4h.
+func ParseDosesWindow(r *http.Request) (before, after time.Duration, err error) {
+	before, after = defaultDosesBefore, defaultDosesAfter
+	for _, param := range []struct {
+		name  string
+		value *time.Duration
+	}{{"before", &before}, {"after", &after}} {
+		value := r.URL.Query().Get(param.name)
+		if value == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(value)
+		if err != nil || duration < 0 || duration > maxDosesWindow {
+			return 0, 0, fmt.Errorf("invalid %s %q, must be a duration like 4h up to %s", param.name, value, maxDosesWindow)
+		}
+		*param.value = duration
+	}
+	return before, after, nil
+}
+
+// ParseDoseQuery reads the time range of doses from the from and until
+// query parameters, RFC 3339 timestamps.
+func ParseDoseQuery(r *http.Request, medicationID string) (*models.DoseQuery, error) {
+	query := &models.DoseQuery{MedicationID: medicationID}
+	for _, param := range []struct {
+		name  string
+		value *time.Time
+	}{{"from", &query.From}, {"until", &query.Until}} {
+		value := r.URL.Query().Get(param.name)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q, must be RFC 3339", param.name, value)
+		}
+		*param.value = t
+	}
+	return query, nil
+}
+
+// Operations accepted by BatchRequest.
+const (
+	BatchOpCreate = "create"
+	BatchOpUpdate = "update"
+	BatchOpDelete = "delete"
+)
+
+const maxBatchSize = 500
+
+// BatchRequest is the request payload for bulk create, update and delete
+// of Records. In atomic mode either all operations are applied or none.
+type BatchRequest struct {
+	Atomic     bool              `json:"atomic"`
+	Operations []*BatchOperation `json:"operations"`
+}
+
+// BatchOperation is a single operation of a BatchRequest.
+type BatchOperation struct {
+	Op     string         `json:"op"`
+	ID     string         `json:"id,omitempty"`
+	Record *models.Record `json:"record,omitempty"`
+}
+
+func (b *BatchRequest) Bind(r *http.Request) error {
+	if len(b.Operations) == 0 {
+		return errors.New("missing operations")
+	}
+	if len(b.Operations) > maxBatchSize {
+		return fmt.Errorf("too many operations, at most %d are allowed", maxBatchSize)
+	}
+	return nil
+}
+
+// validate checks a single operation, so that a broken one fails on its own
+// instead of rejecting the whole batch.
+func (o *BatchOperation) validate() error {
+	if o == nil {
+		return errors.New("missing operation")
+	}
+
+	switch o.Op {
+	case BatchOpCreate:
+		if o.Record == nil {
+			return errors.New("missing required Record fields")
+		}
+		return validateTimezone(o.Record.Timezone)
+	case BatchOpUpdate:
+		if o.ID == "" {
+			return errors.New("missing id")
+		}
+		if o.Record == nil || o.Record.CreatedAt.IsZero() {
+			return errors.New("missing required Record fields")
+		}
+		return validateTimezone(o.Record.Timezone)
+	case BatchOpDelete:
+		if o.ID == "" {
+			return errors.New("missing id")
+		}
+	default:
+		return fmt.Errorf("unknown operation %q", o.Op)
+	}
+	return nil
+}
+
+// BatchResponse is the response payload for a BatchRequest, holding
+// a result per operation in request order.
+type BatchResponse struct {
+	Atomic  bool           `json:"atomic"`
+	Applied bool           `json:"applied"`
+	Results []*BatchResult `json:"results"`
+}
+
+// BatchResult is the outcome of a single BatchOperation.
+type BatchResult struct {
+	Op     string         `json:"op"`
+	ID     string         `json:"id,omitempty"`
+	Status int            `json:"status"`
+	Record *models.Record `json:"record,omitempty"`
+	Error  string         `json:"error,omitempty"`
+}
+
+func (rd *BatchResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+func NewBatchResult(op *BatchOperation, err error) *BatchResult {
+	result := &BatchResult{Op: op.Op, ID: op.ID}
+	if err != nil {
+		result.Status = batchErrorStatus(err)
+		result.Error = err.Error()
+		return result
+	}
+
+	result.Record = op.Record
+	result.Status = http.StatusOK
+	if op.Op == BatchOpCreate {
+		result.Status = http.StatusCreated
+	}
+	if op.Op == BatchOpDelete {
+		result.Record = nil
+	}
+	return result
+}
+
+func batchErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, models.ErrNoRecord):
+		return http.StatusNotFound
+	case errors.Is(err, models.ErrRecordExists):
+		return http.StatusConflict
+	case errors.Is(err, models.ErrBatchAborted):
+		return http.StatusFailedDependency
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// TrendResponse is the response payload for the trend of the readings.
+type TrendResponse struct {
+	*analytics.Trend
+}
+
+func (rd *TrendResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+// CorrelationResponse is the response payload for the correlation of the
+// readings with the environment.
+type CorrelationResponse struct {
+	*analytics.EnvironmentReport
+}
+
+func (rd *CorrelationResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+// ParseAggregateQuery reads the bucket and tz query parameters, which
+// default to daily buckets in the time zone of the user at location.
+func ParseAggregateQuery(r *http.Request, location *time.Location) (*models.AggregateQuery, error) {
+	query := &models.AggregateQuery{Bucket: models.BucketDay, Location: location}
+
+	switch bucket := r.URL.Query().Get("bucket"); bucket {
+	case "":
+	case models.BucketDay, models.BucketWeek, models.BucketMonth:
+		query.Bucket = bucket
+	default:
+		return nil, fmt.Errorf("bucket must be day, week or month, got %q", bucket)
+	}
+
+	if tz := r.URL.Query().Get("tz"); tz != "" {
+		location, err := models.LoadTimezone(tz)
+		if err != nil {
+			return nil, err
+		}
+		query.Location = location
+	}
+	return query, nil
+}
+
+// AggregateResponse is the response payload for summaries per time bucket.
+type AggregateResponse struct {
+	Bucket   string           `json:"bucket"`
+	Timezone string           `json:"tz"`
+	Buckets  []*models.Bucket `json:"buckets"`
+}
+
+func (rd *AggregateResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+// Weeks of the adherence report, a quarter by default.
+const (
+	defaultReportWeeks = 13
+	maxReportWeeks     = 104
+)
+
+// ParseAdherenceQuery reads the weeks and tz query parameters, the number
+// of weeks up to the current one and the time zone of their calendar,
+// the one of the user at location by default.
+func ParseAdherenceQuery(r *http.Request, location *time.Location) (int, *time.Location, error) {
+	weeks := defaultReportWeeks
+	if value := r.URL.Query().Get("weeks"); value != "" {
+		var err error
+		weeks, err = strconv.Atoi(value)
+		if err != nil || weeks < 1 || weeks > maxReportWeeks {
+			return 0, nil, fmt.Errorf("weeks must be from 1 to %d, got %q", maxReportWeeks, value)
+		}
+	}
+
+	if tz := r.URL.Query().Get("tz"); tz != "" {
+		var err error
+		location, err = models.LoadTimezone(tz)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+	return weeks, location, nil
+}
+
+// AdherenceResponse is the response payload for the adherence report.
+type AdherenceResponse struct {
+	*analytics.Adherence
+}
+
+func (rd *AdherenceResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+const maxShareLabelLength = 100
+
+// shareResources are the resources a Share can grant access to.
+var shareResources = []string{models.ShareRecords, models.ShareStats, models.ShareReports}
+
+// ShareRequest is the request payload for the Share data model. It
+// expires after the configured validity if expires_at is left out.
+type ShareRequest struct {
+	*models.Share
+
+	ProtectedID        string     `json:"id"`
+	ProtectedCreatedAt time.Time  `json:"created_at"`
+	ProtectedRevokedAt *time.Time `json:"revoked_at"`
+}
+
+func (a *ShareRequest) Bind(r *http.Request) error {
+	if a.Share == nil {
+		return errors.New("missing required Share fields")
+	}
+
+	a.Label = strings.TrimSpace(a.Label)
+	switch {
+	case len(a.Label) > maxShareLabelLength:
+		return fmt.Errorf("label must be at most %d characters", maxShareLabelLength)
+	case len(a.Resources) == 0:
+		return fmt.Errorf("resources must list any of %s", strings.Join(shareResources, ", "))
+	case a.From.IsZero() || a.Until.IsZero():
+		return errors.New("missing from or until")
+	case !a.From.Before(a.Until):
+		return errors.New("from must be before until")
+	}
+
+	for _, resource := range a.Resources {
+		if !slices.Contains(shareResources, resource) {
+			return fmt.Errorf("unknown resource %q, must be any of %s", resource, strings.Join(shareResources, ", "))
+		}
+	}
+	// in a fixed order without duplicates
+	resources := []string{}
+	for _, resource := range shareResources {
+		if slices.Contains(a.Resources, resource) {
+			resources = append(resources, resource)
+		}
+	}
+	a.Resources = resources
+
+	a.ProtectedID = ""
+	a.ProtectedCreatedAt = time.Time{}
+	a.ProtectedRevokedAt = nil
+	return nil
+}
+
+// ShareResponse is the response payload for the Share data model, with
+// the URL of its link. Active tells whether the link works.
+type ShareResponse struct {
+	*models.Share
+	URL    string `json:"url"`
+	Active bool   `json:"active"`
+}
+
+func NewShareResponse(share *models.Share, url string) *ShareResponse {
+	return &ShareResponse{
+		Share:  share,
+		URL:    url,
+		Active: share.RevokedAt == nil && time.Now().Before(share.ExpiresAt),
+	}
+}
+
+func (rd *ShareResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+// ShareAccessResponse is the response payload for an entry of the access
+// log of a Share.
+type ShareAccessResponse struct {
+	*models.ShareAccess
+}
+
+func (rd *ShareAccessResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+func NewShareAccessListResponse(accesses []*models.ShareAccess) []render.Renderer {
+	list := []render.Renderer{}
+	for _, access := range accesses {
+		list = append(list, &ShareAccessResponse{ShareAccess: access})
+	}
+	return list
+}
+
+const maxNameLength = 100
+
+// UserRequest is the request payload for the User data model.
+type UserRequest struct {
+	*models.User
+
+	ProtectedID         string     `json:"id"`
+	ProtectedRole       string     `json:"role"`
+	ProtectedCreatedAt  time.Time  `json:"created_at"`
+	ProtectedDisabledAt *time.Time `json:"disabled_at"`
+}
+
+func (a *UserRequest) Bind(r *http.Request) error {
+	if a.User == nil {
+		return errors.New("missing required User fields")
+	}
+	if err := validateName(a.Name); err != nil {
+		return err
+	}
+
+	a.ProtectedID = ""
+	a.ProtectedRole = ""
+	a.ProtectedCreatedAt = time.Time{}
+	a.ProtectedDisabledAt = nil
+	return nil
+}
+
+// UserResponse is the response payload for the User data model.
+type UserResponse struct {
+	*models.User
+}
+
+func (rd *UserResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+// CreatedUserResponse is the response payload for a new User, the only
+// one carrying its token.
+type CreatedUserResponse struct {
+	*models.User
+	Token string `json:"token"`
+}
+
+func (rd *CreatedUserResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+// PatientRequest is the request payload for the Patient data model.
+type PatientRequest struct {
+	*models.Patient
+
+	ProtectedID        string    `json:"id"`
+	ProtectedCreatedAt time.Time `json:"created_at"`
+}
+
+func (a *PatientRequest) Bind(r *http.Request) error {
+	if a.Patient == nil {
+		return errors.New("missing required Patient fields")
+	}
+	if err := validateName(a.Name); err != nil {
+		return err
+	}
+
+	a.ProtectedID = ""
+	a.ProtectedCreatedAt = time.Time{}
+	return nil
+}
+
+func validateName(name string) error {
+	switch {
+	case strings.TrimSpace(name) == "":
+		return errors.New("name is required")
+	case len(name) > maxNameLength:
+		return fmt.Errorf("name must be at most %d characters", maxNameLength)
+	}
+	return nil
+}
+
+// PatientResponse is the response payload for the Patient data model,
+// with the role of the user asking.
+type PatientResponse struct {
+	*models.Patient
+	Role string `json:"role"`
+}
+
+func (rd *PatientResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+// MembershipRequest is the request payload for the role of a user.
+type MembershipRequest struct {
+	Role string `json:"role"`
+}
+
+func (a *MembershipRequest) Bind(r *http.Request) error {
+	if !models.ValidRole(a.Role) {
+		return fmt.Errorf("role must be one of %s, %s or %s",
+			models.RoleOwner, models.RoleCaregiver, models.RoleViewer)
+	}
+	return nil
+}
+
+// MembershipResponse is the response payload for the Membership data model.
+type MembershipResponse struct {
+	*models.Membership
+}
+
+func (rd *MembershipResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+func NewMembershipListResponse(memberships []*models.Membership) []render.Renderer {
 	list := []render.Renderer{}
-	for _, Record := range Records {
-		list = append(list, NewRecordResponse(Record))
+	for _, membership := range memberships {
+		list = append(list, &MembershipResponse{Membership: membership})
 	}
 	return list
 }
 
+// StatsResponse is the response payload for the system stats.
+type StatsResponse struct {
+	*services.SystemStats
+}
+
+func (rd *StatsResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+// Page sizes of the change feed.
+const (
+	defaultSyncLimit = 100
+	maxSyncLimit     = 1000
+)
+
+// SyncRequest is the request payload for changes made by a client offline.
+type SyncRequest struct {
+	Changes []*services.SyncChange `json:"changes"`
+}
+
+func (s *SyncRequest) Bind(r *http.Request) error {
+	if len(s.Changes) == 0 {
+		return errors.New("missing changes")
+	}
+	if len(s.Changes) > maxBatchSize {
+		return fmt.Errorf("too many changes, at most %d are allowed", maxBatchSize)
+	}
+	return nil
+}
+
+// SyncResponse is the response payload for a SyncRequest, holding a result
+// per change in request order.
+type SyncResponse struct {
+	Results []*services.SyncResult `json:"results"`
+}
+
+func (rd *SyncResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+// ChangesResponse is the response payload for a page of the change feed.
+// Clients keep the cursor and send it with the next request.
+type ChangesResponse struct {
+	Changes []*models.Change `json:"changes"`
+	Cursor  string           `json:"cursor"`
+	HasMore bool             `json:"has_more"`
+}
+
+func NewChangesResponse(set *services.ChangeSet) *ChangesResponse {
+	return &ChangesResponse{Changes: set.Changes, Cursor: set.Cursor, HasMore: set.HasMore}
+}
+
+func (rd *ChangesResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+// ParseSyncLimit reads the limit query parameter of the change feed.
+func ParseSyncLimit(r *http.Request) (int, error) {
+	value := r.URL.Query().Get("limit")
+	if value == "" {
+		return defaultSyncLimit, nil
+	}
+
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 1 || limit > maxSyncLimit {
+		return 0, fmt.Errorf("limit must be a number from 1 to %d", maxSyncLimit)
+	}
+	return limit, nil
+}
+
+const maxQuickRecordBodySize = 1 << 10
+const maxRecordContextLength = 64
+
+// QuickRecordRequest is the request payload for quick Record creation,
+// made for phone shortcuts. It is sent either as a form with value,
+// created_at, context and tz fields, or as a plain text body holding just
+// the value, with the others passed as query parameters.
+type QuickRecordRequest struct {
+	Value     float32   `json:"value"`
+	CreatedAt time.Time `json:"created_at"`
+	Context   string    `json:"context"`
+	Timezone  string    `json:"tz"`
+}
+
+func ParseQuickRecordRequest(r *http.Request) (*QuickRecordRequest, error) {
+	mediaType := "text/plain"
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		var err error
+		mediaType, _, err = mime.ParseMediaType(contentType)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var value, createdAt, context, tz string
+	switch mediaType {
+	case "application/x-www-form-urlencoded", "multipart/form-data":
+		r.Body = http.MaxBytesReader(nil, r.Body, maxQuickRecordBodySize)
+		value = r.FormValue("value")
+		createdAt = r.FormValue("created_at")
+		context = r.FormValue("context")
+		tz = r.FormValue("tz")
+	case "text/plain":
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxQuickRecordBodySize))
+		if err != nil {
+			return nil, err
+		}
+		value = string(body)
+		createdAt = r.URL.Query().Get("created_at")
+		context = r.URL.Query().Get("context")
+		tz = r.URL.Query().Get("tz")
+	default:
+		return nil, fmt.Errorf("unsupported content type %q", mediaType)
+	}
+
+	data := &QuickRecordRequest{Context: strings.TrimSpace(context), Timezone: strings.TrimSpace(tz)}
+
+	parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value %q", value)
+	}
+	if parsed <= 0 {
+		return nil, errors.New("value must be positive")
+	}
+	data.Value = float32(parsed)
+
+	if createdAt = strings.TrimSpace(createdAt); createdAt != "" {
+		data.CreatedAt, err = time.Parse(time.RFC3339, createdAt)
+		if err != nil {
+			return nil, fmt.Errorf("invalid created_at %q, must be RFC 3339", createdAt)
+		}
+	}
+
+	if len(data.Context) > maxRecordContextLength {
+		return nil, fmt.Errorf("context must be at most %d characters", maxRecordContextLength)
+	}
+	if err := validateTimezone(data.Timezone); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// RecordForm is the dashboard form for adding or editing a Record, it keeps
+// the submitted text to show it again along with any error.
+type RecordForm struct {
+	ID        string
+	Value     string
+	CreatedAt string // datetime-local input, on the clock of the time zone of the Record
+	Context   string
+}
+
+const formDateTimeLayout = "2006-01-02T15:04"
+
+// NewRecordForm fills the form with record, location is the time zone of
+// the user for Records without one.
+func NewRecordForm(record *models.Record, location *time.Location) *RecordForm {
+	return &RecordForm{
+		ID:        record.ID,
+		Value:     strconv.FormatFloat(float64(record.Value), 'f', -1, 32),
+		CreatedAt: record.LocalTime(location).Format(formDateTimeLayout),
+		Context:   record.Context,
+	}
+}
+
+// ParseRecordForm reads the form fields of a submitted dashboard form.
+func ParseRecordForm(r *http.Request) *RecordForm {
+	return &RecordForm{
+		Value:     strings.TrimSpace(r.PostFormValue("value")),
+		CreatedAt: strings.TrimSpace(r.PostFormValue("created_at")),
+		Context:   strings.TrimSpace(r.PostFormValue("context")),
+	}
+}
+
+// Apply validates the form and sets its values on record, an empty
+// created_at keeps the time of record. The time is read in the time zone
+// of record, the one of the user at location if it has none.
+func (f *RecordForm) Apply(record *models.Record, location *time.Location) error {
+	value, err := strconv.ParseFloat(f.Value, 32)
+	if err != nil {
+		return fmt.Errorf("invalid value %q", f.Value)
+	}
+	if value <= 0 {
+		return errors.New("value must be positive")
+	}
+	if len(f.Context) > maxRecordContextLength {
+		return fmt.Errorf("context must be at most %d characters", maxRecordContextLength)
+	}
+
+	createdAt := record.CreatedAt
+	if f.CreatedAt != "" {
+		createdAt, err = time.ParseInLocation(formDateTimeLayout, f.CreatedAt, record.Location(location))
+		if err != nil {
+			return fmt.Errorf("invalid time %q", f.CreatedAt)
+		}
+	}
+
+	record.Value = float32(value)
+	record.CreatedAt = createdAt
+	record.Context = f.Context
+	return nil
+}
+
+// QuickLinkRequest is the request payload for issuing a quick-add link.
+type QuickLinkRequest struct {
+	Context string `json:"context"`
+}
+
+func (q *QuickLinkRequest) Bind(r *http.Request) error {
+	q.Context = strings.TrimSpace(q.Context)
+	if len(q.Context) > maxRecordContextLength {
+		return fmt.Errorf("context must be at most %d characters", maxRecordContextLength)
+	}
+	return nil
+}
+
+// QuickLinkResponse is the response payload for the QuickLink data model,
+// with the URL and token of the link. Active tells whether the link is
+// neither revoked nor expired.
+type QuickLinkResponse struct {
+	*models.QuickLink
+	URL    string `json:"url"`
+	Token  string `json:"token"`
+	Active bool   `json:"active"`
+}
+
+func NewQuickLinkResponse(link *models.QuickLink, url, token string) *QuickLinkResponse {
+	return &QuickLinkResponse{
+		QuickLink: link,
+		URL:       url,
+		Token:     token,
+		Active:    link.RevokedAt == nil && time.Now().Before(link.ExpiresAt),
+	}
+}
+
+func (rd *QuickLinkResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+// GetBaseURL returns scheme and host the request was sent to.
+func GetBaseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// requestLogger returns the logger of the request, set by RequestLogger.
+func (app *application) requestLogger(r *http.Request) *slog.Logger {
+	return logging.FromContext(r.Context(), app.logger)
+}
+
 func GetIPAddress(r *http.Request) string {
 	return r.RemoteAddr
 }
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/services"
+	"net/http"
+	"strings"
+)
+
+// loginPage is the view model of the login template.
+type loginPage struct {
+	CSRFToken string
+	Error     string
+}
+
+// LoginForm asks for the token of an account, browsers can't send it as a
+// bearer token with plain links and forms.
+func (app *application) LoginForm(w http.ResponseWriter, r *http.Request) {
+	app.renderLogin(w, r, http.StatusOK, "")
+}
+
+// Login starts a session of the account of the submitted token, kept in a
+// cookie, and sends the browser to the dashboard.
+func (app *application) Login(w http.ResponseWriter, r *http.Request) {
+	user, err := app.userService.Authenticate(r.Context(), strings.TrimSpace(r.PostFormValue("token")))
+	switch {
+	case errors.Is(err, services.ErrUnauthenticated):
+		app.renderLogin(w, r, http.StatusUnauthorized, "The token is not valid.")
+		return
+	case errors.Is(err, services.ErrAccountDisabled):
+		app.renderLogin(w, r, http.StatusUnauthorized, "The account is disabled.")
+		return
+	case err != nil:
+		app.requestLogger(r).Error("login failed", "error", err)
+		app.renderLogin(w, r, http.StatusInternalServerError, "Something went wrong, please try again.")
+		return
+	}
+
+	value, expiresAt, err := app.sessions.Issue(user)
+	if err != nil {
+		app.requestLogger(r).Error("issuing session failed", "error", err)
+		app.renderLogin(w, r, http.StatusInternalServerError, "Something went wrong, please try again.")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     cookieSession,
+		Value:    value,
+		Path:     "/",
+		Expires:  expiresAt,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	app.requestLogger(r).Info("logged in", "user_id", user.ID)
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// Logout ends the session of the browser.
+func (app *application) Logout(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, endedSessionCookie(r))
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+func (app *application) renderLogin(w http.ResponseWriter, r *http.Request, status int, message string) {
+	page := &loginPage{
+		CSRFToken: r.Context().Value(ContextKeyCSRFToken).(string),
+		Error:     message,
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	err := loginTemplate.Execute(w, page)
+	if err != nil {
+		app.requestLogger(r).Error("rendering login failed", "error", err)
+	}
+}
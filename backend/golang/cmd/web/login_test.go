@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestLogin(t *testing.T) {
+	//given
+	app := newTestApplication(t)
+	handler := app.routes()
+	createAdmin(t, app, testAdminToken)
+	_, cookie, token := openDashboard(t, handler, "/login", nil)
+
+	//when
+	anonymous := httptest.NewRecorder()
+	handler.ServeHTTP(anonymous, newGetRequest(t, "/"))
+	invalid := httptest.NewRecorder()
+	handler.ServeHTTP(invalid, newFormRequest(t, "/login", url.Values{"csrf_token": {token}, "token": {"wrong"}}, cookie))
+	session := logIn(t, handler, testAdminToken)
+
+	//then
+	if anonymous.Code != http.StatusSeeOther || anonymous.Header().Get("Location") != "/login" {
+		t.Errorf("want an anonymous browser sent to log in, got %d %q", anonymous.Code, anonymous.Header().Get("Location"))
+	}
+	if invalid.Code != http.StatusUnauthorized || findCookie(invalid, cookieSession) != nil ||
+		!strings.Contains(invalid.Body.String(), "The token is not valid.") {
+		t.Errorf("want an invalid token refused without a session, got %d: %s", invalid.Code, invalid.Body)
+	}
+	if !session.HttpOnly || session.SameSite != http.SameSiteLaxMode || session.Expires.IsZero() {
+		t.Errorf("want an http only, same site session cookie with an expiry, got %+v", session)
+	}
+
+	r := newGetRequest(t, "/records")
+	r.AddCookie(session)
+	serveJSON(t, handler, r, http.StatusOK, nil)
+
+	//when
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, newFormRequest(t, "/logout", url.Values{"csrf_token": {token}}, cookie, session))
+
+	//then
+	if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/login" {
+		t.Errorf("want sent to log in, got %d %q", rr.Code, rr.Header().Get("Location"))
+	}
+	if ended := findCookie(rr, cookieSession); ended == nil || ended.MaxAge >= 0 {
+		t.Errorf("want the session cookie removed, got %+v", ended)
+	}
+}
+
+func TestSessionUnsafeRequestsNeedCSRFToken(t *testing.T) {
+	//given
+	app := newTestApplication(t)
+	handler := app.routes()
+	createAdmin(t, app, testAdminToken)
+	session := logIn(t, handler, testAdminToken)
+	_, cookie, token := openDashboard(t, handler, "/", session)
+
+	//when
+	forged := newRequest(t, http.MethodPost, "/records", `{"value": 400}`)
+	forged.AddCookie(session)
+	forged.AddCookie(cookie)
+	allowed := newRequest(t, http.MethodPost, "/records", `{"value": 400}`)
+	allowed.AddCookie(session)
+	allowed.AddCookie(cookie)
+	allowed.Header.Set(headerCSRFToken, token)
+
+	//then
+	serveJSON(t, handler, forged, http.StatusForbidden, nil)
+	serveJSON(t, handler, allowed, http.StatusCreated, nil)
+}
+
+func TestSessionEnded(t *testing.T) {
+	//given
+	app := newTestApplication(t)
+	handler := app.routes()
+	admin := createAdmin(t, app, testAdminToken)
+	user := createUser(t, app, handler, "Parent")
+	adminSession := logIn(t, handler, testAdminToken)
+	userSession := logIn(t, handler, user.Token)
+
+	//when
+	if _, err := app.userService.ResetToken(context.Background(), admin.User); err != nil {
+		t.Fatal(err)
+	}
+	reset := newGetRequest(t, "/")
+	reset.AddCookie(adminSession)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, reset)
+
+	//then
+	if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/login" {
+		t.Errorf("want the session ended by a new token, got %d %q", rr.Code, rr.Header().Get("Location"))
+	}
+	if ended := findCookie(rr, cookieSession); ended == nil || ended.MaxAge >= 0 {
+		t.Errorf("want the ended session cookie removed, got %+v", ended)
+	}
+
+	//when
+	page := newGetRequest(t, "/")
+	page.AddCookie(userSession)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, page)
+
+	//then
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("want the dashboard refused to a user, got %d", rr.Code)
+	}
+}
@@ -2,75 +2,291 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/analytics"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/config"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/environment"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/health"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/logging"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/metrics"
 	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
 	"github.com/romanthekat/simple-peak-flowmeter/pkg/models/mongodb"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/policy"
 	"github.com/romanthekat/simple-peak-flowmeter/pkg/services"
-	"log"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/sharing"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/tracing"
+	"github.com/romanthekat/simple-peak-flowmeter/ui"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
 	"net/http"
 	"os"
 	"time"
 )
 
 type application struct {
-	errorLog          *log.Logger
-	infoLog           *log.Logger
+	logger            *slog.Logger
 	records           models.RecordModel
 	recordsService    *services.RecordsService
+	idempotency       *services.IdempotencyService
+	metrics           *metrics.Metrics
+	tracerProvider    trace.TracerProvider
+	health            *health.Registry
+	quickLinks        models.QuickLinkModel
+	quickLinkService  *services.QuickLinkService
+	zones             *services.ZonesService
+	actionPlans       models.ActionPlanModel
+	actionPlanService *services.ActionPlanService
+	medications       models.MedicationModel
+	medicationService *services.MedicationService
+	reports           *services.ReportService
+	environment       *services.EnvironmentService
+	shares            models.ShareModel
+	shareService      *services.ShareService
+	users             models.UserModel
+	userService       *services.UserService
+	patients          models.PatientModel
+	patientService    *services.PatientService
+	stats             *services.StatsService
+	policy            *policy.Policy
+	csrf              *services.CSRFService
+	sessions          *services.SessionService
+	sync              *services.SyncService
+	trends            *services.TrendService
+	simpleAddEnabled  bool
 	generateRoutesDoc bool
 	authorizedIp      string
+	webUI             http.Handler
+	cors              config.CORS
 }
 
-var timeoutCtx, _ = context.WithTimeout(context.Background(), 7*time.Second)
+// shutdownTimeout bounds flushing spans and disconnecting from MongoDB on exit.
+const shutdownTimeout = 7 * time.Second
 
 func main() {
-	var routes bool
-	if getEnv("ROUTES", "false") == "true" {
-		routes = true
+	cfg, options, err := config.Load(os.Args[0], os.Args[1:], os.LookupEnv, os.Stderr)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
 	}
-	addr := getEnv("ADDR", ":3333")
-	dsn := getEnv("DSN", "mongodb://mongo:27017")
-	authorizedIp := getEnv("AUTHORIZED_IP", "-1")
-
-	infoLog := log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
-	errorLog := log.New(os.Stderr, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile)
 
-	infoLog.Printf("Authorized IP: %s", authorizedIp)
-	infoLog.Printf("DSN: %s", dsn)
+	if options.PrintConfig {
+		err = config.Print(os.Stdout, cfg)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
 
-	infoLog.Println("Connecting to MongoDB")
-	client, err := mongodb.OpenDB(dsn)
+	err = cfg.Validate()
 	if err != nil {
-		errorLog.Fatal(err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	logLevel, _ := logging.ParseLevel(cfg.Log.Level) // checked by Validate
+	logger := logging.New(os.Stdout, logLevel)
+
+	quickLinkSecret := cfg.QuickLinks.Secret
+	if quickLinkSecret == "" {
+		logger.Warn("QUICK_LINK_SECRET is not set, quick-add links won't survive a restart")
+		quickLinkSecret = randomSecret()
+	}
+	shareSecret := cfg.Shares.Secret
+	if shareSecret == "" {
+		logger.Warn("SHARE_SECRET is not set, share links won't survive a restart")
+		shareSecret = randomSecret()
+	}
+	csrfSecret := cfg.Dashboard.CSRFSecret
+	if csrfSecret == "" {
+		logger.Warn("CSRF_SECRET is not set, open dashboard forms fail after a restart")
+		csrfSecret = randomSecret()
+	}
+	sessionSecret := cfg.Auth.SessionSecret
+	if sessionSecret == "" {
+		logger.Warn("SESSION_SECRET is not set, browsers have to log in again after a restart")
+		sessionSecret = randomSecret()
+	}
+
+	logger.Info("configured", "config_file", options.File, "authorized_ip", cfg.Server.AuthorizedIP)
+
+	tracerProvider, shutdownTracing, err := tracing.NewProvider(context.Background(), tracing.Config{
+		Exporter:    cfg.Tracing.Exporter,
+		Endpoint:    cfg.Tracing.Endpoint,
+		Insecure:    cfg.Tracing.Insecure,
+		SampleRatio: cfg.Tracing.SampleRatio,
+		ServiceName: cfg.Tracing.ServiceName,
+	}, os.Stdout)
+	exitOnError(logger, "setting up tracing failed", err)
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			logger.Error("flushing traces failed", "error", err)
+		}
+	}()
+	otel.SetTracerProvider(tracerProvider)
+	otel.SetTextMapPropagator(tracing.Propagator)
+	logger.Info("tracing configured", "exporter", cfg.Tracing.Exporter, "sample_ratio", cfg.Tracing.SampleRatio)
+
+	logger.Info("connecting to MongoDB")
+	client, err := mongodb.OpenDB(cfg.Mongo.DSN, tracerProvider)
+	exitOnError(logger, "connecting to MongoDB failed", err)
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		client.Disconnect(ctx)
+	}()
+
+	mongoRecordModel := mongodb.NewRecordModel(client, logger)
+	err = mongoRecordModel.PrepareChanges(context.Background())
+	exitOnError(logger, "preparing the record change feed failed", err)
+	err = mongoRecordModel.CreateIndexes(context.Background())
+	exitOnError(logger, "creating record indexes failed", err)
+
+	appMetrics := metrics.New()
+	var recordModel models.RecordModel = tracing.NewRecordModel(
+		metrics.NewRecordModel(mongoRecordModel, appMetrics),
+		tracerProvider)
+	appMetrics.MustRegister(metrics.NewRecordsCollector(recordModel, tracerProvider))
+
+	environmentProvider, err := environment.New(environment.Config{
+		Provider: cfg.Environment.Provider,
+		File:     cfg.Environment.File,
+		URL:      cfg.Environment.URL,
+		Timeout:  cfg.Environment.Timeout,
+		MaxAge:   cfg.Environment.MaxAge,
+	})
+	exitOnError(logger, "setting up the environment provider failed", err)
+	if environmentProvider != nil {
+		recordModel = environment.NewRecordModel(recordModel, environmentProvider, cfg.Environment.Location, logger)
+		logger.Info("environment provider configured", "provider", cfg.Environment.Provider,
+			"location", cfg.Environment.Location)
 	}
-	defer client.Disconnect(timeoutCtx)
+	recordModel = sharing.NewRecordModel(recordModel)
 
-	recordModel := mongodb.NewRecordModel(client)
+	idempotencyModel := mongodb.NewIdempotencyModel(client, logger)
+	err = idempotencyModel.CreateIndexes(context.Background())
+	exitOnError(logger, "creating idempotency key indexes failed", err)
+
+	actionPlanModel := mongodb.NewActionPlanModel(client, logger)
+	err = actionPlanModel.CreateIndexes(context.Background())
+	exitOnError(logger, "creating action plan indexes failed", err)
+
+	mongoMedicationModel := mongodb.NewMedicationModel(client, logger)
+	err = mongoMedicationModel.CreateIndexes(context.Background())
+	exitOnError(logger, "creating medication indexes failed", err)
+	medicationModel := sharing.NewMedicationModel(mongoMedicationModel)
+
+	quickLinkModel := mongodb.NewQuickLinkModel(client, logger)
+	err = quickLinkModel.CreateIndexes(context.Background())
+	exitOnError(logger, "creating quick-add link indexes failed", err)
+
+	shareModel := mongodb.NewShareModel(client, logger)
+	err = shareModel.CreateIndexes(context.Background())
+	exitOnError(logger, "creating share indexes failed", err)
+
+	userModel := mongodb.NewUserModel(client, logger)
+	err = userModel.CreateIndexes(context.Background())
+	exitOnError(logger, "creating user indexes failed", err)
+
+	patientModel := mongodb.NewPatientModel(client, logger)
+	err = patientModel.CreateIndexes(context.Background())
+	exitOnError(logger, "creating patient indexes failed", err)
+
+	userService := services.NewUserService(userModel)
+	if cfg.Auth.AdminToken != "" {
+		admin, err := userService.EnsureAdmin(context.Background(), cfg.Auth.AdminToken)
+		exitOnError(logger, "creating the admin account failed", err)
+		logger.Info("admin account ready", "user_id", admin.ID)
+	}
+	if cfg.Auth.Open {
+		logger.Warn("access policy is open, requests without a token read and write the household readings")
+	}
+
+	uiFiles := ui.Static()
+	if cfg.Server.StaticDir != "" {
+		uiFiles = os.DirFS(cfg.Server.StaticDir)
+	}
+	webUI, err := ui.NewHandler(uiFiles, cfg.Server.APIBaseURL)
+	exitOnError(logger, "loading the web UI failed", err)
+
+	userLocation, err := models.LoadTimezone(cfg.User.Timezone)
+	exitOnError(logger, "loading the user time zone failed", err)
+
+	healthChecks := health.NewRegistry(cfg.Server.ReadinessTimeout)
+	healthChecks.Register(mongodb.NewHealthChecker(client))
+
+	zones := services.NewZonesService(cfg.Dashboard.PersonalBest)
 
 	app := &application{
-		errorLog:          errorLog,
-		infoLog:           infoLog,
+		logger:            logger,
 		records:           recordModel,
-		recordsService:    services.NewRecordsService(),
-		generateRoutesDoc: routes,
-		authorizedIp:      authorizedIp,
+		recordsService:    services.NewRecordsService(userLocation),
+		idempotency:       services.NewIdempotencyService(idempotencyModel, cfg.Idempotency.TTL),
+		metrics:           appMetrics,
+		tracerProvider:    tracerProvider,
+		health:            healthChecks,
+		quickLinks:        quickLinkModel,
+		quickLinkService:  services.NewQuickLinkService(quickLinkModel, []byte(quickLinkSecret), cfg.QuickLinks.TTL),
+		zones:             zones,
+		actionPlans:       actionPlanModel,
+		actionPlanService: services.NewActionPlanService(actionPlanModel, recordModel, zones),
+		medications:       medicationModel,
+		medicationService: services.NewMedicationService(medicationModel),
+		reports:           services.NewReportService(recordModel, medicationModel),
+		environment:       services.NewEnvironmentService(recordModel, environmentProvider, cfg.Environment.Location, logger),
+		shares:            shareModel,
+		shareService:      services.NewShareService(shareModel, []byte(shareSecret), cfg.Shares.TTL, cfg.Shares.MaxTTL),
+		users:             userModel,
+		userService:       userService,
+		patients:          patientModel,
+		patientService:    services.NewPatientService(patientModel, userModel),
+		stats:             services.NewStatsService(userModel, patientModel, recordModel, shareModel),
+		policy:            policy.Default(cfg.Auth.Open),
+		csrf:              services.NewCSRFService([]byte(csrfSecret)),
+		sessions:          services.NewSessionService(userModel, []byte(sessionSecret), cfg.Auth.SessionTTL),
+		sync:              services.NewSyncService(recordModel, userLocation),
+		trends:            services.NewTrendService(recordModel, analytics.DefaultTrendParams(), userLocation),
+		simpleAddEnabled:  cfg.Records.SimpleAddEnabled,
+		generateRoutesDoc: cfg.Server.PrintRoutes,
+		authorizedIp:      cfg.Server.AuthorizedIP,
+		webUI:             webUI,
+		cors:              cfg.CORS,
 	}
 
 	srv := &http.Server{
-		Addr:     addr,
-		ErrorLog: errorLog,
+		Addr:     cfg.Server.Addr,
+		ErrorLog: slog.NewLogLogger(logger.Handler(), slog.LevelError),
 		Handler:  app.routes(),
 	}
 
-	infoLog.Printf("Starting HTTP server on %s", addr)
+	logger.Info("starting HTTP server", "addr", cfg.Server.Addr)
 	err = srv.ListenAndServe()
+	exitOnError(logger, "HTTP server failed", err)
+}
+
+// exitOnError logs a fatal startup or server error and exits.
+func exitOnError(logger *slog.Logger, msg string, err error) {
 	if err != nil {
-		errorLog.Fatal(err)
+		logger.Error(msg, "error", err)
+		os.Exit(1)
 	}
 }
 
-func getEnv(key, fallback string) string {
-	if value, ok := os.LookupEnv(key); ok {
-		return value
+func randomSecret() string {
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	if err != nil {
+		panic(err)
 	}
-	return fallback
+	return hex.EncodeToString(secret)
 }
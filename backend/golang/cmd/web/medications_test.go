@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func serveJSON(t *testing.T, handler http.Handler, r *http.Request, wantCode int, response any) {
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, r)
+	if rr.Code != wantCode {
+		t.Fatalf("%s %s: want %d; got %d: %s", r.Method, r.URL, wantCode, rr.Code, rr.Body)
+	}
+	if response == nil {
+		return
+	}
+
+	err := json.NewDecoder(rr.Body).Decode(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func createMedication(t *testing.T, handler http.Handler, body string) *MedicationResponse {
+	medication := &MedicationResponse{}
+	serveJSON(t, handler, newRequest(t, http.MethodPost, "/medications", body), http.StatusCreated, medication)
+	return medication
+}
+
+func logDose(t *testing.T, handler http.Handler, medicationID, body string) *DoseResponse {
+	dose := &DoseResponse{}
+	serveJSON(t, handler, newRequest(t, http.MethodPost, "/medications/"+medicationID+"/doses", body),
+		http.StatusCreated, dose)
+	return dose
+}
+
+func TestMedicationInventory(t *testing.T) {
+	//given
+	app := newOpenTestApplication(t)
+	handler := app.routes()
+	medication := createMedication(t, handler,
+		`{"name": "Salbutamol", "type": "reliever", "puffs_per_dose": 2, "capacity": 10, "reorder_below": 3}`)
+
+	//when
+	first := logDose(t, handler, medication.ID, "")
+	second := logDose(t, handler, medication.ID, `{"puffs": 2}`)
+	low := logDose(t, handler, medication.ID, "{}")
+	lower := logDose(t, handler, medication.ID, `{"puffs": 1}`)
+
+	//then
+	if medication.Inventory == nil || medication.Inventory.DosesLeft != 5 || medication.Inventory.Reorder {
+		t.Fatalf("want a full inhaler of 5 doses, got %+v", medication.Inventory)
+	}
+	if first.Puffs != 2 || first.MedicationID != medication.ID || first.TakenAt.IsZero() {
+		t.Errorf("want a dose of 2 puffs taken now by default, got %+v", first.Dose)
+	}
+	tests := []struct {
+		dose      *DoseResponse
+		puffsLeft int
+		dosesLeft int
+		alert     bool
+	}{
+		{first, 8, 4, false},
+		{second, 6, 3, false},
+		{low, 4, 2, true},
+		{lower, 3, 1, false},
+	}
+	for i, tt := range tests {
+		inventory := tt.dose.Inventory
+		if inventory.PuffsLeft != tt.puffsLeft || inventory.DosesLeft != tt.dosesLeft || tt.dose.ReorderAlert != tt.alert {
+			t.Errorf("dose %d: want %d puffs, %d doses left and alert %v, got %+v and alert %v",
+				i, tt.puffsLeft, tt.dosesLeft, tt.alert, inventory, tt.dose.ReorderAlert)
+		}
+	}
+	if !lower.Inventory.Reorder {
+		t.Errorf("want reorder to stay set while low")
+	}
+
+	refilled := &MedicationResponse{}
+	serveJSON(t, handler, newRequest(t, http.MethodPost, "/medications/"+medication.ID+"/refill", ""),
+		http.StatusOK, refilled)
+	if refilled.Inventory.DosesLeft != 5 || refilled.Inventory.Reorder {
+		t.Errorf("want a full inhaler after a refill, got %+v", refilled.Inventory)
+	}
+}
+
+func TestCreateMedicationInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"no name", `{"type": "reliever", "puffs_per_dose": 1, "capacity": 200}`},
+		{"unknown type", `{"name": "x", "type": "antibiotic", "puffs_per_dose": 1, "capacity": 200}`},
+		{"no puffs per dose", `{"name": "x", "type": "controller", "capacity": 200}`},
+		{"capacity below a dose", `{"name": "x", "type": "controller", "puffs_per_dose": 2, "capacity": 1}`},
+		{"negative reorder threshold", `{"name": "x", "type": "controller", "puffs_per_dose": 2, "capacity": 120, "reorder_below": -1}`},
+		{"scheduled reliever", `{"name": "x", "type": "reliever", "puffs_per_dose": 2, "capacity": 200, "doses_per_day": 2}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			//given
+			app := newOpenTestApplication(t)
+
+			//when
+			serveJSON(t, app.routes(), newRequest(t, http.MethodPost, "/medications", tt.body), http.StatusBadRequest, nil)
+		})
+	}
+}
+
+func TestListDosesAndDelete(t *testing.T) {
+	//given
+	app := newOpenTestApplication(t)
+	handler := app.routes()
+	reliever := createMedication(t, handler, `{"name": "Salbutamol", "type": "reliever", "puffs_per_dose": 2, "capacity": 200}`)
+	controller := createMedication(t, handler, `{"name": "Budesonide", "type": "controller", "puffs_per_dose": 1, "capacity": 120}`)
+	old := logDose(t, handler, reliever.ID, `{"taken_at": "2024-03-01T08:00:00Z"}`)
+	logDose(t, handler, reliever.ID, `{"taken_at": "2024-03-02T08:00:00Z"}`)
+	logDose(t, handler, controller.ID, `{"taken_at": "2024-03-01T08:00:00Z"}`)
+
+	//when
+	var doses []*DoseResponse
+	serveJSON(t, handler, newGetRequest(t, "/medications/"+reliever.ID+"/doses?until=2024-03-02T00:00:00Z"),
+		http.StatusOK, &doses)
+	serveJSON(t, handler, newRequest(t, http.MethodDelete, "/medications/"+controller.ID+"/doses/"+old.ID, ""),
+		http.StatusNotFound, nil)
+	serveJSON(t, handler, newRequest(t, http.MethodDelete, "/medications/"+reliever.ID+"/doses/"+old.ID, ""),
+		http.StatusOK, nil)
+
+	//then
+	if len(doses) != 1 || doses[0].ID != old.ID {
+		t.Errorf("want the first dose of the reliever only, got %d", len(doses))
+	}
+	left, err := app.medications.Doses(context.Background(), &models.DoseQuery{MedicationID: reliever.ID})
+	if err != nil || len(left) != 1 {
+		t.Errorf("want one dose left, got %d, %v", len(left), err)
+	}
+}
+
+func TestRecordContext(t *testing.T) {
+	//given
+	app := newOpenTestApplication(t)
+	handler := app.routes()
+	record := &RecordResponse{}
+	serveJSON(t, handler, newGetRequest(t, "/records/1"), http.StatusOK, record)
+
+	reliever := createMedication(t, handler, `{"name": "Salbutamol", "type": "reliever", "puffs_per_dose": 2, "capacity": 200}`)
+	controller := createMedication(t, handler, `{"name": "Budesonide", "type": "controller", "puffs_per_dose": 1, "capacity": 120}`)
+	at := func(offset time.Duration) string {
+		return fmt.Sprintf(`{"taken_at": %q}`, record.CreatedAt.Add(offset).Format(time.RFC3339))
+	}
+	logDose(t, handler, controller.ID, at(-5*time.Hour))
+	logDose(t, handler, reliever.ID, at(-time.Hour))
+	logDose(t, handler, reliever.ID, at(3*time.Hour))
+	logDose(t, handler, reliever.ID, at(-7*time.Hour))
+
+	tests := []struct {
+		query       string
+		wantMinutes []int
+	}{
+		{"", []int{-300, -60}},
+		{"?before=2h&after=4h", []int{-60, 180}},
+		{"?before=0s&after=0s", []int{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			//when
+			response := &RecordContextResponse{}
+			serveJSON(t, handler, newGetRequest(t, "/records/1/context"+tt.query), http.StatusOK, response)
+
+			//then
+			if response.Record == nil || response.Record.Record == nil || response.Record.ID != "1" {
+				t.Fatalf("want the record, got %+v", response.Record)
+			}
+			if len(response.Doses) != len(tt.wantMinutes) {
+				t.Fatalf("want %d doses, got %d", len(tt.wantMinutes), len(response.Doses))
+			}
+			for i, dose := range response.Doses {
+				if dose.MinutesFromReading != tt.wantMinutes[i] {
+					t.Errorf("want a dose %d minutes from the reading, got %d", tt.wantMinutes[i], dose.MinutesFromReading)
+				}
+			}
+			if wantReliever := len(tt.wantMinutes) > 0; response.RelieverBefore != wantReliever {
+				t.Errorf("want reliever before %v, got %v", wantReliever, response.RelieverBefore)
+			}
+		})
+	}
+
+	serveJSON(t, handler, newGetRequest(t, "/records/1/context?before=yesterday"), http.StatusBadRequest, nil)
+}
+
+func TestAdherenceReport(t *testing.T) {
+	//given
+	app := newOpenTestApplication(t)
+	handler := app.routes()
+	controller := createMedication(t, handler,
+		`{"name": "Budesonide", "type": "controller", "puffs_per_dose": 1, "capacity": 120, "doses_per_day": 2}`)
+	reliever := createMedication(t, handler, `{"name": "Salbutamol", "type": "reliever", "puffs_per_dose": 2, "capacity": 200}`)
+	logDose(t, handler, controller.ID, "")
+	logDose(t, handler, reliever.ID, "")
+
+	//when
+	report := &AdherenceResponse{}
+	serveJSON(t, handler, newGetRequest(t, "/reports/adherence?weeks=4&tz=UTC"), http.StatusOK, report)
+
+	//then
+	if report.Adherence == nil || len(report.Weeks) != 4 || report.Timezone != "UTC" {
+		t.Fatalf("want 4 weeks in UTC, got %+v", report.Adherence)
+	}
+	week := report.Weeks[3]
+	if week.ScheduledDoses != 2 || week.TakenDoses != 1 || week.Adherence == nil || *week.Adherence != 50 {
+		t.Errorf("want one of two doses taken today, got %+v", week)
+	}
+	if week.RelieverDays != 1 || week.RelieverOveruse {
+		t.Errorf("want a reliever on one day, got %+v", week)
+	}
+	if report.Weeks[0].Adherence != nil {
+		t.Errorf("want no schedule before the controller was started, got %+v", report.Weeks[0])
+	}
+	readings := 0
+	for _, week := range report.Weeks {
+		readings += week.Readings
+	}
+	if readings != 6 {
+		t.Errorf("want the 6 readings of the last days, got %d", readings)
+	}
+
+	for _, query := range []string{"?weeks=0", "?weeks=105", "?tz=Mars/Olympus"} {
+		serveJSON(t, handler, newGetRequest(t, "/reports/adherence"+query), http.StatusBadRequest, nil)
+	}
+}
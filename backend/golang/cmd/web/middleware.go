@@ -1,15 +1,257 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/render"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/logging"
 	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/policy"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/services"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/sharing"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"log/slog"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 )
 
+const headerIdempotencyKey = "Idempotency-Key"
+const headerIdempotentReplayed = "Idempotent-Replayed"
+const maxIdempotencyKeyLength = 255
+const maxIdempotentBodySize = 1 << 20
+
+const cookieCSRF = "csrf"
+const cookieSession = "session"
+const fieldCSRFToken = "csrf_token"
+const headerCSRFToken = "X-CSRF-Token"
+const maxFormBodySize = 1 << 16
+
+// RequestLogger middleware puts a logger carrying the chi request ID and the
+// trace ID on the request context, for handlers and the storage layer, and
+// logs every request with its route pattern, status and latency once it is
+// done. It must be used after RequestID and tracing, before Recoverer.
+func (app *application) RequestLogger(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		logger := app.logger.With(
+			"request_id", middleware.GetReqID(r.Context()),
+			"method", r.Method,
+			"path", r.URL.Path,
+		)
+		if spanContext := trace.SpanContextFromContext(r.Context()); spanContext.IsValid() {
+			logger = logger.With("trace_id", spanContext.TraceID().String())
+		}
+		entry := &requestLogEntry{request: r, logger: logger}
+
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		defer func() {
+			entry.Write(ww.Status(), ww.BytesWritten(), ww.Header(), time.Since(start), nil)
+		}()
+
+		ctx := logging.WithContext(r.Context(), entry.logger)
+		next.ServeHTTP(ww, middleware.WithLogEntry(r.WithContext(ctx), entry))
+	})
+}
+
+// requestLogEntry implements chi's middleware.LogEntry,
+// so the Recoverer logs panics through it as well.
+type requestLogEntry struct {
+	request *http.Request
+	logger  *slog.Logger
+}
+
+func (e *requestLogEntry) Write(status, bytes int, header http.Header, elapsed time.Duration, extra interface{}) {
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	route := ""
+	if rctx := chi.RouteContext(e.request.Context()); rctx != nil {
+		route = rctx.RoutePattern()
+	}
+
+	level := slog.LevelInfo
+	if status >= http.StatusInternalServerError {
+		level = slog.LevelError
+	}
+
+	e.logger.Log(e.request.Context(), level, "request",
+		"route", route,
+		"status", status,
+		"bytes", bytes,
+		"latency_ms", float64(elapsed.Microseconds())/1000,
+		"remote_addr", e.request.RemoteAddr,
+	)
+}
+
+func (e *requestLogEntry) Panic(v interface{}, stack []byte) {
+	e.logger.Error("panic",
+		"panic", fmt.Sprint(v),
+		"stack", string(stack),
+	)
+}
+
+// Identify middleware authenticates requests carrying a bearer token in
+// the Authorization header, or else the session cookie of a browser logged
+// in to the pages, putting the user and its role on the request context.
+// Requests without either are anonymous, invalid tokens and disabled
+// accounts get a 401, ended sessions are dropped. Unsafe requests of a
+// session must carry a CSRF token like the forms of the pages, or they get
+// a 403. Admins are only admins from the authorized IP if one is
+// configured, users anywhere else.
+func (app *application) Identify(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, err := app.authenticate(w, r)
+		switch {
+		case errors.Is(err, services.ErrUnauthenticated), errors.Is(err, services.ErrAccountDisabled):
+			renderUnauthorized(w, r, err)
+			return
+		case errors.Is(err, errCSRF):
+			app.requestLogger(r).Warn("CSRF check of a session failed")
+			http.Error(w, "Invalid or missing CSRF token, reload the page and try again.", http.StatusForbidden)
+			return
+		case err != nil:
+			render.Render(w, r, ErrRender(err))
+			return
+		case user == nil:
+			ctx := context.WithValue(r.Context(), ContextKeyRole, policy.RoleAnonymous)
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+
+		logger := app.requestLogger(r).With("user_id", user.ID)
+		role := policy.RoleOf(user)
+		if role == policy.RoleAdmin && app.authorizedIp != "" && !app.fromAuthorizedIP(r) {
+			logger.Warn("authorized IP check failed, acting as a user",
+				"authorized_ip", app.authorizedIp,
+				"caller_ip", GetIPAddress(r))
+			role = policy.RoleUser
+		}
+
+		ctx := logging.WithContext(r.Context(), logger)
+		ctx = context.WithValue(ctx, ContextKeyUser, user)
+		ctx = context.WithValue(ctx, ContextKeyRole, role)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// fromAuthorizedIP reports whether r comes from the authorized IP. The
+// addresses are compared, not their text, so 192.0.2.10 isn't 192.0.2.1.
+func (app *application) fromAuthorizedIP(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(GetIPAddress(r))
+	if err != nil {
+		host = GetIPAddress(r)
+	}
+	caller := net.ParseIP(host)
+	return caller != nil && caller.Equal(net.ParseIP(app.authorizedIp))
+}
+
+var errCSRF = errors.New("invalid or missing CSRF token")
+
+// authenticate returns the user of the bearer token or the session cookie
+// of r, nil for anonymous requests.
+func (app *application) authenticate(w http.ResponseWriter, r *http.Request) (*models.User, error) {
+	if token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); found {
+		return app.userService.Authenticate(r.Context(), strings.TrimSpace(token))
+	}
+
+	// other schemes, like basic auth of a proxy, aren't ours
+	cookie, err := r.Cookie(cookieSession)
+	if err != nil {
+		return nil, nil
+	}
+	user, err := app.sessions.Verify(r.Context(), cookie.Value)
+	if errors.Is(err, services.ErrUnauthenticated) || errors.Is(err, services.ErrAccountDisabled) {
+		// the pages send the browser to log in again
+		http.SetCookie(w, endedSessionCookie(r))
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead && !app.verifyCSRF(w, r) {
+		return nil, errCSRF
+	}
+	return user, nil
+}
+
+func endedSessionCookie(r *http.Request) *http.Cookie {
+	return &http.Cookie{
+		Name:     cookieSession,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// Require middleware lets only requests whose role has permission through,
+// anonymous ones get a 401 and others a 403. It must be used after
+// Identify, on every route group but the public ones.
+func (app *application) Require(permission policy.Permission) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			role, _ := r.Context().Value(ContextKeyRole).(policy.Role)
+			if role == "" {
+				role = policy.RoleAnonymous
+			}
+
+			err := app.policy.Check(role, permission)
+			switch {
+			case err == nil:
+				next.ServeHTTP(w, r)
+			case role == policy.RoleAnonymous:
+				renderUnauthorized(w, r, err)
+			default:
+				app.requestLogger(r).Warn("permission denied", "role", role, "permission", permission)
+				render.Render(w, r, ErrPermission(err))
+			}
+		})
+	}
+}
+
+// RequirePage is Require for the HTML pages: anonymous requests are sent to
+// the login page, others without permission get a plain 403.
+func (app *application) RequirePage(permission policy.Permission) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			role, _ := r.Context().Value(ContextKeyRole).(policy.Role)
+			if role == "" {
+				role = policy.RoleAnonymous
+			}
+
+			switch {
+			case app.policy.Allows(role, permission):
+				next.ServeHTTP(w, r)
+			case role == policy.RoleAnonymous:
+				http.Redirect(w, r, "/login", http.StatusSeeOther)
+			default:
+				app.requestLogger(r).Warn("permission denied", "role", role, "permission", permission)
+				http.Error(w, "Your account may not use this page.", http.StatusForbidden)
+			}
+		})
+	}
+}
+
+func renderUnauthorized(w http.ResponseWriter, r *http.Request, err error) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="peak-flowmeter"`)
+	render.Render(w, r, ErrUnauthorized(err))
+}
+
 // RecordCtx middleware is used to load an Record object from
 // the URL parameters passed through as the request. In case
 // the Record could not be found, we stop here and return a 404.
@@ -19,7 +261,7 @@ func (app *application) RecordCtx(next http.Handler) http.Handler {
 		var err error
 
 		if RecordID := chi.URLParam(r, "RecordID"); RecordID != "" {
-			record, err = app.records.Get(RecordID)
+			record, err = app.records.Get(r.Context(), RecordID)
 		} else {
 			render.Render(w, r, ErrNotFound)
 			return
@@ -34,6 +276,207 @@ func (app *application) RecordCtx(next http.Handler) http.Handler {
 	})
 }
 
+// PatientCtx middleware loads the patient of the PatientID URL parameter
+// and the membership of the user, then scopes the models to the
+// patient. Patients the user has no access to get a 404 like missing ones,
+// so their IDs can't be probed.
+func (app *application) PatientCtx(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := r.Context().Value(ContextKeyUser).(*models.User)
+		if !ok {
+			renderUnauthorized(w, r, errors.New("patients require a user"))
+			return
+		}
+		patientID := chi.URLParam(r, "PatientID")
+
+		membership, err := app.patients.Membership(r.Context(), patientID, user.ID)
+		if errors.Is(err, models.ErrNoMembership) {
+			render.Render(w, r, ErrNotFound)
+			return
+		}
+		if err != nil {
+			render.Render(w, r, ErrRender(err))
+			return
+		}
+
+		patient, err := app.patients.Get(r.Context(), patientID)
+		if errors.Is(err, models.ErrNoPatient) {
+			render.Render(w, r, ErrNotFound)
+			return
+		}
+		if err != nil {
+			render.Render(w, r, ErrRender(err))
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), ContextKeyPatient, patient)
+		ctx = context.WithValue(ctx, ContextKeyMembership, membership)
+		next.ServeHTTP(w, r.WithContext(models.WithPatient(ctx, patient.ID)))
+	})
+}
+
+// PatientRole middleware lets only users whose role for the patient allows
+// what required does through, others get a 403. It must be used after
+// PatientCtx.
+func (app *application) PatientRole(required string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			membership := r.Context().Value(ContextKeyMembership).(*models.Membership)
+			if !models.RoleAllows(membership.Role, required) {
+				render.Render(w, r, ErrForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// UserCtx loads the user of the UserID URL parameter, 404 if there is none.
+func (app *application) UserCtx(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, err := app.users.Get(r.Context(), chi.URLParam(r, "UserID"))
+		if errors.Is(err, models.ErrNoUser) {
+			render.Render(w, r, ErrNotFound)
+			return
+		}
+		if err != nil {
+			render.Render(w, r, ErrRender(err))
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), ContextKeyAccount, user)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// ActionPlanCtx middleware is used to load the latest version of an
+// ActionPlan from the URL parameters passed through as the request. In case
+// the ActionPlan could not be found, we stop here and return a 404.
+func (app *application) ActionPlanCtx(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		plan, err := app.actionPlans.Get(r.Context(), chi.URLParam(r, "ActionPlanID"))
+		if errors.Is(err, models.ErrNoActionPlan) {
+			render.Render(w, r, ErrNotFound)
+			return
+		}
+		if err != nil {
+			render.Render(w, r, ErrRender(err))
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), ContextKeyActionPlan, plan)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// MedicationCtx loads the medication of the MedicationID URL parameter,
+// 404 if there is none.
+func (app *application) MedicationCtx(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		medication, err := app.medications.Get(r.Context(), chi.URLParam(r, "MedicationID"))
+		if errors.Is(err, models.ErrNoMedication) {
+			render.Render(w, r, ErrNotFound)
+			return
+		}
+		if err != nil {
+			render.Render(w, r, ErrRender(err))
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), ContextKeyMedication, medication)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// ShareCtx middleware is used to load a Share object from
+// the URL parameters passed through as the request. In case
+// the Share could not be found, we stop here and return a 404.
+func (app *application) ShareCtx(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		share, err := app.shares.Get(r.Context(), chi.URLParam(r, "ShareID"))
+		if errors.Is(err, models.ErrNoShare) {
+			render.Render(w, r, ErrNotFound)
+			return
+		}
+		if err != nil {
+			render.Render(w, r, ErrRender(err))
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), ContextKeyShare, share)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// SharedCtx middleware verifies the token of a share link and scopes the
+// models to the share, so the handlers behind it only see what is shared.
+// Every access is added to the access log of the share, expired and
+// revoked links get a 410, any other invalid one a 404.
+func (app *application) SharedCtx(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := chi.URLParam(r, "ShareToken")
+		share, err := app.shareService.Verify(r.Context(), token)
+		switch {
+		case errors.Is(err, services.ErrShareExpired), errors.Is(err, services.ErrShareRevoked):
+			render.Render(w, r, ErrGone(err))
+			return
+		case errors.Is(err, services.ErrShareInvalid):
+			render.Render(w, r, ErrNotFound)
+			return
+		case err != nil:
+			render.Render(w, r, ErrRender(err))
+			return
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Referrer-Policy", "no-referrer")
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		defer func() {
+			app.logShareAccess(r, share, token, ww.Status())
+		}()
+
+		next.ServeHTTP(ww, r.WithContext(sharing.WithShare(r.Context(), share)))
+	})
+}
+
+// logShareAccess adds the request to the access log of share, a failure is
+// only logged since the response is sent already.
+func (app *application) logShareAccess(r *http.Request, share *models.Share, token string, status int) {
+	path := strings.TrimPrefix(r.URL.Path, "/shared/"+token)
+	if r.URL.RawQuery != "" {
+		path += "?" + r.URL.RawQuery
+	}
+	access := &models.ShareAccess{
+		ShareID:    share.ID,
+		At:         time.Now(),
+		Method:     r.Method,
+		Path:       path,
+		Status:     status,
+		RemoteAddr: r.RemoteAddr,
+		UserAgent:  r.UserAgent(),
+	}
+
+	logger := app.requestLogger(r).With("share_id", share.ID, "share_path", path)
+	logger.Info("share accessed", "status", status)
+	if err := app.shares.LogAccess(r.Context(), access); err != nil {
+		logger.Warn("logging the share access failed", "error", err)
+	}
+}
+
+// ShareAllows middleware lets only requests of a share granting access to
+// resource through, others get a 403.
+func (app *application) ShareAllows(resource string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if share := sharing.FromContext(r.Context()); share == nil || !share.Allows(resource) {
+				render.Render(w, r, ErrForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
 // RecordNewValueCtx middleware is used to load a record value object from
 // the URL parameters passed through as the request. In case of error returns 400
 func (app *application) RecordNewValueCtx(next http.Handler) http.Handler {
@@ -57,19 +500,273 @@ func (app *application) RecordNewValueCtx(next http.Handler) http.Handler {
 	})
 }
 
-// LimitAuthorizedIp middleware limits requests to be performed from certain ip only
-func (app *application) LimitAuthorizedIp(next http.Handler) http.Handler {
+// RevisionCtx middleware is used to load a revision number from
+// the URL parameters passed through as the request. In case of error returns 404
+func (app *application) RevisionCtx(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		callerIp := GetIPAddress(r)
+		rev, err := strconv.Atoi(chi.URLParam(r, "Rev"))
+		if err != nil {
+			render.Render(w, r, ErrNotFound)
+			return
+		}
 
-		if !strings.Contains(callerIp, app.authorizedIp) {
-			app.errorLog.Printf("Authorized IP check failed, must be %s, request from %s\n",
-				app.authorizedIp, callerIp)
+		ctx := context.WithValue(r.Context(), ContextKeyRevision, rev)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// QuickLinkCtx middleware is used to verify a quick-add link token from
+// the URL parameters and scopes the RecordModel to the patient of the link.
+// Invalid tokens get 404, expired and revoked ones 410, as do links of an
+// issuer who may no longer add readings of the patient.
+func (app *application) QuickLinkCtx(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		link, err := app.quickLinkService.Verify(r.Context(), chi.URLParam(r, "QuickLinkToken"))
+		switch {
+		case errors.Is(err, services.ErrQuickLinkExpired), errors.Is(err, services.ErrQuickLinkRevoked):
+			render.Render(w, r, ErrGone(err))
+			return
+		case errors.Is(err, services.ErrQuickLinkInvalid):
+			render.Render(w, r, ErrNotFound)
+			return
+		case err != nil:
+			render.Render(w, r, ErrRender(err))
 			return
 		}
 
-		app.infoLog.Println("Authorized IP check passed")
+		allowed, err := app.issuerAllowed(r.Context(), link)
+		if err != nil {
+			render.Render(w, r, ErrRender(err))
+			return
+		}
+		if !allowed {
+			render.Render(w, r, ErrGone(errQuickLinkIssuer))
+			return
+		}
 
-		next.ServeHTTP(w, r)
+		w.Header().Set("Referrer-Policy", "no-referrer")
+		ctx := context.WithValue(r.Context(), ContextKeyQuickLink, link)
+		next.ServeHTTP(w, r.WithContext(models.WithPatient(ctx, link.PatientID)))
 	})
 }
+
+var errQuickLinkIssuer = errors.New("the issuer of the quick-add link may no longer add readings")
+
+// issuerAllowed reports whether the issuer of link may still add readings
+// of its patient, a link never allows more than its issuer. Links issued
+// without a token depend on the policy for anonymous callers.
+func (app *application) issuerAllowed(ctx context.Context, link *models.QuickLink) (bool, error) {
+	role := policy.RoleAnonymous
+	if link.IssuerID != "" {
+		issuer, err := app.users.Get(ctx, link.IssuerID)
+		if errors.Is(err, models.ErrNoUser) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if issuer.DisabledAt != nil {
+			return false, nil
+		}
+		role = policy.RoleOf(issuer)
+	}
+
+	if link.PatientID == models.DefaultPatient {
+		return app.policy.Allows(role, policy.Household), nil
+	}
+	if link.IssuerID == "" || !app.policy.Allows(role, policy.Patients) {
+		return false, nil
+	}
+	membership, err := app.patients.Membership(ctx, link.PatientID, link.IssuerID)
+	if errors.Is(err, models.ErrNoMembership) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return models.RoleAllows(membership.Role, models.RoleCaregiver), nil
+}
+
+// QuickLinkIDCtx middleware loads the quick-add link of the QuickLinkID URL
+// parameter, links of other patients than the one of the route get a 404.
+func (app *application) QuickLinkIDCtx(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		link, err := app.quickLinks.Get(r.Context(), chi.URLParam(r, "QuickLinkID"))
+		if errors.Is(err, models.ErrNoQuickLink) || (err == nil && link.PatientID != models.PatientID(r.Context())) {
+			render.Render(w, r, ErrNotFound)
+			return
+		}
+		if err != nil {
+			render.Render(w, r, ErrRender(err))
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), ContextKeyQuickLink, link)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// CSRFProtect middleware makes sure unsafe requests of the HTML pages come
+// from a page served by us: they must carry the token of the CSRF cookie in
+// the csrf_token form field or the X-CSRF-Token header. Pages get the token
+// from the request context, a browser without a cookie gets a new one.
+func (app *application) CSRFProtect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var nonce string
+		if cookie, err := r.Cookie(cookieCSRF); err == nil {
+			nonce = cookie.Value
+		}
+
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && !app.verifyCSRF(w, r) {
+			app.requestLogger(r).Warn("CSRF check failed", "has_cookie", nonce != "")
+			http.Error(w, "Invalid or missing CSRF token, reload the page and try again.", http.StatusForbidden)
+			return
+		}
+
+		if nonce == "" {
+			var err error
+			nonce, err = app.csrf.NewNonce()
+			if err != nil {
+				app.requestLogger(r).Error("creating CSRF nonce failed", "error", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			http.SetCookie(w, &http.Cookie{
+				Name:     cookieCSRF,
+				Value:    nonce,
+				Path:     "/",
+				HttpOnly: true,
+				Secure:   r.TLS != nil,
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+
+		ctx := context.WithValue(r.Context(), ContextKeyCSRFToken, app.csrf.Token(nonce))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// verifyCSRF checks the CSRF token of the X-CSRF-Token header, or else of
+// the csrf_token form field, against the CSRF cookie of r.
+func (app *application) verifyCSRF(w http.ResponseWriter, r *http.Request) bool {
+	cookie, err := r.Cookie(cookieCSRF)
+	if err != nil {
+		return false
+	}
+
+	token := r.Header.Get(headerCSRFToken)
+	if token == "" {
+		r.Body = http.MaxBytesReader(w, r.Body, maxFormBodySize)
+		token = r.PostFormValue(fieldCSRFToken)
+	}
+	return app.csrf.Verify(cookie.Value, token)
+}
+
+// Idempotent middleware processes a request carrying an Idempotency-Key
+// header only once per key. Retries, even concurrent ones, get the stored
+// response replayed. Reusing a key for a different request returns 422,
+// a key still being processed by another instance returns 409.
+func (app *application) Idempotent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(headerIdempotencyKey)
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			render.Render(w, r, ErrInvalidRequest(errors.New("idempotency key is too long")))
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxIdempotentBodySize))
+		if err != nil {
+			render.Render(w, r, ErrInvalidRequest(err))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		scoped := idempotencyScope(r, key)
+		entry, err := app.idempotency.Begin(r.Context(), scoped, requestFingerprint(r, body))
+		switch {
+		case errors.Is(err, services.ErrIdempotencyKeyReused):
+			render.Render(w, r, ErrUnprocessable(err))
+			return
+		case errors.Is(err, services.ErrIdempotencyInProgress):
+			render.Render(w, r, ErrConflict(err))
+			return
+		case err != nil:
+			render.Render(w, r, ErrInvalidRequest(err))
+			return
+		case entry != nil:
+			w.Header().Set("Content-Type", entry.ContentType)
+			w.Header().Set(headerIdempotentReplayed, "true")
+			w.WriteHeader(entry.Status)
+			w.Write(entry.Body)
+			return
+		}
+
+		// the key is released even if the client went away meanwhile,
+		// otherwise retries would be rejected until it expires
+		storeCtx := context.WithoutCancel(r.Context())
+		completed := false
+		defer func() {
+			if !completed {
+				app.idempotency.Abort(storeCtx, scoped)
+			}
+		}()
+
+		response := &bytes.Buffer{}
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		ww.Tee(response)
+
+		next.ServeHTTP(ww, r)
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		if status < 200 || status >= 300 {
+			// failed requests aren't stored, so they can be retried
+			return
+		}
+
+		var created struct {
+			ID string `json:"id"`
+		}
+		json.Unmarshal(response.Bytes(), &created)
+
+		err = app.idempotency.Complete(storeCtx, &models.IdempotencyEntry{
+			Key:         scoped,
+			RecordID:    created.ID,
+			Status:      status,
+			ContentType: ww.Header().Get("Content-Type"),
+			Body:        response.Bytes(),
+		})
+		if err != nil {
+			app.requestLogger(r).Error("storing idempotent response failed",
+				"idempotency_key", key,
+				"error", err)
+			return
+		}
+		completed = true
+	})
+}
+
+// idempotencyScope namespaces the key by the caller and the patient, so the
+// key of one user can't replay or block the request of another one.
+func idempotencyScope(r *http.Request, key string) string {
+	userID := ""
+	if user, ok := r.Context().Value(ContextKeyUser).(*models.User); ok {
+		userID = user.ID
+	}
+	return models.PatientID(r.Context()) + "/" + userID + "/" + key
+}
+
+// requestFingerprint identifies a request, to detect an idempotency key
+// being reused for another one.
+func requestFingerprint(r *http.Request, body []byte) string {
+	hash := sha256.New()
+	io.WriteString(hash, r.Method+" "+r.URL.Path+"\n")
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
@@ -0,0 +1,901 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/health"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/openapi"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const apiVersion = "1.0.0"
+
+//go:embed openapi.html
+var openAPIViewer []byte
+
+// undocumentedRoutes aren't part of the API, they serve the UI.
+var undocumentedRoutes = map[string]bool{
+	"/login":                               true,
+	"/logout":                              true,
+	"/":                                    true,
+	"/dashboard/records":                   true,
+	"/dashboard/records/{RecordID}":        true,
+	"/dashboard/records/{RecordID}/delete": true,
+	"/*":                                   true,
+	"/static/*":                            true,
+}
+
+// apiOperations describes every API route, keyed by method and chi route
+// pattern. A route missing here is reported by buildOpenAPI.
+func apiOperations(doc *openapi.Document) map[string]*openapi.Operation {
+	record := doc.Schema(RecordResponse{})
+	recordBody := &openapi.RequestBody{Required: true, Content: openapi.JSON(doc.Schema(RecordRequest{}))}
+	quickBody := &openapi.RequestBody{
+		Required:    true,
+		Description: "Either just the value as plain text, or a form.",
+		Content: map[string]*openapi.MediaType{
+			"text/plain":                        {Schema: &openapi.Schema{Type: "string"}},
+			"application/x-www-form-urlencoded": {Schema: doc.Schema(QuickRecordRequest{})},
+		},
+	}
+	quickQuery := []*openapi.Parameter{
+		{Name: "created_at", In: "query", Description: "RFC 3339 timestamp, for plain text bodies",
+			Schema: &openapi.Schema{Type: "string", Format: "date-time"}},
+		{Name: "context", In: "query", Description: "Context of the reading, for plain text bodies",
+			Schema: &openapi.Schema{Type: "string"}},
+		{Name: "tz", In: "query", Description: "IANA time zone or UTC offset the reading is taken in, for plain text bodies",
+			Schema: &openapi.Schema{Type: "string"}},
+	}
+	actionPlan := doc.Schema(ActionPlanResponse{})
+	actionPlanBody := &openapi.RequestBody{Required: true, Content: openapi.JSON(doc.Schema(ActionPlanRequest{}))}
+	medication := doc.Schema(MedicationResponse{})
+	medicationBody := &openapi.RequestBody{Required: true, Content: openapi.JSON(doc.Schema(MedicationRequest{}))}
+	share := doc.Schema(ShareResponse{})
+	patient := doc.Schema(PatientResponse{})
+	patientBody := &openapi.RequestBody{Required: true, Content: openapi.JSON(doc.Schema(PatientRequest{}))}
+	membership := doc.Schema(MembershipResponse{})
+	user := doc.Schema(UserResponse{})
+	idempotencyKey := &openapi.Parameter{
+		Name:        headerIdempotencyKey,
+		In:          "header",
+		Description: "Retries with the same key get the first response replayed",
+		Schema:      &openapi.Schema{Type: "string"},
+	}
+
+	ok := func(description string, schema *openapi.Schema) *openapi.Response {
+		return &openapi.Response{Description: description, Content: openapi.JSON(schema)}
+	}
+	failed := func(description string) *openapi.Response {
+		return ok(description, doc.Schema(ErrResponse{}))
+	}
+
+	operations := map[string]*openapi.Operation{
+		"GET /records": {
+			OperationID: "listRecords",
+			Summary:     "List all records",
+			Tags:        []string{"records"},
+			Responses: map[string]*openapi.Response{
+				"200": ok("All records", &openapi.Schema{Type: "array", Items: record}),
+			},
+		},
+		"POST /records": {
+			OperationID: "createRecord",
+			Summary:     "Create a record",
+			Tags:        []string{"records"},
+			Parameters:  []*openapi.Parameter{idempotencyKey},
+			RequestBody: recordBody,
+			Responses: map[string]*openapi.Response{
+				"201": ok("Created record", record),
+				"400": failed("Invalid record"),
+				"409": failed("Request with the same idempotency key in progress"),
+				"422": failed("Idempotency key used for another request"),
+			},
+		},
+		"POST /records/batch": {
+			OperationID: "batchRecords",
+			Summary:     "Create, update and delete many records at once",
+			Tags:        []string{"records"},
+			RequestBody: &openapi.RequestBody{Required: true, Content: openapi.JSON(doc.Schema(BatchRequest{}))},
+			Responses: map[string]*openapi.Response{
+				"200": ok("Result per operation", doc.Schema(BatchResponse{})),
+				"400": failed("Invalid batch"),
+				"409": ok("Atomic batch aborted, nothing applied", doc.Schema(BatchResponse{})),
+			},
+		},
+		"GET /records/stats/trend": {
+			OperationID: "recordsTrend",
+			Summary:     "Moving averages, slope and early warning of a sustained decline",
+			Tags:        []string{"statistics"},
+			Responses: map[string]*openapi.Response{
+				"200": ok("Trend of the daily best readings", doc.Schema(TrendResponse{})),
+			},
+		},
+		"GET /records/stats/correlation": {
+			OperationID: "getRecordsCorrelation",
+			Summary:     "Correlation of readings with the temperature, humidity, air quality and pollen count",
+			Tags:        []string{"statistics"},
+			Responses: map[string]*openapi.Response{
+				"200": ok("Correlation coefficient per variable", doc.Schema(CorrelationResponse{})),
+			},
+		},
+		"GET /records/aggregate": {
+			OperationID: "aggregateRecords",
+			Summary:     "Min, max, mean and count, morning and evening means per day, week or month",
+			Tags:        []string{"statistics"},
+			Parameters: []*openapi.Parameter{
+				{Name: "bucket", In: "query", Description: "day, week starting Monday, or month; day by default",
+					Schema: &openapi.Schema{Type: "string", Enum: []string{models.BucketDay, models.BucketWeek, models.BucketMonth}}},
+				{Name: "tz", In: "query", Description: "IANA time zone or UTC offset the buckets start at midnight in, the one of the user by default",
+					Schema: &openapi.Schema{Type: "string"}},
+			},
+			Responses: map[string]*openapi.Response{
+				"200": ok("Buckets with readings, oldest first", doc.Schema(AggregateResponse{})),
+				"400": failed("Invalid bucket or time zone"),
+			},
+		},
+		"POST /records/quick": {
+			OperationID: "quickCreateRecord",
+			Summary:     "Create a record from a plain text value or a form",
+			Tags:        []string{"quick-add"},
+			Parameters:  append([]*openapi.Parameter{idempotencyKey}, quickQuery...),
+			RequestBody: quickBody,
+			Responses: map[string]*openapi.Response{
+				"201": ok("Created record", record),
+				"400": failed("Invalid value"),
+			},
+		},
+		"GET /records/quick-links": {
+			OperationID: "listQuickLinks",
+			Summary:     "List the issued quick-add links, the latest first",
+			Tags:        []string{"quick-add"},
+			Responses: map[string]*openapi.Response{
+				"200": ok("Issued links", doc.ArrayOf(QuickLinkResponse{})),
+			},
+		},
+		"POST /records/quick-links": {
+			OperationID: "createQuickLink",
+			Summary:     "Issue a signed, expiring quick-add link, working while the issuer may add readings",
+			Tags:        []string{"quick-add"},
+			RequestBody: &openapi.RequestBody{Content: openapi.JSON(doc.Schema(QuickLinkRequest{}))},
+			Responses: map[string]*openapi.Response{
+				"201": ok("Issued link", doc.Schema(QuickLinkResponse{})),
+				"400": failed("Invalid request"),
+			},
+		},
+		"DELETE /records/quick-links/{QuickLinkID}": {
+			OperationID: "revokeQuickLink",
+			Summary:     "Revoke a quick-add link",
+			Tags:        []string{"quick-add"},
+			Responses: map[string]*openapi.Response{
+				"200": ok("Revoked link", doc.Schema(QuickLinkResponse{})),
+				"404": failed("Link not found"),
+			},
+		},
+		"GET /records/quick/{QuickLinkToken}": {
+			OperationID: "quickLinkForm",
+			Summary:     "Show the form of a quick-add link, adds nothing",
+			Tags:        []string{"quick-add"},
+			Responses: map[string]*openapi.Response{
+				"200": {Description: "HTML form", Content: map[string]*openapi.MediaType{"text/html": {}}},
+				"404": failed("Invalid link"),
+				"410": failed("Link expired or revoked, or its issuer may no longer add readings"),
+			},
+		},
+		"POST /records/quick/{QuickLinkToken}": {
+			OperationID: "quickLinkCreateRecord",
+			Summary:     "Create a record through a quick-add link",
+			Tags:        []string{"quick-add"},
+			Parameters:  append([]*openapi.Parameter{idempotencyKey}, quickQuery...),
+			RequestBody: quickBody,
+			Responses: map[string]*openapi.Response{
+				"201": ok("Created record", record),
+				"400": failed("Invalid value"),
+				"404": failed("Invalid link"),
+				"410": failed("Link expired or revoked, or its issuer may no longer add readings"),
+			},
+		},
+		"GET /records/simple-add/{NewRecordValue}": {
+			OperationID: "simpleCreateRecord",
+			Summary:     "Create a record on GET, only if SIMPLE_ADD_ENABLED is set",
+			Tags:        []string{"quick-add"},
+			Deprecated:  true,
+			Parameters:  []*openapi.Parameter{idempotencyKey},
+			Responses: map[string]*openapi.Response{
+				"201": ok("Created record", record),
+				"404": failed("Invalid value"),
+			},
+		},
+		"GET /records/{RecordID}": {
+			OperationID: "getRecord",
+			Summary:     "Get a record",
+			Tags:        []string{"records"},
+			Responses: map[string]*openapi.Response{
+				"200": ok("Record", record),
+				"404": failed("No such record"),
+			},
+		},
+		"PUT /records/{RecordID}": {
+			OperationID: "updateRecord",
+			Summary:     "Update a record, the prior version is kept in its history",
+			Tags:        []string{"records"},
+			RequestBody: recordBody,
+			Responses: map[string]*openapi.Response{
+				"200": ok("Updated record", record),
+				"400": failed("Invalid record"),
+				"404": failed("No such record"),
+			},
+		},
+		"DELETE /records/{RecordID}": {
+			OperationID: "deleteRecord",
+			Summary:     "Delete a record and its history",
+			Tags:        []string{"records"},
+			Responses: map[string]*openapi.Response{
+				"200": ok("Deleted record", record),
+				"404": failed("No such record"),
+			},
+		},
+		"GET /records/{RecordID}/history": {
+			OperationID: "listRecordHistory",
+			Summary:     "List prior versions of a record",
+			Tags:        []string{"records"},
+			Responses: map[string]*openapi.Response{
+				"200": ok("Prior versions, oldest first", doc.ArrayOf(RevisionResponse{})),
+				"404": failed("No such record"),
+			},
+		},
+		"POST /records/{RecordID}/revert/{Rev}": {
+			OperationID: "revertRecord",
+			Summary:     "Restore a prior version of a record",
+			Tags:        []string{"records"},
+			Parameters: []*openapi.Parameter{
+				{Name: "Rev", In: "path", Required: true, Schema: &openapi.Schema{Type: "integer"}},
+			},
+			Responses: map[string]*openapi.Response{
+				"200": ok("Restored record", record),
+				"404": failed("No such record or revision"),
+			},
+		},
+		"GET /action-plans": {
+			OperationID: "listActionPlans",
+			Summary:     "List action plans, the latest version of each",
+			Tags:        []string{"action-plans"},
+			Responses: map[string]*openapi.Response{
+				"200": ok("Action plans by the time they take effect", doc.ArrayOf(ActionPlanResponse{})),
+			},
+		},
+		"POST /action-plans": {
+			OperationID: "createActionPlan",
+			Summary:     "Create an action plan with zone thresholds and instructions",
+			Tags:        []string{"action-plans"},
+			RequestBody: actionPlanBody,
+			Responses: map[string]*openapi.Response{
+				"201": ok("Created action plan", actionPlan),
+				"400": failed("Invalid action plan"),
+			},
+		},
+		"GET /action-plans/active": {
+			OperationID: "getActiveActionPlan",
+			Summary:     "Get the action plan in effect at a time",
+			Tags:        []string{"action-plans"},
+			Parameters: []*openapi.Parameter{
+				{Name: "at", In: "query", Description: "RFC 3339 timestamp, now by default",
+					Schema: &openapi.Schema{Type: "string", Format: "date-time"}},
+			},
+			Responses: map[string]*openapi.Response{
+				"200": ok("Action plan in effect", actionPlan),
+				"400": failed("Invalid time"),
+				"404": failed("No action plan in effect"),
+			},
+		},
+		"GET /action-plans/{ActionPlanID}": {
+			OperationID: "getActionPlan",
+			Summary:     "Get the latest version of an action plan",
+			Tags:        []string{"action-plans"},
+			Responses: map[string]*openapi.Response{
+				"200": ok("Action plan", actionPlan),
+				"404": failed("No such action plan"),
+			},
+		},
+		"PUT /action-plans/{ActionPlanID}": {
+			OperationID: "updateActionPlan",
+			Summary:     "Save the next version of an action plan, given the version it replaces",
+			Tags:        []string{"action-plans"},
+			RequestBody: actionPlanBody,
+			Responses: map[string]*openapi.Response{
+				"200": ok("New version of the action plan", actionPlan),
+				"400": failed("Invalid action plan"),
+				"404": failed("No such action plan"),
+				"409": failed("The version replaced isn't the latest"),
+			},
+		},
+		"DELETE /action-plans/{ActionPlanID}": {
+			OperationID: "deleteActionPlan",
+			Summary:     "Delete an action plan with all its versions",
+			Tags:        []string{"action-plans"},
+			Responses: map[string]*openapi.Response{
+				"200": ok("Deleted action plan", actionPlan),
+				"404": failed("No such action plan"),
+			},
+		},
+		"GET /action-plans/{ActionPlanID}/versions": {
+			OperationID: "listActionPlanVersions",
+			Summary:     "List every version of an action plan",
+			Tags:        []string{"action-plans"},
+			Responses: map[string]*openapi.Response{
+				"200": ok("Versions, oldest first", doc.ArrayOf(ActionPlanResponse{})),
+				"404": failed("No such action plan"),
+			},
+		},
+		"GET /records/{RecordID}/context": {
+			OperationID: "getRecordContext",
+			Summary:     "Get a record with the doses of medications taken around it",
+			Tags:        []string{"records", "medications"},
+			Parameters: []*openapi.Parameter{
+				{Name: "before", In: "query", Description: "Duration before the reading like 4h, 6h by default",
+					Schema: &openapi.Schema{Type: "string"}},
+				{Name: "after", In: "query", Description: "Duration after the reading like 30m, 2h by default",
+					Schema: &openapi.Schema{Type: "string"}},
+			},
+			Responses: map[string]*openapi.Response{
+				"200": ok("Record with the doses around it, oldest first", doc.Schema(RecordContextResponse{})),
+				"400": failed("Invalid duration"),
+				"404": failed("No such record"),
+			},
+		},
+		"GET /medications": {
+			OperationID: "listMedications",
+			Summary:     "List medications with the doses left in their inhalers",
+			Tags:        []string{"medications"},
+			Responses: map[string]*openapi.Response{
+				"200": ok("Medications by name", doc.ArrayOf(MedicationResponse{})),
+			},
+		},
+		"POST /medications": {
+			OperationID: "createMedication",
+			Summary:     "Add a medication, its inhaler is full unless refilled_at is given",
+			Tags:        []string{"medications"},
+			RequestBody: medicationBody,
+			Responses: map[string]*openapi.Response{
+				"201": ok("Created medication", medication),
+				"400": failed("Invalid medication"),
+			},
+		},
+		"GET /medications/{MedicationID}": {
+			OperationID: "getMedication",
+			Summary:     "Get a medication with the doses left in its inhaler",
+			Tags:        []string{"medications"},
+			Responses: map[string]*openapi.Response{
+				"200": ok("Medication", medication),
+				"404": failed("No such medication"),
+			},
+		},
+		"PUT /medications/{MedicationID}": {
+			OperationID: "updateMedication",
+			Summary:     "Update a medication",
+			Tags:        []string{"medications"},
+			RequestBody: medicationBody,
+			Responses: map[string]*openapi.Response{
+				"200": ok("Updated medication", medication),
+				"400": failed("Invalid medication"),
+				"404": failed("No such medication"),
+			},
+		},
+		"DELETE /medications/{MedicationID}": {
+			OperationID: "deleteMedication",
+			Summary:     "Delete a medication and its doses",
+			Tags:        []string{"medications"},
+			Responses: map[string]*openapi.Response{
+				"200": ok("Deleted medication", medication),
+				"404": failed("No such medication"),
+			},
+		},
+		"POST /medications/{MedicationID}/refill": {
+			OperationID: "refillMedication",
+			Summary:     "Start a new inhaler, doses taken before don't count against it",
+			Tags:        []string{"medications"},
+			Responses: map[string]*openapi.Response{
+				"200": ok("Medication with a full inhaler", medication),
+				"404": failed("No such medication"),
+			},
+		},
+		"GET /medications/{MedicationID}/doses": {
+			OperationID: "listDoses",
+			Summary:     "List doses of a medication",
+			Tags:        []string{"medications"},
+			Parameters: []*openapi.Parameter{
+				{Name: "from", In: "query", Description: "RFC 3339 timestamp of the first dose",
+					Schema: &openapi.Schema{Type: "string", Format: "date-time"}},
+				{Name: "until", In: "query", Description: "RFC 3339 timestamp the doses are taken before",
+					Schema: &openapi.Schema{Type: "string", Format: "date-time"}},
+			},
+			Responses: map[string]*openapi.Response{
+				"200": ok("Doses, oldest first", doc.ArrayOf(DoseResponse{})),
+				"400": failed("Invalid time range"),
+				"404": failed("No such medication"),
+			},
+		},
+		"POST /medications/{MedicationID}/doses": {
+			OperationID: "logDose",
+			Summary:     "Log a dose, by default the puffs of one dose taken now",
+			Tags:        []string{"medications"},
+			RequestBody: &openapi.RequestBody{Content: openapi.JSON(doc.Schema(DoseRequest{}))},
+			Responses: map[string]*openapi.Response{
+				"201": ok("Dose with the inventory after it, reorder_alert set when it runs low", doc.Schema(DoseResponse{})),
+				"400": failed("Invalid dose"),
+				"404": failed("No such medication"),
+			},
+		},
+		"DELETE /medications/{MedicationID}/doses/{DoseID}": {
+			OperationID: "deleteDose",
+			Summary:     "Delete a dose logged by mistake",
+			Tags:        []string{"medications"},
+			Responses: map[string]*openapi.Response{
+				"200": ok("Deleted dose", doc.Schema(DoseResponse{})),
+				"404": failed("No such medication or dose"),
+			},
+		},
+		"GET /reports/adherence": {
+			OperationID: "getAdherenceReport",
+			Summary:     "Controller adherence, reliever use and mean peak flow per week",
+			Tags:        []string{"reports"},
+			Parameters: []*openapi.Parameter{
+				{Name: "weeks", In: "query", Description: "Weeks up to the current one, 13 by default",
+					Schema: &openapi.Schema{Type: "integer"}},
+				{Name: "tz", In: "query", Description: "IANA time zone or UTC offset of the calendar, the one of the user by default",
+					Schema: &openapi.Schema{Type: "string"}},
+			},
+			Responses: map[string]*openapi.Response{
+				"200": ok("Report, oldest week first", doc.Schema(AdherenceResponse{})),
+				"400": failed("Invalid weeks or time zone"),
+			},
+		},
+		"GET /shares": {
+			OperationID: "listShares",
+			Summary:     "List all share links, revoked and expired ones included",
+			Tags:        []string{"shares"},
+			Responses: map[string]*openapi.Response{
+				"200": ok("Shares, the latest created first", &openapi.Schema{Type: "array", Items: share}),
+			},
+		},
+		"POST /shares": {
+			OperationID: "createShare",
+			Summary:     "Create a signed, expiring read-only link to resources of a date range",
+			Tags:        []string{"shares"},
+			RequestBody: &openapi.RequestBody{Required: true, Content: openapi.JSON(doc.Schema(ShareRequest{}))},
+			Responses: map[string]*openapi.Response{
+				"201": ok("Created share with the URL of its link", share),
+				"400": failed("Invalid share"),
+			},
+		},
+		"GET /shares/{ShareID}": {
+			OperationID: "getShare",
+			Summary:     "Get a share with the URL of its link",
+			Tags:        []string{"shares"},
+			Responses: map[string]*openapi.Response{
+				"200": ok("Share", share),
+				"404": failed("No such share"),
+			},
+		},
+		"DELETE /shares/{ShareID}": {
+			OperationID: "revokeShare",
+			Summary:     "Revoke a share link, the share is kept for its access log",
+			Tags:        []string{"shares"},
+			Responses: map[string]*openapi.Response{
+				"200": ok("Revoked share", share),
+				"404": failed("No such share"),
+			},
+		},
+		"GET /shares/{ShareID}/accesses": {
+			OperationID: "listShareAccesses",
+			Summary:     "Access log of a share link",
+			Tags:        []string{"shares"},
+			Responses: map[string]*openapi.Response{
+				"200": ok("Accesses, oldest first", &openapi.Schema{Type: "array", Items: doc.Schema(ShareAccessResponse{})}),
+				"404": failed("No such share"),
+			},
+		},
+		"POST /users": {
+			OperationID: "createUser",
+			Summary:     "Create an account, the only response carrying its bearer token",
+			Tags:        []string{"users"},
+			RequestBody: &openapi.RequestBody{Required: true, Content: openapi.JSON(doc.Schema(UserRequest{}))},
+			Responses: map[string]*openapi.Response{
+				"201": ok("Created user with its token", doc.Schema(CreatedUserResponse{})),
+				"400": failed("Invalid user"),
+				"401": failed("Sign up is closed, missing or invalid token"),
+				"403": failed("Sign up is closed, not an admin"),
+			},
+		},
+		"GET /users/me": {
+			OperationID: "getCurrentUser",
+			Summary:     "Get the user of the bearer token",
+			Tags:        []string{"users"},
+			Responses: map[string]*openapi.Response{
+				"200": ok("User", user),
+				"401": failed("Missing or invalid token"),
+			},
+		},
+		"GET /patients": {
+			OperationID: "listPatients",
+			Summary:     "List the patients the user has access to, with the role of the user",
+			Tags:        []string{"patients"},
+			Responses: map[string]*openapi.Response{
+				"200": ok("Patients, in the order access was granted", &openapi.Schema{Type: "array", Items: patient}),
+				"401": failed("Missing or invalid token"),
+			},
+		},
+		"POST /patients": {
+			OperationID: "createPatient",
+			Summary:     "Create a patient, the user becomes its owner",
+			Tags:        []string{"patients"},
+			RequestBody: patientBody,
+			Responses: map[string]*openapi.Response{
+				"201": ok("Created patient", patient),
+				"400": failed("Invalid patient"),
+				"401": failed("Missing or invalid token"),
+			},
+		},
+		"GET /patients/{PatientID}": {
+			OperationID: "getPatient",
+			Summary:     "Get a patient with the role of the user",
+			Tags:        []string{"patients"},
+			Responses: map[string]*openapi.Response{
+				"200": ok("Patient", patient),
+				"401": failed("Missing or invalid token"),
+				"404": failed("No such patient, or no access to it"),
+			},
+		},
+		"PUT /patients/{PatientID}": {
+			OperationID: "updatePatient",
+			Summary:     "Rename a patient, owners only",
+			Tags:        []string{"patients"},
+			RequestBody: patientBody,
+			Responses: map[string]*openapi.Response{
+				"200": ok("Updated patient", patient),
+				"400": failed("Invalid patient"),
+				"401": failed("Missing or invalid token"),
+				"403": failed("Not an owner of the patient"),
+				"404": failed("No such patient, or no access to it"),
+			},
+		},
+		"GET /patients/{PatientID}/members": {
+			OperationID: "listMembers",
+			Summary:     "List who has access to a patient, owners only",
+			Tags:        []string{"patients"},
+			Responses: map[string]*openapi.Response{
+				"200": ok("Memberships, in the order access was granted", &openapi.Schema{Type: "array", Items: membership}),
+				"401": failed("Missing or invalid token"),
+				"403": failed("Not an owner of the patient"),
+				"404": failed("No such patient, or no access to it"),
+			},
+		},
+		"PUT /patients/{PatientID}/members/{UserID}": {
+			OperationID: "setMember",
+			Summary:     "Grant a user a role for a patient, owners only",
+			Tags:        []string{"patients"},
+			RequestBody: &openapi.RequestBody{Required: true, Content: openapi.JSON(doc.Schema(MembershipRequest{}))},
+			Responses: map[string]*openapi.Response{
+				"200": ok("Membership", membership),
+				"400": failed("Invalid role"),
+				"401": failed("Missing or invalid token"),
+				"403": failed("Not an owner of the patient"),
+				"404": failed("No such patient or user"),
+				"409": failed("The patient would be left without an owner"),
+			},
+		},
+		"DELETE /patients/{PatientID}/members/{UserID}": {
+			OperationID: "removeMember",
+			Summary:     "Take the access to a patient from a user, owners only",
+			Tags:        []string{"patients"},
+			Responses: map[string]*openapi.Response{
+				"200": ok("Removed membership", membership),
+				"401": failed("Missing or invalid token"),
+				"403": failed("Not an owner of the patient"),
+				"404": failed("No such patient or membership"),
+				"409": failed("The patient would be left without an owner"),
+			},
+		},
+		"GET /admin/stats": {
+			OperationID: "getSystemStats",
+			Summary:     "Counts of the accounts, patients, records and shares of the server, admins only",
+			Tags:        []string{"admin"},
+			Responses: map[string]*openapi.Response{
+				"200": ok("Stats", doc.Schema(StatsResponse{})),
+				"401": failed("Missing or invalid token"),
+				"403": failed("Not an admin"),
+			},
+		},
+		"GET /admin/users": {
+			OperationID: "listUsers",
+			Summary:     "List every account, disabled ones included, admins only",
+			Tags:        []string{"admin"},
+			Responses: map[string]*openapi.Response{
+				"200": ok("Users, oldest first", &openapi.Schema{Type: "array", Items: user}),
+				"401": failed("Missing or invalid token"),
+				"403": failed("Not an admin"),
+			},
+		},
+		"GET /admin/users/{UserID}": {
+			OperationID: "getUser",
+			Summary:     "Get an account, admins only",
+			Tags:        []string{"admin"},
+			Responses: map[string]*openapi.Response{
+				"200": ok("User", user),
+				"401": failed("Missing or invalid token"),
+				"403": failed("Not an admin"),
+				"404": failed("No such user"),
+			},
+		},
+		"POST /admin/users/{UserID}/token": {
+			OperationID: "resetUserToken",
+			Summary:     "Give an account a new token, the previous one stops working, admins only",
+			Tags:        []string{"admin"},
+			Responses: map[string]*openapi.Response{
+				"200": ok("User with its new token", doc.Schema(CreatedUserResponse{})),
+				"401": failed("Missing or invalid token"),
+				"403": failed("Not an admin"),
+				"404": failed("No such user"),
+			},
+		},
+		"POST /admin/users/{UserID}/disable": {
+			OperationID: "disableUser",
+			Summary:     "Keep an account from authenticating, its data is kept, admins only",
+			Tags:        []string{"admin"},
+			Responses: map[string]*openapi.Response{
+				"200": ok("Disabled user", user),
+				"401": failed("Missing or invalid token"),
+				"403": failed("Not an admin"),
+				"404": failed("No such user"),
+				"409": failed("Admins can't disable their own account"),
+			},
+		},
+		"POST /admin/users/{UserID}/enable": {
+			OperationID: "enableUser",
+			Summary:     "Let a disabled account authenticate again, admins only",
+			Tags:        []string{"admin"},
+			Responses: map[string]*openapi.Response{
+				"200": ok("Enabled user", user),
+				"401": failed("Missing or invalid token"),
+				"403": failed("Not an admin"),
+				"404": failed("No such user"),
+			},
+		},
+		"GET /sync": {
+			OperationID: "pullChanges",
+			Summary:     "Changes of records after a cursor, tombstones of removed records included",
+			Tags:        []string{"sync"},
+			Parameters: []*openapi.Parameter{
+				{Name: "since", In: "query", Description: "Cursor of the last response, all changes without it",
+					Schema: &openapi.Schema{Type: "string"}},
+				{Name: "limit", In: "query", Description: "Changes per page, 100 by default",
+					Schema: &openapi.Schema{Type: "integer"}},
+			},
+			Responses: map[string]*openapi.Response{
+				"200": ok("Changes in the order they were made", doc.Schema(ChangesResponse{})),
+				"400": failed("Invalid cursor or limit"),
+			},
+		},
+		"POST /sync": {
+			OperationID: "pushChanges",
+			Summary:     "Apply changes made offline, the server version wins conflicts",
+			Tags:        []string{"sync"},
+			RequestBody: &openapi.RequestBody{Required: true, Content: openapi.JSON(doc.Schema(SyncRequest{}))},
+			Responses: map[string]*openapi.Response{
+				"200": ok("Result per change", doc.Schema(SyncResponse{})),
+				"400": failed("Invalid request"),
+			},
+		},
+		"GET /healthz": {
+			OperationID: "healthz",
+			Summary:     "Liveness, the process is up",
+			Tags:        []string{"operations"},
+			Responses: map[string]*openapi.Response{
+				"200": ok("Up", doc.Schema(health.Report{})),
+			},
+		},
+		"GET /readyz": {
+			OperationID: "readyz",
+			Summary:     "Readiness, every dependency is up",
+			Tags:        []string{"operations"},
+			Responses: map[string]*openapi.Response{
+				"200": ok("All dependencies up", doc.Schema(health.Report{})),
+				"503": ok("A dependency is down", doc.Schema(health.Report{})),
+			},
+		},
+		"GET /metrics": {
+			OperationID: "getMetrics",
+			Summary:     "Prometheus metrics, admins only as they include the latest reading",
+			Tags:        []string{"operations"},
+			Responses: map[string]*openapi.Response{
+				"200": {Description: "Metrics in the Prometheus text format",
+					Content: map[string]*openapi.MediaType{"text/plain": {}}},
+				"401": failed("Missing or invalid token"),
+				"403": failed("Not an admin"),
+			},
+		},
+		"GET /openapi": {
+			OperationID: "getOpenAPI",
+			Summary:     "This OpenAPI document, also served as /openapi.json",
+			Tags:        []string{"docs"},
+			Responses: map[string]*openapi.Response{
+				"200": ok("OpenAPI document", &openapi.Schema{Type: "object"}),
+			},
+		},
+		"GET /docs": {
+			OperationID: "openAPIViewer",
+			Summary:     "Viewer for this OpenAPI document",
+			Tags:        []string{"docs"},
+			Responses: map[string]*openapi.Response{
+				"200": {Description: "HTML page", Content: map[string]*openapi.MediaType{"text/html": {}}},
+			},
+		},
+	}
+
+	// share links serve some GET routes as they are
+	deriveOperations(operations, "/shared/{ShareToken}", "shared", ", of a share link", sharedRoutes,
+		map[string]*openapi.Response{
+			"403": failed("Not shared by the link"),
+			"404": failed("No such link"),
+			"410": failed("Link expired or revoked"),
+		})
+	patientResponses := map[string]*openapi.Response{
+		"401": failed("Missing or invalid token"),
+		"404": failed("No such patient, or no access to it"),
+	}
+	deriveOperations(operations, "/patients/{PatientID}", "patient", ", of a patient", patientRoutes, patientResponses)
+	patientResponses["403"] = failed("Role of the user doesn't allow it")
+	deriveOperations(operations, "/patients/{PatientID}", "patient", ", of a patient", patientWriteRoutes, patientResponses)
+	return operations
+}
+
+// deriveOperations documents the routes served below prefix as well, with
+// the operation ID prefixed by idPrefix, the summary suffixed by summary,
+// tagged by idPrefix and with responses added.
+func deriveOperations(operations map[string]*openapi.Operation, prefix, idPrefix, summary string,
+	routes []string, responses map[string]*openapi.Response) {
+	for _, route := range routes {
+		method, path, _ := strings.Cut(route, " ")
+		operation := *operations[route]
+		operation.OperationID = idPrefix + strings.ToUpper(operation.OperationID[:1]) + operation.OperationID[1:]
+		operation.Summary += summary
+		operation.Tags = []string{idPrefix}
+		operation.Parameters = append([]*openapi.Parameter{}, operation.Parameters...)
+		operation.Responses = map[string]*openapi.Response{}
+		for status, response := range responses {
+			operation.Responses[status] = response
+		}
+		for status, response := range operations[route].Responses {
+			operation.Responses[status] = response
+		}
+		operations[method+" "+prefix+path] = &operation
+	}
+}
+
+// sharedRoutes are the routes served below /shared/{ShareToken} as well.
+var sharedRoutes = []string{
+	"GET /records",
+	"GET /records/stats/trend",
+	"GET /records/stats/correlation",
+	"GET /records/aggregate",
+	"GET /records/{RecordID}",
+	"GET /records/{RecordID}/history",
+	"GET /records/{RecordID}/context",
+	"GET /reports/adherence",
+}
+
+// patientRoutes are the routes served below /patients/{PatientID} as well,
+// to any member of the patient.
+var patientRoutes = []string{
+	"GET /records",
+	"GET /records/stats/trend",
+	"GET /records/stats/correlation",
+	"GET /records/aggregate",
+	"GET /records/{RecordID}",
+	"GET /records/{RecordID}/history",
+	"GET /action-plans",
+	"GET /action-plans/active",
+	"GET /action-plans/{ActionPlanID}",
+	"GET /action-plans/{ActionPlanID}/versions",
+	"GET /medications",
+	"GET /medications/{MedicationID}",
+	"GET /medications/{MedicationID}/doses",
+}
+
+// patientWriteRoutes are the routes served below /patients/{PatientID} as
+// well, to caregivers and owners of the patient.
+var patientWriteRoutes = []string{
+	"POST /records",
+	"POST /records/batch",
+	"PUT /records/{RecordID}",
+	"DELETE /records/{RecordID}",
+	"POST /records/{RecordID}/revert/{Rev}",
+	"GET /records/quick-links",
+	"POST /records/quick-links",
+	"DELETE /records/quick-links/{QuickLinkID}",
+	"POST /action-plans",
+	"PUT /action-plans/{ActionPlanID}",
+	"DELETE /action-plans/{ActionPlanID}",
+	"POST /medications",
+	"PUT /medications/{MedicationID}",
+	"DELETE /medications/{MedicationID}",
+	"POST /medications/{MedicationID}/refill",
+	"POST /medications/{MedicationID}/doses",
+	"DELETE /medications/{MedicationID}/doses/{DoseID}",
+}
+
+// buildOpenAPI documents every route of the router. Routes without a
+// description in apiOperations are returned as undocumented.
+func buildOpenAPI(r chi.Routes) (*openapi.Document, []string) {
+	doc := openapi.NewDocument(
+		"Simple peak flowmeter",
+		"Records of peak flow measurements, having timestamp and value.",
+		apiVersion,
+	)
+	operations := apiOperations(doc)
+
+	var undocumented []string
+	chi.Walk(r, func(method, route string, handler http.Handler, middlewares ...func(http.Handler) http.Handler) error {
+		if undocumentedRoutes[route] {
+			return nil
+		}
+
+		route = normalizeRoute(route)
+		operation, ok := operations[method+" "+route]
+		if !ok {
+			undocumented = append(undocumented, method+" "+route)
+			return nil
+		}
+
+		doc.AddOperation(method, route, operation)
+		return nil
+	})
+
+	sort.Strings(undocumented)
+	return doc, undocumented
+}
+
+// normalizeRoute drops the trailing slash chi adds to sub-router routes.
+func normalizeRoute(route string) string {
+	if route != "/" {
+		route = strings.TrimSuffix(route, "/")
+	}
+	return route
+}
+
+// OpenAPI returns the OpenAPI document of the router it is mounted on.
+func (app *application) OpenAPI(w http.ResponseWriter, r *http.Request) {
+	doc, _ := buildOpenAPI(chi.RouteContext(r.Context()).Routes)
+
+	w.Header().Set("Cache-Control", "no-cache")
+	render.JSON(w, r, doc)
+}
+
+// OpenAPIViewer shows the OpenAPI document in a browser.
+func (app *application) OpenAPIViewer(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(openAPIViewer)
+}
+
+func (app *application) handleRoutesFileGeneration(r *chi.Mux) {
+	// Setting ROUTES=true prints the OpenAPI document of the router
+	// and any undocumented routes on startup.
+	if app.generateRoutesDoc {
+		doc, undocumented := buildOpenAPI(r)
+		for _, route := range undocumented {
+			app.logger.Warn("route is missing from the OpenAPI document", "route", route)
+		}
+
+		spec, err := json.MarshalIndent(doc, "", "  ")
+		if err != nil {
+			app.logger.Error("encoding the OpenAPI document failed", "error", err)
+			return
+		}
+		fmt.Println(string(spec))
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/go-chi/chi/v5"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/openapi"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestOpenAPIMatchesRoutes(t *testing.T) {
+	//given
+	app := newTestApplication(t)
+	app.simpleAddEnabled = true // document optional routes as well
+
+	//when
+	doc, undocumented := buildOpenAPI(app.routes().(chi.Routes))
+
+	//then
+	for _, route := range undocumented {
+		t.Errorf("route %s is missing from apiOperations", route)
+	}
+
+	for key := range apiOperations(openapi.NewDocument("", "", "")) {
+		method, path, _ := strings.Cut(key, " ")
+
+		item, ok := doc.Paths[path]
+		if !ok || (*item)[strings.ToLower(method)] == nil {
+			t.Errorf("apiOperations describes %s, which isn't routed", key)
+		}
+	}
+}
+
+func TestOpenAPIEndpoint(t *testing.T) {
+	//given
+	app := newTestApplication(t)
+
+	ts := httptest.NewServer(app.routes())
+	defer ts.Close()
+
+	//when
+	rs, err := ts.Client().Do(newGetRequest(t, ts.URL+"/openapi.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//then
+	if rs.StatusCode != http.StatusOK {
+		t.Fatalf("want %d; got %d", http.StatusOK, rs.StatusCode)
+	}
+
+	var doc openapi.Document
+	err = json.NewDecoder(rs.Body).Decode(&doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if doc.OpenAPI != openapi.Version {
+		t.Errorf("want openapi %s, got %q", openapi.Version, doc.OpenAPI)
+	}
+	for _, name := range []string{"RecordRequest", "RecordResponse", "ErrResponse"} {
+		if doc.Components.Schemas[name] == nil {
+			t.Errorf("want schema %s in components", name)
+		}
+	}
+	if _, ok := doc.Paths["/records/{RecordID}"]; !ok {
+		t.Errorf("want /records/{RecordID} documented, got paths %v", doc.Paths)
+	}
+}
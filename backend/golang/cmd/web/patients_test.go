@@ -0,0 +1,319 @@
+package main
+
+import (
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/policy"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/services"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// createUser signs up a user named name with the account of the admin, by
+// default only admins may.
+func createUser(t *testing.T, app *application, handler http.Handler, name string) *CreatedUserResponse {
+	admin := createAdmin(t, app, testAdminToken)
+	user := &CreatedUserResponse{}
+	serveJSON(t, handler, authorized(newRequest(t, http.MethodPost, "/users", `{"name": "`+name+`"}`), admin),
+		http.StatusCreated, user)
+	return user
+}
+
+func authorized(r *http.Request, user *CreatedUserResponse) *http.Request {
+	r.Header.Set("Authorization", "Bearer "+user.Token)
+	return r
+}
+
+// createPatient creates a patient owned by owner, the other users are
+// granted the roles of the map.
+func createPatient(t *testing.T, handler http.Handler, owner *CreatedUserResponse, roles map[*CreatedUserResponse]string) *PatientResponse {
+	patient := &PatientResponse{}
+	serveJSON(t, handler, authorized(newRequest(t, http.MethodPost, "/patients", `{"name": "Mia"}`), owner),
+		http.StatusCreated, patient)
+
+	for user, role := range roles {
+		serveJSON(t, handler, authorized(newRequest(t, http.MethodPut,
+			"/patients/"+patient.ID+"/members/"+user.ID, `{"role": "`+role+`"}`), owner), http.StatusOK, nil)
+	}
+	return patient
+}
+
+func TestPatientRecords(t *testing.T) {
+	//given
+	app := newTestApplication(t)
+	handler := app.routes()
+	admin := createAdmin(t, app, testAdminToken)
+	parent := createUser(t, app, handler, "Parent")
+	patient := createPatient(t, handler, parent, nil)
+	sibling := createPatient(t, handler, parent, nil)
+	records := "/patients/" + patient.ID + "/records"
+
+	//when
+	created := &RecordResponse{}
+	serveJSON(t, handler, authorized(newRequest(t, http.MethodPost, records,
+		`{"value": 310, "patient_id": "`+sibling.ID+`"}`), parent), http.StatusCreated, created)
+
+	var patientRecords, siblingRecords, defaultRecords []*RecordResponse
+	serveJSON(t, handler, authorized(newGetRequest(t, records), parent), http.StatusOK, &patientRecords)
+	serveJSON(t, handler, authorized(newGetRequest(t, "/patients/"+sibling.ID+"/records"), parent),
+		http.StatusOK, &siblingRecords)
+	serveJSON(t, handler, authorized(newGetRequest(t, "/records"), admin), http.StatusOK, &defaultRecords)
+
+	//then
+	if created.PatientID != patient.ID {
+		t.Errorf("want the record of patient %s, got %s", patient.ID, created.PatientID)
+	}
+	if len(patientRecords) != 1 || patientRecords[0].ID != created.ID {
+		t.Errorf("want only the created record, got %d records", len(patientRecords))
+	}
+	if len(siblingRecords) != 0 {
+		t.Errorf("want no records of the sibling, got %d", len(siblingRecords))
+	}
+	for _, record := range defaultRecords {
+		if record.ID == created.ID {
+			t.Errorf("want the record of the patient kept from /records")
+		}
+	}
+
+	serveJSON(t, handler, authorized(newGetRequest(t, records+"/"+created.ID), parent), http.StatusOK, nil)
+	serveJSON(t, handler, authorized(newGetRequest(t, records+"/0"), parent), http.StatusNotFound, nil)
+	serveJSON(t, handler, authorized(newGetRequest(t, "/records/"+created.ID), admin), http.StatusNotFound, nil)
+	serveJSON(t, handler, authorized(newRequest(t, http.MethodDelete,
+		"/patients/"+sibling.ID+"/records/"+created.ID, ""), parent), http.StatusNotFound, nil)
+}
+
+func TestPatientActionPlans(t *testing.T) {
+	//given
+	app := newTestApplication(t)
+	handler := app.routes()
+	admin := createAdmin(t, app, testAdminToken)
+	parent := createUser(t, app, handler, "Parent")
+	patient := createPatient(t, handler, parent, nil)
+	sibling := createPatient(t, handler, parent, nil)
+	prefix := "/patients/" + patient.ID
+
+	//when
+	plan := &ActionPlanResponse{}
+	serveJSON(t, handler, authorized(newRequest(t, http.MethodPost, prefix+"/action-plans", planBody(30, 0)), parent),
+		http.StatusCreated, plan)
+	medication := &MedicationResponse{}
+	serveJSON(t, handler, authorized(newRequest(t, http.MethodPost, prefix+"/medications",
+		`{"name": "Salbutamol", "type": "reliever", "puffs_per_dose": 2, "capacity": 200, "reorder_below": 20}`), parent),
+		http.StatusCreated, medication)
+
+	body := `{"value": 400, "created_at": "` + time.Now().AddDate(0, 0, -1).UTC().Format(time.RFC3339) + `"}`
+	record, siblingRecord := &RecordResponse{}, &RecordResponse{}
+	serveJSON(t, handler, authorized(newRequest(t, http.MethodPost, prefix+"/records", body), parent),
+		http.StatusCreated, record)
+	serveJSON(t, handler, authorized(newRequest(t, http.MethodPost, "/patients/"+sibling.ID+"/records", body), parent),
+		http.StatusCreated, siblingRecord)
+
+	var siblingPlans, defaultPlans []*ActionPlanResponse
+	serveJSON(t, handler, authorized(newGetRequest(t, "/patients/"+sibling.ID+"/action-plans"), parent),
+		http.StatusOK, &siblingPlans)
+	serveJSON(t, handler, authorized(newGetRequest(t, "/action-plans"), admin), http.StatusOK, &defaultPlans)
+	var siblingMedications, defaultMedications []*MedicationResponse
+	serveJSON(t, handler, authorized(newGetRequest(t, "/patients/"+sibling.ID+"/medications"), parent),
+		http.StatusOK, &siblingMedications)
+	serveJSON(t, handler, authorized(newGetRequest(t, "/medications"), admin), http.StatusOK, &defaultMedications)
+
+	//then
+	if plan.PatientID != patient.ID || medication.PatientID != patient.ID {
+		t.Errorf("want the plan and medication of patient %s, got %q and %q", patient.ID, plan.PatientID, medication.PatientID)
+	}
+	if record.ZoneAdvice == nil || record.Zone != services.ZoneYellow || record.PlanID != plan.ID {
+		t.Errorf("want the record in the yellow zone of the plan of the patient, got %+v", record.ZoneAdvice)
+	}
+	if siblingRecord.ZoneAdvice != nil && siblingRecord.PlanID != "" {
+		t.Errorf("want the record of the sibling without the plan, got %+v", siblingRecord.ZoneAdvice)
+	}
+	if len(siblingPlans) != 0 || len(defaultPlans) != 0 {
+		t.Errorf("want no plans of others, got %d of the sibling and %d by default", len(siblingPlans), len(defaultPlans))
+	}
+	if len(siblingMedications) != 0 || len(defaultMedications) != 0 {
+		t.Errorf("want no medications of others, got %d of the sibling and %d by default",
+			len(siblingMedications), len(defaultMedications))
+	}
+
+	serveJSON(t, handler, authorized(newGetRequest(t, prefix+"/action-plans/"+plan.ID), parent), http.StatusOK, nil)
+	serveJSON(t, handler, authorized(newGetRequest(t, "/patients/"+sibling.ID+"/action-plans/"+plan.ID), parent),
+		http.StatusNotFound, nil)
+	serveJSON(t, handler, authorized(newGetRequest(t, "/action-plans/"+plan.ID), admin), http.StatusNotFound, nil)
+	serveJSON(t, handler, authorized(newRequest(t, http.MethodPost,
+		"/patients/"+sibling.ID+"/medications/"+medication.ID+"/doses", ""), parent), http.StatusNotFound, nil)
+	serveJSON(t, handler, authorized(newRequest(t, http.MethodDelete, "/medications/"+medication.ID, ""), admin),
+		http.StatusNotFound, nil)
+}
+
+func TestPatientRoles(t *testing.T) {
+	//given
+	app := newTestApplication(t)
+	handler := app.routes()
+	owner := createUser(t, app, handler, "Owner")
+	caregiver := createUser(t, app, handler, "Caregiver")
+	viewer := createUser(t, app, handler, "Viewer")
+	stranger := createUser(t, app, handler, "Stranger")
+	patient := createPatient(t, handler, owner, map[*CreatedUserResponse]string{
+		caregiver: models.RoleCaregiver,
+		viewer:    models.RoleViewer,
+	})
+	prefix := "/patients/" + patient.ID
+	record := &RecordResponse{}
+	serveJSON(t, handler, authorized(newRequest(t, http.MethodPost, prefix+"/records", `{"value": 300}`), owner),
+		http.StatusCreated, record)
+
+	tests := []struct {
+		method, path, body                 string
+		owner, caregiver, viewer, stranger int
+	}{
+		{http.MethodGet, "", "", 200, 200, 200, 404},
+		{http.MethodPut, "", `{"name": "Mia"}`, 200, 403, 403, 404},
+		{http.MethodGet, "/members", "", 200, 403, 403, 404},
+		{http.MethodGet, "/records", "", 200, 200, 200, 404},
+		{http.MethodGet, "/records/stats/trend", "", 200, 200, 200, 404},
+		{http.MethodGet, "/records/" + record.ID, "", 200, 200, 200, 404},
+		{http.MethodGet, "/records/" + record.ID + "/history", "", 200, 200, 200, 404},
+		{http.MethodPost, "/records", `{"value": 320}`, 201, 201, 403, 404},
+		{http.MethodPost, "/records/batch", `{"operations": [{"op": "create", "record": {"value": 340}}]}`, 200, 200, 403, 404},
+		{http.MethodPut, "/records/" + record.ID, `{"value": 330}`, 200, 200, 403, 404},
+		{http.MethodGet, "/records/quick-links", "", 200, 200, 403, 404},
+		{http.MethodPost, "/records/quick-links", `{}`, 201, 201, 403, 404},
+		{http.MethodGet, "/action-plans", "", 200, 200, 200, 404},
+		{http.MethodPost, "/action-plans", planBody(30, 0), 201, 201, 403, 404},
+		{http.MethodGet, "/medications", "", 200, 200, 200, 404},
+		{http.MethodPost, "/medications", `{"name": "Salbutamol", "type": "reliever", "puffs_per_dose": 2, "capacity": 200}`,
+			201, 201, 403, 404},
+	}
+
+	for _, tt := range tests {
+		for user, want := range map[*CreatedUserResponse]int{
+			owner: tt.owner, caregiver: tt.caregiver, viewer: tt.viewer, stranger: tt.stranger,
+		} {
+			t.Run(tt.method+" "+tt.path+" as "+user.Name, func(t *testing.T) {
+				//when
+				r := authorized(newRequest(t, tt.method, prefix+tt.path, tt.body), user)
+
+				//then
+				serveJSON(t, handler, r, want, nil)
+			})
+		}
+	}
+
+	var patients []*PatientResponse
+	serveJSON(t, handler, authorized(newGetRequest(t, "/patients"), viewer), http.StatusOK, &patients)
+	if len(patients) != 1 || patients[0].ID != patient.ID || patients[0].Role != models.RoleViewer {
+		t.Errorf("want the patient the viewer has access to, got %+v", patients)
+	}
+	serveJSON(t, handler, authorized(newGetRequest(t, "/patients"), stranger), http.StatusOK, &patients)
+	if len(patients) != 0 {
+		t.Errorf("want no patients of a stranger, got %d", len(patients))
+	}
+}
+
+func TestPatientQuickLink(t *testing.T) {
+	//given
+	app := newTestApplication(t)
+	handler := app.routes()
+	admin := createAdmin(t, app, testAdminToken)
+	owner := createUser(t, app, handler, "Owner")
+	caregiver := createUser(t, app, handler, "Caregiver")
+	patient := createPatient(t, handler, owner, map[*CreatedUserResponse]string{caregiver: models.RoleCaregiver})
+	prefix := "/patients/" + patient.ID
+
+	link := &QuickLinkResponse{}
+	serveJSON(t, handler, authorized(newRequest(t, http.MethodPost, prefix+"/records/quick-links",
+		`{"context": "evening"}`), caregiver), http.StatusCreated, link)
+	path := "/records/quick/" + link.Token
+
+	//when
+	created := &RecordResponse{}
+	serveJSON(t, handler, newQuickRequest(t, path, "410"), http.StatusCreated, created)
+
+	//then
+	if link.PatientID != patient.ID || link.IssuerID != caregiver.ID {
+		t.Errorf("want the link bound to the patient and the caregiver, got %+v", link.QuickLink)
+	}
+	if created.PatientID != patient.ID || created.Context != "evening" {
+		t.Errorf("want the record of the patient with the link context, got %+v", created.Record)
+	}
+	serveJSON(t, handler, authorized(newRequest(t, http.MethodDelete, "/records/quick-links/"+link.ID, ""), admin),
+		http.StatusNotFound, nil)
+
+	//when
+	serveJSON(t, handler, authorized(newRequest(t, http.MethodPut,
+		prefix+"/members/"+caregiver.ID, `{"role": "`+models.RoleViewer+`"}`), owner), http.StatusOK, nil)
+
+	//then
+	serveJSON(t, handler, newGetRequest(t, path), http.StatusGone, nil)
+	serveJSON(t, handler, newQuickRequest(t, path, "420"), http.StatusGone, nil)
+}
+
+func TestPatientAuthentication(t *testing.T) {
+	//given
+	app := newTestApplication(t)
+	handler := app.routes()
+	user := createUser(t, app, handler, "Parent")
+	invalid := &CreatedUserResponse{Token: "invalid"}
+
+	//when
+	me := &UserResponse{}
+	serveJSON(t, handler, authorized(newGetRequest(t, "/users/me"), user), http.StatusOK, me)
+
+	//then
+	if me.ID != user.ID || me.Name != "Parent" {
+		t.Errorf("want the user of the token, got %+v", me.User)
+	}
+	for _, r := range []*http.Request{
+		newGetRequest(t, "/patients"),
+		authorized(newGetRequest(t, "/patients"), invalid),
+		authorized(newGetRequest(t, "/users/me"), invalid),
+	} {
+		serveJSON(t, handler, r, http.StatusUnauthorized, nil)
+	}
+}
+
+func TestPatientWithoutUser(t *testing.T) {
+	//given
+	app := newTestApplication(t)
+	// a policy letting anonymous callers reach the patient routes
+	app.policy = policy.New(map[policy.Role][]policy.Permission{policy.RoleAnonymous: {policy.Patients}})
+	handler := app.routes()
+
+	//when
+	r := newGetRequest(t, "/patients/unknown/records")
+
+	//then
+	serveJSON(t, handler, r, http.StatusUnauthorized, nil)
+}
+
+func TestPatientMembers(t *testing.T) {
+	//given
+	app := newTestApplication(t)
+	handler := app.routes()
+	owner := createUser(t, app, handler, "Owner")
+	other := createUser(t, app, handler, "Other")
+	patient := createPatient(t, handler, owner, nil)
+	members := "/patients/" + patient.ID + "/members/"
+
+	//when
+	serveJSON(t, handler, authorized(newRequest(t, http.MethodPut, members+owner.ID, `{"role": "viewer"}`), owner),
+		http.StatusConflict, nil)
+	serveJSON(t, handler, authorized(newRequest(t, http.MethodDelete, members+owner.ID, ""), owner),
+		http.StatusConflict, nil)
+	serveJSON(t, handler, authorized(newRequest(t, http.MethodPut, members+"unknown", `{"role": "viewer"}`), owner),
+		http.StatusNotFound, nil)
+	serveJSON(t, handler, authorized(newRequest(t, http.MethodPut, members+other.ID, `{"role": "doctor"}`), owner),
+		http.StatusBadRequest, nil)
+	serveJSON(t, handler, authorized(newRequest(t, http.MethodPut, members+other.ID, `{"role": "owner"}`), owner),
+		http.StatusOK, nil)
+	serveJSON(t, handler, authorized(newRequest(t, http.MethodDelete, members+owner.ID, ""), other),
+		http.StatusOK, nil)
+
+	//then
+	var memberships []*MembershipResponse
+	serveJSON(t, handler, authorized(newGetRequest(t, members), other), http.StatusOK, &memberships)
+	if len(memberships) != 1 || memberships[0].UserID != other.ID || memberships[0].Role != models.RoleOwner {
+		t.Errorf("want the other user as the only owner, got %d memberships", len(memberships))
+	}
+	serveJSON(t, handler, authorized(newGetRequest(t, "/patients/"+patient.ID), owner), http.StatusNotFound, nil)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"github.com/go-chi/chi/v5"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/policy"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// routePermissions is the permission every route requires, "" for the
+// public ones. Routes missing here fail TestPolicyRoutes.
+var routePermissions = map[string]policy.Permission{
+	"/records":                                                        policy.Household,
+	"/records/batch":                                                  policy.Household,
+	"/records/stats/trend":                                            policy.Household,
+	"/records/stats/correlation":                                      policy.Household,
+	"/records/aggregate":                                              policy.Household,
+	"/records/quick":                                                  policy.Household,
+	"/records/quick-links":                                            policy.Household,
+	"/records/quick-links/{QuickLinkID}":                              policy.Household,
+	"/records/quick/{QuickLinkToken}":                                 "",
+	"/records/{RecordID}":                                             policy.Household,
+	"/records/{RecordID}/history":                                     policy.Household,
+	"/records/{RecordID}/context":                                     policy.Household,
+	"/records/{RecordID}/revert/{Rev}":                                policy.Household,
+	"/action-plans":                                                   policy.Household,
+	"/action-plans/active":                                            policy.Household,
+	"/action-plans/{ActionPlanID}":                                    policy.Household,
+	"/action-plans/{ActionPlanID}/versions":                           policy.Household,
+	"/medications":                                                    policy.Household,
+	"/medications/{MedicationID}":                                     policy.Household,
+	"/medications/{MedicationID}/refill":                              policy.Household,
+	"/medications/{MedicationID}/doses":                               policy.Household,
+	"/medications/{MedicationID}/doses/{DoseID}":                      policy.Household,
+	"/reports/adherence":                                              policy.Household,
+	"/shares":                                                         policy.Household,
+	"/shares/{ShareID}":                                               policy.Household,
+	"/shares/{ShareID}/accesses":                                      policy.Household,
+	"/shared/{ShareToken}/records":                                    "",
+	"/shared/{ShareToken}/records/stats/trend":                        "",
+	"/shared/{ShareToken}/records/stats/correlation":                  "",
+	"/shared/{ShareToken}/records/aggregate":                          "",
+	"/shared/{ShareToken}/records/{RecordID}":                         "",
+	"/shared/{ShareToken}/records/{RecordID}/history":                 "",
+	"/shared/{ShareToken}/records/{RecordID}/context":                 "",
+	"/shared/{ShareToken}/reports/adherence":                          "",
+	"/users":                                                          policy.SignUp,
+	"/users/me":                                                       policy.Account,
+	"/patients":                                                       policy.Patients,
+	"/patients/{PatientID}":                                           policy.Patients,
+	"/patients/{PatientID}/members":                                   policy.Patients,
+	"/patients/{PatientID}/members/{UserID}":                          policy.Patients,
+	"/patients/{PatientID}/records":                                   policy.Patients,
+	"/patients/{PatientID}/records/batch":                             policy.Patients,
+	"/patients/{PatientID}/records/quick-links":                       policy.Patients,
+	"/patients/{PatientID}/records/quick-links/{QuickLinkID}":         policy.Patients,
+	"/patients/{PatientID}/records/stats/trend":                       policy.Patients,
+	"/patients/{PatientID}/records/stats/correlation":                 policy.Patients,
+	"/patients/{PatientID}/records/aggregate":                         policy.Patients,
+	"/patients/{PatientID}/records/{RecordID}":                        policy.Patients,
+	"/patients/{PatientID}/records/{RecordID}/history":                policy.Patients,
+	"/patients/{PatientID}/records/{RecordID}/revert/{Rev}":           policy.Patients,
+	"/patients/{PatientID}/action-plans":                              policy.Patients,
+	"/patients/{PatientID}/action-plans/active":                       policy.Patients,
+	"/patients/{PatientID}/action-plans/{ActionPlanID}":               policy.Patients,
+	"/patients/{PatientID}/action-plans/{ActionPlanID}/versions":      policy.Patients,
+	"/patients/{PatientID}/medications":                               policy.Patients,
+	"/patients/{PatientID}/medications/{MedicationID}":                policy.Patients,
+	"/patients/{PatientID}/medications/{MedicationID}/refill":         policy.Patients,
+	"/patients/{PatientID}/medications/{MedicationID}/doses":          policy.Patients,
+	"/patients/{PatientID}/medications/{MedicationID}/doses/{DoseID}": policy.Patients,
+	"/admin/stats":                                                    policy.Admin,
+	"/admin/users":                                                    policy.Admin,
+	"/admin/users/{UserID}":                                           policy.Admin,
+	"/admin/users/{UserID}/token":                                     policy.Admin,
+	"/admin/users/{UserID}/disable":                                   policy.Admin,
+	"/admin/users/{UserID}/enable":                                    policy.Admin,
+	"/sync":                                                           policy.Household,
+	"/healthz":                                                        "",
+	"/readyz":                                                         "",
+	"/metrics":                                                        policy.Admin,
+	"/openapi":                                                        "",
+	"/docs":                                                           "",
+	"/login":                                                          "",
+	"/logout":                                                         "",
+	"/":                                                               policy.Household,
+	"/dashboard/records":                                              policy.Household,
+	"/dashboard/records/{RecordID}":                                   policy.Household,
+	"/dashboard/records/{RecordID}/delete":                            policy.Household,
+	"/*":                                                              "",
+	"/static/*":                                                       "",
+}
+
+var routeParam = regexp.MustCompile(`\{[^}]+\}`)
+
+func TestPolicyRoutes(t *testing.T) {
+	for _, open := range []bool{true, false} {
+		//given
+		app := newTestApplication(t)
+		app.policy = policy.Default(open)
+		handler := app.routes()
+
+		user, userToken, err := app.userService.Create(context.Background(), "User")
+		if err != nil {
+			t.Fatal(err)
+		}
+		adminToken := testAdminToken
+		if _, err := app.userService.EnsureAdmin(context.Background(), adminToken); err != nil {
+			t.Fatal(err)
+		}
+		tokens := map[policy.Role]string{policy.RoleUser: userToken, policy.RoleAdmin: adminToken}
+
+		var routes []string
+		chi.Walk(handler.(chi.Routes), func(method, route string, _ http.Handler, _ ...func(http.Handler) http.Handler) error {
+			routes = append(routes, method+" "+normalizeRoute(route))
+			return nil
+		})
+
+		for _, route := range routes {
+			method, pattern, _ := strings.Cut(route, " ")
+			permission, ok := routePermissions[pattern]
+			if !ok {
+				t.Errorf("route %s is missing from routePermissions", route)
+				continue
+			}
+			path := strings.ReplaceAll(routeParam.ReplaceAllString(pattern, "unknown"), "*", "unknown.js")
+
+			for _, role := range policy.Roles {
+				allowed := permission == "" || app.policy.Allows(role, permission)
+				name := route + " as " + string(role)
+				if !open {
+					name += " closed"
+				}
+
+				t.Run(name, func(t *testing.T) {
+					//when
+					r := newRequest(t, method, path, "")
+					if tokens[role] != "" {
+						r.Header.Set("Authorization", "Bearer "+tokens[role])
+					}
+					rr := httptest.NewRecorder()
+					handler.ServeHTTP(rr, r)
+
+					//then
+					denied := strings.Contains(rr.Body.String(), policy.ErrDenied.Error())
+					page := undocumentedRoutes[pattern] && permission != ""
+					switch {
+					case page && allowed && (rr.Code == http.StatusSeeOther && rr.Header().Get("Location") == "/login"):
+						t.Errorf("want %s allowed, got sent to log in", permission)
+					case page && !allowed && role == policy.RoleAnonymous &&
+						(rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/login"):
+						t.Errorf("want sent to log in without %s, got %d: %s", permission, rr.Code, rr.Body)
+					case page && !allowed && role != policy.RoleAnonymous && rr.Code != http.StatusForbidden:
+						t.Errorf("want 403 without %s, got %d: %s", permission, rr.Code, rr.Body)
+					case page:
+					case allowed && (denied || rr.Code == http.StatusUnauthorized):
+						t.Errorf("want %s allowed, got %d: %s", permission, rr.Code, rr.Body)
+					case !allowed && role == policy.RoleAnonymous && (!denied || rr.Code != http.StatusUnauthorized):
+						t.Errorf("want 401 without %s, got %d: %s", permission, rr.Code, rr.Body)
+					case !allowed && role != policy.RoleAnonymous && (!denied || rr.Code != http.StatusForbidden):
+						t.Errorf("want 403 without %s, got %d: %s", permission, rr.Code, rr.Body)
+					}
+				})
+			}
+		}
+
+		for pattern := range routePermissions {
+			found := false
+			for _, route := range routes {
+				found = found || strings.HasSuffix(route, " "+pattern)
+			}
+			if !found {
+				t.Errorf("routePermissions has %s, which isn't routed", pattern)
+			}
+		}
+		if user.Role != string(policy.RoleUser) {
+			t.Errorf("want new accounts to be users, got %q", user.Role)
+		}
+	}
+}
@@ -1,104 +1,339 @@
 package main
 
 import (
-	"fmt"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/cors"
-	"github.com/go-chi/docgen"
 	"github.com/go-chi/render"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/config"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/origin"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/policy"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/tracing"
 	"net/http"
-	"strings"
 )
 
 func (app *application) routes() http.Handler {
 	r := chi.NewRouter()
 
 	r.Use(middleware.RequestID)
-	r.Use(middleware.Logger)
+	r.Use(tracing.Middleware(app.tracerProvider))
+	r.Use(app.metrics.Middleware)
+	r.Use(app.RequestLogger)
 	r.Use(middleware.Recoverer)
 	r.Use(middleware.URLFormat)
 	r.Use(render.SetContentType(render.ContentTypeJSON))
-	handleCors(r)
+	handleCors(r, app.cors)
+	r.Use(app.Identify)
 
 	// RESTy routes for "Records" resource
 	r.Route("/records", func(r chi.Router) {
-		r.Get("/", app.ListRecords)
+		// Signed quick-add links carry a token of their own
+		r.Route("/quick/{QuickLinkToken}", func(r chi.Router) {
+			r.Use(app.QuickLinkCtx)
+			r.Get("/", app.QuickLinkForm)
+			r.With(app.Idempotent).Post("/", app.QuickLinkCreateRecord)
+		})
+
+		r.Group(func(r chi.Router) {
+			r.Use(app.Require(policy.Household))
+			r.Get("/", app.ListRecords)
+
+			r.With(app.Idempotent).Post("/", app.CreateRecord) // POST /Records
+
+			r.Post("/batch", app.BatchRecords) // POST /Records/batch
+
+			r.Get("/stats/trend", app.RecordsTrend)             // GET /Records/stats/trend
+			r.Get("/stats/correlation", app.RecordsCorrelation) // GET /Records/stats/correlation
+			r.Get("/aggregate", app.AggregateRecords)           // GET /Records/aggregate?bucket=week&tz=Europe/Berlin
+
+			r.With(app.Idempotent).Post("/quick", app.QuickCreateRecord) // POST /Records/quick
+
+			r.Route("/quick-links", func(r chi.Router) {
+				r.Get("/", app.ListQuickLinks)                                           // GET /Records/quick-links
+				r.Post("/", app.CreateQuickLink)                                         // POST /Records/quick-links
+				r.With(app.QuickLinkIDCtx).Delete("/{QuickLinkID}", app.RevokeQuickLink) // DELETE /Records/quick-links/123
+			})
+
+			// Legacy shortcut, disabled by default since it changes state on GET
+			if app.simpleAddEnabled {
+				r.Route("/simple-add/{NewRecordValue}", func(r chi.Router) {
+					r.Use(app.RecordNewValueCtx)
+					r.Use(app.Idempotent)
+					r.Get("/", app.SimpleCreateRecord)
+				})
+			}
 
-		r.Post("/", app.CreateRecord) // POST /Records
+			r.Route("/{RecordID}", func(r chi.Router) {
+				r.Use(app.RecordCtx)            // Load the *Record on the request context
+				r.Get("/", app.GetRecord)       // GET /Records/123
+				r.Put("/", app.UpdateRecord)    // PUT /Records/123
+				r.Delete("/", app.DeleteRecord) // DELETE /Records/123
 
-		r.Route("/simple-add/{NewRecordValue}", func(r chi.Router) {
-			r.Use(app.RecordNewValueCtx)
-			r.Get("/", app.SimpleCreateRecord)
+				r.Get("/history", app.ListRecordHistory) // GET /Records/123/history
+				r.Get("/context", app.RecordContext)     // GET /Records/123/context?before=6h&after=2h
+				r.With(app.RevisionCtx).
+					Post("/revert/{Rev}", app.RevertRecord) // POST /Records/123/revert/2
+			})
 		})
+	})
+
+	// Asthma action plans of the doctor, every change is a new version
+	r.Route("/action-plans", func(r chi.Router) {
+		r.Use(app.Require(policy.Household))
+		r.Get("/", app.ListActionPlans)        // GET /action-plans
+		r.Post("/", app.CreateActionPlan)      // POST /action-plans
+		r.Get("/active", app.ActiveActionPlan) // GET /action-plans/active?at=2024-03-01T08:00:00Z
 
-		r.Route("/{RecordID}", func(r chi.Router) {
-			r.Use(app.RecordCtx)            // Load the *Record on the request context
-			r.Get("/", app.GetRecord)       // GET /Records/123
-			r.Put("/", app.UpdateRecord)    // PUT /Records/123
-			r.Delete("/", app.DeleteRecord) // DELETE /Records/123
+		r.Route("/{ActionPlanID}", func(r chi.Router) {
+			r.Use(app.ActionPlanCtx)
+			r.Get("/", app.GetActionPlan)                  // GET /action-plans/123
+			r.Put("/", app.UpdateActionPlan)               // PUT /action-plans/123
+			r.Delete("/", app.DeleteActionPlan)            // DELETE /action-plans/123
+			r.Get("/versions", app.ListActionPlanVersions) // GET /action-plans/123/versions
 		})
 	})
 
-	fileServer := http.FileServer(http.Dir("./ui/static/"))
-	r.Handle("/", handleMimeType(app, fileServer))
-	r.Handle("/static/", http.StripPrefix("/static", handleMimeType(app, fileServer)))
+	// Inhalers in use and the doses taken
+	r.Route("/medications", func(r chi.Router) {
+		r.Use(app.Require(policy.Household))
+		r.Get("/", app.ListMedications)   // GET /medications
+		r.Post("/", app.CreateMedication) // POST /medications
 
-	app.handleRoutesFileGeneration(r)
+		r.Route("/{MedicationID}", func(r chi.Router) {
+			r.Use(app.MedicationCtx)
+			r.Get("/", app.GetMedication)               // GET /medications/123
+			r.Put("/", app.UpdateMedication)            // PUT /medications/123
+			r.Delete("/", app.DeleteMedication)         // DELETE /medications/123
+			r.Post("/refill", app.RefillMedication)     // POST /medications/123/refill
+			r.Get("/doses", app.ListDoses)              // GET /medications/123/doses?from=2024-03-01T00:00:00Z
+			r.Post("/doses", app.LogDose)               // POST /medications/123/doses
+			r.Delete("/doses/{DoseID}", app.DeleteDose) // DELETE /medications/123/doses/456
+		})
+	})
 
-	return r
-}
+	// Reports for reviews with the doctor
+	r.Route("/reports", func(r chi.Router) {
+		r.Use(app.Require(policy.Household))
+		r.Get("/adherence", app.AdherenceReport) // GET /reports/adherence?weeks=13&tz=Europe/Berlin
+	})
 
-func handleMimeType(app *application, next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		/*if strings.HasSuffix(r.URL.Path, "/") {
-			http.NotFound(w, r)
-			return
-		}*/
-
-		path := r.URL.Path
-
-		app.infoLog.Println("fileserver path:", path)
-
-		var contentType string
-		if strings.HasSuffix(path, ".css") {
-			contentType = "text/css"
-		} else if strings.HasSuffix(path, ".js") {
-			contentType = "text/javascript"
-		} else if strings.HasSuffix(path, ".html") {
-			contentType = "text/html"
-		} else {
-			contentType = "text/html"
-		}
+	// Read-only links for others, like a doctor, to a date range
+	r.Route("/shares", func(r chi.Router) {
+		r.Use(app.Require(policy.Household))
+		r.Get("/", app.ListShares)   // GET /shares
+		r.Post("/", app.CreateShare) // POST /shares
+
+		r.Route("/{ShareID}", func(r chi.Router) {
+			r.Use(app.ShareCtx)
+			r.Get("/", app.GetShare)                  // GET /shares/123
+			r.Delete("/", app.RevokeShare)            // DELETE /shares/123
+			r.Get("/accesses", app.ListShareAccesses) // GET /shares/123/accesses
+		})
+	})
 
-		w.Header().Add("Content-Type", contentType)
+	// Views of a share link, only GET routes through the same handlers,
+	// the models only see what the share covers
+	r.Route("/shared/{ShareToken}", func(r chi.Router) {
+		r.Use(app.SharedCtx)
+
+		r.Route("/records", func(r chi.Router) {
+			r.With(app.ShareAllows(models.ShareRecords)).Get("/", app.ListRecords) // GET /shared/token/records
+
+			r.Group(func(r chi.Router) {
+				r.Use(app.ShareAllows(models.ShareStats))
+				r.Get("/stats/trend", app.RecordsTrend)             // GET /shared/token/records/stats/trend
+				r.Get("/stats/correlation", app.RecordsCorrelation) // GET /shared/token/records/stats/correlation
+				r.Get("/aggregate", app.AggregateRecords)           // GET /shared/token/records/aggregate?bucket=week
+			})
+
+			r.Route("/{RecordID}", func(r chi.Router) {
+				r.Use(app.ShareAllows(models.ShareRecords))
+				r.Use(app.RecordCtx)
+				r.Get("/", app.GetRecord)                // GET /shared/token/records/123
+				r.Get("/history", app.ListRecordHistory) // GET /shared/token/records/123/history
+				r.Get("/context", app.RecordContext)     // GET /shared/token/records/123/context
+			})
+		})
 
-		next.ServeHTTP(w, r)
+		r.With(app.ShareAllows(models.ShareReports)).
+			Get("/reports/adherence", app.AdherenceReport) // GET /shared/token/reports/adherence
 	})
-}
 
-func handleCors(r *chi.Mux) {
-	corsSettings := cors.New(cors.Options{
-		AllowedOrigins:   []string{"*"},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
-		ExposedHeaders:   []string{"Link"},
-		AllowCredentials: true,
-		MaxAge:           300, // Maximum value not ignored by any of major browsers
+	// Accounts, authenticated by a bearer token
+	r.Route("/users", func(r chi.Router) {
+		r.With(app.Require(policy.SignUp)).Post("/", app.CreateUser)       // POST /users
+		r.With(app.Require(policy.Account)).Get("/me", app.GetCurrentUser) // GET /users/me
+	})
+
+	// Patients readings are taken of, like children, and the Records of
+	// each one, the RecordModel only sees the patient of the route
+	r.Route("/patients", func(r chi.Router) {
+		r.Use(app.Require(policy.Patients))
+		r.Get("/", app.ListPatients)   // GET /patients
+		r.Post("/", app.CreatePatient) // POST /patients
+
+		r.Route("/{PatientID}", func(r chi.Router) {
+			r.Use(app.PatientCtx)
+			caregiver := app.PatientRole(models.RoleCaregiver)
+
+			r.Get("/", app.GetPatient)                                            // GET /patients/123
+			r.With(app.PatientRole(models.RoleOwner)).Put("/", app.UpdatePatient) // PUT /patients/123
+
+			r.Route("/members", func(r chi.Router) {
+				r.Use(app.PatientRole(models.RoleOwner))
+				r.Get("/", app.ListMembers)             // GET /patients/123/members
+				r.Put("/{UserID}", app.SetMember)       // PUT /patients/123/members/456
+				r.Delete("/{UserID}", app.RemoveMember) // DELETE /patients/123/members/456
+			})
+
+			r.Route("/records", func(r chi.Router) {
+				r.Get("/", app.ListRecords)                                   // GET /patients/123/records
+				r.With(caregiver, app.Idempotent).Post("/", app.CreateRecord) // POST /patients/123/records
+				r.With(caregiver).Post("/batch", app.BatchRecords)            // POST /patients/123/records/batch
+
+				r.Route("/quick-links", func(r chi.Router) {
+					r.Use(caregiver)
+					r.Get("/", app.ListQuickLinks)                                           // GET /patients/123/records/quick-links
+					r.Post("/", app.CreateQuickLink)                                         // POST /patients/123/records/quick-links
+					r.With(app.QuickLinkIDCtx).Delete("/{QuickLinkID}", app.RevokeQuickLink) // DELETE /patients/123/records/quick-links/456
+				})
+
+				r.Get("/stats/trend", app.RecordsTrend)             // GET /patients/123/records/stats/trend
+				r.Get("/stats/correlation", app.RecordsCorrelation) // GET /patients/123/records/stats/correlation
+				r.Get("/aggregate", app.AggregateRecords)           // GET /patients/123/records/aggregate?bucket=week
+
+				r.Route("/{RecordID}", func(r chi.Router) {
+					r.Use(app.RecordCtx)
+					r.Get("/", app.GetRecord)                // GET /patients/123/records/456
+					r.Get("/history", app.ListRecordHistory) // GET /patients/123/records/456/history
+
+					r.Group(func(r chi.Router) {
+						r.Use(caregiver)
+						r.Put("/", app.UpdateRecord)    // PUT /patients/123/records/456
+						r.Delete("/", app.DeleteRecord) // DELETE /patients/123/records/456
+						r.With(app.RevisionCtx).
+							Post("/revert/{Rev}", app.RevertRecord) // POST /patients/123/records/456/revert/2
+					})
+				})
+			})
+
+			r.Route("/action-plans", func(r chi.Router) {
+				r.Get("/", app.ListActionPlans)                   // GET /patients/123/action-plans
+				r.With(caregiver).Post("/", app.CreateActionPlan) // POST /patients/123/action-plans
+				r.Get("/active", app.ActiveActionPlan)            // GET /patients/123/action-plans/active
+
+				r.Route("/{ActionPlanID}", func(r chi.Router) {
+					r.Use(app.ActionPlanCtx)
+					r.Get("/", app.GetActionPlan)                       // GET /patients/123/action-plans/456
+					r.With(caregiver).Put("/", app.UpdateActionPlan)    // PUT /patients/123/action-plans/456
+					r.With(caregiver).Delete("/", app.DeleteActionPlan) // DELETE /patients/123/action-plans/456
+					r.Get("/versions", app.ListActionPlanVersions)      // GET /patients/123/action-plans/456/versions
+				})
+			})
+
+			r.Route("/medications", func(r chi.Router) {
+				r.Get("/", app.ListMedications)                   // GET /patients/123/medications
+				r.With(caregiver).Post("/", app.CreateMedication) // POST /patients/123/medications
+
+				r.Route("/{MedicationID}", func(r chi.Router) {
+					r.Use(app.MedicationCtx)
+					r.Get("/", app.GetMedication)  // GET /patients/123/medications/456
+					r.Get("/doses", app.ListDoses) // GET /patients/123/medications/456/doses
+
+					r.Group(func(r chi.Router) {
+						r.Use(caregiver)
+						r.Put("/", app.UpdateMedication)            // PUT /patients/123/medications/456
+						r.Delete("/", app.DeleteMedication)         // DELETE /patients/123/medications/456
+						r.Post("/refill", app.RefillMedication)     // POST /patients/123/medications/456/refill
+						r.Post("/doses", app.LogDose)               // POST /patients/123/medications/456/doses
+						r.Delete("/doses/{DoseID}", app.DeleteDose) // DELETE /patients/123/medications/456/doses/789
+					})
+				})
+			})
+		})
+	})
+
+	// Accounts and stats of the whole server
+	r.Route("/admin", func(r chi.Router) {
+		r.Use(app.Require(policy.Admin))
+		r.Get("/stats", app.SystemStats) // GET /admin/stats
+
+		r.Route("/users", func(r chi.Router) {
+			r.Get("/", app.ListUsers) // GET /admin/users
+
+			r.Route("/{UserID}", func(r chi.Router) {
+				r.Use(app.UserCtx)
+				r.Get("/", app.GetUser)              // GET /admin/users/123
+				r.Post("/token", app.ResetUserToken) // POST /admin/users/123/token
+				r.Post("/disable", app.DisableUser)  // POST /admin/users/123/disable
+				r.Post("/enable", app.EnableUser)    // POST /admin/users/123/enable
+			})
+		})
 	})
 
-	r.Use(corsSettings.Handler)
+	// Offline-first sync of mobile clients
+	r.Route("/sync", func(r chi.Router) {
+		r.Use(app.Require(policy.Household))
+		r.Get("/", app.PullChanges)  // GET /sync?since=cursor
+		r.Post("/", app.PushChanges) // POST /sync
+	})
+
+	r.Get("/healthz", app.Healthz)
+	r.Get("/readyz", app.Readyz)
+	// the metrics include the latest reading, which is health data
+	r.With(app.Require(policy.Admin)).Method(http.MethodGet, "/metrics", app.metrics.Handler())
+
+	r.Get("/openapi", app.OpenAPI) // GET /openapi.json, URLFormat strips the extension
+	r.Get("/docs", app.OpenAPIViewer)
+
+	// Browsers log in to the pages with a session cookie
+	r.Group(func(r chi.Router) {
+		r.Use(app.CSRFProtect)
+		r.Get("/login", app.LoginForm)
+		r.Post("/login", app.Login)
+		r.Post("/logout", app.Logout)
+	})
+
+	r.Group(func(r chi.Router) {
+		r.Use(app.RequirePage(policy.Household))
+		r.Use(app.CSRFProtect)
+		r.Get("/", app.Dashboard)
+		r.Post("/dashboard/records", app.DashboardCreateRecord)
+		r.Post("/dashboard/records/{RecordID}", app.DashboardUpdateRecord)
+		r.Post("/dashboard/records/{RecordID}/delete", app.DashboardDeleteRecord)
+	})
+
+	r.Handle("/*", app.webUI) // URLFormat doesn't change the path of files
+	r.Handle("/static/*", http.StripPrefix("/static", app.webUI))
+
+	app.handleRoutesFileGeneration(r)
+
+	return r
 }
 
-func (app *application) handleRoutesFileGeneration(r *chi.Mux) {
-	// Passing -routes to the program will generate docs for the above
-	// router definition. See the `routes.json` file in this folder for
-	// the output.
-	if app.generateRoutesDoc {
-		// fmt.Println(docgen.JSONRoutesDoc(r))
-		fmt.Println(docgen.MarkdownRoutesDoc(r, docgen.MarkdownOpts{
-			ProjectPath: "github.com/romanthekat/simple-peak-flowmeter/backend/golang",
-			Intro:       "Simple peak flowmeter golang generated docs.",
-		}))
+// handleCors applies the configured CORS policy, the config is validated
+// already, so any origin is never allowed together with credentials.
+func handleCors(r *chi.Mux, policy config.CORS) {
+	options := cors.Options{
+		AllowedMethods:   policy.AllowedMethods,
+		AllowedHeaders:   policy.AllowedHeaders,
+		ExposedHeaders:   policy.ExposedHeaders,
+		AllowCredentials: policy.AllowCredentials,
+		MaxAge:           int(policy.MaxAge.Seconds()),
 	}
+
+	origins, err := origin.NewMatcher(policy.AllowedOrigins)
+	switch {
+	case err != nil:
+		options.AllowOriginFunc = func(r *http.Request, origin string) bool { return false }
+	case origins.AllowsAny():
+		options.AllowedOrigins = []string{origin.Any}
+	default:
+		options.AllowOriginFunc = func(r *http.Request, origin string) bool {
+			return origins.Allowed(origin)
+		}
+	}
+
+	r.Use(cors.New(options).Handler)
 }
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// createShare shares the fixture records 1 to 3 with resources.
+func createShare(t *testing.T, handler http.Handler, resources string) (*ShareResponse, string) {
+	now := time.Now()
+	body := `{"label": "Dr. Lung", "resources": ` + resources + `,
+		"from": "` + now.Add(-50*time.Hour).Format(time.RFC3339) + `",
+		"until": "` + now.Add(-22*time.Hour).Format(time.RFC3339) + `"}`
+
+	share := &ShareResponse{}
+	serveJSON(t, handler, newRequest(t, http.MethodPost, "/shares", body), http.StatusCreated, share)
+	_, path, found := strings.Cut(share.URL, "/shared/")
+	if !found {
+		t.Fatalf("want a share link, got %s", share.URL)
+	}
+	return share, "/shared/" + path
+}
+
+func TestShareLink(t *testing.T) {
+	//given
+	app := newOpenTestApplication(t)
+	handler := app.routes()
+	share, link := createShare(t, handler, `["stats", "records", "records"]`)
+
+	//when
+	var records []*RecordResponse
+	serveJSON(t, handler, newGetRequest(t, link+"/records"), http.StatusOK, &records)
+	record := &RecordResponse{}
+	serveJSON(t, handler, newGetRequest(t, link+"/records/2"), http.StatusOK, record)
+	serveJSON(t, handler, newGetRequest(t, link+"/records/4"), http.StatusNotFound, nil)
+	serveJSON(t, handler, newGetRequest(t, link+"/records/stats/trend"), http.StatusOK, nil)
+	aggregate := &AggregateResponse{}
+	serveJSON(t, handler, newGetRequest(t, link+"/records/aggregate?bucket=month"), http.StatusOK, aggregate)
+	serveJSON(t, handler, newGetRequest(t, link+"/reports/adherence"), http.StatusForbidden, nil)
+	serveJSON(t, handler, newRequest(t, http.MethodPost, link+"/records", `{"value": 300}`), http.StatusMethodNotAllowed, nil)
+	serveJSON(t, handler, newRequest(t, http.MethodDelete, link+"/records/2", ""), http.StatusMethodNotAllowed, nil)
+
+	//then
+	if strings.Join(share.Resources, ",") != "records,stats" || !share.Active || share.ExpiresAt.IsZero() {
+		t.Errorf("want an active share of records and stats, got %+v", share)
+	}
+	var ids []string
+	for _, record := range records {
+		ids = append(ids, record.ID)
+	}
+	if strings.Join(ids, ",") != "1,2,3" {
+		t.Errorf("want the records of the date range, got %v", ids)
+	}
+	if record.Value != 480 {
+		t.Errorf("want record 2, got %+v", record)
+	}
+	count := 0
+	for _, bucket := range aggregate.Buckets {
+		count += bucket.Count
+	}
+	if count != 3 {
+		t.Errorf("want the 3 shared records aggregated, got %d", count)
+	}
+	if _, err := app.records.Get(context.Background(), "2"); err != nil {
+		t.Errorf("want the record kept, got %v", err)
+	}
+
+	var accesses []*models.ShareAccess
+	serveJSON(t, handler, newGetRequest(t, "/shares/"+share.ID+"/accesses"), http.StatusOK, &accesses)
+	wantAccesses := []string{
+		"GET /records 200", "GET /records/2 200", "GET /records/4 404", "GET /records/stats/trend 200",
+		"GET /records/aggregate?bucket=month 200", "GET /reports/adherence 403",
+		"POST /records 405", "DELETE /records/2 405",
+	}
+	if len(accesses) != len(wantAccesses) {
+		t.Fatalf("want %d accesses logged, got %d", len(wantAccesses), len(accesses))
+	}
+	for i, access := range accesses {
+		got := fmt.Sprintf("%s %s %d", access.Method, access.Path, access.Status)
+		if got != wantAccesses[i] || access.ShareID != share.ID {
+			t.Errorf("access %d: want %s, got %s of share %s", i, wantAccesses[i], got, access.ShareID)
+		}
+	}
+}
+
+func TestShareRevokedAndExpired(t *testing.T) {
+	//given
+	app := newOpenTestApplication(t)
+	handler := app.routes()
+	revoked, revokedLink := createShare(t, handler, `["records"]`)
+	expired, expiredLink := createShare(t, handler, `["records"]`)
+	_, validLink := createShare(t, handler, `["records"]`)
+
+	//when
+	serveJSON(t, handler, newRequest(t, http.MethodDelete, "/shares/"+revoked.ID, ""), http.StatusOK, revoked)
+	share, _ := app.shares.Get(context.Background(), expired.ID)
+	share.ExpiresAt = time.Now().Add(-time.Minute)
+	app.shares.Update(context.Background(), share)
+
+	//then
+	if revoked.RevokedAt == nil || revoked.Active {
+		t.Errorf("want the share revoked, got %+v", revoked)
+	}
+	serveJSON(t, handler, newGetRequest(t, revokedLink+"/records"), http.StatusGone, nil)
+	serveJSON(t, handler, newGetRequest(t, expiredLink+"/records"), http.StatusGone, nil)
+	serveJSON(t, handler, newGetRequest(t, validLink+"/records"), http.StatusOK, nil)
+	serveJSON(t, handler, newGetRequest(t, validLink+"x/records"), http.StatusNotFound, nil)
+	serveJSON(t, handler, newGetRequest(t, "/shared/nonsense/records"), http.StatusNotFound, nil)
+
+	var shares []*ShareResponse
+	serveJSON(t, handler, newGetRequest(t, "/shares"), http.StatusOK, &shares)
+	if len(shares) != 3 {
+		t.Errorf("want revoked and expired shares listed too, got %d", len(shares))
+	}
+}
+
+func TestCreateShareInvalid(t *testing.T) {
+	app := newOpenTestApplication(t)
+	handler := app.routes()
+	now := time.Now()
+	from := now.Add(-48 * time.Hour).Format(time.RFC3339)
+	until := now.Format(time.RFC3339)
+
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"no resources", `{"from": "` + from + `", "until": "` + until + `"}`},
+		{"unknown resource", `{"resources": ["medications"], "from": "` + from + `", "until": "` + until + `"}`},
+		{"no range", `{"resources": ["records"]}`},
+		{"until before from", `{"resources": ["records"], "from": "` + until + `", "until": "` + from + `"}`},
+		{"expired", `{"resources": ["records"], "from": "` + from + `", "until": "` + until + `", "expires_at": "` + from + `"}`},
+		{"beyond the longest validity", `{"resources": ["records"], "from": "` + from + `", "until": "` + until +
+			`", "expires_at": "` + now.Add(48*time.Hour).Format(time.RFC3339) + `"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serveJSON(t, handler, newRequest(t, http.MethodPost, "/shares", tt.body), http.StatusBadRequest, nil)
+		})
+	}
+}
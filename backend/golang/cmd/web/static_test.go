@@ -0,0 +1,129 @@
+package main
+
+import (
+	"github.com/romanthekat/simple-peak-flowmeter/ui"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestWebUIIndex(t *testing.T) {
+	//given
+	app := newTestApplication(t)
+	webUI, err := ui.NewHandler(ui.Static(), "https://api.peakflow.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.webUI = webUI
+
+	for _, path := range []string{"/index.html", "/static/"} {
+		t.Run(path, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+
+			//when
+			app.routes().ServeHTTP(rr, newGetRequest(t, path))
+
+			//then
+			if rr.Code != http.StatusOK {
+				t.Fatalf("want %d; got %d", http.StatusOK, rr.Code)
+			}
+			if !strings.HasPrefix(rr.Header().Get("Content-Type"), "text/html") {
+				t.Errorf("want html, got %q", rr.Header().Get("Content-Type"))
+			}
+			if rr.Header().Get("Cache-Control") != "no-cache" {
+				t.Errorf("the index must be revalidated, got %q", rr.Header().Get("Cache-Control"))
+			}
+
+			body := rr.Body.String()
+			if !strings.Contains(body, `content="https://api.peakflow.example"`) {
+				t.Errorf("want API base URL injected:\n%s", body)
+			}
+			if !regexp.MustCompile(`src="app\.js\?v=[0-9a-f]{16}"`).MatchString(body) {
+				t.Errorf("want hashed asset links:\n%s", body)
+			}
+		})
+	}
+}
+
+func TestWebUIFiles(t *testing.T) {
+	app := newTestApplication(t)
+	handler := app.routes()
+
+	tests := []struct {
+		path        string
+		wantStatus  int
+		contentType string
+	}{
+		{"/app.js", http.StatusOK, "text/javascript"},
+		{"/style.css", http.StatusOK, "text/css"},
+		{"/data.json", http.StatusOK, "application/json"},
+		{"/static/app.js", http.StatusOK, "text/javascript"},
+		{"/missing.js", http.StatusNotFound, ""},
+		{"/../go.mod", http.StatusNotFound, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+
+			handler.ServeHTTP(rr, newGetRequest(t, tt.path))
+
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("want %d; got %d", tt.wantStatus, rr.Code)
+			}
+			if tt.contentType != "" && !strings.HasPrefix(rr.Header().Get("Content-Type"), tt.contentType) {
+				t.Errorf("want %s, got %q", tt.contentType, rr.Header().Get("Content-Type"))
+			}
+		})
+	}
+}
+
+func TestWebUICaching(t *testing.T) {
+	//given
+	app := newTestApplication(t)
+	ts := httptest.NewServer(app.routes())
+	defer ts.Close()
+
+	rs, err := ts.Client().Get(ts.URL + "/static/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, _ := io.ReadAll(rs.Body)
+	rs.Body.Close()
+	link := regexp.MustCompile(`app\.js\?v=[0-9a-f]+`).FindString(string(index))
+
+	//when
+	hashed, err := ts.Client().Get(ts.URL + "/static/" + link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashed.Body.Close()
+
+	plain, err := ts.Client().Get(ts.URL + "/app.js?v=outdated")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain.Body.Close()
+
+	revalidate := newGetRequest(t, ts.URL+"/app.js")
+	revalidate.Header.Set("If-None-Match", hashed.Header.Get("ETag"))
+	notModified, err := ts.Client().Do(revalidate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notModified.Body.Close()
+
+	//then
+	if hashed.Header.Get("Cache-Control") != "public, max-age=31536000, immutable" {
+		t.Errorf("want hashed links cached forever, got %q", hashed.Header.Get("Cache-Control"))
+	}
+	if plain.Header.Get("Cache-Control") != "no-cache" {
+		t.Errorf("want outdated links revalidated, got %q", plain.Header.Get("Cache-Control"))
+	}
+	if notModified.StatusCode != http.StatusNotModified {
+		t.Errorf("want %d for a matching ETag, got %d", http.StatusNotModified, notModified.StatusCode)
+	}
+}
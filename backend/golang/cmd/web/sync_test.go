@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/services"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func pullChanges(t *testing.T, handler http.Handler, query string) *ChangesResponse {
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, newGetRequest(t, "/sync"+query))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("want %d; got %d: %s", http.StatusOK, rr.Code, rr.Body)
+	}
+
+	response := &ChangesResponse{}
+	err := json.NewDecoder(rr.Body).Decode(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func pushChanges(t *testing.T, handler http.Handler, changes ...*services.SyncChange) []*services.SyncResult {
+	body, err := json.Marshal(&SyncRequest{Changes: changes})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, newRequest(t, http.MethodPost, "/sync", string(body)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("want %d; got %d: %s", http.StatusOK, rr.Code, rr.Body)
+	}
+
+	response := &SyncResponse{}
+	err = json.NewDecoder(rr.Body).Decode(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response.Results
+}
+
+func TestPullChanges(t *testing.T) {
+	//given
+	app := newOpenTestApplication(t)
+	handler := app.routes()
+
+	//when
+	first := pullChanges(t, handler, "?limit=4")
+	rest := pullChanges(t, handler, "?limit=4&since="+first.Cursor)
+
+	//then
+	if len(first.Changes) != 4 || !first.HasMore {
+		t.Fatalf("want a first page of 4 and more, got %d, has more %v", len(first.Changes), first.HasMore)
+	}
+	if len(rest.Changes) != 2 || rest.HasMore {
+		t.Fatalf("want the last 2 changes, got %d, has more %v", len(rest.Changes), rest.HasMore)
+	}
+
+	seen := map[string]bool{}
+	var last int64
+	for _, change := range append(first.Changes, rest.Changes...) {
+		if change.Seq <= last {
+			t.Errorf("want increasing sequence numbers, got %d after %d", change.Seq, last)
+		}
+		if change.Record == nil || change.Record.ID != change.RecordID {
+			t.Errorf("want the record with the change, got %+v", change)
+		}
+		last = change.Seq
+		seen[change.RecordID] = true
+	}
+	if len(seen) != 6 {
+		t.Errorf("want every record once, got %v", seen)
+	}
+
+	//when
+	empty := pullChanges(t, handler, "?since="+rest.Cursor)
+
+	//then
+	if len(empty.Changes) != 0 || empty.Cursor != rest.Cursor {
+		t.Errorf("want no changes and the same cursor, got %+v", empty)
+	}
+}
+
+func TestPullChangesAfterWrites(t *testing.T) {
+	//given
+	app := newOpenTestApplication(t)
+	handler := app.routes()
+	cursor := pullChanges(t, handler, "").Cursor
+
+	record, _ := app.records.Get(context.Background(), "2")
+	record.Value = 333
+	app.records.Update(context.Background(), record)
+	app.records.Remove(context.Background(), "4")
+	app.records.Update(context.Background(), record)
+
+	//when
+	response := pullChanges(t, handler, "?since="+cursor)
+
+	//then
+	if len(response.Changes) != 2 {
+		t.Fatalf("want the latest change of 2 records, got %+v", response.Changes)
+	}
+	tombstone, updated := response.Changes[0], response.Changes[1]
+	if tombstone.RecordID != "4" || !tombstone.Deleted || tombstone.Record != nil {
+		t.Errorf("want a tombstone of record 4, got %+v", tombstone)
+	}
+	if updated.RecordID != "2" || updated.Record.Value != 333 || updated.Record.Rev != 3 {
+		t.Errorf("want the latest version of record 2, got %+v", updated.Record)
+	}
+}
+
+func TestPullChangesInvalidParameters(t *testing.T) {
+	app := newOpenTestApplication(t)
+
+	for _, query := range []string{"?since=abc", "?since=-1", "?limit=0", "?limit=5000"} {
+		rr := httptest.NewRecorder()
+
+		app.routes().ServeHTTP(rr, newGetRequest(t, "/sync"+query))
+
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: want %d; got %d", query, http.StatusBadRequest, rr.Code)
+		}
+	}
+}
+
+func TestPushChanges(t *testing.T) {
+	takenAt := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+
+	tests := []struct {
+		name        string
+		change      *services.SyncChange
+		wantStatus  services.SyncStatus
+		wantValue   float32
+		wantDeleted bool
+	}{
+		{"create with client id",
+			&services.SyncChange{ID: "phone-1", CreatedAt: takenAt, Value: 410, Context: "morning"},
+			services.SyncApplied, 410, false},
+		{"update of the current version",
+			&services.SyncChange{ID: "1", BaseRev: 1, CreatedAt: takenAt, Value: 515},
+			services.SyncApplied, 515, false},
+		{"update of an old version",
+			&services.SyncChange{ID: "1", BaseRev: 0, CreatedAt: takenAt, Value: 515},
+			services.SyncConflict, 505, false},
+		{"delete of the current version",
+			&services.SyncChange{ID: "1", BaseRev: 1, Deleted: true},
+			services.SyncApplied, 0, true},
+		{"delete of an old version",
+			&services.SyncChange{ID: "1", BaseRev: 7, Deleted: true},
+			services.SyncConflict, 505, false},
+		{"update of a record removed on the server",
+			&services.SyncChange{ID: "removed", BaseRev: 2, CreatedAt: takenAt, Value: 400},
+			services.SyncConflict, 0, true},
+		{"delete of a record removed on the server",
+			&services.SyncChange{ID: "removed", BaseRev: 2, Deleted: true},
+			services.SyncUnchanged, 0, true},
+		{"invalid value",
+			&services.SyncChange{ID: "phone-2", CreatedAt: takenAt, Value: -1},
+			services.SyncRejected, 0, false},
+		{"invalid time zone",
+			&services.SyncChange{ID: "phone-2", CreatedAt: takenAt, Value: 400, Timezone: "Local"},
+			services.SyncRejected, 0, false},
+		{"reading from the future",
+			&services.SyncChange{ID: "phone-3", CreatedAt: time.Now().Add(48 * time.Hour), Value: 400},
+			services.SyncRejected, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			//given
+			app := newOpenTestApplication(t)
+
+			//when
+			results := pushChanges(t, app.routes(), tt.change)
+
+			//then
+			result := results[0]
+			if result.Status != tt.wantStatus || result.Deleted != tt.wantDeleted {
+				t.Fatalf("want %s, deleted %v; got %+v", tt.wantStatus, tt.wantDeleted, result)
+			}
+			if tt.wantValue > 0 && (result.Record == nil || result.Record.Value != tt.wantValue) {
+				t.Errorf("want the server version with %v, got %+v", tt.wantValue, result.Record)
+			}
+
+			stored, err := app.records.Get(context.Background(), tt.change.ID)
+			switch {
+			case tt.wantDeleted && err == nil:
+				t.Errorf("want %s removed on the server", tt.change.ID)
+			case tt.wantValue > 0 && (err != nil || stored.Value != tt.wantValue):
+				t.Errorf("want %v stored, got %+v", tt.wantValue, stored)
+			}
+		})
+	}
+}
+
+func TestPushChangesRetry(t *testing.T) {
+	//given
+	app := newOpenTestApplication(t)
+	handler := app.routes()
+	change := &services.SyncChange{ID: "phone-1", CreatedAt: time.Now().Truncate(time.Millisecond), Value: 430}
+	pushChanges(t, handler, change)
+
+	//when
+	results := pushChanges(t, handler, change)
+
+	//then
+	if results[0].Status != services.SyncUnchanged || results[0].Record.Rev != 1 {
+		t.Errorf("want a lost response retried without another write, got %+v", results[0])
+	}
+
+	//when
+	results = pushChanges(t, handler, &services.SyncChange{ID: "phone-1", CreatedAt: change.CreatedAt, Value: 440})
+
+	//then
+	if results[0].Status != services.SyncConflict {
+		t.Errorf("want another reading with a taken id to conflict, got %+v", results[0])
+	}
+}
+
+func TestPushChangesTimezone(t *testing.T) {
+	//given
+	app := newOpenTestApplication(t)
+	takenAt := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+
+	//when
+	results := pushChanges(t, app.routes(),
+		&services.SyncChange{ID: "phone-1", CreatedAt: takenAt, Value: 410, Timezone: "America/New_York"},
+		&services.SyncChange{ID: "phone-2", CreatedAt: takenAt, Value: 420})
+
+	//then
+	for index, wantTz := range []string{"America/New_York", "UTC"} {
+		if results[index].Status != services.SyncApplied || results[index].Record.Timezone != wantTz {
+			t.Errorf("want the reading stored in %s, got %+v", wantTz, results[index].Record)
+		}
+	}
+}
+
+func TestPushChangesShowUpInFeed(t *testing.T) {
+	//given
+	app := newOpenTestApplication(t)
+	handler := app.routes()
+	cursor := pullChanges(t, handler, "").Cursor
+
+	//when
+	pushChanges(t, handler,
+		&services.SyncChange{ID: "phone-1", CreatedAt: time.Now(), Value: 430},
+		&services.SyncChange{ID: "3", BaseRev: 1, Deleted: true})
+	response := pullChanges(t, handler, "?since="+cursor)
+
+	//then
+	want := []*models.Change{{RecordID: "phone-1"}, {RecordID: "3", Deleted: true}}
+	if len(response.Changes) != len(want) {
+		t.Fatalf("want %d changes, got %+v", len(want), response.Changes)
+	}
+	for index, change := range response.Changes {
+		if change.RecordID != want[index].RecordID || change.Deleted != want[index].Deleted {
+			t.Errorf("want change %+v, got %+v", want[index], change)
+		}
+	}
+}
+
+// failingRecords fails to store the reading of brokenID.
+type failingRecords struct {
+	models.RecordModel
+	brokenID string
+}
+
+func (f *failingRecords) Update(ctx context.Context, record *models.Record) (string, error) {
+	if record.ID == f.brokenID {
+		return "", models.ErrDbProblem
+	}
+	return f.RecordModel.Update(ctx, record)
+}
+
+func TestPushChangesStorageErrors(t *testing.T) {
+	//given
+	app := newOpenTestApplication(t)
+	takenAt := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+	_, err := app.records.Update(models.WithPatient(context.Background(), "patient-1"),
+		&models.Record{ID: "phone-1", CreatedAt: takenAt, Value: 300})
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.sync = services.NewSyncService(&failingRecords{RecordModel: app.records, brokenID: "phone-2"}, time.UTC)
+
+	//when
+	results := pushChanges(t, app.routes(),
+		&services.SyncChange{ID: "phone-1", CreatedAt: takenAt, Value: 410},
+		&services.SyncChange{ID: "phone-2", CreatedAt: takenAt, Value: 420},
+		&services.SyncChange{ID: "phone-3", CreatedAt: takenAt, Value: 430})
+
+	//then
+	want := []services.SyncStatus{services.SyncRejected, services.SyncFailed, services.SyncApplied}
+	if len(results) != len(want) {
+		t.Fatalf("want %d results, got %d", len(want), len(results))
+	}
+	for index, result := range results {
+		if result.Status != want[index] || (result.Status != services.SyncApplied && result.Error == "") {
+			t.Errorf("want %s for change %d, got %+v", want[index], index, result)
+		}
+	}
+	if _, err := app.records.Get(context.Background(), "phone-3"); err != nil {
+		t.Errorf("want the change after the failed ones stored, got %v", err)
+	}
+	stored, err := app.records.Get(models.WithPatient(context.Background(), "patient-1"), "phone-1")
+	if err != nil || stored.Value != 300 {
+		t.Errorf("want the record of the other patient kept, got %+v, %v", stored, err)
+	}
+}
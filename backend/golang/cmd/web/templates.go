@@ -0,0 +1,136 @@
+package main
+
+import "html/template"
+
+// quickLinkFormTemplate is served for GET requests on a quick-add link,
+// so opening or prefetching a bookmarked link never adds a record.
+var quickLinkFormTemplate = template.Must(template.New("quick-link").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <meta name="viewport" content="width=device-width, initial-scale=1">
+  <meta name="robots" content="noindex">
+  <title>Add peak flow record</title>
+</head>
+<body>
+  <h1>Add peak flow record</h1>
+  <form method="post">
+    <label>Value, L/min <input name="value" type="number" min="1" step="any" required autofocus></label>
+    <label>Context <input name="context" value="{{.Context}}"></label>
+    <button type="submit">Add</button>
+  </form>
+  <p><small>Link expires {{.ExpiresAt.Format "2006-01-02 15:04 MST"}}</small></p>
+</body>
+</html>
+`))
+
+// loginTemplate lets browsers log in to the pages with the token of their
+// account, the pages can't send it as a bearer token.
+var loginTemplate = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <meta name="viewport" content="width=device-width, initial-scale=1">
+  <meta name="robots" content="noindex">
+  <title>Log in to peak flow</title>
+  <style>
+    body { font-family: sans-serif; max-width: 760px; margin: 1em auto; padding: 0 1em; }
+    .error { color: #b00020; }
+    label { display: block; margin: .5em 0; }
+  </style>
+</head>
+<body>
+  <h1>Log in to peak flow</h1>
+  {{with .Error}}<p class="error" role="alert">{{.}}</p>{{end}}
+  <form method="post" action="/login">
+    <input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+    <label>Token of your account <input name="token" type="password" autocomplete="current-password" required autofocus></label>
+    <button type="submit">Log in</button>
+  </form>
+</body>
+</html>
+`))
+
+// dashboardTemplate is the server rendered dashboard, it works without
+// JavaScript: the chart is an SVG and every change is a plain form post.
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <meta name="viewport" content="width=device-width, initial-scale=1">
+  <title>Peak flow</title>
+  <style>
+    body { font-family: sans-serif; max-width: 760px; margin: 1em auto; padding: 0 1em; }
+    table { border-collapse: collapse; width: 100%; }
+    td, th { padding: .3em .5em; text-align: left; border-bottom: 1px solid #ddd; }
+    .zone-green { background: #dff5df; }
+    .zone-yellow { background: #fff4c2; }
+    .zone-red { background: #ffd6d6; }
+    svg .zone-green { fill: #dff5df; }
+    svg .zone-yellow { fill: #fff4c2; }
+    svg .zone-red { fill: #ffd6d6; }
+    svg polyline { fill: none; stroke: steelblue; stroke-width: 1.5; }
+    svg circle { fill: steelblue; }
+    .error { color: #b00020; }
+    label { display: block; margin: .5em 0; }
+  </style>
+</head>
+<body>
+  <h1>Peak flow</h1>
+  {{with .UserName}}
+  <form method="post" action="/logout">
+    <input type="hidden" name="csrf_token" value="{{$.CSRFToken}}">
+    Logged in as {{.}} <button type="submit">Log out</button>
+  </form>
+  {{end}}
+  {{with .PersonalBest}}<p>Personal best: {{.}} L/min</p>{{end}}
+  {{with .Plan}}<p>Action plan{{with .Name}} {{.}}{{end}}: green from {{.GreenFrom}} L/min, yellow from {{.YellowFrom}} L/min</p>{{end}}
+  {{with .Advice}}{{if .Instructions}}<p class="zone-{{.Zone}}" role="status">Latest reading in the {{.Zone}} zone: {{.Instructions}}</p>{{end}}{{end}}
+
+  {{if .Chart.Points}}
+  <svg width="{{.Chart.Width}}" height="{{.Chart.Height}}" viewBox="0 0 {{.Chart.Width}} {{.Chart.Height}}" role="img" aria-label="Chart of recent readings">
+    {{range .Chart.Zones}}<rect class="zone-{{.Zone}}" x="0" y="{{printf "%.1f" .Y}}" width="{{$.Chart.Width}}" height="{{printf "%.1f" .Height}}"/>{{end}}
+    <polyline points="{{.Chart.Line}}"/>
+    {{range .Chart.Points}}<circle cx="{{printf "%.1f" .X}}" cy="{{printf "%.1f" .Y}}" r="3"><title>{{.Title}}</title></circle>{{end}}
+  </svg>
+  {{end}}
+
+  <h2>{{if .Form.ID}}Edit reading{{else}}Add reading{{end}}</h2>
+  {{with .Error}}<p class="error" role="alert">{{.}}</p>{{end}}
+  <form method="post" action="{{if .Form.ID}}/dashboard/records/{{.Form.ID}}{{else}}/dashboard/records{{end}}">
+    <input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+    <label>Value, L/min <input name="value" type="number" min="1" step="any" required value="{{.Form.Value}}"></label>
+    <label>Time <input name="created_at" type="datetime-local" value="{{.Form.CreatedAt}}"> <small>now if empty</small></label>
+    <label>Context <input name="context" maxlength="64" value="{{.Form.Context}}"></label>
+    <button type="submit">{{if .Form.ID}}Save{{else}}Add{{end}}</button>
+    {{if .Form.ID}}<a href="/">Cancel</a>{{end}}
+  </form>
+  {{if .Form.ID}}
+  <form method="post" action="/dashboard/records/{{.Form.ID}}/delete">
+    <input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+    <button type="submit">Delete this reading</button>
+  </form>
+  {{end}}
+
+  <h2>Recent readings</h2>
+  {{if .Readings}}
+  <table>
+    <thead><tr><th>Time</th><th>L/min</th><th>Zone</th><th>Context</th><th></th></tr></thead>
+    <tbody>
+    {{range .Readings}}
+      <tr class="zone-{{.Zone}}">
+        <td>{{.TakenAt.Format "2006-01-02 15:04 MST"}}</td>
+        <td>{{.Value}}</td>
+        <td>{{.Zone}}</td>
+        <td>{{.Context}}</td>
+        <td><a href="/?edit={{.ID}}">Edit</a></td>
+      </tr>
+    {{end}}
+    </tbody>
+  </table>
+  {{else}}
+  <p>No readings yet.</p>
+  {{end}}
+</body>
+</html>
+`))
@@ -1,20 +1,88 @@
 package main
 
 import (
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/analytics"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/config"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/health"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/logging"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/metrics"
 	"github.com/romanthekat/simple-peak-flowmeter/pkg/models/mock"
-	"io/ioutil"
-	"log"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/policy"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/services"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/sharing"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/tracing"
+	"github.com/romanthekat/simple-peak-flowmeter/ui"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"io"
+	"log/slog"
 	"net/http"
+	"strings"
 	"testing"
+	"time"
 )
 
 func newTestApplication(t *testing.T) *application {
-	recordsModel := mock.NewRecordsModel()
+	return newTracedTestApplication(t, noop.NewTracerProvider())
+}
+
+// newOpenTestApplication creates a test application with the open policy
+// of AUTH_OPEN, for tests using the household routes without a token.
+func newOpenTestApplication(t *testing.T) *application {
+	app := newTestApplication(t)
+	app.policy = policy.Default(true)
+	return app
+}
+
+// newTracedTestApplication creates a test application exporting spans
+// with tracerProvider.
+func newTracedTestApplication(t *testing.T, tracerProvider trace.TracerProvider) *application {
+	appMetrics := metrics.New()
+	recordsModel := sharing.NewRecordModel(tracing.NewRecordModel(
+		metrics.NewRecordModel(mock.NewRecordsModel(), appMetrics),
+		tracerProvider))
+	appMetrics.MustRegister(metrics.NewRecordsCollector(recordsModel, tracerProvider))
+	actionPlans := mock.NewActionPlanModel()
+	zones := services.NewZonesService(0)
+	medications := sharing.NewMedicationModel(mock.NewMedicationModel())
+	shares := mock.NewShareModel()
+	quickLinks := mock.NewQuickLinkModel()
+	users := mock.NewUserModel()
+	patients := mock.NewPatientModel()
+	logger := logging.New(io.Discard, slog.LevelError)
+
 	return &application{
-		errorLog:          log.New(ioutil.Discard, "", 0),
-		infoLog:           log.New(ioutil.Discard, "", 0),
+		logger:            logger,
 		records:           recordsModel,
+		metrics:           appMetrics,
+		tracerProvider:    tracerProvider,
+		health:            health.NewRegistry(time.Second),
+		recordsService:    services.NewRecordsService(time.UTC),
+		idempotency:       services.NewIdempotencyService(mock.NewIdempotencyModel(), time.Hour),
+		quickLinks:        quickLinks,
+		quickLinkService:  services.NewQuickLinkService(quickLinks, []byte("test secret"), time.Hour),
+		zones:             zones,
+		actionPlans:       actionPlans,
+		actionPlanService: services.NewActionPlanService(actionPlans, recordsModel, zones),
+		medications:       medications,
+		medicationService: services.NewMedicationService(medications),
+		reports:           services.NewReportService(recordsModel, medications),
+		environment:       services.NewEnvironmentService(recordsModel, nil, "", logger),
+		shares:            shares,
+		shareService:      services.NewShareService(shares, []byte("test secret"), time.Hour, 24*time.Hour),
+		users:             users,
+		userService:       services.NewUserService(users),
+		patients:          patients,
+		patientService:    services.NewPatientService(patients, users),
+		stats:             services.NewStatsService(users, patients, recordsModel, shares),
+		policy:            policy.Default(false),
+		csrf:              services.NewCSRFService([]byte("test secret")),
+		sessions:          services.NewSessionService(users, []byte("test secret"), time.Hour),
+		sync:              services.NewSyncService(recordsModel, time.UTC),
+		trends:            services.NewTrendService(recordsModel, analytics.DefaultTrendParams(), time.UTC),
 		generateRoutesDoc: false,
+		webUI:             newTestUI(t),
+		cors:              config.Default().CORS,
 	}
 }
 
@@ -25,3 +93,20 @@ func newGetRequest(t *testing.T, url string) *http.Request {
 	}
 	return r
 }
+
+func newRequest(t *testing.T, method, url, body string) *http.Request {
+	r, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Content-Type", "application/json")
+	return r
+}
+
+func newTestUI(t *testing.T) http.Handler {
+	webUI, err := ui.NewHandler(ui.Static(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return webUI
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newTracedTest(t *testing.T) (*application, *tracetest.InMemoryExporter) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	t.Cleanup(func() { _ = provider.Shutdown(context.Background()) })
+
+	return newTracedTestApplication(t, provider), exporter
+}
+
+func findSpan(t *testing.T, spans tracetest.SpanStubs, name string) tracetest.SpanStub {
+	for _, span := range spans {
+		if span.Name == name {
+			return span
+		}
+	}
+
+	var names []string
+	for _, span := range spans {
+		names = append(names, span.Name)
+	}
+	t.Fatalf("span %q not found in %v", name, names)
+	return tracetest.SpanStub{}
+}
+
+func TestTracingContinuesIncomingTrace(t *testing.T) {
+	//given
+	app, exporter := newTracedTest(t)
+	admin := createAdmin(t, app, testAdminToken)
+
+	r := authorized(newGetRequest(t, "/records/1"), admin)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	rr := httptest.NewRecorder()
+
+	//when
+	app.routes().ServeHTTP(rr, r)
+
+	//then
+	if rr.Code != http.StatusOK {
+		t.Fatalf("want %d; got %d", http.StatusOK, rr.Code)
+	}
+
+	spans := exporter.GetSpans()
+	server := findSpan(t, spans, "GET /records/{RecordID}")
+	if server.SpanContext.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("want the incoming trace to continue, got trace %s", server.SpanContext.TraceID())
+	}
+	if !server.Parent.IsRemote() || server.Parent.SpanID().String() != "00f067aa0ba902b7" {
+		t.Errorf("want the incoming span as parent, got %s", server.Parent.SpanID())
+	}
+
+	storage := findSpan(t, spans, "RecordModel.Get")
+	if storage.Parent.SpanID() != server.SpanContext.SpanID() {
+		t.Errorf("want storage span to be a child of the server span")
+	}
+}
+
+func TestTracingStartsNewTrace(t *testing.T) {
+	//given
+	app, exporter := newTracedTest(t)
+	admin := createAdmin(t, app, testAdminToken)
+
+	rr := httptest.NewRecorder()
+
+	//when
+	app.routes().ServeHTTP(rr, authorized(newGetRequest(t, "/records/"), admin))
+
+	//then
+	spans := exporter.GetSpans()
+	server := findSpan(t, spans, "GET /records")
+	if server.Parent.IsValid() {
+		t.Errorf("want a root span, got parent %s", server.Parent.SpanID())
+	}
+	if rr.Header().Get("traceparent") != "" {
+		t.Errorf("trace context must not be leaked in responses")
+	}
+
+	storage := findSpan(t, spans, "RecordModel.GetAll")
+	if storage.SpanContext.TraceID() != server.SpanContext.TraceID() {
+		t.Errorf("want storage span in the request trace")
+	}
+}
+
+func TestTracingBackgroundJob(t *testing.T) {
+	//given
+	app, exporter := newTracedTest(t)
+	admin := createAdmin(t, app, testAdminToken)
+
+	rr := httptest.NewRecorder()
+
+	//when
+	app.routes().ServeHTTP(rr, authorized(newGetRequest(t, "/metrics"), admin))
+
+	//then
+	spans := exporter.GetSpans()
+	server := findSpan(t, spans, "GET /metrics")
+	job := findSpan(t, spans, "RecordsCollector.Collect")
+	if job.Parent.IsValid() || job.SpanContext.TraceID() == server.SpanContext.TraceID() {
+		t.Errorf("want the collector job in its own trace")
+	}
+
+	storage := findSpan(t, spans, "RecordModel.Summarize")
+	if storage.Parent.SpanID() != job.SpanContext.SpanID() {
+		t.Errorf("want storage span to be a child of the job span")
+	}
+}
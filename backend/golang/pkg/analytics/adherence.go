@@ -0,0 +1,162 @@
+package analytics
+
+import (
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+	"time"
+)
+
+// RelieverOveruseDays is the most days a week GINA allows a reliever to be
+// needed on for asthma to count as well controlled.
+const RelieverOveruseDays = 2
+
+// GoodAdherence is the share of scheduled controller doses, in percent,
+// from which adherence counts as good.
+const GoodAdherence = 80
+
+// Adherence reports per week how many of the scheduled controller doses
+// were taken, how often a reliever was needed, and the mean peak flow.
+type Adherence struct {
+	Timezone string           `json:"tz"`
+	Weeks    []*AdherenceWeek `json:"weeks"`
+	// Adherence over all weeks, in percent of the scheduled doses taken.
+	Adherence            *float64 `json:"adherence,omitempty"`
+	RelieverOveruseWeeks int      `json:"reliever_overuse_weeks"`
+	// PeakFlowCorrelation is the correlation of the weekly adherence with
+	// the weekly mean peak flow over weeks with both, positive if peak
+	// flow is higher in weeks more doses were taken.
+	PeakFlowCorrelation *float64 `json:"peak_flow_correlation,omitempty"`
+	// Mean peak flow of the weeks with good adherence and of the others.
+	MeanPeakFlowAdherent    *float64 `json:"mean_peak_flow_adherent,omitempty"`
+	MeanPeakFlowNonAdherent *float64 `json:"mean_peak_flow_non_adherent,omitempty"`
+}
+
+// AdherenceWeek holds the statistics of a week from Monday. Taken doses
+// are counted up to the scheduled ones per controller and day, extra doses
+// don't make up for missed ones. Adherence is left out without a schedule,
+// MeanPeakFlow without readings.
+type AdherenceWeek struct {
+	Start           time.Time `json:"start"`
+	End             time.Time `json:"end"`
+	ScheduledDoses  int       `json:"scheduled_doses"`
+	TakenDoses      int       `json:"taken_doses"`
+	Adherence       *float64  `json:"adherence,omitempty"`
+	RelieverDoses   int       `json:"reliever_doses"`
+	RelieverDays    int       `json:"reliever_days"`
+	RelieverOveruse bool      `json:"reliever_overuse"` // on more than RelieverOveruseDays
+	Readings        int       `json:"readings"`
+	MeanPeakFlow    *float64  `json:"mean_peak_flow,omitempty"`
+}
+
+// NewAdherence reports on the number of weeks up to the one of now, days
+// after today aren't scheduled yet. Doses are counted on their day in loc,
+// records on their local day like in Aggregate.
+func NewAdherence(medications []*models.Medication, doses []*models.Dose, records []*models.Record,
+	now time.Time, loc *time.Location, weeks int) *Adherence {
+	type medicationDay struct {
+		medicationID string
+		day          int
+	}
+
+	byID := make(map[string]*models.Medication, len(medications))
+	for _, medication := range medications {
+		byID[medication.ID] = medication
+	}
+	controllerDoses := map[medicationDay]int{}
+	relieverDoses := map[int]int{}
+	for _, dose := range doses {
+		medication, ok := byID[dose.MedicationID]
+		if !ok {
+			continue
+		}
+		day := DayOf(dose.TakenAt, loc)
+		switch medication.Type {
+		case models.MedicationController:
+			controllerDoses[medicationDay{medication.ID, day}]++
+		case models.MedicationReliever:
+			relieverDoses[day]++
+		}
+	}
+
+	peakFlow := map[int64]*models.Bucket{}
+	for _, bucket := range Aggregate(records, &models.AggregateQuery{Bucket: models.BucketWeek, Location: loc}) {
+		peakFlow[bucket.Start.Unix()] = bucket
+	}
+
+	report := &Adherence{Timezone: loc.String(), Weeks: []*AdherenceWeek{}}
+	today := DayOf(now, loc)
+	start := BucketStart(now.In(loc), models.BucketWeek).AddDate(0, 0, -7*(weeks-1))
+	var scheduled, taken int
+	var adherences, means, adherent, nonAdherent []float64
+	for i := 0; i < weeks; i++ {
+		weekStart := start.AddDate(0, 0, 7*i)
+		week := &AdherenceWeek{Start: weekStart, End: BucketEnd(weekStart, models.BucketWeek)}
+
+		first := DayOf(weekStart, loc)
+		for day := first; day < first+7 && day <= today; day++ {
+			for _, medication := range medications {
+				if medication.Type != models.MedicationController || medication.DosesPerDay <= 0 ||
+					day < DayOf(medication.StartedAt, loc) {
+					continue
+				}
+				week.ScheduledDoses += medication.DosesPerDay
+				week.TakenDoses += min(controllerDoses[medicationDay{medication.ID, day}], medication.DosesPerDay)
+			}
+			if count := relieverDoses[day]; count > 0 {
+				week.RelieverDays++
+				week.RelieverDoses += count
+			}
+		}
+		week.RelieverOveruse = week.RelieverDays > RelieverOveruseDays
+		if week.RelieverOveruse {
+			report.RelieverOveruseWeeks++
+		}
+
+		if week.ScheduledDoses > 0 {
+			adherence := percent(week.TakenDoses, week.ScheduledDoses)
+			week.Adherence = &adherence
+			scheduled += week.ScheduledDoses
+			taken += week.TakenDoses
+		}
+		if bucket, ok := peakFlow[weekStart.Unix()]; ok {
+			week.Readings = bucket.Count
+			mean := bucket.Mean
+			week.MeanPeakFlow = &mean
+		}
+
+		if week.Adherence != nil && week.MeanPeakFlow != nil {
+			adherences = append(adherences, *week.Adherence)
+			means = append(means, *week.MeanPeakFlow)
+			if *week.Adherence >= GoodAdherence {
+				adherent = append(adherent, *week.MeanPeakFlow)
+			} else {
+				nonAdherent = append(nonAdherent, *week.MeanPeakFlow)
+			}
+		}
+		report.Weeks = append(report.Weeks, week)
+	}
+
+	if scheduled > 0 {
+		adherence := percent(taken, scheduled)
+		report.Adherence = &adherence
+	}
+	if r, ok := Correlation(adherences, means); ok {
+		r = Round(r)
+		report.PeakFlowCorrelation = &r
+	}
+	report.MeanPeakFlowAdherent = meanOf(adherent)
+	report.MeanPeakFlowNonAdherent = meanOf(nonAdherent)
+	return report
+}
+
+func percent(part, whole int) float64 {
+	return Round(100 * float64(part) / float64(whole))
+}
+
+// meanOf returns the rounded mean of values, nil if there are none.
+func meanOf(values []float64) *float64 {
+	if len(values) == 0 {
+		return nil
+	}
+	mean := Round(Mean(values))
+	return &mean
+}
@@ -0,0 +1,126 @@
+package analytics
+
+import (
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+	"testing"
+	"time"
+)
+
+func at(month time.Month, day, hour int) time.Time {
+	return time.Date(2024, month, day, hour, 0, 0, 0, berlin)
+}
+
+func TestNewAdherence(t *testing.T) {
+	//given
+	medications := []*models.Medication{
+		{ID: "controller", Type: models.MedicationController, DosesPerDay: 2, StartedAt: at(time.March, 27, 8)},
+		{ID: "reliever", Type: models.MedicationReliever},
+		{ID: "unscheduled", Type: models.MedicationController},
+	}
+	var doses []*models.Dose
+	dose := func(medicationID string, t time.Time) {
+		doses = append(doses, &models.Dose{MedicationID: medicationID, TakenAt: t})
+	}
+	// every dose in the week of the DST change, an extra one on Thursday
+	for day := 27; day <= 31; day++ {
+		dose("controller", at(time.March, day, 8))
+		dose("controller", at(time.March, day, 20))
+	}
+	dose("controller", at(time.March, 28, 21))
+	dose("reliever", at(time.March, 29, 15))
+	// half of them in the next week, a reliever on four days
+	for day := 1; day <= 7; day++ {
+		dose("controller", at(time.April, day, 8))
+	}
+	for _, day := range []int{1, 2, 2, 4, 6} {
+		dose("reliever", at(time.April, day, 14))
+	}
+	// two of six up to today
+	dose("controller", at(time.April, 8, 8))
+	dose("controller", at(time.April, 8, 20))
+	dose("unscheduled", at(time.April, 9, 8))
+	dose("removed", at(time.April, 9, 8))
+
+	records := []*models.Record{
+		{CreatedAt: at(time.March, 28, 8), Value: 480},
+		{CreatedAt: at(time.March, 30, 8), Value: 520},
+		{CreatedAt: at(time.April, 3, 8), Value: 400},
+		{CreatedAt: at(time.April, 9, 8), Value: 450},
+	}
+
+	//when
+	report := NewAdherence(medications, doses, records, at(time.April, 10, 12), berlin, 4)
+
+	//then
+	tests := []struct {
+		start                       string
+		scheduled, taken            int
+		adherence                   float64
+		relieverDoses, relieverDays int
+		overuse                     bool
+		meanPeakFlow                float64
+	}{
+		{"2024-03-18T00:00:00+01:00", 0, 0, 0, 0, 0, false, 0},
+		{"2024-03-25T00:00:00+01:00", 10, 10, 100, 1, 1, false, 500},
+		{"2024-04-01T00:00:00+02:00", 14, 7, 50, 5, 4, true, 400},
+		{"2024-04-08T00:00:00+02:00", 6, 2, 33.33, 0, 0, false, 450},
+	}
+	if len(report.Weeks) != len(tests) {
+		t.Fatalf("want %d weeks, got %d", len(tests), len(report.Weeks))
+	}
+	for i, tt := range tests {
+		week := report.Weeks[i]
+		if week.Start.Format(time.RFC3339) != tt.start {
+			t.Errorf("week %d: want start %s, got %s", i, tt.start, week.Start.Format(time.RFC3339))
+		}
+		if week.ScheduledDoses != tt.scheduled || week.TakenDoses != tt.taken || valueOf(week.Adherence) != tt.adherence {
+			t.Errorf("%s: want %d of %d doses, %v%%, got %d of %d, %v%%", tt.start,
+				tt.taken, tt.scheduled, tt.adherence, week.TakenDoses, week.ScheduledDoses, valueOf(week.Adherence))
+		}
+		if week.RelieverDoses != tt.relieverDoses || week.RelieverDays != tt.relieverDays || week.RelieverOveruse != tt.overuse {
+			t.Errorf("%s: want %d reliever doses on %d days, overuse %v, got %+v", tt.start,
+				tt.relieverDoses, tt.relieverDays, tt.overuse, week)
+		}
+		if valueOf(week.MeanPeakFlow) != tt.meanPeakFlow {
+			t.Errorf("%s: want mean peak flow %v, got %v", tt.start, tt.meanPeakFlow, valueOf(week.MeanPeakFlow))
+		}
+	}
+	if report.Weeks[0].Adherence != nil {
+		t.Errorf("want no adherence before the schedule started")
+	}
+
+	if valueOf(report.Adherence) != 63.33 || report.RelieverOveruseWeeks != 1 {
+		t.Errorf("want 63.33%% overall and one week of overuse, got %v and %d",
+			valueOf(report.Adherence), report.RelieverOveruseWeeks)
+	}
+	if valueOf(report.PeakFlowCorrelation) != 0.72 {
+		t.Errorf("want a correlation of 0.72, got %v", valueOf(report.PeakFlowCorrelation))
+	}
+	if valueOf(report.MeanPeakFlowAdherent) != 500 || valueOf(report.MeanPeakFlowNonAdherent) != 425 {
+		t.Errorf("want 500 in adherent weeks and 425 in others, got %v and %v",
+			valueOf(report.MeanPeakFlowAdherent), valueOf(report.MeanPeakFlowNonAdherent))
+	}
+}
+
+func TestCorrelation(t *testing.T) {
+	tests := []struct {
+		name   string
+		xs, ys []float64
+		want   float64
+		wantOK bool
+	}{
+		{"perfect", []float64{1, 2, 3}, []float64{10, 20, 30}, 1, true},
+		{"inverse", []float64{1, 2, 3, 4}, []float64{8, 6, 4, 2}, -1, true},
+		{"too few", []float64{1, 2}, []float64{1, 2}, 0, false},
+		{"constant", []float64{1, 2, 3}, []float64{5, 5, 5}, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, ok := Correlation(tt.xs, tt.ys)
+			if ok != tt.wantOK || Round(r) != tt.want {
+				t.Errorf("want %v, %v, got %v, %v", tt.want, tt.wantOK, r, ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package analytics
+
+import (
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+	"math"
+	"sort"
+	"time"
+)
+
+// Aggregate summarizes records per bucket of the query, oldest first. It is
+// the implementation of models.RecordModel.Aggregate for storages without
+// aggregations of their own, they must return the same buckets. Records
+// count for the day and the hour on the clock where they were taken, the
+// buckets of those days start at midnight in the query location.
+func Aggregate(records []*models.Record, query *models.AggregateQuery) []*models.Bucket {
+	type summary struct {
+		bucket                     *models.Bucket
+		sum, morning, evening      float64
+		morningCount, eveningCount int
+	}
+
+	summaries := map[int64]*summary{}
+	for _, record := range records {
+		local := record.LocalTime(query.Location)
+		year, month, day := local.Date()
+		start := BucketStart(time.Date(year, month, day, 0, 0, 0, 0, query.Location), query.Bucket)
+		value := float64(record.Value)
+
+		s, ok := summaries[start.Unix()]
+		if !ok {
+			s = &summary{bucket: &models.Bucket{
+				Start: start,
+				End:   BucketEnd(start, query.Bucket),
+				Min:   value,
+				Max:   value,
+			}}
+			summaries[start.Unix()] = s
+		}
+
+		s.bucket.Count++
+		s.bucket.Min = math.Min(s.bucket.Min, value)
+		s.bucket.Max = math.Max(s.bucket.Max, value)
+		s.sum += value
+		switch hour := local.Hour(); {
+		case hour < models.MorningEndHour:
+			s.morning += value
+			s.morningCount++
+		case hour >= models.EveningStartHour:
+			s.evening += value
+			s.eveningCount++
+		}
+	}
+
+	buckets := make([]*models.Bucket, 0, len(summaries))
+	for _, s := range summaries {
+		s.bucket.Mean = Round(s.sum / float64(s.bucket.Count))
+		if s.morningCount > 0 {
+			mean := Round(s.morning / float64(s.morningCount))
+			s.bucket.MorningMean = &mean
+		}
+		if s.eveningCount > 0 {
+			mean := Round(s.evening / float64(s.eveningCount))
+			s.bucket.EveningMean = &mean
+		}
+		buckets = append(buckets, s.bucket)
+	}
+	sort.Slice(buckets, func(i, j int) bool {
+		return buckets[i].Start.Before(buckets[j].Start)
+	})
+	return buckets
+}
+
+// Summarize returns the latest of records and the number of them taken
+// since the given time. It is the implementation of
+// models.RecordModel.Summarize for storages without queries of their own.
+func Summarize(records []*models.Record, since time.Time) *models.Summary {
+	summary := &models.Summary{}
+	for _, record := range records {
+		if summary.Latest == nil || record.CreatedAt.After(summary.Latest.CreatedAt) {
+			summary.Latest = record
+		}
+		if !record.CreatedAt.Before(since) {
+			summary.Since++
+		}
+	}
+	return summary
+}
+
+// BucketStart returns local midnight starting the day, the week from Monday
+// or the month of t, in the location of t.
+func BucketStart(t time.Time, bucket string) time.Time {
+	year, month, day := t.Date()
+	switch bucket {
+	case models.BucketWeek:
+		day -= (int(t.Weekday()) + 6) % 7
+	case models.BucketMonth:
+		day = 1
+	}
+	return time.Date(year, month, day, 0, 0, 0, 0, t.Location())
+}
+
+// BucketEnd returns the start of the bucket following the one at start.
+// Days are counted on the calendar, so a day can have 23 or 25 hours.
+func BucketEnd(start time.Time, bucket string) time.Time {
+	switch bucket {
+	case models.BucketWeek:
+		return start.AddDate(0, 0, 7)
+	case models.BucketMonth:
+		return start.AddDate(0, 1, 0)
+	default:
+		return start.AddDate(0, 0, 1)
+	}
+}
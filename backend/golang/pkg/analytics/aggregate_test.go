@@ -0,0 +1,207 @@
+package analytics
+
+import (
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+	"testing"
+	"time"
+)
+
+func utc(value string) time.Time {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// aroundDST has readings around the start of summer time in Berlin on
+// 2024-03-31 at 02:00, when clocks went from UTC+1 to UTC+2.
+var aroundDST = []*models.Record{
+	{ID: "0", CreatedAt: utc("2024-03-30T06:30:00Z"), Value: 400}, // 07:30 CET, morning
+	{ID: "1", CreatedAt: utc("2024-03-30T19:00:00Z"), Value: 440}, // 20:00 CET, evening
+	{ID: "2", CreatedAt: utc("2024-03-30T23:30:00Z"), Value: 420}, // 00:30 CET on the 31st, morning
+	{ID: "3", CreatedAt: utc("2024-03-31T05:30:00Z"), Value: 410}, // 07:30 CEST, morning
+	{ID: "4", CreatedAt: utc("2024-03-31T13:00:00Z"), Value: 430}, // 15:00 CEST, afternoon
+	{ID: "5", CreatedAt: utc("2024-03-31T22:30:00Z"), Value: 450}, // 00:30 CEST on April 1st, morning
+}
+
+func TestAggregateDays(t *testing.T) {
+	//when
+	buckets := Aggregate(aroundDST, &models.AggregateQuery{Bucket: models.BucketDay, Location: berlin})
+
+	//then
+	tests := []struct {
+		start, end               string
+		count                    int
+		min, max, mean           float64
+		morningMean, eveningMean float64
+	}{
+		{"2024-03-30T00:00:00+01:00", "2024-03-31T00:00:00+01:00", 2, 400, 440, 420, 400, 440},
+		{"2024-03-31T00:00:00+01:00", "2024-04-01T00:00:00+02:00", 3, 410, 430, 420, 415, 0},
+		{"2024-04-01T00:00:00+02:00", "2024-04-02T00:00:00+02:00", 1, 450, 450, 450, 450, 0},
+	}
+	if len(buckets) != len(tests) {
+		t.Fatalf("want %d days, got %d", len(tests), len(buckets))
+	}
+
+	for i, tt := range tests {
+		bucket := buckets[i]
+		if bucket.Start.Format(time.RFC3339) != tt.start || bucket.End.Format(time.RFC3339) != tt.end {
+			t.Errorf("day %d: want %s to %s, got %s to %s", i, tt.start, tt.end,
+				bucket.Start.Format(time.RFC3339), bucket.End.Format(time.RFC3339))
+		}
+		if bucket.Count != tt.count || bucket.Min != tt.min || bucket.Max != tt.max || bucket.Mean != tt.mean {
+			t.Errorf("day %d: want count %d, min %v, max %v, mean %v, got %+v",
+				i, tt.count, tt.min, tt.max, tt.mean, bucket)
+		}
+		if got := valueOf(bucket.MorningMean); got != tt.morningMean {
+			t.Errorf("day %d: want morning mean %v, got %v", i, tt.morningMean, got)
+		}
+		if got := valueOf(bucket.EveningMean); got != tt.eveningMean {
+			t.Errorf("day %d: want evening mean %v, got %v", i, tt.eveningMean, got)
+		}
+	}
+
+	if hours := buckets[1].End.Sub(buckets[1].Start).Hours(); hours != 23 {
+		t.Errorf("want the day of the DST change to last 23 hours, got %v", hours)
+	}
+}
+
+func TestAggregateBuckets(t *testing.T) {
+	tests := []struct {
+		name       string
+		query      *models.AggregateQuery
+		wantStarts []string
+		wantCounts []int
+	}{
+		{"days in UTC",
+			&models.AggregateQuery{Bucket: models.BucketDay, Location: time.UTC},
+			[]string{"2024-03-30T00:00:00Z", "2024-03-31T00:00:00Z"}, []int{3, 3}},
+		{"weeks from Monday",
+			&models.AggregateQuery{Bucket: models.BucketWeek, Location: berlin},
+			[]string{"2024-03-25T00:00:00+01:00", "2024-04-01T00:00:00+02:00"}, []int{5, 1}},
+		{"months",
+			&models.AggregateQuery{Bucket: models.BucketMonth, Location: berlin},
+			[]string{"2024-03-01T00:00:00+01:00", "2024-04-01T00:00:00+02:00"}, []int{5, 1}},
+		{"months in UTC",
+			&models.AggregateQuery{Bucket: models.BucketMonth, Location: time.UTC},
+			[]string{"2024-03-01T00:00:00Z"}, []int{6}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buckets := Aggregate(aroundDST, tt.query)
+
+			if len(buckets) != len(tt.wantStarts) {
+				t.Fatalf("want %d buckets, got %d", len(tt.wantStarts), len(buckets))
+			}
+			for i, bucket := range buckets {
+				if bucket.Start.Format(time.RFC3339) != tt.wantStarts[i] || bucket.Count != tt.wantCounts[i] {
+					t.Errorf("want bucket %s with %d readings, got %s with %d",
+						tt.wantStarts[i], tt.wantCounts[i], bucket.Start.Format(time.RFC3339), bucket.Count)
+				}
+			}
+		})
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	//when
+	summary := Summarize(aroundDST, utc("2024-03-31T05:30:00Z"))
+
+	//then
+	if summary.Latest == nil || summary.Latest.ID != "5" {
+		t.Errorf("want the latest reading 5, got %+v", summary.Latest)
+	}
+	if summary.Since != 3 {
+		t.Errorf("want 3 readings since, got %d", summary.Since)
+	}
+
+	//when
+	summary = Summarize(nil, utc("2024-03-31T05:30:00Z"))
+
+	//then
+	if summary.Latest != nil || summary.Since != 0 {
+		t.Errorf("want an empty summary, got %+v", summary)
+	}
+}
+
+func TestBucketEndAcrossDST(t *testing.T) {
+	// Berlin went back to winter time on 2024-10-27
+	start := time.Date(2024, 10, 27, 0, 0, 0, 0, berlin)
+
+	if hours := BucketEnd(start, models.BucketDay).Sub(start).Hours(); hours != 25 {
+		t.Errorf("want 25 hours, got %v", hours)
+	}
+	week := BucketStart(start, models.BucketWeek)
+	if week.Format(time.RFC3339) != "2024-10-21T00:00:00+02:00" || BucketEnd(week, models.BucketWeek).Format(time.RFC3339) != "2024-10-28T00:00:00+01:00" {
+		t.Errorf("want the week from Monday to Monday, got %s to %s", week, BucketEnd(week, models.BucketWeek))
+	}
+}
+
+func valueOf(mean *float64) float64 {
+	if mean == nil {
+		return 0
+	}
+	return *mean
+}
+
+// travelling are readings of a user from Berlin taken on a trip to Tokyo
+// and New York, each in the time zone it was taken in. On the clock of
+// Berlin most of them would fall on another day or time of day.
+var travelling = []*models.Record{
+	{ID: "0", CreatedAt: utc("2024-04-01T05:30:00Z"), Value: 400, Timezone: "Europe/Berlin"},    // 07:30 in Berlin
+	{ID: "1", CreatedAt: utc("2024-04-01T21:00:00Z"), Value: 410, Timezone: "Asia/Tokyo"},       // 06:00 on the 2nd in Tokyo, 23:00 in Berlin
+	{ID: "2", CreatedAt: utc("2024-04-02T11:00:00Z"), Value: 440, Timezone: "Asia/Tokyo"},       // 20:00 in Tokyo, 13:00 in Berlin
+	{ID: "3", CreatedAt: utc("2024-04-03T11:00:00Z"), Value: 420, Timezone: "-04:00"},           // 07:00 in New York, 13:00 in Berlin
+	{ID: "4", CreatedAt: utc("2024-04-03T23:00:00Z"), Value: 450, Timezone: "America/New_York"}, // 19:00 in New York, 01:00 on the 4th in Berlin
+	{ID: "5", CreatedAt: utc("2024-04-04T05:30:00Z"), Value: 430},                               // back home, 07:30 in Berlin
+}
+
+func TestAggregateWhileTravelling(t *testing.T) {
+	//when
+	buckets := Aggregate(travelling, &models.AggregateQuery{Bucket: models.BucketDay, Location: berlin})
+
+	//then
+	tests := []struct {
+		start                    string
+		count                    int
+		morningMean, eveningMean float64
+	}{
+		{"2024-04-01T00:00:00+02:00", 1, 400, 0},
+		{"2024-04-02T00:00:00+02:00", 2, 410, 440},
+		{"2024-04-03T00:00:00+02:00", 2, 420, 450},
+		{"2024-04-04T00:00:00+02:00", 1, 430, 0},
+	}
+	if len(buckets) != len(tests) {
+		t.Fatalf("want %d days, got %d", len(tests), len(buckets))
+	}
+
+	for i, tt := range tests {
+		bucket := buckets[i]
+		if bucket.Start.Format(time.RFC3339) != tt.start || bucket.Count != tt.count {
+			t.Errorf("want %d readings on %s, got %d on %s",
+				tt.count, tt.start, bucket.Count, bucket.Start.Format(time.RFC3339))
+		}
+		if valueOf(bucket.MorningMean) != tt.morningMean || valueOf(bucket.EveningMean) != tt.eveningMean {
+			t.Errorf("%s: want morning %v and evening %v, got %v and %v", tt.start,
+				tt.morningMean, tt.eveningMean, valueOf(bucket.MorningMean), valueOf(bucket.EveningMean))
+		}
+	}
+}
+
+func TestDailyBestWhileTravelling(t *testing.T) {
+	//when
+	points := DailyBest(travelling, berlin)
+
+	//then
+	want := map[string]float64{"2024-04-01": 400, "2024-04-02": 440, "2024-04-03": 450, "2024-04-04": 430}
+	if len(points) != len(want) {
+		t.Fatalf("want %d days, got %v", len(want), points)
+	}
+	for _, point := range points {
+		if want[Date(point.Day)] != point.Value {
+			t.Errorf("want %v on %s, got %v", want[Date(point.Day)], Date(point.Day), point.Value)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+// Package analytics computes statistics of peak flow readings. Everything
+// here is a pure function of its arguments, readings are loaded by callers.
+package analytics
+
+import (
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+	"math"
+	"sort"
+	"time"
+)
+
+const dateLayout = "2006-01-02"
+
+// Point is the value of a calendar day, Day counts days since 1970-01-01,
+// so gaps between days are kept.
+type Point struct {
+	Day   int
+	Value float64
+}
+
+// DailyBest returns the best reading of every day with readings, oldest
+// first. Days are the local days of the records, loc is the calendar of
+// records without a time zone. The best reading is the one that counts
+// for peak flow, lower ones are usually bad blows.
+func DailyBest(records []*models.Record, loc *time.Location) []Point {
+	best := map[int]float64{}
+	for _, record := range records {
+		day := DayOf(record.CreatedAt, record.Location(loc))
+		if value := float64(record.Value); value > best[day] {
+			best[day] = value
+		}
+	}
+
+	points := make([]Point, 0, len(best))
+	for day, value := range best {
+		points = append(points, Point{Day: day, Value: value})
+	}
+	sort.Slice(points, func(i, j int) bool {
+		return points[i].Day < points[j].Day
+	})
+	return points
+}
+
+// DayOf returns the calendar day of t in loc, as days since 1970-01-01.
+// Days are counted on the date, so they are a day apart across DST changes.
+func DayOf(t time.Time, loc *time.Location) int {
+	year, month, day := t.In(loc).Date()
+	return int(time.Date(year, month, day, 0, 0, 0, 0, time.UTC).Unix() / (24 * 60 * 60))
+}
+
+// Date formats a day counted by DayOf as 2006-01-02.
+func Date(day int) string {
+	return time.Unix(int64(day)*24*60*60, 0).UTC().Format(dateLayout)
+}
+
+// MovingAverage returns the mean of the points within the trailing window
+// of days for every point, days without readings don't count.
+func MovingAverage(points []Point, days int) []float64 {
+	averages := make([]float64, len(points))
+
+	from, sum := 0, 0.0
+	for i, point := range points {
+		sum += point.Value
+		for points[from].Day <= point.Day-days {
+			sum -= points[from].Value
+			from++
+		}
+		averages[i] = sum / float64(i-from+1)
+	}
+	return averages
+}
+
+// Slope fits a line to the points by least squares and returns its slope
+// in value per day. It is 0 for less than two distinct days.
+func Slope(points []Point) float64 {
+	if len(points) < 2 {
+		return 0
+	}
+
+	var meanDay, meanValue float64
+	for _, point := range points {
+		meanDay += float64(point.Day)
+		meanValue += point.Value
+	}
+	meanDay /= float64(len(points))
+	meanValue /= float64(len(points))
+
+	var covariance, variance float64
+	for _, point := range points {
+		dx := float64(point.Day) - meanDay
+		covariance += dx * (point.Value - meanValue)
+		variance += dx * dx
+	}
+	if variance == 0 {
+		return 0
+	}
+	return covariance / variance
+}
+
+// EWMA smooths values with the exponentially weighted moving average
+// z = lambda*x + (1-lambda)*z, starting from start.
+func EWMA(values []float64, lambda, start float64) []float64 {
+	smoothed := make([]float64, len(values))
+
+	z := start
+	for i, value := range values {
+		z = lambda*value + (1-lambda)*z
+		smoothed[i] = z
+	}
+	return smoothed
+}
+
+// LowerCUSUM accumulates how far values fall below target, beyond the slack
+// allowed for normal variation: s = max(0, s + target - slack - x). A sum
+// above a threshold signals a sustained decline, single bad days don't add up.
+func LowerCUSUM(values []float64, target, slack float64) []float64 {
+	sums := make([]float64, len(values))
+
+	s := 0.0
+	for i, value := range values {
+		s = math.Max(0, s+target-slack-value)
+		sums[i] = s
+	}
+	return sums
+}
+
+// Mean of values, 0 if there are none.
+func Mean(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+
+	sum := 0.0
+	for _, value := range values {
+		sum += value
+	}
+	return sum / float64(len(values))
+}
+
+// Correlation returns the Pearson correlation coefficient of the pairs of
+// xs and ys, from -1 to 1. It is not defined, ok is false, for fewer than
+// three pairs or if either of them doesn't vary.
+func Correlation(xs, ys []float64) (r float64, ok bool) {
+	if len(xs) != len(ys) || len(xs) < 3 {
+		return 0, false
+	}
+
+	meanX, meanY := Mean(xs), Mean(ys)
+	var covariance, varianceX, varianceY float64
+	for i := range xs {
+		dx, dy := xs[i]-meanX, ys[i]-meanY
+		covariance += dx * dy
+		varianceX += dx * dx
+		varianceY += dy * dy
+	}
+	if varianceX == 0 || varianceY == 0 {
+		return 0, false
+	}
+	return covariance / math.Sqrt(varianceX*varianceY), true
+}
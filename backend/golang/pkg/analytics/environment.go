@@ -0,0 +1,66 @@
+package analytics
+
+import "github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+
+// EnvironmentReport tells how readings go along with the environment they
+// were taken in.
+type EnvironmentReport struct {
+	Location     string                    `json:"location,omitempty"`
+	Readings     int                       `json:"readings"`
+	Observed     int                       `json:"observed"` // readings with an observation
+	Correlations []*EnvironmentCorrelation `json:"correlations"`
+}
+
+// EnvironmentCorrelation of readings with a variable of the environment.
+// R is the Pearson correlation coefficient over the readings the variable
+// was observed for, negative if readings are lower when it is higher, and
+// left out if it isn't defined, see Correlation.
+type EnvironmentCorrelation struct {
+	Variable string   `json:"variable"`
+	Pairs    int      `json:"pairs"`
+	R        *float64 `json:"r,omitempty"`
+}
+
+// environmentVariables are the variables of models.Observation correlated
+// with readings.
+var environmentVariables = []struct {
+	name  string
+	value func(*models.Observation) *float64
+}{
+	{"temperature", func(o *models.Observation) *float64 { return o.Temperature }},
+	{"humidity", func(o *models.Observation) *float64 { return o.Humidity }},
+	{"aqi", func(o *models.Observation) *float64 { return o.AQI }},
+	{"pollen", func(o *models.Observation) *float64 { return o.Pollen }},
+}
+
+// CorrelateEnvironment correlates every reading with the observation of
+// its Environment.
+func CorrelateEnvironment(records []*models.Record) *EnvironmentReport {
+	report := &EnvironmentReport{Readings: len(records), Correlations: []*EnvironmentCorrelation{}}
+	for _, record := range records {
+		if record.Environment != nil {
+			report.Observed++
+		}
+	}
+
+	for _, variable := range environmentVariables {
+		var readings, observed []float64
+		for _, record := range records {
+			if record.Environment == nil {
+				continue
+			}
+			if value := variable.value(record.Environment); value != nil {
+				readings = append(readings, float64(record.Value))
+				observed = append(observed, *value)
+			}
+		}
+
+		correlation := &EnvironmentCorrelation{Variable: variable.name, Pairs: len(readings)}
+		if r, ok := Correlation(observed, readings); ok {
+			r = Round(r)
+			correlation.R = &r
+		}
+		report.Correlations = append(report.Correlations, correlation)
+	}
+	return report
+}
@@ -0,0 +1,135 @@
+package analytics
+
+import (
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+	"math"
+	"time"
+)
+
+// TrendParams tune the trend detection, they are set by the server.
+type TrendParams struct {
+	// Days of readings looked at, up to today.
+	Days int `json:"days"`
+	// SlopeDays are the most recent days the slope is fitted to.
+	SlopeDays int `json:"slope_days"`
+	// Lambda weights the latest day in the EWMA, from 0 to 1.
+	Lambda float64 `json:"lambda"`
+	// Slack is the share of the baseline a day may fall short of it
+	// without adding to the CUSUM, as normal variation.
+	Slack float64 `json:"slack"`
+	// Threshold is the share of the baseline the CUSUM must exceed to
+	// raise the alarm.
+	Threshold float64 `json:"threshold"`
+}
+
+// DefaultTrendParams raise the alarm after about four days 13% below the
+// baseline, or a week 10% below. That is well before the red zone at 50%
+// of the personal best.
+func DefaultTrendParams() TrendParams {
+	return TrendParams{
+		Days:      90,
+		SlopeDays: 14,
+		Lambda:    0.3,
+		Slack:     0.05,
+		Threshold: 0.3,
+	}
+}
+
+// Trend of the daily best readings.
+type Trend struct {
+	Params TrendParams `json:"params"`
+	From   string      `json:"from,omitempty"`
+	To     string      `json:"to,omitempty"`
+	// Baseline is the best 7-day moving average, the level the CUSUM
+	// measures declines from.
+	Baseline float64 `json:"baseline"`
+	// Slope of the daily best in L/min per day over the last SlopeDays.
+	Slope float64 `json:"slope"`
+	// Warning is set while the latest day is in a sustained decline,
+	// which started on DeclineSince.
+	Warning      bool        `json:"warning"`
+	DeclineSince string      `json:"decline_since,omitempty"`
+	Days         []*TrendDay `json:"days"`
+}
+
+// TrendDay holds the statistics of a day with readings. The alarm is raised
+// when the CUSUM exceeds its threshold and the EWMA is below the baseline
+// as well, so it clears as soon as readings recover.
+type TrendDay struct {
+	Date  string  `json:"date"`
+	Best  float64 `json:"best"`
+	MA3   float64 `json:"ma3"`
+	MA7   float64 `json:"ma7"`
+	EWMA  float64 `json:"ewma"`
+	CUSUM float64 `json:"cusum"`
+	Alarm bool    `json:"alarm,omitempty"`
+}
+
+// NewTrend computes the trend of the records taken in the params.Days up to
+// the day of now, in the calendar of loc.
+func NewTrend(records []*models.Record, now time.Time, loc *time.Location, params TrendParams) *Trend {
+	trend := &Trend{Params: params, Days: []*TrendDay{}}
+
+	today := DayOf(now, loc)
+	var points []Point
+	for _, point := range DailyBest(records, loc) {
+		if point.Day > today-params.Days && point.Day <= today {
+			points = append(points, point)
+		}
+	}
+	if len(points) == 0 {
+		return trend
+	}
+
+	values := make([]float64, len(points))
+	for i, point := range points {
+		values[i] = point.Value
+	}
+
+	ma3 := MovingAverage(points, 3)
+	ma7 := MovingAverage(points, 7)
+	for _, average := range ma7 {
+		trend.Baseline = math.Max(trend.Baseline, average)
+	}
+
+	ewma := EWMA(values, params.Lambda, trend.Baseline)
+	cusum := LowerCUSUM(values, trend.Baseline, params.Slack*trend.Baseline)
+	threshold := params.Threshold * trend.Baseline
+
+	declineSince := 0
+	for i, point := range points {
+		day := &TrendDay{
+			Date:  Date(point.Day),
+			Best:  Round(point.Value),
+			MA3:   Round(ma3[i]),
+			MA7:   Round(ma7[i]),
+			EWMA:  Round(ewma[i]),
+			CUSUM: Round(cusum[i]),
+			Alarm: cusum[i] > threshold && ewma[i] < trend.Baseline*(1-params.Slack),
+		}
+		trend.Days = append(trend.Days, day)
+
+		if cusum[i] == 0 {
+			declineSince = i + 1
+		}
+	}
+
+	slopeFrom := 0
+	for slopeFrom < len(points) && points[slopeFrom].Day <= today-params.SlopeDays {
+		slopeFrom++
+	}
+	trend.Slope = Round(Slope(points[slopeFrom:]))
+
+	trend.From, trend.To = trend.Days[0].Date, trend.Days[len(trend.Days)-1].Date
+	trend.Baseline = Round(trend.Baseline)
+	trend.Warning = trend.Days[len(trend.Days)-1].Alarm
+	if trend.Warning {
+		trend.DeclineSince = trend.Days[declineSince].Date
+	}
+	return trend
+}
+
+// Round to two decimals, as statistics are returned.
+func Round(value float64) float64 {
+	return math.Round(value*100) / 100
+}
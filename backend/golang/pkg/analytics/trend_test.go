@@ -0,0 +1,188 @@
+package analytics
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+var berlin, _ = time.LoadLocation("Europe/Berlin")
+
+// now is the evening of the last day of every fixture.
+var now = time.Date(2024, 3, 31, 21, 0, 0, 0, berlin)
+
+// daily returns records like mock.Records, a morning and an evening reading
+// per day up to today, each morning 20 L/min below the evening. A value of
+// 0 skips the day.
+func daily(values ...float32) []*models.Record {
+	var records []*models.Record
+	for i, value := range values {
+		if value == 0 {
+			continue
+		}
+
+		day := now.AddDate(0, 0, i-len(values)+1)
+		morning := time.Date(day.Year(), day.Month(), day.Day(), 7, 30, 0, 0, berlin)
+		evening := time.Date(day.Year(), day.Month(), day.Day(), 20, 0, 0, 0, berlin)
+		records = append(records,
+			&models.Record{ID: strconv.Itoa(2 * i), CreatedAt: morning, Value: value - 20, Rev: 1},
+			&models.Record{ID: strconv.Itoa(2*i + 1), CreatedAt: evening, Value: value, Context: "evening", Rev: 1},
+		)
+	}
+	return records
+}
+
+var trendFixtures = map[string][]*models.Record{
+	"empty": nil,
+	"steady": daily(
+		500, 510, 495, 505, 500, 490, 505, 510, 500, 495,
+		505, 500, 490, 510, 500, 505, 495, 500, 510, 500),
+	// a slow decline over two weeks, still above the red zone
+	"decline": daily(
+		500, 510, 495, 505, 500, 490, 505, 510, 500, 495,
+		480, 470, 455, 445, 430, 420, 410, 395, 385, 370),
+	// single bad days don't raise the alarm
+	"outliers": daily(
+		500, 510, 495, 380, 500, 490, 505, 510, 390, 495,
+		505, 500, 490, 510, 370, 505, 495, 500, 510, 500),
+	// a decline which has recovered by today
+	"recovery": daily(
+		500, 510, 495, 505, 430, 410, 400, 405, 420, 450,
+		480, 495, 500, 505, 500, 510, 495, 500, 505, 500),
+	// days without readings don't count for averages
+	"gaps": daily(
+		500, 0, 0, 505, 500, 0, 0, 0, 490, 495,
+		0, 470, 0, 440, 0, 420, 0, 0, 400, 390),
+}
+
+func TestTrendGolden(t *testing.T) {
+	for name, records := range trendFixtures {
+		t.Run(name, func(t *testing.T) {
+			//given
+			golden := filepath.Join("testdata", "trend_"+name+".golden.json")
+
+			//when
+			trend := NewTrend(records, now, berlin, DefaultTrendParams())
+
+			//then
+			got, err := json.MarshalIndent(trend, "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, '\n')
+
+			if *update {
+				err = os.WriteFile(golden, got, 0o644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("%v, run go test ./pkg/analytics -update to create it", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("trend differs from %s, got:\n%s", golden, got)
+			}
+		})
+	}
+}
+
+func TestTrendWarnings(t *testing.T) {
+	tests := []struct {
+		fixture      string
+		wantWarning  bool
+		declineSince string
+	}{
+		{"steady", false, ""},
+		{"decline", true, "2024-03-23"},
+		{"outliers", false, ""},
+		{"recovery", false, ""},
+		{"gaps", true, "2024-03-23"},
+	}
+
+	for _, tt := range tests {
+		trend := NewTrend(trendFixtures[tt.fixture], now, berlin, DefaultTrendParams())
+
+		if trend.Warning != tt.wantWarning || trend.DeclineSince != tt.declineSince {
+			t.Errorf("%s: want warning %v since %q, got %v since %q",
+				tt.fixture, tt.wantWarning, tt.declineSince, trend.Warning, trend.DeclineSince)
+		}
+		if tt.wantWarning && trend.Slope >= 0 {
+			t.Errorf("%s: want a falling slope, got %v", tt.fixture, trend.Slope)
+		}
+	}
+}
+
+func TestTrendBeforeRedZone(t *testing.T) {
+	//given
+	records := trendFixtures["decline"]
+
+	//when
+	trend := NewTrend(records, now, berlin, DefaultTrendParams())
+
+	//then
+	for _, day := range trend.Days {
+		if day.Alarm {
+			if day.Best < trend.Baseline*0.8 {
+				t.Errorf("want the alarm while still in the green zone, first alarm on %s at %v", day.Date, day.Best)
+			}
+			return
+		}
+	}
+	t.Error("want an alarm")
+}
+
+func TestDayOfAcrossDST(t *testing.T) {
+	// Berlin switched to summer time on 2024-03-31 at 02:00
+	before := time.Date(2024, 3, 30, 23, 30, 0, 0, berlin)
+	after := time.Date(2024, 3, 31, 23, 30, 0, 0, berlin)
+
+	if DayOf(after, berlin)-DayOf(before, berlin) != 1 {
+		t.Errorf("want consecutive days across DST, got %s and %s",
+			Date(DayOf(before, berlin)), Date(DayOf(after, berlin)))
+	}
+	if got := Date(DayOf(time.Date(2024, 3, 31, 0, 30, 0, 0, time.UTC), berlin)); got != "2024-03-31" {
+		t.Errorf("want the day in Berlin, got %s", got)
+	}
+}
+
+func TestStatistics(t *testing.T) {
+	points := []Point{{0, 10}, {1, 20}, {2, 30}, {5, 60}}
+
+	tests := []struct {
+		name string
+		got  []float64
+		want []float64
+	}{
+		{"moving average of 3 days", MovingAverage(points, 3), []float64{10, 15, 20, 60}},
+		{"moving average of 7 days", MovingAverage(points, 7), []float64{10, 15, 20, 30}},
+		{"slope", []float64{Slope(points)}, []float64{10}},
+		{"slope of one point", []float64{Slope(points[:1])}, []float64{0}},
+		{"ewma", EWMA([]float64{10, 20, 20}, 0.5, 0), []float64{5, 12.5, 16.25}},
+		{"lower cusum", LowerCUSUM([]float64{100, 80, 90, 70, 120}, 100, 5), []float64{0, 15, 20, 45, 20}},
+	}
+
+	for _, tt := range tests {
+		if len(tt.got) != len(tt.want) {
+			t.Errorf("%s: want %v, got %v", tt.name, tt.want, tt.got)
+			continue
+		}
+		for i := range tt.want {
+			if math.Abs(tt.got[i]-tt.want[i]) > 1e-9 {
+				t.Errorf("%s: want %v, got %v", tt.name, tt.want, tt.got)
+				break
+			}
+		}
+	}
+}
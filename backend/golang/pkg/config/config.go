@@ -0,0 +1,289 @@
+// Package config holds the typed configuration of the server. It is loaded
+// from defaults, a YAML or TOML file, environment variables and command line
+// flags, each source overriding the previous ones.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/environment"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/logging"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/origin"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/tracing"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Fields are bound to sources by struct tags: yaml and toml name them in the
+// config file, env names the environment variable and flag the command line
+// flag, described by usage. Fields tagged secret are redacted when printed,
+// secret:"url" only redacts the password of a URL.
+type Config struct {
+	Server      Server      `yaml:"server" toml:"server"`
+	Mongo       Mongo       `yaml:"mongo" toml:"mongo"`
+	Log         Log         `yaml:"log" toml:"log"`
+	User        User        `yaml:"user" toml:"user"`
+	Records     Records     `yaml:"records" toml:"records"`
+	QuickLinks  QuickLinks  `yaml:"quick_links" toml:"quick_links"`
+	Shares      Shares      `yaml:"shares" toml:"shares"`
+	Auth        Auth        `yaml:"auth" toml:"auth"`
+	Dashboard   Dashboard   `yaml:"dashboard" toml:"dashboard"`
+	Idempotency Idempotency `yaml:"idempotency" toml:"idempotency"`
+	Tracing     Tracing     `yaml:"tracing" toml:"tracing"`
+	CORS        CORS        `yaml:"cors" toml:"cors"`
+	Environment Environment `yaml:"environment" toml:"environment"`
+}
+
+type Server struct {
+	Addr             string        `yaml:"addr" toml:"addr" env:"ADDR" flag:"addr" usage:"address to listen on"`
+	StaticDir        string        `yaml:"static_dir" toml:"static_dir" env:"STATIC_DIR" flag:"static-dir" usage:"serve the web UI from this directory instead of the embedded one"`
+	APIBaseURL       string        `yaml:"api_base_url" toml:"api_base_url" env:"API_BASE_URL" flag:"api-base-url" usage:"URL the web UI sends API requests to, the same origin if empty"`
+	AuthorizedIP     string        `yaml:"authorized_ip" toml:"authorized_ip" env:"AUTHORIZED_IP" flag:"authorized-ip" usage:"only let admins act as admins from this caller IP, empty allows any"`
+	ReadinessTimeout time.Duration `yaml:"readiness_timeout" toml:"readiness_timeout" env:"READINESS_TIMEOUT" flag:"readiness-timeout" usage:"timeout of every readiness check"`
+	PrintRoutes      bool          `yaml:"print_routes" toml:"print_routes" env:"ROUTES" flag:"routes" usage:"print the OpenAPI document on startup"`
+}
+
+type Mongo struct {
+	DSN string `yaml:"dsn" toml:"dsn" env:"DSN" flag:"dsn" usage:"MongoDB connection string" secret:"url"`
+}
+
+type Log struct {
+	Level string `yaml:"level" toml:"level" env:"LOG_LEVEL" flag:"log-level" usage:"debug, info, warn or error"`
+}
+
+// User holds the settings of the user of the server.
+type User struct {
+	Timezone string `yaml:"timezone" toml:"timezone" env:"USER_TIMEZONE" flag:"user-timezone" usage:"IANA time zone like Europe/Berlin or UTC offset like +05:30 of readings sent without one"`
+}
+
+type Records struct {
+	SimpleAddEnabled bool `yaml:"simple_add_enabled" toml:"simple_add_enabled" env:"SIMPLE_ADD_ENABLED" flag:"simple-add-enabled" usage:"enable the legacy GET simple-add route"`
+}
+
+type QuickLinks struct {
+	Secret string        `yaml:"secret" toml:"secret" env:"QUICK_LINK_SECRET" flag:"quick-link-secret" usage:"key signing quick-add links, random if empty" secret:"true"`
+	TTL    time.Duration `yaml:"ttl" toml:"ttl" env:"QUICK_LINK_TTL" flag:"quick-link-ttl" usage:"validity of quick-add links"`
+}
+
+// Shares are read-only links for others, like a doctor, valid for TTL
+// unless the owner sets another expiry up to MaxTTL.
+type Shares struct {
+	Secret string        `yaml:"secret" toml:"secret" env:"SHARE_SECRET" flag:"share-secret" usage:"key signing share links, random if empty" secret:"true"`
+	TTL    time.Duration `yaml:"ttl" toml:"ttl" env:"SHARE_TTL" flag:"share-ttl" usage:"validity of share links without an expiry"`
+	MaxTTL time.Duration `yaml:"max_ttl" toml:"max_ttl" env:"SHARE_MAX_TTL" flag:"share-max-ttl" usage:"longest validity of share links"`
+}
+
+// minAdminTokenLength keeps the admin token from being guessed.
+const minAdminTokenLength = 16
+
+// Auth is the access policy. An open one lets anyone, without a token as
+// well, use the household routes and sign up, like before there were
+// accounts. It is closed by default. AdminToken lets the first admin in.
+// Browsers log in to the pages with a token for a session of SessionTTL.
+type Auth struct {
+	Open          bool          `yaml:"open" toml:"open" env:"AUTH_OPEN" flag:"auth-open" usage:"let requests without a token use the household routes and sign up"`
+	AdminToken    string        `yaml:"admin_token" toml:"admin_token" env:"ADMIN_TOKEN" flag:"admin-token" usage:"bearer token of an admin account created on startup, none if empty" secret:"true"`
+	SessionSecret string        `yaml:"session_secret" toml:"session_secret" env:"SESSION_SECRET" flag:"session-secret" usage:"key signing session cookies of browsers, random if empty" secret:"true"`
+	SessionTTL    time.Duration `yaml:"session_ttl" toml:"session_ttl" env:"SESSION_TTL" flag:"session-ttl" usage:"validity of browser sessions"`
+}
+
+type Dashboard struct {
+	PersonalBest float32 `yaml:"personal_best" toml:"personal_best" env:"PERSONAL_BEST" flag:"personal-best" usage:"personal best in L/min for the zones, the best reading if 0"`
+	CSRFSecret   string  `yaml:"csrf_secret" toml:"csrf_secret" env:"CSRF_SECRET" flag:"csrf-secret" usage:"key signing CSRF tokens of the dashboard, random if empty" secret:"true"`
+}
+
+type Idempotency struct {
+	TTL time.Duration `yaml:"ttl" toml:"ttl" env:"IDEMPOTENCY_TTL" flag:"idempotency-ttl" usage:"how long idempotency keys are remembered"`
+}
+
+type Tracing struct {
+	Exporter    string  `yaml:"exporter" toml:"exporter" env:"TRACING_EXPORTER" flag:"tracing-exporter" usage:"none, stdout or otlp"`
+	Endpoint    string  `yaml:"endpoint" toml:"endpoint" env:"TRACING_ENDPOINT" flag:"tracing-endpoint" usage:"OTLP/HTTP collector address"`
+	Insecure    bool    `yaml:"insecure" toml:"insecure" env:"TRACING_INSECURE" flag:"tracing-insecure" usage:"disable TLS for the OTLP exporter"`
+	SampleRatio float64 `yaml:"sample_ratio" toml:"sample_ratio" env:"TRACING_SAMPLE_RATIO" flag:"tracing-sample-ratio" usage:"ratio of new traces to sample"`
+	ServiceName string  `yaml:"service_name" toml:"service_name" env:"OTEL_SERVICE_NAME" flag:"tracing-service-name" usage:"service name of the spans"`
+}
+
+// CORS origins are exact like "https://app.example.com" or allow any
+// subdomain like "https://*.example.com", "*" allows any origin but can't be
+// combined with credentials.
+type CORS struct {
+	AllowedOrigins   []string      `yaml:"allowed_origins" toml:"allowed_origins" env:"CORS_ALLOWED_ORIGINS" flag:"cors-allowed-origins" usage:"comma separated origins allowed to call the API, none if empty"`
+	AllowedMethods   []string      `yaml:"allowed_methods" toml:"allowed_methods" env:"CORS_ALLOWED_METHODS" flag:"cors-allowed-methods" usage:"comma separated methods allowed in cross-origin requests"`
+	AllowedHeaders   []string      `yaml:"allowed_headers" toml:"allowed_headers" env:"CORS_ALLOWED_HEADERS" flag:"cors-allowed-headers" usage:"comma separated request headers allowed in cross-origin requests"`
+	ExposedHeaders   []string      `yaml:"exposed_headers" toml:"exposed_headers" env:"CORS_EXPOSED_HEADERS" flag:"cors-exposed-headers" usage:"comma separated response headers readable by cross-origin callers"`
+	AllowCredentials bool          `yaml:"allow_credentials" toml:"allow_credentials" env:"CORS_ALLOW_CREDENTIALS" flag:"cors-allow-credentials" usage:"allow cookies and authorization headers in cross-origin requests"`
+	MaxAge           time.Duration `yaml:"max_age" toml:"max_age" env:"CORS_MAX_AGE" flag:"cors-max-age" usage:"how long browsers may cache preflight responses"`
+}
+
+// Environment selects the provider of observations like pollen counts
+// attached to readings, looked up for Location.
+type Environment struct {
+	Provider string        `yaml:"provider" toml:"provider" env:"ENVIRONMENT_PROVIDER" flag:"environment-provider" usage:"none, csv or http"`
+	Location string        `yaml:"location" toml:"location" env:"ENVIRONMENT_LOCATION" flag:"environment-location" usage:"location of the user observations are looked up for, like a city"`
+	File     string        `yaml:"file" toml:"file" env:"ENVIRONMENT_FILE" flag:"environment-file" usage:"CSV file of observations of the csv provider"`
+	URL      string        `yaml:"url" toml:"url" env:"ENVIRONMENT_URL" flag:"environment-url" usage:"URL template of the http provider, {location} and {time} are replaced" secret:"true"`
+	Timeout  time.Duration `yaml:"timeout" toml:"timeout" env:"ENVIRONMENT_TIMEOUT" flag:"environment-timeout" usage:"timeout of requests of the http provider"`
+	MaxAge   time.Duration `yaml:"max_age" toml:"max_age" env:"ENVIRONMENT_MAX_AGE" flag:"environment-max-age" usage:"oldest observation of the csv provider before a reading that counts for it"`
+}
+
+// Default returns the configuration used for anything not set otherwise.
+func Default() *Config {
+	return &Config{
+		Server: Server{
+			Addr:             ":3333",
+			ReadinessTimeout: 2 * time.Second,
+		},
+		Mongo: Mongo{
+			DSN: "mongodb://mongo:27017",
+		},
+		Log: Log{
+			Level: "info",
+		},
+		User: User{
+			Timezone: "UTC",
+		},
+		Auth: Auth{
+			SessionTTL: 7 * 24 * time.Hour,
+		},
+		QuickLinks: QuickLinks{
+			TTL: 168 * time.Hour,
+		},
+		Shares: Shares{
+			TTL:    14 * 24 * time.Hour,
+			MaxTTL: 90 * 24 * time.Hour,
+		},
+		Idempotency: Idempotency{
+			TTL: 24 * time.Hour,
+		},
+		Tracing: Tracing{
+			Exporter:    tracing.ExporterNone,
+			SampleRatio: 1,
+			ServiceName: "simple-peak-flowmeter",
+		},
+		CORS: CORS{
+			AllowedOrigins: []string{},
+			AllowedMethods: []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+			AllowedHeaders: []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token", "Idempotency-Key"},
+			ExposedHeaders: []string{"Link", "Idempotent-Replayed", "Deprecation"},
+			MaxAge:         5 * time.Minute, // maximum value not ignored by any of major browsers
+		},
+		Environment: Environment{
+			Provider: environment.ProviderNone,
+			Timeout:  5 * time.Second,
+			MaxAge:   24 * time.Hour, // daily pollen counts still count in the evening
+		},
+	}
+}
+
+// Validate reports every invalid setting at once.
+func (c *Config) Validate() error {
+	var errs []error
+	invalid := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("config: "+format, args...))
+	}
+
+	if _, _, err := net.SplitHostPort(c.Server.Addr); err != nil {
+		invalid("server.addr %q is not a host:port address", c.Server.Addr)
+	}
+	if c.Server.AuthorizedIP != "" && net.ParseIP(c.Server.AuthorizedIP) == nil {
+		invalid("server.authorized_ip %q is not an IP address", c.Server.AuthorizedIP)
+	}
+	if c.Server.APIBaseURL != "" {
+		base, err := url.Parse(c.Server.APIBaseURL)
+		if err != nil || (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" ||
+			base.RawQuery != "" || strings.HasSuffix(base.Path, "/") {
+			invalid("server.api_base_url must be an http(s) URL without a trailing slash")
+		}
+	}
+	if c.Server.ReadinessTimeout <= 0 {
+		invalid("server.readiness_timeout must be positive")
+	}
+
+	dsn, err := url.Parse(c.Mongo.DSN)
+	if err != nil || (dsn.Scheme != "mongodb" && dsn.Scheme != "mongodb+srv") {
+		invalid("mongo.dsn must be a mongodb:// or mongodb+srv:// URL")
+	}
+
+	if _, err := logging.ParseLevel(c.Log.Level); err != nil {
+		invalid("log.level: %v", err)
+	}
+
+	if _, err := models.LoadTimezone(c.User.Timezone); err != nil {
+		invalid("user.timezone: %v", err)
+	}
+
+	if c.Auth.SessionTTL <= 0 {
+		invalid("auth.session_ttl must be positive")
+	}
+	if c.QuickLinks.TTL <= 0 {
+		invalid("quick_links.ttl must be positive")
+	}
+	if c.Shares.TTL <= 0 {
+		invalid("shares.ttl must be positive")
+	}
+	if c.Shares.MaxTTL < c.Shares.TTL {
+		invalid("shares.max_ttl must not be shorter than shares.ttl")
+	}
+	if c.Auth.AdminToken != "" && len(c.Auth.AdminToken) < minAdminTokenLength {
+		invalid("auth.admin_token must be at least %d characters", minAdminTokenLength)
+	}
+	if c.Dashboard.PersonalBest < 0 {
+		invalid("dashboard.personal_best must not be negative")
+	}
+	if c.Idempotency.TTL <= 0 {
+		invalid("idempotency.ttl must be positive")
+	}
+
+	switch c.Tracing.Exporter {
+	case tracing.ExporterNone, tracing.ExporterStdout, tracing.ExporterOTLP:
+	default:
+		invalid("tracing.exporter %q must be one of none, stdout or otlp", c.Tracing.Exporter)
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		invalid("tracing.sample_ratio must be between 0 and 1")
+	}
+
+	origins, err := origin.NewMatcher(c.CORS.AllowedOrigins)
+	if err != nil {
+		invalid("cors.allowed_origins: %v", err)
+	} else if origins.AllowsAny() && c.CORS.AllowCredentials {
+		invalid("cors.allowed_origins can't allow any origin with cors.allow_credentials, browsers reject it")
+	}
+	for _, method := range c.CORS.AllowedMethods {
+		if method != strings.ToUpper(method) || strings.ContainsAny(method, " ,") {
+			invalid("cors.allowed_methods: %q is not an upper case method", method)
+		}
+	}
+	if c.CORS.MaxAge < 0 {
+		invalid("cors.max_age must not be negative")
+	}
+
+	switch c.Environment.Provider {
+	case environment.ProviderNone:
+	case environment.ProviderCSV:
+		if c.Environment.File == "" {
+			invalid("environment.file must be set for the csv provider")
+		}
+		if c.Environment.MaxAge <= 0 {
+			invalid("environment.max_age must be positive")
+		}
+	case environment.ProviderHTTP:
+		if _, err := environment.NewHTTPProvider(c.Environment.URL, nil); err != nil {
+			invalid("environment.url: %v", err)
+		}
+		if c.Environment.Timeout <= 0 {
+			invalid("environment.timeout must be positive")
+		}
+	default:
+		invalid("environment.provider %q must be one of none, csv or http", c.Environment.Provider)
+	}
+	if c.Environment.Provider != environment.ProviderNone && c.Environment.Location == "" {
+		invalid("environment.location must be set for the %s provider", c.Environment.Provider)
+	}
+
+	return errors.Join(errs...)
+}
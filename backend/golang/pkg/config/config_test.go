@@ -0,0 +1,220 @@
+package config
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	err := os.WriteFile(path, []byte(content), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func env(values map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		value, ok := values[key]
+		return value, ok
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	yamlFile := writeFile(t, "config.yaml", `
+server:
+  addr: ":4000"
+  readiness_timeout: 5s
+mongo:
+  dsn: mongodb://file:27017
+log:
+  level: warn
+cors:
+  allowed_origins: [https://file.example]
+`)
+	tomlFile := writeFile(t, "config.toml", `
+[server]
+addr = ":4000"
+readiness_timeout = "5s"
+
+[mongo]
+dsn = "mongodb://file:27017"
+
+[log]
+level = "warn"
+
+[cors]
+allowed_origins = ["https://file.example"]
+`)
+
+	for _, file := range []string{yamlFile, tomlFile} {
+		t.Run(filepath.Ext(file), func(t *testing.T) {
+			//when
+			config, options, err := Load("web",
+				[]string{"--config", file, "--log-level", "debug"},
+				env(map[string]string{
+					"DSN":                  "mongodb://env:27017",
+					"LOG_LEVEL":            "error",
+					"CORS_ALLOWED_ORIGINS": "https://a.example, https://b.example",
+				}),
+				io.Discard)
+
+			//then
+			if err != nil {
+				t.Fatal(err)
+			}
+			if options.File != file {
+				t.Errorf("want config file %s, got %s", file, options.File)
+			}
+
+			if config.Server.Addr != ":4000" || config.Server.ReadinessTimeout != 5*time.Second {
+				t.Errorf("want file to override defaults, got %+v", config.Server)
+			}
+			if config.Mongo.DSN != "mongodb://env:27017" {
+				t.Errorf("want env to override file, got %s", config.Mongo.DSN)
+			}
+			if config.Log.Level != "debug" {
+				t.Errorf("want flags to override env, got %s", config.Log.Level)
+			}
+			if strings.Join(config.CORS.AllowedOrigins, " ") != "https://a.example https://b.example" {
+				t.Errorf("want env list, got %v", config.CORS.AllowedOrigins)
+			}
+			if config.Idempotency.TTL != 24*time.Hour {
+				t.Errorf("want defaults for anything unset, got %s", config.Idempotency.TTL)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFileFromEnv(t *testing.T) {
+	file := writeFile(t, "config.yml", "records:\n  simple_add_enabled: true\n")
+
+	config, _, err := Load("web", nil, env(map[string]string{"CONFIG_FILE": file}), io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !config.Records.SimpleAddEnabled {
+		t.Errorf("want config file named by CONFIG_FILE to be loaded")
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+	}{
+		{"unknown flag", []string{"--nope"}, nil},
+		{"invalid flag value", []string{"--idempotency-ttl", "soon"}, nil},
+		{"invalid env value", nil, map[string]string{"TRACING_INSECURE": "maybe"}},
+		{"unknown file key", []string{"--config", writeFile(t, "c.yaml", "server:\n  adr: x\n")}, nil},
+		{"unknown file format", []string{"--config", writeFile(t, "c.json", "{}")}, nil},
+		{"missing file", []string{"--config", "missing.yaml"}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := Load("web", tt.args, env(tt.env), io.Discard)
+			if err == nil {
+				t.Errorf("want error")
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	config := Default()
+	if err := config.Validate(); err != nil {
+		t.Fatalf("want defaults to be valid, got %v", err)
+	}
+
+	config.Server.Addr = "3333"
+	config.Mongo.DSN = "postgres://db"
+	config.Tracing.SampleRatio = 2
+	config.CORS.AllowedOrigins = []string{"*"}
+	config.CORS.AllowCredentials = true
+	config.User.Timezone = "Local"
+	config.Environment.Provider = "http"
+	config.Environment.URL = "https://env.example.com/observations"
+	config.Shares.MaxTTL = time.Hour
+	config.Auth.AdminToken = "short"
+
+	err := config.Validate()
+	if err == nil {
+		t.Fatal("want validation errors")
+	}
+	for _, setting := range []string{"server.addr", "mongo.dsn", "tracing.sample_ratio", "cors.allow_credentials", "user.timezone",
+		"environment.url", "environment.location", "shares.max_ttl", "auth.admin_token"} {
+		if !strings.Contains(err.Error(), setting) {
+			t.Errorf("want %s to be reported, got %v", setting, err)
+		}
+	}
+}
+
+func TestPrintRedactsSecrets(t *testing.T) {
+	config := Default()
+	config.Mongo.DSN = "mongodb://user:hunter2@db:27017"
+	config.QuickLinks.Secret = "s3cr3t"
+
+	var out bytes.Buffer
+	err := Print(&out, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	printed := out.String()
+	if strings.Contains(printed, "hunter2") || strings.Contains(printed, "s3cr3t") {
+		t.Errorf("secrets must be redacted:\n%s", printed)
+	}
+	if !strings.Contains(printed, "mongodb://user:REDACTED@db:27017") || !strings.Contains(printed, "ttl: 24h0m0s") {
+		t.Errorf("want other settings printed as is:\n%s", printed)
+	}
+	if config.QuickLinks.Secret != "s3cr3t" {
+		t.Errorf("printing must not change the config")
+	}
+
+	// the printed config is a valid config file
+	file := writeFile(t, "printed.yaml", printed)
+	loaded, _, err := Load("web", []string{"--config", file}, env(nil), io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Idempotency.TTL != config.Idempotency.TTL {
+		t.Errorf("want printed config to load, got %s", loaded.Idempotency.TTL)
+	}
+}
+
+func TestValidateCorsOrigins(t *testing.T) {
+	tests := []struct {
+		origin string
+		valid  bool
+	}{
+		{"https://app.example.com", true},
+		{"http://localhost:3000", true},
+		{"https://*.example.com", true},
+		{"*", true},
+		{"app.example.com", false},
+		{"https://app.example.com/path", false},
+		{"https://*", false},
+		{"https://app.*.com", false},
+		{"ftp://example.com", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.origin, func(t *testing.T) {
+			config := Default()
+			config.CORS.AllowedOrigins = []string{tt.origin}
+
+			err := config.Validate()
+			if (err == nil) != tt.valid {
+				t.Errorf("want valid %v, got %v", tt.valid, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+package config
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const envConfigFile = "CONFIG_FILE"
+
+// Options are given on the command line only, they control loading.
+type Options struct {
+	// File is the YAML or TOML config file, also set by CONFIG_FILE.
+	File string
+	// PrintConfig asks to print the effective config instead of serving.
+	PrintConfig bool
+}
+
+// field is a leaf setting of Config, bound to its sources.
+type field struct {
+	path  string
+	value reflect.Value
+	tag   reflect.StructTag
+}
+
+// Load builds the configuration from defaults, the config file, environment
+// variables looked up with lookupEnv and command line args, in that order.
+// It doesn't validate the result.
+func Load(name string, args []string, lookupEnv func(string) (string, bool), output io.Writer) (*Config, *Options, error) {
+	config := Default()
+	fields := fieldsOf(config)
+
+	options := &Options{}
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(output)
+	flags.StringVar(&options.File, "config", "", "YAML or TOML config file, or set "+envConfigFile)
+	flags.BoolVar(&options.PrintConfig, "print-config", false, "print the effective config with secrets redacted and exit")
+
+	// flags are only collected here, they must override the file and env
+	flagValues := map[string]string{}
+	for _, f := range fields {
+		f := f
+		flags.Func(f.tag.Get("flag"), f.usage(), func(value string) error {
+			err := setValue(f.value.Type(), reflect.New(f.value.Type()).Elem(), value)
+			flagValues[f.path] = value
+			return err
+		})
+	}
+
+	err := flags.Parse(args)
+	if err != nil {
+		return nil, nil, err
+	}
+	if flags.NArg() > 0 {
+		return nil, nil, fmt.Errorf("config: unexpected arguments %v", flags.Args())
+	}
+
+	if options.File == "" {
+		options.File, _ = lookupEnv(envConfigFile)
+	}
+	if options.File != "" {
+		err = loadFile(options.File, config)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for _, f := range fields {
+		if value, ok := lookupEnv(f.tag.Get("env")); ok {
+			err = setValue(f.value.Type(), f.value, value)
+			if err != nil {
+				return nil, nil, fmt.Errorf("config: env %s: %w", f.tag.Get("env"), err)
+			}
+		}
+	}
+
+	for _, f := range fields {
+		if value, ok := flagValues[f.path]; ok {
+			_ = setValue(f.value.Type(), f.value, value) // checked while parsing
+		}
+	}
+
+	return config, options, nil
+}
+
+func loadFile(path string, config *Config) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(content))
+		decoder.KnownFields(true)
+		err = decoder.Decode(config)
+		if err == io.EOF {
+			err = nil
+		}
+	case ".toml":
+		var meta toml.MetaData
+		meta, err = toml.Decode(string(content), config)
+		if err == nil && len(meta.Undecoded()) > 0 {
+			err = fmt.Errorf("unknown keys %v", meta.Undecoded())
+		}
+	default:
+		return fmt.Errorf("config: %s is neither a .yaml, .yml nor .toml file", path)
+	}
+	if err != nil {
+		return fmt.Errorf("config: %s: %w", path, err)
+	}
+	return nil
+}
+
+// fieldsOf lists the leaf settings of the config sections.
+func fieldsOf(config *Config) []*field {
+	var fields []*field
+
+	sections := reflect.ValueOf(config).Elem()
+	for i := 0; i < sections.NumField(); i++ {
+		section := sections.Field(i)
+		sectionName := sections.Type().Field(i).Tag.Get("yaml")
+
+		for j := 0; j < section.NumField(); j++ {
+			structField := section.Type().Field(j)
+			fields = append(fields, &field{
+				path:  sectionName + "." + structField.Tag.Get("yaml"),
+				value: section.Field(j),
+				tag:   structField.Tag,
+			})
+		}
+	}
+	return fields
+}
+
+func (f *field) usage() string {
+	return fmt.Sprintf("%s (%s, env %s)", f.tag.Get("usage"), f.path, f.tag.Get("env"))
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// setValue parses value into target, lists are comma separated.
+func setValue(t reflect.Type, target reflect.Value, value string) error {
+	switch {
+	case t == durationType:
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		target.SetInt(int64(duration))
+		return nil
+	case t.Kind() == reflect.String:
+		target.SetString(value)
+		return nil
+	case t.Kind() == reflect.Bool:
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		target.SetBool(parsed)
+		return nil
+	case t.Kind() == reflect.Float64 || t.Kind() == reflect.Float32:
+		parsed, err := strconv.ParseFloat(value, t.Bits())
+		if err != nil {
+			return err
+		}
+		target.SetFloat(parsed)
+		return nil
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.String:
+		items := []string{}
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		target.Set(reflect.ValueOf(items))
+		return nil
+	}
+	return fmt.Errorf("unsupported setting type %s", t)
+}
@@ -0,0 +1,66 @@
+package config
+
+import (
+	"gopkg.in/yaml.v3"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const redacted = "REDACTED"
+
+// Print writes the config as YAML, which can be used as a config file,
+// with secrets redacted.
+func Print(w io.Writer, config *Config) error {
+	printed := *config
+	for _, f := range fieldsOf(&printed) {
+		switch f.tag.Get("secret") {
+		case "true":
+			if f.value.String() != "" {
+				f.value.SetString(redacted)
+			}
+		case "url":
+			f.value.SetString(redactURL(f.value.String()))
+		}
+	}
+
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	err := encoder.Encode(durations(&printed))
+	if err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+// redactURL hides the password of a URL, anything unparsable entirely.
+func redactURL(raw string) string {
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		return redacted
+	}
+	if _, hasPassword := parsed.User.Password(); hasPassword {
+		parsed.User = url.UserPassword(parsed.User.Username(), redacted)
+	}
+	return parsed.String()
+}
+
+// durations converts the config to nested maps, printing durations as
+// strings like "24h0m0s" rather than nanoseconds.
+func durations(config *Config) map[string]map[string]interface{} {
+	printed := map[string]map[string]interface{}{}
+	for _, f := range fieldsOf(config) {
+		section, name, _ := strings.Cut(f.path, ".")
+		if printed[section] == nil {
+			printed[section] = map[string]interface{}{}
+		}
+
+		value := f.value.Interface()
+		if duration, ok := value.(time.Duration); ok {
+			value = duration.String()
+		}
+		printed[section][name] = value
+	}
+	return printed
+}
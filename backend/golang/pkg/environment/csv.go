@@ -0,0 +1,136 @@
+package environment
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CSVProvider serves observations read from a CSV file once. The header
+// names the columns: time, an RFC 3339 timestamp or a date in UTC, and
+// any of location, temperature, humidity, aqi and pollen. Empty cells
+// aren't observed, rows without a location apply to every location.
+type CSVProvider struct {
+	maxAge time.Duration
+	// observations per location oldest first, "" for any location
+	observations map[string][]*models.Observation
+}
+
+// LoadCSV reads the observations of the CSV file at path.
+func LoadCSV(path string, maxAge time.Duration) (*CSVProvider, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("environment: %w", err)
+	}
+	defer file.Close()
+
+	return NewCSVProvider(file, maxAge)
+}
+
+// NewCSVProvider reads the observations of r, the latest one before a
+// reading counts for it up to maxAge.
+func NewCSVProvider(r io.Reader, maxAge time.Duration) (*CSVProvider, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("environment: reading the CSV header: %w", err)
+	}
+	columns := map[string]int{}
+	for index, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = index
+	}
+	if _, ok := columns["time"]; !ok {
+		return nil, fmt.Errorf("environment: the CSV has no time column")
+	}
+
+	p := &CSVProvider{maxAge: maxAge, observations: map[string][]*models.Observation{}}
+	for line := 2; ; line++ {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("environment: %w", err)
+		}
+
+		observation, err := parseRow(row, columns)
+		if err != nil {
+			return nil, fmt.Errorf("environment: line %d: %w", line, err)
+		}
+		p.observations[observation.Location] = append(p.observations[observation.Location], observation)
+	}
+
+	for _, observations := range p.observations {
+		sort.SliceStable(observations, func(i, j int) bool {
+			return observations[i].Time.Before(observations[j].Time)
+		})
+	}
+	return p, nil
+}
+
+func parseRow(row []string, columns map[string]int) (*models.Observation, error) {
+	cell := func(name string) string {
+		if index, ok := columns[name]; ok && index < len(row) {
+			return strings.TrimSpace(row[index])
+		}
+		return ""
+	}
+
+	observation := &models.Observation{Location: cell("location")}
+	var err error
+	observation.Time, err = time.Parse(time.RFC3339, cell("time"))
+	if err != nil {
+		observation.Time, err = time.Parse(time.DateOnly, cell("time"))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid time %q", cell("time"))
+	}
+
+	for name, value := range map[string]**float64{
+		"temperature": &observation.Temperature,
+		"humidity":    &observation.Humidity,
+		"aqi":         &observation.AQI,
+		"pollen":      &observation.Pollen,
+	} {
+		if cell(name) == "" {
+			continue
+		}
+		number, err := strconv.ParseFloat(cell(name), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q", name, cell(name))
+		}
+		*value = &number
+	}
+	return observation, nil
+}
+
+func (p *CSVProvider) Observe(ctx context.Context, location string, t time.Time) (*models.Observation, error) {
+	var latest *models.Observation
+	for _, key := range []string{location, ""} {
+		observations := p.observations[key]
+		// the first observation after t, the one before is the latest
+		index := sort.Search(len(observations), func(i int) bool {
+			return observations[i].Time.After(t)
+		})
+		if index > 0 && (latest == nil || observations[index-1].Time.After(latest.Time)) {
+			latest = observations[index-1]
+		}
+	}
+	if latest == nil || t.Sub(latest.Time) > p.maxAge {
+		return nil, ErrNoObservation
+	}
+
+	observation := *latest
+	observation.Location = location
+	return &observation, nil
+}
@@ -0,0 +1,128 @@
+// Package environment looks up observations of the environment, like the
+// weather, air quality or pollen counts, at the time of readings. Providers
+// are pluggable: a CSV file or any HTTP service answering in JSON.
+package environment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var ErrNoObservation = errors.New("environment: no observation found")
+
+// Provider looks up observations keyed by location and time.
+type Provider interface {
+	// Observe returns the latest observation at location taken at or
+	// before t, ErrNoObservation if there is none recent enough.
+	Observe(ctx context.Context, location string, t time.Time) (*models.Observation, error)
+}
+
+const (
+	ProviderNone = "none"
+	ProviderCSV  = "csv"
+	ProviderHTTP = "http"
+)
+
+// Config selects where observations come from.
+type Config struct {
+	// Provider is one of ProviderNone, ProviderCSV or ProviderHTTP.
+	Provider string
+	// File of the CSV provider.
+	File string
+	// URL template of the HTTP provider, see NewHTTPProvider.
+	URL string
+	// Timeout of requests of the HTTP provider.
+	Timeout time.Duration
+	// MaxAge of the latest observation before a reading of the CSV
+	// provider, older ones don't count for it.
+	MaxAge time.Duration
+}
+
+// New creates the configured provider, nil for ProviderNone.
+func New(config Config) (Provider, error) {
+	switch config.Provider {
+	case ProviderNone, "":
+		return nil, nil
+	case ProviderCSV:
+		return LoadCSV(config.File, config.MaxAge)
+	case ProviderHTTP:
+		return NewHTTPProvider(config.URL, &http.Client{Timeout: config.Timeout})
+	default:
+		return nil, fmt.Errorf("environment: unknown provider %q", config.Provider)
+	}
+}
+
+// maxConcurrentLookups bounds the lookups of ObserveAll running at once.
+const maxConcurrentLookups = 8
+
+// ObserveAll looks up the observations at location at each of times at
+// once, equal times only once and at most maxConcurrentLookups at a time.
+// It returns an observation or an error per time, ErrNoObservation if
+// there is none. The first other error cancels the lookups left, so a
+// provider which is down is waited for once per batch.
+func ObserveAll(ctx context.Context, provider Provider, location string, times []time.Time) ([]*models.Observation, []error) {
+	observations := make([]*models.Observation, len(times))
+	errs := make([]error, len(times))
+	for index := range errs {
+		errs[index] = context.Canceled // until looked up
+	}
+
+	indexes := map[time.Time][]int{}
+	var unique []time.Time
+	for index, t := range times {
+		t = t.UTC()
+		if _, ok := indexes[t]; !ok {
+			unique = append(unique, t)
+		}
+		indexes[t] = append(indexes[t], index)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	jobs := make(chan time.Time)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for worker := 0; worker < min(maxConcurrentLookups, len(unique)); worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range jobs {
+				if ctx.Err() != nil {
+					continue
+				}
+				observation, err := provider.Observe(ctx, location, t)
+				if err != nil && !errors.Is(err, ErrNoObservation) {
+					cancel()
+				}
+
+				mu.Lock()
+				for _, index := range indexes[t] {
+					errs[index] = err
+					if observation != nil {
+						copied := *observation
+						observations[index] = &copied
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+send:
+	for _, t := range unique {
+		select {
+		case jobs <- t:
+		case <-ctx.Done():
+			break send
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	return observations, errs
+}
@@ -0,0 +1,311 @@
+package environment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/models/mock"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubProvider observes a temperature of the hour of the day, and fails
+// for the location "down".
+type stubProvider struct {
+	mu    sync.Mutex
+	calls int
+}
+
+func (p *stubProvider) Observe(ctx context.Context, location string, t time.Time) (*models.Observation, error) {
+	p.mu.Lock()
+	p.calls++
+	p.mu.Unlock()
+	switch location {
+	case "nowhere":
+		return nil, ErrNoObservation
+	case "down":
+		return nil, errors.New("connection refused")
+	}
+	temperature := float64(t.Hour())
+	return &models.Observation{Location: location, Time: t, Temperature: &temperature}, nil
+}
+
+func date(day, hour int) time.Time {
+	return time.Date(2024, time.May, day, hour, 0, 0, 0, time.UTC)
+}
+
+func TestCSVProvider(t *testing.T) {
+	//given
+	provider, err := NewCSVProvider(strings.NewReader(`time,location,temperature,pollen
+2024-05-02T12:00:00Z,Berlin,18.5,
+2024-05-01,,,3
+2024-05-01T06:00:00Z,Berlin,9,
+`), 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name            string
+		location        string
+		time            time.Time
+		wantTemperature float64
+		wantPollen      float64
+		wantErr         error
+	}{
+		{"before any", "Berlin", date(1, 0).Add(-time.Minute), 0, 0, ErrNoObservation},
+		{"any location", "Paris", date(1, 5), 0, 3, nil},
+		{"latest of the location", "Berlin", date(1, 7), 9, 0, nil},
+		{"latest of the day", "Berlin", date(2, 13), 18.5, 0, nil},
+		{"too old", "Paris", date(2, 1), 0, 0, ErrNoObservation},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			//when
+			observation, err := provider.Observe(context.Background(), tt.location, tt.time)
+
+			//then
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("want error %v, got %v", tt.wantErr, err)
+			}
+			if err != nil {
+				return
+			}
+			if observation.Location != tt.location {
+				t.Errorf("want location %s, got %s", tt.location, observation.Location)
+			}
+			if valueOf(observation.Temperature) != tt.wantTemperature || valueOf(observation.Pollen) != tt.wantPollen {
+				t.Errorf("want temperature %v and pollen %v, got %+v", tt.wantTemperature, tt.wantPollen, observation)
+			}
+		})
+	}
+}
+
+func TestCSVProviderInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		csv  string
+	}{
+		{"no time column", "location,aqi\nBerlin,40\n"},
+		{"invalid time", "time,aqi\nyesterday,40\n"},
+		{"invalid number", "time,aqi\n2024-05-01,good\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewCSVProvider(strings.NewReader(tt.csv), time.Hour)
+			if err == nil {
+				t.Errorf("want an error")
+			}
+		})
+	}
+}
+
+func TestHTTPProvider(t *testing.T) {
+	//given
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.RawQuery)
+		if r.URL.Query().Get("q") == "nowhere" {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, `{"aqi": 42}`)
+	}))
+	defer server.Close()
+
+	provider, err := NewHTTPProvider(server.URL+"/observations?q={location}&at={time}", server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//when
+	first, err := provider.Observe(context.Background(), "Berlin", date(1, 8).Add(10*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = provider.Observe(context.Background(), "Berlin", date(1, 8).Add(40*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, missing := provider.Observe(context.Background(), "nowhere", date(1, 8))
+
+	//then
+	if valueOf(first.AQI) != 42 || first.Location != "Berlin" || !first.Time.Equal(date(1, 8)) {
+		t.Errorf("want an AQI of 42 in Berlin at 8:00, got %+v", first)
+	}
+	if !errors.Is(missing, ErrNoObservation) {
+		t.Errorf("want ErrNoObservation, got %v", missing)
+	}
+	if len(requests) != 2 || requests[0] != "q=Berlin&at=2024-05-01T08%3A00%3A00Z" {
+		t.Errorf("want a request per hour and location, got %v", requests)
+	}
+}
+
+func TestNewHTTPProviderInvalid(t *testing.T) {
+	for _, template := range []string{
+		"ftp://example.com/{location}/{time}",
+		"https://example.com/{location}",
+		"/observations?q={location}&at={time}",
+	} {
+		if _, err := NewHTTPProvider(template, http.DefaultClient); err == nil {
+			t.Errorf("want an error for %s", template)
+		}
+	}
+}
+
+func TestRecordModel(t *testing.T) {
+	//given
+	provider := &stubProvider{}
+	records := NewRecordModel(mock.NewRecordsModel(), provider, "Berlin",
+		slog.New(slog.NewTextHandler(io.Discard, nil)))
+	ctx := context.Background()
+
+	//when
+	id, err := records.Update(ctx, &models.Record{Value: 480, CreatedAt: date(3, 9)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = records.BulkWrite(ctx, []*models.BulkOperation{
+		{Kind: models.BulkCreate, Record: &models.Record{ID: "bulk", Value: 500, CreatedAt: date(3, 21)}},
+	}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//then
+	for id, want := range map[string]float64{id: 9, "bulk": 21} {
+		record, err := records.Get(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if record.Environment == nil || valueOf(record.Environment.Temperature) != want {
+			t.Errorf("%s: want a temperature of %v, got %+v", id, want, record.Environment)
+		}
+	}
+}
+
+func TestRecordModelWithoutObservation(t *testing.T) {
+	//given
+	records := NewRecordModel(mock.NewRecordsModel(), &stubProvider{}, "nowhere",
+		slog.New(slog.NewTextHandler(io.Discard, nil)))
+	temperature := 20.0
+	record := &models.Record{Value: 480, CreatedAt: date(3, 9),
+		Environment: &models.Observation{Temperature: &temperature}}
+
+	//when
+	id, err := records.Update(context.Background(), record)
+
+	//then
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := records.Get(context.Background(), id)
+	if stored.Environment != nil {
+		t.Errorf("want the stale observation removed, got %+v", stored.Environment)
+	}
+}
+
+func TestRecordModelBatchLookups(t *testing.T) {
+	//given
+	provider := &stubProvider{}
+	records := NewRecordModel(mock.NewRecordsModel(), provider, "Berlin",
+		slog.New(slog.NewTextHandler(io.Discard, nil)))
+	var ops []*models.BulkOperation
+	for index, hour := range []int{6, 6, 12, 18, 6} {
+		ops = append(ops, &models.BulkOperation{Kind: models.BulkCreate,
+			Record: &models.Record{ID: fmt.Sprint("bulk-", index), Value: 500, CreatedAt: date(3, hour)}})
+	}
+
+	//when
+	_, err := records.BulkWrite(context.Background(), ops, false)
+
+	//then
+	if err != nil {
+		t.Fatal(err)
+	}
+	if provider.calls != 3 {
+		t.Errorf("want a lookup per distinct time, got %d", provider.calls)
+	}
+	for _, op := range ops {
+		if valueOf(op.Record.Environment.Temperature) != float64(op.Record.CreatedAt.Hour()) {
+			t.Errorf("%s: want the observation of its time, got %+v", op.Record.ID, op.Record.Environment)
+		}
+	}
+	if ops[0].Record.Environment == ops[1].Record.Environment {
+		t.Errorf("want every record to get an observation of its own")
+	}
+}
+
+func TestRecordModelProviderDown(t *testing.T) {
+	//given
+	provider := &stubProvider{}
+	records := NewRecordModel(mock.NewRecordsModel(), provider, "down",
+		slog.New(slog.NewTextHandler(io.Discard, nil)))
+	ctx := context.Background()
+	temperature := 20.0
+	record := &models.Record{Value: 480, CreatedAt: date(3, 9),
+		Environment: &models.Observation{Temperature: &temperature}}
+
+	//when
+	_, err := records.Update(ctx, record)
+
+	//then
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Environment == nil || provider.calls != 1 {
+		t.Errorf("want the record stored with its observation after a lookup, got %+v, %d lookups",
+			record.Environment, provider.calls)
+	}
+
+	//when
+	_, err = records.BulkWrite(ctx, []*models.BulkOperation{
+		{Kind: models.BulkCreate, Record: &models.Record{ID: "bulk", Value: 500, CreatedAt: date(3, 21)}},
+	}, false)
+
+	//then
+	if err != nil {
+		t.Fatal(err)
+	}
+	if provider.calls != 1 {
+		t.Errorf("want no lookups right after a failure, got %d", provider.calls)
+	}
+}
+
+func TestObserveAllStopsAtFailure(t *testing.T) {
+	//given
+	provider := &stubProvider{}
+	var times []time.Time
+	for hour := 0; hour < 24; hour++ {
+		times = append(times, date(4, hour))
+	}
+
+	//when
+	observations, errs := ObserveAll(context.Background(), provider, "down", times)
+
+	//then
+	if provider.calls > 2*maxConcurrentLookups {
+		t.Errorf("want the lookups left canceled, got %d lookups", provider.calls)
+	}
+	for index := range times {
+		if observations[index] != nil || errs[index] == nil {
+			t.Errorf("%d: want an error, got %+v, %v", index, observations[index], errs[index])
+		}
+	}
+}
+
+func valueOf(value *float64) float64 {
+	if value == nil {
+		return 0
+	}
+	return *value
+}
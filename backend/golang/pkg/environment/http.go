@@ -0,0 +1,111 @@
+package environment
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxCachedObservations bounds the cache of the HTTP provider, it is
+// cleared when full.
+const maxCachedObservations = 10000
+
+// HTTPProvider asks an HTTP service for observations. It sends a GET
+// request to the URL template with {location} and {time} replaced, the
+// time as an RFC 3339 timestamp in UTC, and expects a JSON object like
+// models.Observation in return, 404 if there is none. Times are truncated
+// to the hour and answers are cached, so readings of the same hour
+// share a request.
+type HTTPProvider struct {
+	template string
+	client   *http.Client
+
+	mu    sync.Mutex
+	cache map[string]*models.Observation // nil for ErrNoObservation
+}
+
+// NewHTTPProvider checks that template is an http(s) URL with a
+// {location} and a {time} placeholder.
+func NewHTTPProvider(template string, client *http.Client) (*HTTPProvider, error) {
+	parsed, err := url.Parse(template)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return nil, fmt.Errorf("environment: the URL template must be an http(s) URL")
+	}
+	if !strings.Contains(template, "{location}") || !strings.Contains(template, "{time}") {
+		return nil, fmt.Errorf("environment: the URL template must contain {location} and {time}")
+	}
+	return &HTTPProvider{template: template, client: client, cache: map[string]*models.Observation{}}, nil
+}
+
+func (p *HTTPProvider) Observe(ctx context.Context, location string, t time.Time) (*models.Observation, error) {
+	hour := t.UTC().Truncate(time.Hour).Format(time.RFC3339)
+	key := location + "|" + hour
+
+	p.mu.Lock()
+	observation, ok := p.cache[key]
+	p.mu.Unlock()
+	if !ok {
+		var err error
+		observation, err = p.fetch(ctx, location, hour)
+		if err != nil {
+			return nil, err
+		}
+
+		p.mu.Lock()
+		if len(p.cache) >= maxCachedObservations {
+			p.cache = map[string]*models.Observation{}
+		}
+		p.cache[key] = observation
+		p.mu.Unlock()
+	}
+
+	if observation == nil {
+		return nil, ErrNoObservation
+	}
+	copied := *observation
+	return &copied, nil
+}
+
+// fetch returns nil without an error if the service has no observation.
+func (p *HTTPProvider) fetch(ctx context.Context, location, hour string) (*models.Observation, error) {
+	target := strings.NewReplacer(
+		"{location}", url.QueryEscape(location),
+		"{time}", url.QueryEscape(hour),
+	).Replace(p.template)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("environment: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, nil
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("environment: the provider answered %s", resp.Status)
+	}
+
+	observation := &models.Observation{}
+	err = json.NewDecoder(resp.Body).Decode(observation)
+	if err != nil {
+		return nil, fmt.Errorf("environment: invalid observation: %w", err)
+	}
+	observation.Location = location
+	if observation.Time.IsZero() {
+		observation.Time, _ = time.Parse(time.RFC3339, hour)
+	}
+	return observation, nil
+}
@@ -0,0 +1,113 @@
+package environment
+
+import (
+	"context"
+	"errors"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/logging"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// failureBackoff is how long writes skip lookups after one failed, so a
+// provider which is down holds up a write once in a while only.
+const failureBackoff = time.Minute
+
+// RecordModel decorates any models.RecordModel, attaching the observation
+// at location at the time of the reading to every Record written. The
+// observations of a batch are looked up at once. If the provider fails the
+// Record is written with the observation it had, a missing observation
+// doesn't keep readings from being stored.
+type RecordModel struct {
+	models.RecordModel
+	provider Provider
+	location string
+	logger   *slog.Logger
+
+	mu       sync.Mutex
+	failedAt time.Time
+}
+
+func NewRecordModel(next models.RecordModel, provider Provider, location string, logger *slog.Logger) *RecordModel {
+	return &RecordModel{RecordModel: next, provider: provider, location: location, logger: logger}
+}
+
+// Attach sets the observation at the time of record, removing the one of
+// another time if there is none.
+func Attach(ctx context.Context, provider Provider, location string, record *models.Record) error {
+	observation, err := provider.Observe(ctx, location, record.CreatedAt)
+	return apply(record, observation, err)
+}
+
+func apply(record *models.Record, observation *models.Observation, err error) error {
+	if errors.Is(err, ErrNoObservation) {
+		record.Environment = nil
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	record.Environment = observation
+	return nil
+}
+
+// attach looks up the observations of records at once, unless a lookup
+// failed within failureBackoff.
+func (m *RecordModel) attach(ctx context.Context, records []*models.Record) {
+	if len(records) == 0 {
+		return
+	}
+	m.mu.Lock()
+	backingOff := time.Since(m.failedAt) < failureBackoff
+	m.mu.Unlock()
+	if backingOff {
+		logging.FromContext(ctx, m.logger).Debug("skipping environment lookups after a failure",
+			"records", len(records))
+		return
+	}
+
+	times := make([]time.Time, len(records))
+	for index, record := range records {
+		times[index] = record.CreatedAt
+	}
+	observations, errs := ObserveAll(ctx, m.provider, m.location, times)
+
+	var failure error
+	failed := 0
+	for index, record := range records {
+		if err := apply(record, observations[index], errs[index]); err != nil {
+			failed++
+			if failure == nil || errors.Is(failure, context.Canceled) {
+				failure = err
+			}
+		}
+	}
+	if failure == nil {
+		return
+	}
+	if ctx.Err() == nil {
+		m.mu.Lock()
+		m.failedAt = time.Now()
+		m.mu.Unlock()
+	}
+	logging.FromContext(ctx, m.logger).Warn("looking up the environment of records failed",
+		"records", failed, "error", failure)
+}
+
+func (m *RecordModel) Update(ctx context.Context, record *models.Record) (string, error) {
+	m.attach(ctx, []*models.Record{record})
+	return m.RecordModel.Update(ctx, record)
+}
+
+func (m *RecordModel) BulkWrite(ctx context.Context, ops []*models.BulkOperation, atomic bool) ([]error, error) {
+	var records []*models.Record
+	for _, op := range ops {
+		if op.Kind != models.BulkRemove && op.Record != nil {
+			records = append(records, op.Record)
+		}
+	}
+	m.attach(ctx, records)
+	return m.RecordModel.BulkWrite(ctx, ops, atomic)
+}
@@ -0,0 +1,131 @@
+// Package health checks the dependencies the server needs to be ready.
+package health
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	StatusUp   = "up"
+	StatusDown = "down"
+)
+
+// Checker reports whether a dependency is usable. Storage backends,
+// schedulers, notifiers and the like register one with the Registry.
+type Checker interface {
+	Name() string
+	Check(ctx context.Context) error
+}
+
+type checkerFunc struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+func (c *checkerFunc) Name() string {
+	return c.name
+}
+
+func (c *checkerFunc) Check(ctx context.Context) error {
+	return c.check(ctx)
+}
+
+// CheckerFunc turns a function into a named Checker.
+func CheckerFunc(name string, check func(ctx context.Context) error) Checker {
+	return &checkerFunc{name: name, check: check}
+}
+
+// Report is the outcome of running all checkers.
+type Report struct {
+	Status string                  `json:"status"`
+	Checks map[string]*CheckResult `json:"checks"`
+}
+
+// CheckResult is the outcome of a single checker.
+type CheckResult struct {
+	Status    string  `json:"status"`
+	LatencyMs float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// Registry runs the registered checkers, each limited by the timeout.
+type Registry struct {
+	timeout time.Duration
+
+	mu       sync.RWMutex
+	checkers []Checker
+}
+
+func NewRegistry(timeout time.Duration) *Registry {
+	return &Registry{timeout: timeout}
+}
+
+func (r *Registry) Register(checkers ...Checker) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.checkers = append(r.checkers, checkers...)
+	sort.Slice(r.checkers, func(i, j int) bool {
+		return r.checkers[i].Name() < r.checkers[j].Name()
+	})
+}
+
+// Check runs all checkers concurrently, the report is up only if all of them are.
+func (r *Registry) Check(ctx context.Context) *Report {
+	r.mu.RLock()
+	checkers := append([]Checker{}, r.checkers...)
+	r.mu.RUnlock()
+
+	results := make([]*CheckResult, len(checkers))
+	var wg sync.WaitGroup
+	for index, checker := range checkers {
+		wg.Add(1)
+		go func(index int, checker Checker) {
+			defer wg.Done()
+			results[index] = r.check(ctx, checker)
+		}(index, checker)
+	}
+	wg.Wait()
+
+	report := &Report{Status: StatusUp, Checks: map[string]*CheckResult{}}
+	for index, checker := range checkers {
+		report.Checks[checker.Name()] = results[index]
+		if results[index].Status != StatusUp {
+			report.Status = StatusDown
+		}
+	}
+	return report
+}
+
+func (r *Registry) check(ctx context.Context, checker Checker) *CheckResult {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	start := time.Now()
+
+	// don't wait for checkers ignoring the context past the timeout
+	done := make(chan error, 1)
+	go func() {
+		done <- checker.Check(ctx)
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	result := &CheckResult{
+		Status:    StatusUp,
+		LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if err != nil {
+		result.Status = StatusDown
+		result.Error = err.Error()
+	}
+	return result
+}
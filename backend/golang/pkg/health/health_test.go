@@ -0,0 +1,100 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func up(ctx context.Context) error {
+	return nil
+}
+
+func TestCheckUp(t *testing.T) {
+	//given
+	registry := NewRegistry(time.Second)
+	registry.Register(CheckerFunc("mongodb", up), CheckerFunc("scheduler", up))
+
+	//when
+	report := registry.Check(context.Background())
+
+	//then
+	if report.Status != StatusUp {
+		t.Errorf("want %s, got %s", StatusUp, report.Status)
+	}
+	if len(report.Checks) != 2 {
+		t.Fatalf("want 2 checks, got %d", len(report.Checks))
+	}
+	for name, result := range report.Checks {
+		if result.Status != StatusUp || result.Error != "" {
+			t.Errorf("want %s up, got %+v", name, result)
+		}
+	}
+}
+
+func TestCheckFailing(t *testing.T) {
+	//given
+	registry := NewRegistry(time.Second)
+	registry.Register(CheckerFunc("mongodb", func(ctx context.Context) error {
+		return errors.New("connection refused")
+	}), CheckerFunc("scheduler", up))
+
+	//when
+	report := registry.Check(context.Background())
+
+	//then
+	if report.Status != StatusDown {
+		t.Errorf("want %s, got %s", StatusDown, report.Status)
+	}
+	if result := report.Checks["mongodb"]; result.Status != StatusDown || result.Error != "connection refused" {
+		t.Errorf("want the failing check down with its error, got %+v", result)
+	}
+	if result := report.Checks["scheduler"]; result.Status != StatusUp {
+		t.Errorf("want the other check up, got %+v", result)
+	}
+}
+
+func TestCheckTimeout(t *testing.T) {
+	tests := []struct {
+		name  string
+		check func(ctx context.Context) error
+	}{
+		{"honouring the context", func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}},
+		{"ignoring the context", func(ctx context.Context) error {
+			time.Sleep(time.Second)
+			return nil
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			//given
+			registry := NewRegistry(20 * time.Millisecond)
+			registry.Register(CheckerFunc("slow", tt.check))
+
+			//when
+			start := time.Now()
+			report := registry.Check(context.Background())
+			elapsed := time.Since(start)
+
+			//then
+			if elapsed >= 500*time.Millisecond {
+				t.Errorf("want the check cut off at the timeout, took %s", elapsed)
+			}
+			if report.Status != StatusDown {
+				t.Errorf("want %s, got %s", StatusDown, report.Status)
+			}
+			result := report.Checks["slow"]
+			if result.Status != StatusDown || result.Error != context.DeadlineExceeded.Error() {
+				t.Errorf("want the slow check down with a deadline error, got %+v", result)
+			}
+			if result.LatencyMs < 20 {
+				t.Errorf("want the latency of at least the timeout, got %vms", result.LatencyMs)
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/tracing"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"time"
+)
+
+// RecordModel decorates any models.RecordModel with latency
+// and error metrics per method.
+type RecordModel struct {
+	next    models.RecordModel
+	metrics *Metrics
+}
+
+func NewRecordModel(next models.RecordModel, metrics *Metrics) *RecordModel {
+	return &RecordModel{next: next, metrics: metrics}
+}
+
+func (m *RecordModel) observe(operation string, start time.Time, err error) {
+	m.metrics.storageDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+
+	if err != nil && !errors.Is(err, models.ErrNoRecord) && !errors.Is(err, models.ErrNoRevision) {
+		m.metrics.storageErrors.WithLabelValues(operation).Inc()
+	}
+}
+
+func (m *RecordModel) Update(ctx context.Context, record *models.Record) (string, error) {
+	start := time.Now()
+	id, err := m.next.Update(ctx, record)
+	m.observe("Update", start, err)
+	return id, err
+}
+
+func (m *RecordModel) Get(ctx context.Context, id string) (*models.Record, error) {
+	start := time.Now()
+	record, err := m.next.Get(ctx, id)
+	m.observe("Get", start, err)
+	return record, err
+}
+
+func (m *RecordModel) Remove(ctx context.Context, id string) (int64, error) {
+	start := time.Now()
+	removed, err := m.next.Remove(ctx, id)
+	m.observe("Remove", start, err)
+	return removed, err
+}
+
+func (m *RecordModel) GetAll(ctx context.Context) ([]*models.Record, error) {
+	start := time.Now()
+	records, err := m.next.GetAll(ctx)
+	m.observe("GetAll", start, err)
+	return records, err
+}
+
+func (m *RecordModel) History(ctx context.Context, id string) ([]*models.Revision, error) {
+	start := time.Now()
+	revisions, err := m.next.History(ctx, id)
+	m.observe("History", start, err)
+	return revisions, err
+}
+
+func (m *RecordModel) Revert(ctx context.Context, id string, rev int) (*models.Record, error) {
+	start := time.Now()
+	record, err := m.next.Revert(ctx, id, rev)
+	m.observe("Revert", start, err)
+	return record, err
+}
+
+func (m *RecordModel) BulkWrite(ctx context.Context, ops []*models.BulkOperation, atomic bool) ([]error, error) {
+	start := time.Now()
+	errs, err := m.next.BulkWrite(ctx, ops, atomic)
+	m.observe("BulkWrite", start, err)
+	return errs, err
+}
+
+func (m *RecordModel) Changes(ctx context.Context, since int64, limit int) ([]*models.Change, error) {
+	start := time.Now()
+	changes, err := m.next.Changes(ctx, since, limit)
+	m.observe("Changes", start, err)
+	return changes, err
+}
+
+func (m *RecordModel) Aggregate(ctx context.Context, query *models.AggregateQuery) ([]*models.Bucket, error) {
+	start := time.Now()
+	buckets, err := m.next.Aggregate(ctx, query)
+	m.observe("Aggregate", start, err)
+	return buckets, err
+}
+
+func (m *RecordModel) Summarize(ctx context.Context, since time.Time) (*models.Summary, error) {
+	start := time.Now()
+	summary, err := m.next.Summarize(ctx, since)
+	m.observe("Summarize", start, err)
+	return summary, err
+}
+
+// RecordsCollector computes domain gauges from a summary of the stored
+// records on every scrape, which is traced as a background job.
+type RecordsCollector struct {
+	records        models.RecordModel
+	tracerProvider trace.TracerProvider
+
+	latest     *prometheus.Desc
+	lastDay    *prometheus.Desc
+	sinceLast  *prometheus.Desc
+	scrapeFail *prometheus.Desc
+}
+
+func NewRecordsCollector(records models.RecordModel, tracerProvider trace.TracerProvider) *RecordsCollector {
+	return &RecordsCollector{
+		records:        records,
+		tracerProvider: tracerProvider,
+		latest: prometheus.NewDesc(namespace+"_latest_reading_liters_per_minute",
+			"Value of the most recent peak flow reading.", nil, nil),
+		lastDay: prometheus.NewDesc(namespace+"_readings_last_24h",
+			"Number of readings taken in the last 24 hours.", nil, nil),
+		sinceLast: prometheus.NewDesc(namespace+"_seconds_since_last_reading",
+			"Time since the most recent peak flow reading.", nil, nil),
+		scrapeFail: prometheus.NewDesc(namespace+"_records_scrape_error",
+			"1 if the records could not be loaded for this scrape.", nil, nil),
+	}
+}
+
+func (c *RecordsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.latest
+	ch <- c.lastDay
+	ch <- c.sinceLast
+	ch <- c.scrapeFail
+}
+
+func (c *RecordsCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, span := tracing.StartJob(context.Background(), c.tracerProvider, "RecordsCollector.Collect")
+	defer span.End()
+
+	now := time.Now()
+	summary, err := c.records.Summarize(ctx, now.Add(-24*time.Hour))
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		ch <- prometheus.MustNewConstMetric(c.scrapeFail, prometheus.GaugeValue, 1)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(c.scrapeFail, prometheus.GaugeValue, 0)
+
+	ch <- prometheus.MustNewConstMetric(c.lastDay, prometheus.GaugeValue, float64(summary.Since))
+	if latest := summary.Latest; latest != nil {
+		ch <- prometheus.MustNewConstMetric(c.latest, prometheus.GaugeValue, float64(latest.Value))
+		ch <- prometheus.MustNewConstMetric(c.sinceLast, prometheus.GaugeValue, now.Sub(latest.CreatedAt).Seconds())
+	}
+}
@@ -0,0 +1,105 @@
+package mock
+
+import (
+	"context"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+	"sort"
+	"sync"
+)
+
+// ActionPlanModel keeps every version of action plans in memory.
+type ActionPlanModel struct {
+	mu       sync.Mutex
+	versions map[string][]*models.ActionPlan
+}
+
+func NewActionPlanModel() *ActionPlanModel {
+	return &ActionPlanModel{versions: map[string][]*models.ActionPlan{}}
+}
+
+// of returns the versions of a plan of the patient of ctx.
+func (m *ActionPlanModel) of(ctx context.Context, id string) []*models.ActionPlan {
+	versions := m.versions[id]
+	if len(versions) == 0 || versions[0].PatientID != models.PatientID(ctx) {
+		return nil
+	}
+	return versions
+}
+
+func (m *ActionPlanModel) Save(ctx context.Context, plan *models.ActionPlan) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	versions := m.of(ctx, plan.ID)
+	if len(versions) < len(m.versions[plan.ID]) { // the id is taken by another patient
+		return models.ErrVersionConflict
+	}
+	if plan.Version != len(versions) {
+		return models.ErrVersionConflict
+	}
+
+	plan.PatientID = models.PatientID(ctx)
+	plan.Version++
+	saved := *plan
+	m.versions[plan.ID] = append(versions, &saved)
+	return nil
+}
+
+func (m *ActionPlanModel) Get(ctx context.Context, id string) (*models.ActionPlan, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	versions := m.of(ctx, id)
+	if len(versions) == 0 {
+		return nil, models.ErrNoActionPlan
+	}
+
+	latest := *versions[len(versions)-1]
+	return &latest, nil
+}
+
+func (m *ActionPlanModel) GetAll(ctx context.Context) ([]*models.ActionPlan, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	plans := make([]*models.ActionPlan, 0, len(m.versions))
+	for _, versions := range m.versions {
+		if versions[0].PatientID != models.PatientID(ctx) {
+			continue
+		}
+		latest := *versions[len(versions)-1]
+		plans = append(plans, &latest)
+	}
+	sort.Slice(plans, func(i, j int) bool {
+		return plans[i].EffectiveFrom.Before(plans[j].EffectiveFrom)
+	})
+	return plans, nil
+}
+
+func (m *ActionPlanModel) Versions(ctx context.Context, id string) ([]*models.ActionPlan, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	versions := m.of(ctx, id)
+	if len(versions) == 0 {
+		return nil, models.ErrNoActionPlan
+	}
+
+	copies := make([]*models.ActionPlan, len(versions))
+	for index, version := range versions {
+		copied := *version
+		copies[index] = &copied
+	}
+	return copies, nil
+}
+
+func (m *ActionPlanModel) Remove(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.of(ctx, id)) == 0 {
+		return models.ErrNoActionPlan
+	}
+	delete(m.versions, id)
+	return nil
+}
@@ -0,0 +1,70 @@
+package mock
+
+import (
+	"context"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+	"sync"
+	"time"
+)
+
+// IdempotencyModel keeps idempotency entries in memory.
+type IdempotencyModel struct {
+	mu      sync.Mutex
+	entries map[string]*models.IdempotencyEntry
+}
+
+func NewIdempotencyModel() *IdempotencyModel {
+	return &IdempotencyModel{entries: map[string]*models.IdempotencyEntry{}}
+}
+
+func (m *IdempotencyModel) Reserve(ctx context.Context, entry *models.IdempotencyEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if existing, ok := m.entries[entry.Key]; ok && existing.ExpiresAt.After(time.Now()) {
+		return models.ErrIdempotencyKeyExists
+	}
+
+	reserved := *entry
+	reserved.Completed = false
+	m.entries[entry.Key] = &reserved
+	return nil
+}
+
+func (m *IdempotencyModel) Get(ctx context.Context, key string) (*models.IdempotencyEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, ok := m.entries[key]
+	if !ok || !entry.ExpiresAt.After(time.Now()) {
+		return nil, models.ErrNoRecord
+	}
+
+	copied := *entry
+	return &copied, nil
+}
+
+func (m *IdempotencyModel) Complete(ctx context.Context, entry *models.IdempotencyEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	existing, ok := m.entries[entry.Key]
+	if !ok {
+		return models.ErrNoRecord
+	}
+
+	completed := *entry
+	completed.Completed = true
+	completed.Fingerprint = existing.Fingerprint
+	completed.ExpiresAt = existing.ExpiresAt
+	m.entries[entry.Key] = &completed
+	return nil
+}
+
+func (m *IdempotencyModel) Remove(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.entries, key)
+	return nil
+}
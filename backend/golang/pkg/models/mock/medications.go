@@ -0,0 +1,123 @@
+package mock
+
+import (
+	"context"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+	"sort"
+	"sync"
+)
+
+// MedicationModel keeps medications and their doses in memory.
+type MedicationModel struct {
+	mu          sync.Mutex
+	medications map[string]*models.Medication
+	doses       []*models.Dose
+}
+
+func NewMedicationModel() *MedicationModel {
+	return &MedicationModel{medications: map[string]*models.Medication{}}
+}
+
+func (m *MedicationModel) Update(ctx context.Context, medication *models.Medication) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if existing, ok := m.medications[medication.ID]; ok && existing.PatientID != models.PatientID(ctx) {
+		return models.ErrNoMedication
+	}
+
+	medication.PatientID = models.PatientID(ctx)
+	saved := *medication
+	m.medications[medication.ID] = &saved
+	return nil
+}
+
+func (m *MedicationModel) Get(ctx context.Context, id string) (*models.Medication, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	medication, ok := m.medications[id]
+	if !ok || medication.PatientID != models.PatientID(ctx) {
+		return nil, models.ErrNoMedication
+	}
+
+	copied := *medication
+	return &copied, nil
+}
+
+func (m *MedicationModel) GetAll(ctx context.Context) ([]*models.Medication, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	medications := make([]*models.Medication, 0, len(m.medications))
+	for _, medication := range m.medications {
+		if medication.PatientID != models.PatientID(ctx) {
+			continue
+		}
+		copied := *medication
+		medications = append(medications, &copied)
+	}
+	sort.Slice(medications, func(i, j int) bool {
+		return medications[i].Name < medications[j].Name
+	})
+	return medications, nil
+}
+
+func (m *MedicationModel) Remove(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if medication, ok := m.medications[id]; !ok || medication.PatientID != models.PatientID(ctx) {
+		return models.ErrNoMedication
+	}
+	delete(m.medications, id)
+
+	doses := m.doses[:0]
+	for _, dose := range m.doses {
+		if dose.MedicationID != id || dose.PatientID != models.PatientID(ctx) {
+			doses = append(doses, dose)
+		}
+	}
+	m.doses = doses
+	return nil
+}
+
+func (m *MedicationModel) AddDose(ctx context.Context, dose *models.Dose) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dose.PatientID = models.PatientID(ctx)
+	saved := *dose
+	m.doses = append(m.doses, &saved)
+	return nil
+}
+
+func (m *MedicationModel) RemoveDose(ctx context.Context, medicationID, id string) (*models.Dose, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for index, dose := range m.doses {
+		if dose.ID == id && dose.MedicationID == medicationID && dose.PatientID == models.PatientID(ctx) {
+			m.doses = append(m.doses[:index], m.doses[index+1:]...)
+			return dose, nil
+		}
+	}
+	return nil, models.ErrNoDose
+}
+
+func (m *MedicationModel) Doses(ctx context.Context, query *models.DoseQuery) ([]*models.Dose, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	doses := []*models.Dose{}
+	for _, dose := range m.doses {
+		if dose.PatientID == models.PatientID(ctx) && query.Matches(dose) {
+			copied := *dose
+			doses = append(doses, &copied)
+		}
+	}
+	sort.SliceStable(doses, func(i, j int) bool {
+		return doses[i].TakenAt.Before(doses[j].TakenAt)
+	})
+	return doses, nil
+}
@@ -0,0 +1,129 @@
+package mock
+
+import (
+	"context"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+	"sort"
+	"sync"
+)
+
+// PatientModel keeps patients and their memberships in memory.
+type PatientModel struct {
+	mu          sync.Mutex
+	patients    map[string]*models.Patient
+	memberships []*models.Membership
+}
+
+func NewPatientModel() *PatientModel {
+	return &PatientModel{patients: map[string]*models.Patient{}}
+}
+
+func (m *PatientModel) Update(ctx context.Context, patient *models.Patient) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	saved := *patient
+	m.patients[patient.ID] = &saved
+	return nil
+}
+
+func (m *PatientModel) Get(ctx context.Context, id string) (*models.Patient, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	patient, ok := m.patients[id]
+	if !ok {
+		return nil, models.ErrNoPatient
+	}
+
+	copied := *patient
+	return &copied, nil
+}
+
+func (m *PatientModel) GetAll(ctx context.Context) ([]*models.Patient, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	patients := []*models.Patient{}
+	for _, patient := range m.patients {
+		copied := *patient
+		patients = append(patients, &copied)
+	}
+	sort.Slice(patients, func(i, j int) bool {
+		if !patients[i].CreatedAt.Equal(patients[j].CreatedAt) {
+			return patients[i].CreatedAt.Before(patients[j].CreatedAt)
+		}
+		return patients[i].ID < patients[j].ID
+	})
+	return patients, nil
+}
+
+func (m *PatientModel) SetMembership(ctx context.Context, membership *models.Membership) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	saved := *membership
+	for index, existing := range m.memberships {
+		if existing.PatientID == membership.PatientID && existing.UserID == membership.UserID {
+			m.memberships[index] = &saved
+			return nil
+		}
+	}
+	m.memberships = append(m.memberships, &saved)
+	return nil
+}
+
+func (m *PatientModel) Membership(ctx context.Context, patientID, userID string) (*models.Membership, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, membership := range m.memberships {
+		if membership.PatientID == patientID && membership.UserID == userID {
+			copied := *membership
+			return &copied, nil
+		}
+	}
+	return nil, models.ErrNoMembership
+}
+
+func (m *PatientModel) RemoveMembership(ctx context.Context, patientID, userID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for index, membership := range m.memberships {
+		if membership.PatientID == patientID && membership.UserID == userID {
+			m.memberships = append(m.memberships[:index], m.memberships[index+1:]...)
+			return nil
+		}
+	}
+	return models.ErrNoMembership
+}
+
+func (m *PatientModel) Memberships(ctx context.Context, patientID string) ([]*models.Membership, error) {
+	return m.find(func(membership *models.Membership) bool {
+		return membership.PatientID == patientID
+	}), nil
+}
+
+func (m *PatientModel) MembershipsOf(ctx context.Context, userID string) ([]*models.Membership, error) {
+	return m.find(func(membership *models.Membership) bool {
+		return membership.UserID == userID
+	}), nil
+}
+
+func (m *PatientModel) find(matches func(*models.Membership) bool) []*models.Membership {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	memberships := []*models.Membership{}
+	for _, membership := range m.memberships {
+		if matches(membership) {
+			copied := *membership
+			memberships = append(memberships, &copied)
+		}
+	}
+	sort.SliceStable(memberships, func(i, j int) bool {
+		return memberships[i].CreatedAt.Before(memberships[j].CreatedAt)
+	})
+	return memberships
+}
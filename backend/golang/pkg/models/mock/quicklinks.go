@@ -0,0 +1,62 @@
+package mock
+
+import (
+	"context"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+	"sort"
+	"sync"
+)
+
+// QuickLinkModel keeps quick-add links in memory.
+type QuickLinkModel struct {
+	mu    sync.Mutex
+	links map[string]*models.QuickLink
+}
+
+func NewQuickLinkModel() *QuickLinkModel {
+	return &QuickLinkModel{links: map[string]*models.QuickLink{}}
+}
+
+func (m *QuickLinkModel) Update(ctx context.Context, link *models.QuickLink) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.links[link.ID] = copyQuickLink(link)
+	return nil
+}
+
+func (m *QuickLinkModel) Get(ctx context.Context, id string) (*models.QuickLink, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	link, ok := m.links[id]
+	if !ok {
+		return nil, models.ErrNoQuickLink
+	}
+	return copyQuickLink(link), nil
+}
+
+func (m *QuickLinkModel) GetAll(ctx context.Context, patientID string) ([]*models.QuickLink, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	links := []*models.QuickLink{}
+	for _, link := range m.links {
+		if link.PatientID == patientID {
+			links = append(links, copyQuickLink(link))
+		}
+	}
+	sort.Slice(links, func(i, j int) bool {
+		return links[i].CreatedAt.After(links[j].CreatedAt)
+	})
+	return links, nil
+}
+
+func copyQuickLink(link *models.QuickLink) *models.QuickLink {
+	copied := *link
+	if link.RevokedAt != nil {
+		revokedAt := *link.RevokedAt
+		copied.RevokedAt = &revokedAt
+	}
+	return &copied
+}
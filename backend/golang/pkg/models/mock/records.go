@@ -1,44 +1,306 @@
 package mock
 
 import (
+	"context"
+	"fmt"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/analytics"
 	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+	"sort"
+	"sync"
 	"time"
 )
 
-type RecordModel struct{}
+// RecordModel keeps records in memory, starting from the Records fixture
+// data of the default patient. Every call is scoped to the patient of the
+// context, records of others look like they don't exist.
+type RecordModel struct {
+	mu        sync.Mutex
+	records   []*models.Record
+	revisions map[string][]*models.Revision
+	// seq is the last change sequence number, changes the latest
+	// change per record, tombstones included, of the patient in patients
+	seq      int64
+	changes  map[string]*models.Change
+	patients map[string]string
+}
 
 func NewRecordsModel() *RecordModel {
-	return &RecordModel{}
+	r := &RecordModel{
+		records:   make([]*models.Record, 0, len(Records)),
+		revisions: map[string][]*models.Revision{},
+		changes:   map[string]*models.Change{},
+		patients:  map[string]string{},
+	}
+	for _, record := range Records {
+		r.records = append(r.records, copyRecord(record))
+		r.changed(record, false)
+	}
+	return r
 }
 
-func (r RecordModel) Update(id string, createdAt time.Time, value float32) (string, error) {
-	panic("implement me")
+// changed assigns the next sequence number to a write of the record.
+func (r *RecordModel) changed(record *models.Record, deleted bool) {
+	r.seq++
+	r.changes[record.ID] = &models.Change{
+		Seq:       r.seq,
+		RecordID:  record.ID,
+		Deleted:   deleted,
+		ChangedAt: time.Now(),
+	}
+	r.patients[record.ID] = record.PatientID
 }
 
-func (r RecordModel) Get(id string) (*models.Record, error) {
-	for _, record := range Records {
-		if record.ID == id {
-			return record, nil
-		}
+// Update fails with ErrRecordExists if the ID is taken by a record of
+// another patient.
+func (r *RecordModel) Update(ctx context.Context, record *models.Record) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	record.PatientID = models.PatientID(ctx)
+	if r.indexOf(record.ID) >= 0 && r.scopedIndexOf(ctx, record.ID) < 0 {
+		return "", models.ErrRecordExists
+	}
+	record.Rev = r.update(record)
+	return record.ID, nil
+}
+
+func (r *RecordModel) update(record *models.Record) int {
+	updated := copyRecord(record)
+	updated.Rev = 1
+	r.changed(record, false)
+
+	if index := r.indexOf(record.ID); index >= 0 {
+		previous := r.records[index]
+		r.revisions[record.ID] = append(r.revisions[record.ID], &models.Revision{
+			RecordID:   record.ID,
+			Rev:        previous.Rev,
+			ArchivedAt: time.Now(),
+			Record:     copyRecord(previous),
+		})
+
+		updated.Rev = previous.Rev + 1
+		r.records[index] = updated
+		return updated.Rev
+	}
+
+	r.records = append(r.records, updated)
+	return updated.Rev
+}
+
+func (r *RecordModel) Get(ctx context.Context, id string) (*models.Record, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if index := r.scopedIndexOf(ctx, id); index >= 0 {
+		return copyRecord(r.records[index]), nil
 	}
 
 	return nil, models.ErrNoRecord
 }
 
-func (r RecordModel) Remove(id string) (int64, error) {
-	panic("implement me")
+func (r *RecordModel) Remove(ctx context.Context, id string) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	index := r.scopedIndexOf(ctx, id)
+	if index < 0 {
+		return 0, nil
+	}
+
+	removed := r.records[index]
+	r.records = append(r.records[:index], r.records[index+1:]...)
+	delete(r.revisions, id)
+	r.changed(removed, true)
+	return 1, nil
+}
+
+func (r *RecordModel) GetAll(ctx context.Context) ([]*models.Record, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	patientID := models.PatientID(ctx)
+	result := make([]*models.Record, 0, len(r.records))
+	for _, record := range r.records {
+		if record.PatientID == patientID {
+			result = append(result, copyRecord(record))
+		}
+	}
+	return result, nil
+}
+
+func (r *RecordModel) History(ctx context.Context, id string) ([]*models.Revision, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	result := []*models.Revision{}
+	if r.scopedIndexOf(ctx, id) < 0 {
+		return result, nil
+	}
+	for _, revision := range r.revisions[id] {
+		result = append(result, &models.Revision{
+			RecordID:   revision.RecordID,
+			Rev:        revision.Rev,
+			ArchivedAt: revision.ArchivedAt,
+			Record:     copyRecord(revision.Record),
+		})
+	}
+	return result, nil
+}
+
+func (r *RecordModel) Revert(ctx context.Context, id string, rev int) (*models.Record, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.scopedIndexOf(ctx, id) < 0 {
+		return nil, models.ErrNoRecord
+	}
+
+	for _, revision := range r.revisions[id] {
+		if revision.Rev == rev {
+			restored := copyRecord(revision.Record)
+			restored.ID = id
+			r.update(restored)
+			return copyRecord(r.records[r.indexOf(id)]), nil
+		}
+	}
+
+	return nil, models.ErrNoRevision
+}
+
+func (r *RecordModel) BulkWrite(ctx context.Context, ops []*models.BulkOperation, atomic bool) ([]error, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	records := append([]*models.Record{}, r.records...)
+	revisions := map[string][]*models.Revision{}
+	for id, history := range r.revisions {
+		revisions[id] = append([]*models.Revision{}, history...)
+	}
+	changes := map[string]*models.Change{}
+	patients := map[string]string{}
+	for id, change := range r.changes {
+		changes[id] = change
+		patients[id] = r.patients[id]
+	}
+
+	errs := make([]error, len(ops))
+	for index, op := range ops {
+		record := op.Record
+		record.PatientID = models.PatientID(ctx)
+		exists := r.scopedIndexOf(ctx, record.ID) >= 0
+
+		switch op.Kind {
+		case models.BulkCreate:
+			if r.indexOf(record.ID) >= 0 {
+				errs[index] = models.ErrRecordExists
+				continue
+			}
+			r.update(record)
+		case models.BulkUpdate:
+			if !exists {
+				errs[index] = models.ErrNoRecord
+				continue
+			}
+			r.update(record)
+		case models.BulkRemove:
+			if !exists {
+				errs[index] = models.ErrNoRecord
+				continue
+			}
+			index := r.indexOf(record.ID)
+			r.records = append(r.records[:index:index], r.records[index+1:]...)
+			delete(r.revisions, record.ID)
+			r.changed(record, true)
+			continue
+		default:
+			errs[index] = fmt.Errorf("models: unknown bulk operation %q", op.Kind)
+			continue
+		}
+		record.Rev = r.records[r.indexOf(record.ID)].Rev
+	}
+
+	if atomic && models.AbortBatch(errs) {
+		r.records = records
+		r.revisions = revisions
+		r.changes = changes
+		r.patients = patients
+	}
+	return errs, nil
+}
+
+func (r *RecordModel) Changes(ctx context.Context, since int64, limit int) ([]*models.Change, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	patientID := models.PatientID(ctx)
+	result := []*models.Change{}
+	for _, change := range r.changes {
+		if change.Seq <= since || r.patients[change.RecordID] != patientID {
+			continue
+		}
+
+		copied := *change
+		if index := r.indexOf(change.RecordID); index >= 0 && !change.Deleted {
+			copied.Record = copyRecord(r.records[index])
+		}
+		result = append(result, &copied)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Seq < result[j].Seq
+	})
+	if len(result) > limit {
+		result = result[:limit]
+	}
+	return result, nil
+}
+
+// Aggregate uses the implementation in Go, which MongoDB follows.
+func (r *RecordModel) Aggregate(ctx context.Context, query *models.AggregateQuery) ([]*models.Bucket, error) {
+	records, err := r.GetAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return analytics.Aggregate(records, query), nil
+}
+
+func (r *RecordModel) Summarize(ctx context.Context, since time.Time) (*models.Summary, error) {
+	records, err := r.GetAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return analytics.Summarize(records, since), nil
+}
+
+func (r *RecordModel) indexOf(id string) int {
+	for index, record := range r.records {
+		if record.ID == id {
+			return index
+		}
+	}
+	return -1
+}
+
+// scopedIndexOf returns the index of a record of the patient of ctx.
+func (r *RecordModel) scopedIndexOf(ctx context.Context, id string) int {
+	index := r.indexOf(id)
+	if index < 0 || r.records[index].PatientID != models.PatientID(ctx) {
+		return -1
+	}
+	return index
 }
 
-func (r RecordModel) GetAll() ([]*models.Record, error) {
-	return Records, nil
+func copyRecord(record *models.Record) *models.Record {
+	copied := *record
+	return &copied
 }
 
 // Records fixture data
 var Records = []*models.Record{
-	{ID: "0", CreatedAt: time.Now().Add(-1 * (time.Hour * 72)), Value: 490},
-	{ID: "1", CreatedAt: time.Now().Add(-1 * (time.Hour * 48)), Value: 505},
-	{ID: "2", CreatedAt: time.Now().Add(-1 * (time.Hour * 44)), Value: 480},
-	{ID: "3", CreatedAt: time.Now().Add(-1 * (time.Hour * 24)), Value: 525},
-	{ID: "4", CreatedAt: time.Now().Add(-1 * (time.Hour * 20)), Value: 495},
-	{ID: "5", CreatedAt: time.Now(), Value: 520},
+	{ID: "0", CreatedAt: time.Now().Add(-1 * (time.Hour * 72)), Value: 490, Rev: 1},
+	{ID: "1", CreatedAt: time.Now().Add(-1 * (time.Hour * 48)), Value: 505, Rev: 1},
+	{ID: "2", CreatedAt: time.Now().Add(-1 * (time.Hour * 44)), Value: 480, Rev: 1},
+	{ID: "3", CreatedAt: time.Now().Add(-1 * (time.Hour * 24)), Value: 525, Rev: 1},
+	{ID: "4", CreatedAt: time.Now().Add(-1 * (time.Hour * 20)), Value: 495, Rev: 1},
+	{ID: "5", CreatedAt: time.Now(), Value: 520, Rev: 1},
 }
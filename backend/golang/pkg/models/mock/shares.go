@@ -0,0 +1,85 @@
+package mock
+
+import (
+	"context"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+	"sort"
+	"sync"
+)
+
+// ShareModel keeps shares and their access log in memory.
+type ShareModel struct {
+	mu       sync.Mutex
+	shares   map[string]*models.Share
+	accesses []*models.ShareAccess
+}
+
+func NewShareModel() *ShareModel {
+	return &ShareModel{shares: map[string]*models.Share{}}
+}
+
+func (m *ShareModel) Update(ctx context.Context, share *models.Share) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.shares[share.ID] = copyShare(share)
+	return nil
+}
+
+func (m *ShareModel) Get(ctx context.Context, id string) (*models.Share, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	share, ok := m.shares[id]
+	if !ok {
+		return nil, models.ErrNoShare
+	}
+	return copyShare(share), nil
+}
+
+func (m *ShareModel) GetAll(ctx context.Context) ([]*models.Share, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	shares := make([]*models.Share, 0, len(m.shares))
+	for _, share := range m.shares {
+		shares = append(shares, copyShare(share))
+	}
+	sort.Slice(shares, func(i, j int) bool {
+		return shares[i].CreatedAt.After(shares[j].CreatedAt)
+	})
+	return shares, nil
+}
+
+func (m *ShareModel) LogAccess(ctx context.Context, access *models.ShareAccess) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	saved := *access
+	m.accesses = append(m.accesses, &saved)
+	return nil
+}
+
+func (m *ShareModel) Accesses(ctx context.Context, shareID string) ([]*models.ShareAccess, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	accesses := []*models.ShareAccess{}
+	for _, access := range m.accesses {
+		if access.ShareID == shareID {
+			copied := *access
+			accesses = append(accesses, &copied)
+		}
+	}
+	return accesses, nil
+}
+
+func copyShare(share *models.Share) *models.Share {
+	copied := *share
+	copied.Resources = append([]string{}, share.Resources...)
+	if share.RevokedAt != nil {
+		revokedAt := *share.RevokedAt
+		copied.RevokedAt = &revokedAt
+	}
+	return &copied
+}
@@ -0,0 +1,71 @@
+package mock
+
+import (
+	"context"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+	"sort"
+	"sync"
+)
+
+// UserModel keeps users in memory.
+type UserModel struct {
+	mu    sync.Mutex
+	users map[string]*models.User
+}
+
+func NewUserModel() *UserModel {
+	return &UserModel{users: map[string]*models.User{}}
+}
+
+func (m *UserModel) Update(ctx context.Context, user *models.User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	saved := *user
+	m.users[user.ID] = &saved
+	return nil
+}
+
+func (m *UserModel) Get(ctx context.Context, id string) (*models.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[id]
+	if !ok {
+		return nil, models.ErrNoUser
+	}
+
+	copied := *user
+	return &copied, nil
+}
+
+func (m *UserModel) GetAll(ctx context.Context) ([]*models.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	users := []*models.User{}
+	for _, user := range m.users {
+		copied := *user
+		users = append(users, &copied)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		if !users[i].CreatedAt.Equal(users[j].CreatedAt) {
+			return users[i].CreatedAt.Before(users[j].CreatedAt)
+		}
+		return users[i].ID < users[j].ID
+	})
+	return users, nil
+}
+
+func (m *UserModel) GetByTokenHash(ctx context.Context, tokenHash string) (*models.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, user := range m.users {
+		if user.TokenHash == tokenHash {
+			copied := *user
+			return &copied, nil
+		}
+	}
+	return nil, models.ErrNoUser
+}
@@ -1,24 +1,389 @@
 package models
 
 import (
+	"context"
 	"errors"
 	"time"
 )
 
 var ErrNoRecord = errors.New("models: no matching record found")
+var ErrNoRevision = errors.New("models: no matching revision found")
+var ErrRecordExists = errors.New("models: record already exists")
+var ErrBatchAborted = errors.New("models: batch aborted because another operation failed")
+var ErrIdempotencyKeyExists = errors.New("models: idempotency key already exists")
+var ErrNoActionPlan = errors.New("models: no matching action plan found")
+var ErrVersionConflict = errors.New("models: a newer version exists")
+var ErrNoMedication = errors.New("models: no matching medication found")
+var ErrNoDose = errors.New("models: no matching dose found")
+var ErrNoShare = errors.New("models: no matching share found")
+var ErrNoQuickLink = errors.New("models: no matching quick-add link found")
 var ErrDbProblem = errors.New("models: problem with db")
 
+// Kinds of BulkOperation
+const (
+	BulkCreate = "create"
+	BulkUpdate = "update"
+	BulkRemove = "remove"
+)
+
 //Record struct contains information of one measurement record
 type Record struct {
 	ID        string    `json:"id"`
 	CreatedAt time.Time `json:"created_at"`
 	Value     float32   `json:"value"`
+	Context   string    `json:"context,omitempty"`
+	// Timezone the reading was taken in, an IANA time zone or a UTC offset
+	// like +05:30, see LoadTimezone. Days and times of day of the Record
+	// are in it, so readings taken while travelling keep their local day.
+	Timezone string `json:"tz,omitempty"`
+	Rev      int    `json:"rev"`
+	// PatientID of the patient the reading is of, DefaultPatient for
+	// readings of the legacy routes. It is set by RecordModel, see WithPatient.
+	PatientID string `json:"patient_id,omitempty"`
+	// Environment at the time of the reading, if a provider is configured
+	Environment *Observation `json:"environment,omitempty"`
+}
+
+//Observation of the environment at a location, every value is optional
+type Observation struct {
+	Location    string    `json:"location"`
+	Time        time.Time `json:"time"`
+	Temperature *float64  `json:"temperature,omitempty"` // in °C
+	Humidity    *float64  `json:"humidity,omitempty"`    // relative, in percent
+	AQI         *float64  `json:"aqi,omitempty"`         // air quality index
+	Pollen      *float64  `json:"pollen,omitempty"`      // grains per m³
+}
+
+//Revision struct contains one prior version of a Record,
+//archived when the Record was overwritten
+type Revision struct {
+	RecordID   string    `json:"record_id"`
+	Rev        int       `json:"rev"`
+	ArchivedAt time.Time `json:"archived_at"`
+	Record     *Record   `json:"record"`
+}
+
+//Change is an entry of the change feed of Records. Every write of a Record
+//gets the next number of a monotonic sequence, removing a Record leaves a
+//tombstone with Deleted set and no Record
+type Change struct {
+	Seq       int64     `json:"seq"`
+	RecordID  string    `json:"record_id"`
+	Deleted   bool      `json:"deleted,omitempty"`
+	Record    *Record   `json:"record,omitempty"`
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+// Bucket sizes of AggregateQuery
+const (
+	BucketDay   = "day"
+	BucketWeek  = "week" // from Monday
+	BucketMonth = "month"
+)
+
+// Local hours splitting readings into morning and evening ones
+const (
+	MorningEndHour   = 12
+	EveningStartHour = 18
+)
+
+//AggregateQuery asks for summaries of Records per time bucket. Records go
+//to the bucket of their local day, buckets start at midnight in Location,
+//so they follow its DST changes. Records without a time zone are in Location
+type AggregateQuery struct {
+	Bucket   string
+	Location *time.Location
+}
+
+//Bucket summarizes the Records of a time bucket. Readings before
+//MorningEndHour local time count as morning, from EveningStartHour on as evening
+type Bucket struct {
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"`
+	Count       int       `json:"count"`
+	Min         float64   `json:"min"`
+	Max         float64   `json:"max"`
+	Mean        float64   `json:"mean"`
+	MorningMean *float64  `json:"morning_mean,omitempty"`
+	EveningMean *float64  `json:"evening_mean,omitempty"`
+}
+
+//Summary tells the latest Record, nil without any, and the number of
+//Records taken since a point in time
+type Summary struct {
+	Latest *Record
+	Since  int
+}
+
+//BulkOperation is a single write of a RecordModel.BulkWrite call,
+//for BulkRemove only the Record ID is used
+type BulkOperation struct {
+	Kind   string
+	Record *Record
+}
+
+//AbortBatch marks every successful operation of an all-or-nothing batch
+//as aborted if any other operation failed, and reports whether it did
+func AbortBatch(errs []error) bool {
+	failed := false
+	for _, err := range errs {
+		if err != nil {
+			failed = true
+			break
+		}
+	}
+	if !failed {
+		return false
+	}
+
+	for index, err := range errs {
+		if err == nil {
+			errs[index] = ErrBatchAborted
+		}
+	}
+	return true
 }
 
 //RecordModel defines model/DAO methods for Record
 type RecordModel interface {
-	Update(id string, createdAt time.Time, value float32) (string, error)
-	Get(id string) (*Record, error)
-	Remove(id string) (int64, error)
-	GetAll() ([]*Record, error)
+	Update(ctx context.Context, record *Record) (string, error)
+	Get(ctx context.Context, id string) (*Record, error)
+	Remove(ctx context.Context, id string) (int64, error)
+	GetAll(ctx context.Context) ([]*Record, error)
+
+	History(ctx context.Context, id string) ([]*Revision, error)
+	Revert(ctx context.Context, id string, rev int) (*Record, error)
+
+	// BulkWrite applies the operations in order and returns an error per
+	// operation. In atomic mode either all operations are applied or none.
+	BulkWrite(ctx context.Context, ops []*BulkOperation, atomic bool) ([]error, error)
+
+	// Changes returns the latest change of every Record changed after the
+	// since sequence number, up to limit changes ordered by Seq.
+	Changes(ctx context.Context, since int64, limit int) ([]*Change, error)
+
+	// Aggregate summarizes all Records per bucket, oldest bucket first,
+	// empty buckets are left out.
+	Aggregate(ctx context.Context, query *AggregateQuery) ([]*Bucket, error)
+
+	// Summarize returns the latest Record and the number of Records taken
+	// since the given time, without loading all of them.
+	Summarize(ctx context.Context, since time.Time) (*Summary, error)
+}
+
+//IdempotencyEntry stores the outcome of a request sent with an Idempotency-Key,
+//it is pending until the request completes
+type IdempotencyEntry struct {
+	Key         string    `json:"key"`
+	Fingerprint string    `json:"fingerprint"`
+	Completed   bool      `json:"completed"`
+	RecordID    string    `json:"record_id"`
+	Status      int       `json:"status"`
+	ContentType string    `json:"content_type"`
+	Body        []byte    `json:"body"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+//IdempotencyModel defines model/DAO methods for IdempotencyEntry
+type IdempotencyModel interface {
+	// Reserve stores a pending entry, unless an entry which is not
+	// expired yet exists for the key, then ErrIdempotencyKeyExists is returned.
+	Reserve(ctx context.Context, entry *IdempotencyEntry) error
+	Get(ctx context.Context, key string) (*IdempotencyEntry, error)
+	Complete(ctx context.Context, entry *IdempotencyEntry) error
+	Remove(ctx context.Context, key string) error
+}
+
+//ActionPlan is the written asthma action plan of the doctor: zone thresholds
+//in L/min and what to do in each zone. It applies to readings taken from
+//EffectiveFrom until EffectiveUntil, without an end if that is nil. Every
+//change is saved as a new Version, prior versions are kept
+type ActionPlan struct {
+	ID             string           `json:"id"`
+	PatientID      string           `json:"patient_id,omitempty"`
+	Version        int              `json:"version"`
+	Name           string           `json:"name,omitempty"`
+	EffectiveFrom  time.Time        `json:"effective_from"`
+	EffectiveUntil *time.Time       `json:"effective_until,omitempty"`
+	GreenFrom      float32          `json:"green_from"`  // lowest reading of the green zone
+	YellowFrom     float32          `json:"yellow_from"` // lowest reading of the yellow zone, red below
+	Instructions   ZoneInstructions `json:"instructions"`
+	UpdatedAt      time.Time        `json:"updated_at"`
+}
+
+//ZoneInstructions tell what to do in each zone of an ActionPlan
+type ZoneInstructions struct {
+	Green  string `json:"green"`
+	Yellow string `json:"yellow"`
+	Red    string `json:"red"`
+}
+
+// Covers reports whether the plan applies to a reading taken at t.
+func (p *ActionPlan) Covers(t time.Time) bool {
+	return !t.Before(p.EffectiveFrom) && (p.EffectiveUntil == nil || t.Before(*p.EffectiveUntil))
+}
+
+//ActionPlanModel defines model/DAO methods for ActionPlan, scoped to the
+//patient of the context like RecordModel
+type ActionPlanModel interface {
+	// Save stores plan as the next version of the one plan.Version names,
+	// 0 for a new plan, and sets plan.Version. If that is not the latest
+	// version anymore ErrVersionConflict is returned.
+	Save(ctx context.Context, plan *ActionPlan) error
+	// Get returns the latest version of a plan.
+	Get(ctx context.Context, id string) (*ActionPlan, error)
+	// GetAll returns the latest version of every plan.
+	GetAll(ctx context.Context) ([]*ActionPlan, error)
+	// Versions returns every version of a plan, oldest first.
+	Versions(ctx context.Context, id string) ([]*ActionPlan, error)
+	// Remove deletes a plan with all its versions.
+	Remove(ctx context.Context, id string) error
+}
+
+// Types of Medication
+const (
+	MedicationReliever   = "reliever"   // taken when needed, like salbutamol
+	MedicationController = "controller" // taken every day, like inhaled steroids
+)
+
+//Medication is an inhaler in use. Capacity is the number of puffs of a full
+//inhaler, the current one was started at RefilledAt, so only Doses taken
+//since count against it. A new inhaler should be ordered when fewer than
+//ReorderBelow doses are left. Controllers are scheduled DosesPerDay times a
+//day from the day of StartedAt on, without DosesPerDay they aren't scheduled
+type Medication struct {
+	ID           string    `json:"id"`
+	PatientID    string    `json:"patient_id,omitempty"`
+	Name         string    `json:"name"`
+	Type         string    `json:"type"`
+	PuffsPerDose int       `json:"puffs_per_dose"`
+	Capacity     int       `json:"capacity"`
+	ReorderBelow int       `json:"reorder_below"`
+	RefilledAt   time.Time `json:"refilled_at"`
+	DosesPerDay  int       `json:"doses_per_day,omitempty"`
+	StartedAt    time.Time `json:"started_at"`
+}
+
+//Dose is one intake of a Medication
+type Dose struct {
+	ID           string    `json:"id"`
+	PatientID    string    `json:"patient_id,omitempty"`
+	MedicationID string    `json:"medication_id"`
+	TakenAt      time.Time `json:"taken_at"`
+	Puffs        int       `json:"puffs"`
+}
+
+//DoseQuery selects Doses taken from From until before Until, of one
+//Medication or of all if MedicationID is empty. Zero times leave the range open
+type DoseQuery struct {
+	MedicationID string
+	From         time.Time
+	Until        time.Time
+}
+
+// Matches reports whether dose is selected by the query.
+func (q *DoseQuery) Matches(dose *Dose) bool {
+	return (q.MedicationID == "" || dose.MedicationID == q.MedicationID) &&
+		(q.From.IsZero() || !dose.TakenAt.Before(q.From)) &&
+		(q.Until.IsZero() || dose.TakenAt.Before(q.Until))
+}
+
+//MedicationModel defines model/DAO methods for Medication and its Doses,
+//scoped to the patient of the context like RecordModel
+type MedicationModel interface {
+	// Update creates or replaces a medication.
+	Update(ctx context.Context, medication *Medication) error
+	Get(ctx context.Context, id string) (*Medication, error)
+	// GetAll returns every medication ordered by name.
+	GetAll(ctx context.Context) ([]*Medication, error)
+	// Remove deletes a medication with all its doses.
+	Remove(ctx context.Context, id string) error
+
+	AddDose(ctx context.Context, dose *Dose) error
+	// RemoveDose deletes a dose of the medication and returns it.
+	RemoveDose(ctx context.Context, medicationID, id string) (*Dose, error)
+	// Doses returns the doses selected by query, oldest first.
+	Doses(ctx context.Context, query *DoseQuery) ([]*Dose, error)
+}
+
+// Resources of a Share
+const (
+	ShareRecords = "records" // readings with their history and context
+	ShareStats   = "stats"   // trend, correlation and aggregates of readings
+	ShareReports = "reports" // reports like the adherence one
+)
+
+//Share grants read-only access to the Resources for the Records taken from
+//From until before Until. It stops working at ExpiresAt or once revoked, it is
+//kept afterwards for its access log
+type Share struct {
+	ID        string     `json:"id"`
+	Label     string     `json:"label,omitempty"` // who it is for, like the name of a doctor
+	Resources []string   `json:"resources"`
+	From      time.Time  `json:"from"`
+	Until     time.Time  `json:"until"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// Allows reports whether resource is shared.
+func (s *Share) Allows(resource string) bool {
+	for _, shared := range s.Resources {
+		if shared == resource {
+			return true
+		}
+	}
+	return false
+}
+
+// Covers reports whether data of the time t is shared.
+func (s *Share) Covers(t time.Time) bool {
+	return !t.Before(s.From) && t.Before(s.Until)
+}
+
+//ShareAccess is an entry of the access log of a Share
+type ShareAccess struct {
+	ShareID    string    `json:"share_id"`
+	At         time.Time `json:"at"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"` // below the share link, the token left out
+	Status     int       `json:"status"`
+	RemoteAddr string    `json:"remote_addr"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+}
+
+//ShareModel defines model/DAO methods for Share and its access log
+type ShareModel interface {
+	// Update creates or replaces a share.
+	Update(ctx context.Context, share *Share) error
+	Get(ctx context.Context, id string) (*Share, error)
+	// GetAll returns every share, the latest created first.
+	GetAll(ctx context.Context) ([]*Share, error)
+
+	LogAccess(ctx context.Context, access *ShareAccess) error
+	// Accesses returns the access log of a share, oldest first.
+	Accesses(ctx context.Context, shareID string) ([]*ShareAccess, error)
+}
+
+//QuickLink lets anyone with its link add readings of the patient PatientID,
+//with Context unless they set one. It stops working at ExpiresAt, once
+//revoked or once IssuerID may no longer add readings of the patient
+type QuickLink struct {
+	ID        string     `json:"id"`
+	PatientID string     `json:"patient_id,omitempty"`
+	IssuerID  string     `json:"issuer_id,omitempty"` // empty if issued without a token
+	Context   string     `json:"context,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+//QuickLinkModel defines model/DAO methods for QuickLink
+type QuickLinkModel interface {
+	// Update creates or replaces a quick-add link.
+	Update(ctx context.Context, link *QuickLink) error
+	Get(ctx context.Context, id string) (*QuickLink, error)
+	// GetAll returns the links of a patient, the latest created first.
+	GetAll(ctx context.Context, patientID string) ([]*QuickLink, error)
 }
@@ -0,0 +1,134 @@
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log/slog"
+)
+
+const collectionActionPlans = "actionPlans"
+
+// ActionPlanModel stores every version of a plan as a document of its own,
+// the latest version is the one with the highest number.
+// Plans of the default patient saved before there were patients have no
+// patientid.
+type ActionPlanModel struct {
+	client *mongo.Client
+	logger *slog.Logger
+}
+
+func NewActionPlanModel(client *mongo.Client, logger *slog.Logger) *ActionPlanModel {
+	return &ActionPlanModel{client, logger}
+}
+
+func (m *ActionPlanModel) getCollection() *mongo.Collection {
+	return m.client.Database(databaseName).Collection(collectionActionPlans)
+}
+
+// CreateIndexes makes version numbers unique per plan, so of concurrent
+// saves of the same version only one succeeds.
+func (m *ActionPlanModel) CreateIndexes(ctx context.Context) error {
+	_, err := m.getCollection().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "id", Value: 1}, {Key: "version", Value: -1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+func (m *ActionPlanModel) Save(ctx context.Context, plan *models.ActionPlan) error {
+	if plan.Version > 0 {
+		latest, err := m.Get(ctx, plan.ID)
+		if errors.Is(err, models.ErrNoActionPlan) {
+			return models.ErrVersionConflict
+		}
+		if err != nil {
+			return err
+		}
+		if latest.Version != plan.Version {
+			return models.ErrVersionConflict
+		}
+	}
+
+	plan.PatientID = models.PatientID(ctx)
+	saved := *plan
+	saved.Version++
+	_, err := m.getCollection().InsertOne(ctx, &saved)
+	if mongo.IsDuplicateKeyError(err) {
+		return models.ErrVersionConflict
+	}
+	if err != nil {
+		return failed(ctx, m.logger, "ActionPlanModel.Save", err)
+	}
+
+	plan.Version = saved.Version
+	return nil
+}
+
+func (m *ActionPlanModel) Get(ctx context.Context, id string) (*models.ActionPlan, error) {
+	result := m.getCollection().FindOne(ctx, scopedBy(ctx, "patientid", bson.M{"id": id}),
+		options.FindOne().SetSort(bson.M{"version": -1}))
+
+	var plan *models.ActionPlan
+	err := result.Decode(&plan)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, models.ErrNoActionPlan
+	}
+	if err != nil {
+		return nil, failed(ctx, m.logger, "ActionPlanModel.Get", err)
+	}
+	return plan, nil
+}
+
+func (m *ActionPlanModel) GetAll(ctx context.Context) ([]*models.ActionPlan, error) {
+	cur, err := m.getCollection().Aggregate(ctx, bson.A{
+		bson.M{"$match": scopedBy(ctx, "patientid", bson.M{})},
+		bson.M{"$sort": bson.D{{Key: "id", Value: 1}, {Key: "version", Value: -1}}},
+		bson.M{"$group": bson.M{"_id": "$id", "latest": bson.M{"$first": "$$ROOT"}}},
+		bson.M{"$replaceRoot": bson.M{"newRoot": "$latest"}},
+		bson.M{"$sort": bson.M{"effectivefrom": 1}},
+	})
+	if err != nil {
+		return nil, failed(ctx, m.logger, "ActionPlanModel.GetAll", err)
+	}
+	defer cur.Close(ctx)
+
+	plans := []*models.ActionPlan{}
+	err = cur.All(ctx, &plans)
+	if err != nil {
+		return nil, failed(ctx, m.logger, "ActionPlanModel.GetAll", err)
+	}
+	return plans, nil
+}
+
+func (m *ActionPlanModel) Versions(ctx context.Context, id string) ([]*models.ActionPlan, error) {
+	cur, err := m.getCollection().Find(ctx, scopedBy(ctx, "patientid", bson.M{"id": id}), options.Find().SetSort(bson.M{"version": 1}))
+	if err != nil {
+		return nil, failed(ctx, m.logger, "ActionPlanModel.Versions", err)
+	}
+	defer cur.Close(ctx)
+
+	var versions []*models.ActionPlan
+	err = cur.All(ctx, &versions)
+	if err != nil {
+		return nil, failed(ctx, m.logger, "ActionPlanModel.Versions", err)
+	}
+	if len(versions) == 0 {
+		return nil, models.ErrNoActionPlan
+	}
+	return versions, nil
+}
+
+func (m *ActionPlanModel) Remove(ctx context.Context, id string) error {
+	result, err := m.getCollection().DeleteMany(ctx, scopedBy(ctx, "patientid", bson.M{"id": id}))
+	if err != nil {
+		return failed(ctx, m.logger, "ActionPlanModel.Remove", err)
+	}
+	if result.DeletedCount == 0 {
+		return models.ErrNoActionPlan
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/analytics"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+// Summarize counts the records of the patient of ctx taken since the given
+// time and finds the latest one, both on the patient and creation index.
+func (m *RecordModel) Summarize(ctx context.Context, since time.Time) (*models.Summary, error) {
+	records := m.getRecordsCollection()
+
+	count, err := records.CountDocuments(ctx, scoped(ctx, bson.M{"createdAt": bson.M{"$gte": since}}))
+	if err != nil {
+		return nil, failed(ctx, m.logger, "RecordModel.Summarize", err)
+	}
+	summary := &models.Summary{Since: int(count)}
+
+	latest := options.FindOne().SetSort(bson.D{{Key: "createdAt", Value: -1}})
+	err = records.FindOne(ctx, scoped(ctx, bson.M{}), latest).Decode(&summary.Latest)
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, failed(ctx, m.logger, "RecordModel.Summarize", err)
+	}
+	return summary, nil
+}
+
+// Aggregate groups the records of the patient of ctx with an aggregation
+// pipeline, following the contract of analytics.Aggregate. $dateTrunc needs
+// MongoDB 5.0 or later.
+func (m *RecordModel) Aggregate(ctx context.Context, query *models.AggregateQuery) ([]*models.Bucket, error) {
+	pipeline := append(bson.A{bson.M{"$match": scoped(ctx, bson.M{})}}, aggregatePipeline(query)...)
+	cur, err := m.getRecordsCollection().Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, failed(ctx, m.logger, "RecordModel.Aggregate", err)
+	}
+	defer cur.Close(ctx)
+
+	buckets := []*models.Bucket{}
+	for cur.Next(ctx) {
+		var group struct {
+			Date        string   `bson:"_id"`
+			Count       int      `bson:"count"`
+			Min         float64  `bson:"min"`
+			Max         float64  `bson:"max"`
+			Mean        float64  `bson:"mean"`
+			MorningMean *float64 `bson:"morningMean"`
+			EveningMean *float64 `bson:"eveningMean"`
+		}
+		err := cur.Decode(&group)
+		if err != nil {
+			return nil, failed(ctx, m.logger, "RecordModel.Aggregate", err)
+		}
+
+		start, err := time.ParseInLocation(dateLayout, group.Date, query.Location)
+		if err != nil {
+			return nil, failed(ctx, m.logger, "RecordModel.Aggregate", err)
+		}
+		buckets = append(buckets, &models.Bucket{
+			Start:       start,
+			End:         analytics.BucketEnd(start, query.Bucket),
+			Count:       group.Count,
+			Min:         group.Min,
+			Max:         group.Max,
+			Mean:        analytics.Round(group.Mean),
+			MorningMean: roundMean(group.MorningMean),
+			EveningMean: roundMean(group.EveningMean),
+		})
+	}
+	if err := cur.Err(); err != nil {
+		return nil, failed(ctx, m.logger, "RecordModel.Aggregate", err)
+	}
+	return buckets, nil
+}
+
+// dateLayout of the local dates grouped by, as formatted by bucketDate.
+const dateLayout = "2006-01-02"
+
+// aggregatePipeline truncates reading times to the bucket in the time zone
+// of each record, the one of the query if it has none, and groups by the
+// local date the bucket starts on. MongoDB applies DST rules like Go does
+// and takes UTC offsets like +05:30 as well.
+func aggregatePipeline(query *models.AggregateQuery) bson.A {
+	// $ifNull alone keeps "", which $dateTrunc rejects
+	timezone := bson.M{"$cond": bson.A{
+		bson.M{"$eq": bson.A{bson.M{"$ifNull": bson.A{"$timezone", ""}}, ""}},
+		query.Location.String(),
+		"$timezone",
+	}}
+
+	trunc := bson.M{"date": "$createdAt", "unit": query.Bucket, "timezone": timezone}
+	if query.Bucket == models.BucketWeek {
+		trunc["startOfWeek"] = "monday"
+	}
+	hour := bson.M{"$hour": bson.M{"date": "$createdAt", "timezone": timezone}}
+
+	// $avg skips the nulls of readings at other times of the day
+	meanOf := func(condition bson.M) bson.M {
+		return bson.M{"$avg": bson.M{"$cond": bson.A{condition, "$value", nil}}}
+	}
+
+	return bson.A{
+		bson.M{"$group": bson.M{
+			"_id": bson.M{"$dateToString": bson.M{
+				"date":     bson.M{"$dateTrunc": trunc},
+				"format":   "%Y-%m-%d",
+				"timezone": timezone,
+			}},
+			"count":       bson.M{"$sum": 1},
+			"min":         bson.M{"$min": "$value"},
+			"max":         bson.M{"$max": "$value"},
+			"mean":        bson.M{"$avg": "$value"},
+			"morningMean": meanOf(bson.M{"$lt": bson.A{hour, models.MorningEndHour}}),
+			"eveningMean": meanOf(bson.M{"$gte": bson.A{hour, models.EveningStartHour}}),
+		}},
+		bson.M{"$sort": bson.M{"_id": 1}},
+	}
+}
+
+func roundMean(mean *float64) *float64 {
+	if mean == nil {
+		return nil
+	}
+	rounded := analytics.Round(*mean)
+	return &rounded
+}
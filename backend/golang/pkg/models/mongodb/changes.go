@@ -0,0 +1,279 @@
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"sort"
+	"time"
+)
+
+const (
+	collectionCounters   = "counters"
+	collectionTombstones = "tombstones"
+
+	// changeSeqCounter is the counter document of the record change sequence
+	changeSeqCounter = "recordChanges"
+
+	// pendingSeqTimeout is how long a reserved number may hold back the change
+	// feed, writes taking longer are assumed to have crashed
+	pendingSeqTimeout = time.Minute
+)
+
+func (m *RecordModel) getCountersCollection() *mongo.Collection {
+	return m.client.Database(databaseName).Collection(collectionCounters)
+}
+
+func (m *RecordModel) getTombstonesCollection() *mongo.Collection {
+	return m.client.Database(databaseName).Collection(collectionTombstones)
+}
+
+// reserveSeq takes the next n numbers of the change sequence and returns the
+// first. Numbers are taken before the write they stamp, a number may be
+// skipped if the write fails. They stay pending until releaseSeq, so the
+// change feed doesn't pass them before their write is visible.
+func (m *RecordModel) reserveSeq(ctx context.Context, n int) (int64, error) {
+	now := time.Now()
+	result := m.getCountersCollection().FindOneAndUpdate(ctx,
+		bson.M{"_id": changeSeqCounter},
+		mongo.Pipeline{
+			{{Key: "$set", Value: bson.M{
+				"seq": bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$seq", int64(0)}}, int64(n)}},
+			}}},
+			{{Key: "$set", Value: bson.M{
+				"pending": bson.M{"$concatArrays": bson.A{
+					// reservations of crashed writers are dropped eventually
+					bson.M{"$filter": bson.M{
+						"input": bson.M{"$ifNull": bson.A{"$pending", bson.A{}}},
+						"cond":  bson.M{"$gte": bson.A{"$$this.at", now.Add(-pendingSeqTimeout)}},
+					}},
+					bson.A{bson.M{"seq": bson.M{"$subtract": bson.A{"$seq", int64(n - 1)}}, "at": now}},
+				}},
+			}}},
+		},
+		options.FindOneAndUpdate().
+			SetUpsert(true).
+			SetReturnDocument(options.After),
+	)
+
+	var counter struct {
+		Seq int64 `bson:"seq"`
+	}
+	err := result.Decode(&counter)
+	if err != nil {
+		return 0, err
+	}
+	return counter.Seq - int64(n) + 1, nil
+}
+
+// releaseSeq marks the numbers reserved from seq on as written, or skipped.
+// It runs even if the request was canceled, a pending number holds back the
+// change feed until it times out.
+func (m *RecordModel) releaseSeq(ctx context.Context, seq int64) {
+	_, err := m.getCountersCollection().UpdateOne(context.WithoutCancel(ctx),
+		bson.M{"_id": changeSeqCounter},
+		bson.M{"$pull": bson.M{"pending": bson.M{"seq": seq}}})
+	if err != nil {
+		m.logger.Error("releasing change numbers failed", "seq", seq, "error", err)
+	}
+}
+
+// changesHorizon returns the lowest number still being written, the change
+// feed must stop before it. There is none if ok is false.
+func (m *RecordModel) changesHorizon(ctx context.Context) (horizon int64, ok bool, err error) {
+	var counter struct {
+		Pending []struct {
+			Seq int64     `bson:"seq"`
+			At  time.Time `bson:"at"`
+		} `bson:"pending"`
+	}
+	err = m.getCountersCollection().FindOne(ctx, bson.M{"_id": changeSeqCounter}).Decode(&counter)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	expired := time.Now().Add(-pendingSeqTimeout)
+	for _, pending := range counter.Pending {
+		if pending.At.Before(expired) {
+			continue
+		}
+		if !ok || pending.Seq < horizon {
+			horizon, ok = pending.Seq, true
+		}
+	}
+	return horizon, ok, nil
+}
+
+// bury leaves a tombstone of a removed record of the patient of ctx for the
+// change feed, numbered with the seq of the same index, which the caller
+// reserved.
+func (m *RecordModel) bury(ctx context.Context, ids []string, seqs []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	writes := make([]mongo.WriteModel, 0, len(ids))
+	for index, id := range ids {
+		writes = append(writes, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"recordId": id}).
+			SetUpdate(bson.M{"$set": bson.M{
+				"recordId":  id,
+				"patientId": models.PatientID(ctx),
+				"seq":       seqs[index],
+				"changedAt": time.Now(),
+			}}).
+			SetUpsert(true))
+	}
+	_, err := m.getTombstonesCollection().BulkWrite(ctx, writes)
+	return err
+}
+
+// unbury drops the tombstones of records written again with the same id.
+func (m *RecordModel) unbury(ctx context.Context, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	_, err := m.getTombstonesCollection().DeleteMany(ctx, bson.M{"recordId": bson.M{"$in": ids}})
+	return err
+}
+
+// PrepareChanges creates the indexes of the change feed and numbers records
+// written before there was a change sequence.
+func (m *RecordModel) PrepareChanges(ctx context.Context) error {
+	_, err := m.getRecordsCollection().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.M{"seq": 1},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = m.getTombstonesCollection().Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.M{"recordId": 1},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bson.M{"seq": 1},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	records := m.getRecordsCollection()
+	cur, err := records.Find(ctx, bson.M{"seq": bson.M{"$exists": false}})
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		var record models.Record
+		err := cur.Decode(&record)
+		if err != nil {
+			return err
+		}
+
+		seq, err := m.reserveSeq(ctx, 1)
+		if err != nil {
+			return err
+		}
+		_, err = records.UpdateOne(ctx,
+			bson.M{"id": record.ID, "seq": bson.M{"$exists": false}},
+			bson.M{"$set": bson.M{"seq": seq, "changedAt": time.Now()}})
+		m.releaseSeq(ctx, seq)
+		if err != nil {
+			return err
+		}
+	}
+	return cur.Err()
+}
+
+// Changes merges the records and tombstones of the patient of ctx written
+// after since. Each keeps the number of its latest write only, so it is the
+// latest change already. Changes from the lowest number still being written
+// on are left for later, a client passing them would never see that one.
+func (m *RecordModel) Changes(ctx context.Context, since int64, limit int) ([]*models.Change, error) {
+	horizon, pending, err := m.changesHorizon(ctx)
+	if err != nil {
+		return nil, failed(ctx, m.logger, "RecordModel.Changes", err)
+	}
+	seqFilter := bson.M{"$gt": since}
+	if pending {
+		seqFilter["$lt"] = horizon
+	}
+	query := scoped(ctx, bson.M{"seq": seqFilter})
+	findOptions := options.Find().SetSort(bson.M{"seq": 1}).SetLimit(int64(limit))
+
+	changes := []*models.Change{}
+
+	cur, err := m.getRecordsCollection().Find(ctx, query, findOptions)
+	if err != nil {
+		return nil, failed(ctx, m.logger, "RecordModel.Changes", err)
+	}
+	for cur.Next(ctx) {
+		var written struct {
+			models.Record `bson:",inline"`
+			Seq           int64     `bson:"seq"`
+			ChangedAt     time.Time `bson:"changedAt"`
+		}
+		err := cur.Decode(&written)
+		if err != nil {
+			cur.Close(ctx)
+			return nil, failed(ctx, m.logger, "RecordModel.Changes", err)
+		}
+
+		record := written.Record
+		changes = append(changes, &models.Change{
+			Seq:       written.Seq,
+			RecordID:  record.ID,
+			Record:    &record,
+			ChangedAt: written.ChangedAt,
+		})
+	}
+	cur.Close(ctx)
+	if err := cur.Err(); err != nil {
+		return nil, failed(ctx, m.logger, "RecordModel.Changes", err)
+	}
+
+	cur, err = m.getTombstonesCollection().Find(ctx, query, findOptions)
+	if err != nil {
+		return nil, failed(ctx, m.logger, "RecordModel.Changes", err)
+	}
+	defer cur.Close(ctx)
+	for cur.Next(ctx) {
+		var tombstone struct {
+			RecordID  string    `bson:"recordId"`
+			Seq       int64     `bson:"seq"`
+			ChangedAt time.Time `bson:"changedAt"`
+		}
+		err := cur.Decode(&tombstone)
+		if err != nil {
+			return nil, failed(ctx, m.logger, "RecordModel.Changes", err)
+		}
+
+		changes = append(changes, &models.Change{
+			Seq:       tombstone.Seq,
+			RecordID:  tombstone.RecordID,
+			Deleted:   true,
+			ChangedAt: tombstone.ChangedAt,
+		})
+	}
+	if err := cur.Err(); err != nil {
+		return nil, failed(ctx, m.logger, "RecordModel.Changes", err)
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Seq < changes[j].Seq
+	})
+	if len(changes) > limit {
+		changes = changes[:limit]
+	}
+	return changes, nil
+}
@@ -0,0 +1,24 @@
+package mongodb
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// HealthChecker pings the primary, it satisfies health.Checker.
+type HealthChecker struct {
+	client *mongo.Client
+}
+
+func NewHealthChecker(client *mongo.Client) *HealthChecker {
+	return &HealthChecker{client}
+}
+
+func (c *HealthChecker) Name() string {
+	return "mongodb"
+}
+
+func (c *HealthChecker) Check(ctx context.Context) error {
+	return c.client.Ping(ctx, readpref.Primary())
+}
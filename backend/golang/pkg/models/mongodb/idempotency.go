@@ -0,0 +1,110 @@
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log/slog"
+	"time"
+)
+
+const collectionIdempotencyKeys = "idempotencyKeys"
+
+type IdempotencyModel struct {
+	client *mongo.Client
+	logger *slog.Logger
+}
+
+func NewIdempotencyModel(client *mongo.Client, logger *slog.Logger) *IdempotencyModel {
+	return &IdempotencyModel{client, logger}
+}
+
+func (m *IdempotencyModel) getCollection() *mongo.Collection {
+	return m.client.Database(databaseName).Collection(collectionIdempotencyKeys)
+}
+
+// CreateIndexes makes keys unique and lets MongoDB drop expired entries.
+func (m *IdempotencyModel) CreateIndexes(ctx context.Context) error {
+	_, err := m.getCollection().Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.M{"key": 1},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys:    bson.M{"expiresAt": 1},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	return err
+}
+
+// Reserve relies on the unique index on key, so concurrent reservations
+// of the same key from several instances can't both succeed.
+func (m *IdempotencyModel) Reserve(ctx context.Context, entry *models.IdempotencyEntry) error {
+	entries := m.getCollection()
+
+	// the TTL monitor runs only once a minute, expired entries may still be there
+	_, err := entries.DeleteOne(ctx, bson.M{"key": entry.Key, "expiresAt": bson.M{"$lte": time.Now()}})
+	if err != nil {
+		return failed(ctx, m.logger, "IdempotencyModel.Reserve", err)
+	}
+
+	_, err = entries.InsertOne(ctx, bson.M{
+		"key":         entry.Key,
+		"fingerprint": entry.Fingerprint,
+		"completed":   false,
+		"expiresAt":   entry.ExpiresAt,
+	})
+	if mongo.IsDuplicateKeyError(err) {
+		return models.ErrIdempotencyKeyExists
+	}
+	if err != nil {
+		return failed(ctx, m.logger, "IdempotencyModel.Reserve", err)
+	}
+	return nil
+}
+
+func (m *IdempotencyModel) Get(ctx context.Context, key string) (*models.IdempotencyEntry, error) {
+	result := m.getCollection().FindOne(ctx, bson.M{"key": key, "expiresAt": bson.M{"$gt": time.Now()}})
+
+	var entry *models.IdempotencyEntry
+	err := result.Decode(&entry)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, models.ErrNoRecord
+	}
+	if err != nil {
+		return nil, failed(ctx, m.logger, "IdempotencyModel.Get", err)
+	}
+
+	return entry, nil
+}
+
+func (m *IdempotencyModel) Complete(ctx context.Context, entry *models.IdempotencyEntry) error {
+	_, err := m.getCollection().UpdateOne(ctx,
+		bson.M{"key": entry.Key},
+		bson.M{
+			"$set": bson.M{
+				"completed":   true,
+				"recordId":    entry.RecordID,
+				"status":      entry.Status,
+				"contentType": entry.ContentType,
+				"body":        entry.Body,
+			},
+		},
+	)
+	if err != nil {
+		return failed(ctx, m.logger, "IdempotencyModel.Complete", err)
+	}
+	return nil
+}
+
+func (m *IdempotencyModel) Remove(ctx context.Context, key string) error {
+	_, err := m.getCollection().DeleteOne(ctx, bson.M{"key": key})
+	if err != nil {
+		return failed(ctx, m.logger, "IdempotencyModel.Remove", err)
+	}
+	return nil
+}
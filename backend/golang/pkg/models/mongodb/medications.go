@@ -0,0 +1,168 @@
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log/slog"
+)
+
+const collectionMedications = "medications"
+const collectionDoses = "doses"
+
+// MedicationModel stores medications and their doses in collections of
+// their own, doses refer to their medication by id. Both keep their patient,
+// those of the default patient stored before there were patients have none.
+type MedicationModel struct {
+	client *mongo.Client
+	logger *slog.Logger
+}
+
+func NewMedicationModel(client *mongo.Client, logger *slog.Logger) *MedicationModel {
+	return &MedicationModel{client, logger}
+}
+
+func (m *MedicationModel) getMedicationsCollection() *mongo.Collection {
+	return m.client.Database(databaseName).Collection(collectionMedications)
+}
+
+func (m *MedicationModel) getDosesCollection() *mongo.Collection {
+	return m.client.Database(databaseName).Collection(collectionDoses)
+}
+
+// CreateIndexes makes ids unique and indexes doses by the time taken,
+// the doses around a reading are looked up by it.
+func (m *MedicationModel) CreateIndexes(ctx context.Context) error {
+	_, err := m.getMedicationsCollection().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.M{"id": 1},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = m.getDosesCollection().Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.M{"id": 1},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bson.D{{Key: "medicationid", Value: 1}, {Key: "takenat", Value: 1}},
+		},
+		{
+			Keys: bson.M{"takenat": 1},
+		},
+	})
+	return err
+}
+
+func (m *MedicationModel) Update(ctx context.Context, medication *models.Medication) error {
+	medication.PatientID = models.PatientID(ctx)
+	_, err := m.getMedicationsCollection().ReplaceOne(ctx, scopedBy(ctx, "patientid", bson.M{"id": medication.ID}), medication,
+		options.Replace().SetUpsert(true))
+	if err != nil {
+		return failed(ctx, m.logger, "MedicationModel.Update", err)
+	}
+	return nil
+}
+
+func (m *MedicationModel) Get(ctx context.Context, id string) (*models.Medication, error) {
+	result := m.getMedicationsCollection().FindOne(ctx, scopedBy(ctx, "patientid", bson.M{"id": id}))
+
+	var medication *models.Medication
+	err := result.Decode(&medication)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, models.ErrNoMedication
+	}
+	if err != nil {
+		return nil, failed(ctx, m.logger, "MedicationModel.Get", err)
+	}
+	return medication, nil
+}
+
+func (m *MedicationModel) GetAll(ctx context.Context) ([]*models.Medication, error) {
+	cur, err := m.getMedicationsCollection().Find(ctx, scopedBy(ctx, "patientid", bson.M{}), options.Find().SetSort(bson.M{"name": 1}))
+	if err != nil {
+		return nil, failed(ctx, m.logger, "MedicationModel.GetAll", err)
+	}
+	defer cur.Close(ctx)
+
+	medications := []*models.Medication{}
+	err = cur.All(ctx, &medications)
+	if err != nil {
+		return nil, failed(ctx, m.logger, "MedicationModel.GetAll", err)
+	}
+	return medications, nil
+}
+
+func (m *MedicationModel) Remove(ctx context.Context, id string) error {
+	result, err := m.getMedicationsCollection().DeleteOne(ctx, scopedBy(ctx, "patientid", bson.M{"id": id}))
+	if err != nil {
+		return failed(ctx, m.logger, "MedicationModel.Remove", err)
+	}
+	if result.DeletedCount == 0 {
+		return models.ErrNoMedication
+	}
+
+	_, err = m.getDosesCollection().DeleteMany(ctx, scopedBy(ctx, "patientid", bson.M{"medicationid": id}))
+	if err != nil {
+		return failed(ctx, m.logger, "MedicationModel.Remove", err)
+	}
+	return nil
+}
+
+func (m *MedicationModel) AddDose(ctx context.Context, dose *models.Dose) error {
+	dose.PatientID = models.PatientID(ctx)
+	_, err := m.getDosesCollection().InsertOne(ctx, dose)
+	if err != nil {
+		return failed(ctx, m.logger, "MedicationModel.AddDose", err)
+	}
+	return nil
+}
+
+func (m *MedicationModel) RemoveDose(ctx context.Context, medicationID, id string) (*models.Dose, error) {
+	result := m.getDosesCollection().FindOneAndDelete(ctx, scopedBy(ctx, "patientid", bson.M{"id": id, "medicationid": medicationID}))
+
+	var dose *models.Dose
+	err := result.Decode(&dose)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, models.ErrNoDose
+	}
+	if err != nil {
+		return nil, failed(ctx, m.logger, "MedicationModel.RemoveDose", err)
+	}
+	return dose, nil
+}
+
+func (m *MedicationModel) Doses(ctx context.Context, query *models.DoseQuery) ([]*models.Dose, error) {
+	filter := scopedBy(ctx, "patientid", bson.M{})
+	if query.MedicationID != "" {
+		filter["medicationid"] = query.MedicationID
+	}
+	takenAt := bson.M{}
+	if !query.From.IsZero() {
+		takenAt["$gte"] = query.From
+	}
+	if !query.Until.IsZero() {
+		takenAt["$lt"] = query.Until
+	}
+	if len(takenAt) > 0 {
+		filter["takenat"] = takenAt
+	}
+
+	cur, err := m.getDosesCollection().Find(ctx, filter, options.Find().SetSort(bson.M{"takenat": 1}))
+	if err != nil {
+		return nil, failed(ctx, m.logger, "MedicationModel.Doses", err)
+	}
+	defer cur.Close(ctx)
+
+	doses := []*models.Dose{}
+	err = cur.All(ctx, &doses)
+	if err != nil {
+		return nil, failed(ctx, m.logger, "MedicationModel.Doses", err)
+	}
+	return doses, nil
+}
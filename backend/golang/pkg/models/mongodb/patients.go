@@ -0,0 +1,155 @@
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log/slog"
+)
+
+const collectionPatients = "patients"
+const collectionMemberships = "memberships"
+
+// PatientModel stores patients and the memberships of users in
+// collections of their own.
+type PatientModel struct {
+	client *mongo.Client
+	logger *slog.Logger
+}
+
+func NewPatientModel(client *mongo.Client, logger *slog.Logger) *PatientModel {
+	return &PatientModel{client, logger}
+}
+
+func (m *PatientModel) getPatientsCollection() *mongo.Collection {
+	return m.client.Database(databaseName).Collection(collectionPatients)
+}
+
+func (m *PatientModel) getMembershipsCollection() *mongo.Collection {
+	return m.client.Database(databaseName).Collection(collectionMemberships)
+}
+
+// CreateIndexes makes ids unique, a user has one membership per patient,
+// and indexes memberships by user.
+func (m *PatientModel) CreateIndexes(ctx context.Context) error {
+	_, err := m.getPatientsCollection().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.M{"id": 1},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = m.getMembershipsCollection().Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "patientid", Value: 1}, {Key: "userid", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bson.M{"userid": 1},
+		},
+	})
+	return err
+}
+
+func (m *PatientModel) Update(ctx context.Context, patient *models.Patient) error {
+	_, err := m.getPatientsCollection().ReplaceOne(ctx, bson.M{"id": patient.ID}, patient,
+		options.Replace().SetUpsert(true))
+	if err != nil {
+		return failed(ctx, m.logger, "PatientModel.Update", err)
+	}
+	return nil
+}
+
+func (m *PatientModel) Get(ctx context.Context, id string) (*models.Patient, error) {
+	result := m.getPatientsCollection().FindOne(ctx, bson.M{"id": id})
+
+	var patient *models.Patient
+	err := result.Decode(&patient)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, models.ErrNoPatient
+	}
+	if err != nil {
+		return nil, failed(ctx, m.logger, "PatientModel.Get", err)
+	}
+	return patient, nil
+}
+
+func (m *PatientModel) GetAll(ctx context.Context) ([]*models.Patient, error) {
+	cur, err := m.getPatientsCollection().Find(ctx, bson.M{}, options.Find().SetSort(bson.D{
+		{Key: "createdat", Value: 1},
+		{Key: "id", Value: 1},
+	}))
+	if err != nil {
+		return nil, failed(ctx, m.logger, "PatientModel.GetAll", err)
+	}
+	defer cur.Close(ctx)
+
+	patients := []*models.Patient{}
+	err = cur.All(ctx, &patients)
+	if err != nil {
+		return nil, failed(ctx, m.logger, "PatientModel.GetAll", err)
+	}
+	return patients, nil
+}
+
+func (m *PatientModel) SetMembership(ctx context.Context, membership *models.Membership) error {
+	_, err := m.getMembershipsCollection().ReplaceOne(ctx,
+		bson.M{"patientid": membership.PatientID, "userid": membership.UserID}, membership,
+		options.Replace().SetUpsert(true))
+	if err != nil {
+		return failed(ctx, m.logger, "PatientModel.SetMembership", err)
+	}
+	return nil
+}
+
+func (m *PatientModel) Membership(ctx context.Context, patientID, userID string) (*models.Membership, error) {
+	result := m.getMembershipsCollection().FindOne(ctx, bson.M{"patientid": patientID, "userid": userID})
+
+	var membership *models.Membership
+	err := result.Decode(&membership)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, models.ErrNoMembership
+	}
+	if err != nil {
+		return nil, failed(ctx, m.logger, "PatientModel.Membership", err)
+	}
+	return membership, nil
+}
+
+func (m *PatientModel) RemoveMembership(ctx context.Context, patientID, userID string) error {
+	result, err := m.getMembershipsCollection().DeleteOne(ctx, bson.M{"patientid": patientID, "userid": userID})
+	if err != nil {
+		return failed(ctx, m.logger, "PatientModel.RemoveMembership", err)
+	}
+	if result.DeletedCount == 0 {
+		return models.ErrNoMembership
+	}
+	return nil
+}
+
+func (m *PatientModel) Memberships(ctx context.Context, patientID string) ([]*models.Membership, error) {
+	return m.find(ctx, "PatientModel.Memberships", bson.M{"patientid": patientID})
+}
+
+func (m *PatientModel) MembershipsOf(ctx context.Context, userID string) ([]*models.Membership, error) {
+	return m.find(ctx, "PatientModel.MembershipsOf", bson.M{"userid": userID})
+}
+
+func (m *PatientModel) find(ctx context.Context, operation string, filter bson.M) ([]*models.Membership, error) {
+	cur, err := m.getMembershipsCollection().Find(ctx, filter, options.Find().SetSort(bson.M{"createdat": 1}))
+	if err != nil {
+		return nil, failed(ctx, m.logger, operation, err)
+	}
+	defer cur.Close(ctx)
+
+	memberships := []*models.Membership{}
+	err = cur.All(ctx, &memberships)
+	if err != nil {
+		return nil, failed(ctx, m.logger, operation, err)
+	}
+	return memberships, nil
+}
@@ -0,0 +1,80 @@
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log/slog"
+)
+
+const collectionQuickLinks = "quick_links"
+
+// QuickLinkModel stores quick-add links, so they can be revoked.
+type QuickLinkModel struct {
+	client *mongo.Client
+	logger *slog.Logger
+}
+
+func NewQuickLinkModel(client *mongo.Client, logger *slog.Logger) *QuickLinkModel {
+	return &QuickLinkModel{client, logger}
+}
+
+func (m *QuickLinkModel) getQuickLinksCollection() *mongo.Collection {
+	return m.client.Database(databaseName).Collection(collectionQuickLinks)
+}
+
+// CreateIndexes makes ids unique and indexes links by patient.
+func (m *QuickLinkModel) CreateIndexes(ctx context.Context) error {
+	_, err := m.getQuickLinksCollection().Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.M{"id": 1},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bson.D{{Key: "patientid", Value: 1}, {Key: "createdat", Value: -1}},
+		},
+	})
+	return err
+}
+
+func (m *QuickLinkModel) Update(ctx context.Context, link *models.QuickLink) error {
+	_, err := m.getQuickLinksCollection().ReplaceOne(ctx, bson.M{"id": link.ID}, link,
+		options.Replace().SetUpsert(true))
+	if err != nil {
+		return failed(ctx, m.logger, "QuickLinkModel.Update", err)
+	}
+	return nil
+}
+
+func (m *QuickLinkModel) Get(ctx context.Context, id string) (*models.QuickLink, error) {
+	result := m.getQuickLinksCollection().FindOne(ctx, bson.M{"id": id})
+
+	var link *models.QuickLink
+	err := result.Decode(&link)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, models.ErrNoQuickLink
+	}
+	if err != nil {
+		return nil, failed(ctx, m.logger, "QuickLinkModel.Get", err)
+	}
+	return link, nil
+}
+
+func (m *QuickLinkModel) GetAll(ctx context.Context, patientID string) ([]*models.QuickLink, error) {
+	cur, err := m.getQuickLinksCollection().Find(ctx, bson.M{"patientid": patientID},
+		options.Find().SetSort(bson.M{"createdat": -1}))
+	if err != nil {
+		return nil, failed(ctx, m.logger, "QuickLinkModel.GetAll", err)
+	}
+	defer cur.Close(ctx)
+
+	links := []*models.QuickLink{}
+	err = cur.All(ctx, &links)
+	if err != nil {
+		return nil, failed(ctx, m.logger, "QuickLinkModel.GetAll", err)
+	}
+	return links, nil
+}
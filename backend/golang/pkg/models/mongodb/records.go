@@ -2,27 +2,36 @@ package mongodb
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/logging"
 	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
 	"time"
 	"unicode/utf8"
 )
 
 const (
-	databaseName      = "simple-peak-flowmeter"
-	collectionRecords = "records"
+	collectionRecords   = "records"
+	collectionRevisions = "revisions"
 )
 
-var (
-	ctx = context.Background()
-)
+// databaseName is a variable for the integration tests, which use a
+// database of their own.
+var databaseName = "simple-peak-flowmeter"
+
+// OpenDB connects to MongoDB, commands are traced with tracerProvider.
+func OpenDB(dsn string, tracerProvider trace.TracerProvider) (*mongo.Client, error) {
+	ctx := context.Background()
 
-func OpenDB(dsn string) (*mongo.Client, error) {
-	client, err := mongo.Connect(ctx, options.Client().ApplyURI(dsn))
+	client, err := mongo.Connect(ctx, options.Client().
+		ApplyURI(dsn).
+		SetMonitor(NewCommandMonitor(tracerProvider)))
 	if err != nil {
 		return nil, err
 	}
@@ -35,80 +44,270 @@ func OpenDB(dsn string) (*mongo.Client, error) {
 	return client, nil
 }
 
+// RecordModel stores records of every patient in one collection, every
+// query is scoped to the patient of the context.
 type RecordModel struct {
 	client *mongo.Client
+	logger *slog.Logger
+}
+
+func NewRecordModel(client *mongo.Client, logger *slog.Logger) *RecordModel {
+	return &RecordModel{client, logger}
 }
 
-func NewRecordModel(client *mongo.Client) *RecordModel {
-	return &RecordModel{client}
+// failed logs a storage error with the logger of the request, if there is one.
+func failed(ctx context.Context, fallback *slog.Logger, operation string, err error) error {
+	logging.FromContext(ctx, fallback).Error("mongodb operation failed",
+		"operation", operation,
+		"error", err)
+	return err
 }
 
 func (m *RecordModel) getRecordsCollection() *mongo.Collection {
 	return m.client.Database(databaseName).Collection(collectionRecords)
 }
 
-// This will insert a new record into the database or updates existing.
-func (m *RecordModel) Update(id string, createdAt time.Time, value float32) (string, error) {
-	records := m.getRecordsCollection()
+func (m *RecordModel) getRevisionsCollection() *mongo.Collection {
+	return m.client.Database(databaseName).Collection(collectionRevisions)
+}
 
-	upsert := true
-	result, err := records.UpdateOne(ctx,
-		bson.M{"id": id},
-		bson.M{
-			"$set": bson.M{
-				"id":        id,
-				"value":     value,
-				"createdAt": createdAt},
+// CreateIndexes makes ids unique across patients and indexes records by
+// patient, every query filters by it. A revision is archived once.
+func (m *RecordModel) CreateIndexes(ctx context.Context) error {
+	_, err := m.getRecordsCollection().Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.M{"id": 1},
+			Options: options.Index().SetUnique(true),
 		},
-		&options.UpdateOptions{
-			Upsert: &upsert,
+		{
+			Keys: bson.D{{Key: "patientId", Value: 1}, {Key: "createdAt", Value: 1}},
 		},
-	)
+	})
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	return fmt.Sprint(result.UpsertedID), nil
+	_, err = m.getRevisionsCollection().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "recordId", Value: 1}, {Key: "rev", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+// scoped adds the patient of ctx to filter. Records of the default patient
+// written before there were patients have no patientId.
+func scoped(ctx context.Context, filter bson.M) bson.M {
+	return scopedBy(ctx, "patientId", filter)
+}
+
+// scopedBy is scoped for documents keeping the patient under key, the
+// documents encoded from models structs keep it under "patientid".
+func scopedBy(ctx context.Context, key string, filter bson.M) bson.M {
+	patientID := models.PatientID(ctx)
+	if patientID == models.DefaultPatient {
+		filter[key] = bson.M{"$in": bson.A{nil, models.DefaultPatient}}
+	} else {
+		filter[key] = patientID
+	}
+	return filter
+}
+
+// This will insert a new record into the database or updates existing.
+// The overwritten version of an existing record is archived as a revision,
+// record.Rev is set to the new revision number. An id taken by a record of
+// another patient fails with ErrRecordExists.
+//
+// The record is only overwritten if its rev is still the one archived, a
+// concurrent update makes it start over. The revision is archived first,
+// so a crash in between leaves at most a copy of the current version,
+// which History skips, instead of losing one.
+func (m *RecordModel) Update(ctx context.Context, record *models.Record) (string, error) {
+	records := m.getRecordsCollection()
+	record.PatientID = models.PatientID(ctx)
+
+	seq, err := m.reserveSeq(ctx, 1)
+	if err != nil {
+		return "", failed(ctx, m.logger, "RecordModel.Update", err)
+	}
+	defer m.releaseSeq(ctx, seq)
+
+	fields := bson.M{
+		"id":          record.ID,
+		"patientId":   record.PatientID,
+		"value":       record.Value,
+		"createdAt":   record.CreatedAt,
+		"context":     record.Context,
+		"timezone":    record.Timezone,
+		"environment": record.Environment,
+		"seq":         seq,
+	}
+
+	for {
+		var previous *models.Record
+		err = records.FindOne(ctx, scoped(ctx, bson.M{"id": record.ID})).Decode(&previous)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			inserted, err := m.insert(ctx, fields)
+			if err != nil {
+				return "", err
+			}
+			if !inserted {
+				// written concurrently, update that one
+				continue
+			}
+			record.Rev = 1
+			return record.ID, nil
+		}
+		if err != nil {
+			return "", failed(ctx, m.logger, "RecordModel.Update", err)
+		}
+
+		err = m.archive(ctx, previous)
+		if err != nil {
+			return "", failed(ctx, m.logger, "RecordModel.Update", err)
+		}
+
+		fields["rev"] = previous.Rev + 1
+		fields["changedAt"] = time.Now()
+		result, err := records.UpdateOne(ctx,
+			scoped(ctx, bson.M{"id": record.ID, "rev": revFilter(previous.Rev)}),
+			bson.M{"$set": fields})
+		if err != nil {
+			return "", failed(ctx, m.logger, "RecordModel.Update", err)
+		}
+		if result.MatchedCount == 0 {
+			// overwritten or removed since it was read
+			continue
+		}
+
+		record.Rev = previous.Rev + 1
+		return record.ID, nil
+	}
+}
+
+// insert writes the first revision of a record. It reports false if a record
+// with the id was written for the patient of ctx in the meantime, the id
+// taken by another patient fails with ErrRecordExists.
+func (m *RecordModel) insert(ctx context.Context, fields bson.M) (bool, error) {
+	document := bson.M{"rev": 1, "changedAt": time.Now()}
+	for key, value := range fields {
+		document[key] = value
+	}
+
+	_, err := m.getRecordsCollection().InsertOne(ctx, document)
+	if mongo.IsDuplicateKeyError(err) {
+		count, err := m.getRecordsCollection().CountDocuments(ctx, scoped(ctx, bson.M{"id": fields["id"]}))
+		if err != nil {
+			return false, failed(ctx, m.logger, "RecordModel.Update", err)
+		}
+		if count == 0 {
+			return false, models.ErrRecordExists
+		}
+		return false, nil
+	}
+	if err != nil {
+		return false, failed(ctx, m.logger, "RecordModel.Update", err)
+	}
+
+	err = m.unbury(ctx, []string{fields["id"].(string)})
+	if err != nil {
+		return false, failed(ctx, m.logger, "RecordModel.Update", err)
+	}
+	return true, nil
+}
+
+// revFilter matches the rev of a record, records written before there were
+// revisions have none.
+func revFilter(rev int) interface{} {
+	if rev == 0 {
+		return bson.M{"$in": bson.A{nil, 0}}
+	}
+	return rev
+}
+
+// archive stores a prior version of a record in the revisions collection.
+// Archiving the same version again, as concurrent updates do, changes nothing.
+func (m *RecordModel) archive(ctx context.Context, record *models.Record) error {
+	_, err := m.getRevisionsCollection().UpdateOne(ctx,
+		bson.M{"recordId": record.ID, "rev": record.Rev},
+		revisionInsert(record),
+		options.Update().SetUpsert(true))
+	return err
+}
+
+// revisionInsert writes a revision of record on upsert only. The patient is
+// kept at the top level, so revisions are scoped like records.
+func revisionInsert(record *models.Record) bson.M {
+	return bson.M{"$setOnInsert": bson.M{
+		"patientId":  record.PatientID,
+		"archivedAt": time.Now(),
+		"record":     record,
+	}}
 }
 
 // This will return a specific Record based on its id.
-func (m *RecordModel) Get(id string) (*models.Record, error) {
+func (m *RecordModel) Get(ctx context.Context, id string) (*models.Record, error) {
 	if utf8.RuneCountInString(id) == 0 {
 		return nil, nil
 	}
 
 	records := m.getRecordsCollection()
 
-	result := records.FindOne(ctx, bson.M{"id": id})
+	result := records.FindOne(ctx, scoped(ctx, bson.M{"id": id}))
 
 	var record *models.Record
 	err := result.Decode(&record)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, models.ErrNoRecord
+	}
 	if err != nil {
-		return nil, err
+		return nil, failed(ctx, m.logger, "RecordModel.Get", err)
 	}
 
 	return record, nil
 }
 
-func (m *RecordModel) Remove(id string) (int64, error) {
+func (m *RecordModel) Remove(ctx context.Context, id string) (int64, error) {
 	if utf8.RuneCountInString(id) == 0 {
 		return 0, nil
 	}
 
 	records := m.getRecordsCollection()
 
-	result, err := records.DeleteOne(ctx, bson.M{"id": id})
-	return result.DeletedCount, err
+	result, err := records.DeleteOne(ctx, scoped(ctx, bson.M{"id": id}))
+	if err != nil {
+		return 0, failed(ctx, m.logger, "RecordModel.Remove", err)
+	}
+	if result.DeletedCount == 0 {
+		return 0, nil
+	}
+
+	revisions := m.getRevisionsCollection()
+	_, err = revisions.DeleteMany(ctx, scoped(ctx, bson.M{"recordId": id}))
+	if err != nil {
+		return 0, failed(ctx, m.logger, "RecordModel.Remove", err)
+	}
+
+	seq, err := m.reserveSeq(ctx, 1)
+	if err != nil {
+		return 0, failed(ctx, m.logger, "RecordModel.Remove", err)
+	}
+	defer m.releaseSeq(ctx, seq)
+
+	err = m.bury(ctx, []string{id}, []int64{seq})
+	if err != nil {
+		return 0, failed(ctx, m.logger, "RecordModel.Remove", err)
+	}
+	return result.DeletedCount, nil
 }
 
 // This will return all the created Records.
-func (m *RecordModel) GetAll() ([]*models.Record, error) {
+func (m *RecordModel) GetAll(ctx context.Context) ([]*models.Record, error) {
 	var result []*models.Record
 
 	records := m.getRecordsCollection()
-	cur, err := records.Find(ctx, bson.M{})
+	cur, err := records.Find(ctx, scoped(ctx, bson.M{}))
 	if err != nil {
-		return nil, err
+		return nil, failed(ctx, m.logger, "RecordModel.GetAll", err)
 	}
 	defer cur.Close(ctx)
 
@@ -116,10 +315,304 @@ func (m *RecordModel) GetAll() ([]*models.Record, error) {
 		var record models.Record
 		err := cur.Decode(&record)
 		if err != nil {
-			return nil, err
+			return nil, failed(ctx, m.logger, "RecordModel.GetAll", err)
 		}
 
 		result = append(result, &record)
 	}
 	return result, nil
 }
+
+// This will return all archived revisions of a Record, oldest first.
+func (m *RecordModel) History(ctx context.Context, id string) ([]*models.Revision, error) {
+	result := []*models.Revision{}
+
+	current, err := m.Get(ctx, id)
+	if errors.Is(err, models.ErrNoRecord) {
+		return result, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// a copy of the current version is left by an update that didn't finish
+	revisions := m.getRevisionsCollection()
+	cur, err := revisions.Find(ctx,
+		scoped(ctx, bson.M{"recordId": id, "rev": bson.M{"$lt": current.Rev}}),
+		options.Find().SetSort(bson.M{"rev": 1}),
+	)
+	if err != nil {
+		return nil, failed(ctx, m.logger, "RecordModel.History", err)
+	}
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		var revision models.Revision
+		err := cur.Decode(&revision)
+		if err != nil {
+			return nil, failed(ctx, m.logger, "RecordModel.History", err)
+		}
+
+		result = append(result, &revision)
+	}
+	return result, nil
+}
+
+// This will restore a Record to the given revision. The current version
+// is archived first, so a revert can be reverted as well.
+func (m *RecordModel) Revert(ctx context.Context, id string, rev int) (*models.Record, error) {
+	_, err := m.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	revisions := m.getRevisionsCollection()
+
+	result := revisions.FindOne(ctx, scoped(ctx, bson.M{"recordId": id, "rev": rev}))
+
+	var revision *models.Revision
+	err = result.Decode(&revision)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, models.ErrNoRevision
+	}
+	if err != nil {
+		return nil, failed(ctx, m.logger, "RecordModel.Revert", err)
+	}
+
+	restored := *revision.Record
+	restored.ID = id
+	_, err = m.Update(ctx, &restored)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.Get(ctx, id)
+}
+
+// BulkWrite applies all operations with a single bulk write. In atomic mode
+// it runs inside a transaction, which requires MongoDB to run as a replica set.
+//
+// The change numbers of the batch are reserved up front, outside of the
+// transaction, so it doesn't hold the counter every write goes through.
+func (m *RecordModel) BulkWrite(ctx context.Context, ops []*models.BulkOperation, atomic bool) ([]error, error) {
+	// numbers of failed operations are skipped
+	seq, err := m.reserveSeq(ctx, len(ops))
+	if err != nil {
+		return nil, failed(ctx, m.logger, "RecordModel.BulkWrite", err)
+	}
+	defer m.releaseSeq(ctx, seq)
+
+	if !atomic {
+		errs, err := m.bulkWrite(ctx, ops, seq, false)
+		if err != nil {
+			return nil, failed(ctx, m.logger, "RecordModel.BulkWrite", err)
+		}
+		return errs, nil
+	}
+
+	session, err := m.client.StartSession()
+	if err != nil {
+		return nil, failed(ctx, m.logger, "RecordModel.BulkWrite", err)
+	}
+	defer session.EndSession(ctx)
+
+	var errs []error
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		var err error
+		errs, err = m.bulkWrite(sc, ops, seq, true)
+		if err != nil {
+			return nil, err
+		}
+		if models.AbortBatch(errs) {
+			return nil, models.ErrBatchAborted
+		}
+		return nil, nil
+	})
+	if errors.Is(err, models.ErrBatchAborted) {
+		return errs, nil
+	}
+	if err != nil {
+		return nil, failed(ctx, m.logger, "RecordModel.BulkWrite", err)
+	}
+
+	return errs, nil
+}
+
+// bulkWrite numbers the operation of each index with seq + index.
+func (m *RecordModel) bulkWrite(ctx context.Context, ops []*models.BulkOperation, seq int64, atomic bool) ([]error, error) {
+	errs := make([]error, len(ops))
+
+	existing, err := m.findExisting(ctx, ops)
+	if err != nil {
+		return nil, err
+	}
+
+	var writes []mongo.WriteModel
+	var writeOps []int
+	archived := map[int]*models.Record{}
+	patientID := models.PatientID(ctx)
+	for index, op := range ops {
+		record := op.Record
+		record.PatientID = patientID
+		previous, exists := existing[record.ID]
+
+		switch op.Kind {
+		case models.BulkCreate:
+			if exists {
+				errs[index] = models.ErrRecordExists
+				continue
+			}
+			record.Rev = 1
+			writes = append(writes, mongo.NewInsertOneModel().SetDocument(bson.M{
+				"id":          record.ID,
+				"patientId":   record.PatientID,
+				"value":       record.Value,
+				"createdAt":   record.CreatedAt,
+				"context":     record.Context,
+				"timezone":    record.Timezone,
+				"environment": record.Environment,
+				"rev":         record.Rev,
+				"seq":         seq + int64(index),
+				"changedAt":   time.Now(),
+			}))
+			existing[record.ID] = record
+		case models.BulkUpdate:
+			if !exists {
+				errs[index] = models.ErrNoRecord
+				continue
+			}
+			record.Rev = previous.Rev + 1
+			writes = append(writes, mongo.NewUpdateOneModel().
+				SetFilter(scoped(ctx, bson.M{"id": record.ID})).
+				SetUpdate(bson.M{
+					"$set": bson.M{
+						"value":       record.Value,
+						"createdAt":   record.CreatedAt,
+						"context":     record.Context,
+						"timezone":    record.Timezone,
+						"environment": record.Environment,
+						"seq":         seq + int64(index),
+						"changedAt":   time.Now(),
+					},
+					"$inc": bson.M{"rev": 1},
+				}))
+			archived[index] = previous
+			existing[record.ID] = record
+		case models.BulkRemove:
+			if !exists {
+				errs[index] = models.ErrNoRecord
+				continue
+			}
+			writes = append(writes, mongo.NewDeleteOneModel().SetFilter(scoped(ctx, bson.M{"id": record.ID})))
+			delete(existing, record.ID)
+		default:
+			errs[index] = fmt.Errorf("models: unknown bulk operation %q", op.Kind)
+			continue
+		}
+		writeOps = append(writeOps, index)
+	}
+
+	if atomic && models.AbortBatch(errs) {
+		return errs, nil
+	}
+	if len(writes) == 0 {
+		return errs, nil
+	}
+
+	records := m.getRecordsCollection()
+	_, err = records.BulkWrite(ctx, writes, options.BulkWrite().SetOrdered(atomic))
+
+	var bulkErr mongo.BulkWriteException
+	if errors.As(err, &bulkErr) {
+		for _, writeErr := range bulkErr.WriteErrors {
+			errs[writeOps[writeErr.Index]] = writeErr
+			if mongo.IsDuplicateKeyError(writeErr) {
+				// the id is taken by a record of another patient
+				errs[writeOps[writeErr.Index]] = models.ErrRecordExists
+			}
+		}
+		if atomic {
+			return errs, nil
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	return errs, m.archiveBulk(ctx, ops, seq, errs, archived)
+}
+
+// findExisting loads the current version of every record of the patient of
+// ctx referenced by ops. Ids taken by records of other patients are only
+// noticed when creating a record fails with a duplicate key.
+func (m *RecordModel) findExisting(ctx context.Context, ops []*models.BulkOperation) (map[string]*models.Record, error) {
+	ids := make([]string, 0, len(ops))
+	for _, op := range ops {
+		ids = append(ids, op.Record.ID)
+	}
+
+	records := m.getRecordsCollection()
+	cur, err := records.Find(ctx, scoped(ctx, bson.M{"id": bson.M{"$in": ids}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	existing := map[string]*models.Record{}
+	for cur.Next(ctx) {
+		var record models.Record
+		err := cur.Decode(&record)
+		if err != nil {
+			return nil, err
+		}
+
+		existing[record.ID] = &record
+	}
+	return existing, cur.Err()
+}
+
+// archiveBulk stores the overwritten versions of successfully updated records
+// and drops the revisions of removed ones, leaving tombstones instead.
+func (m *RecordModel) archiveBulk(ctx context.Context, ops []*models.BulkOperation, seq int64,
+	errs []error, archived map[int]*models.Record) error {
+	var revisions []mongo.WriteModel
+	var removed, created []string
+	var removedSeqs []int64
+	for index, op := range ops {
+		if errs[index] != nil {
+			continue
+		}
+		if op.Kind == models.BulkCreate {
+			created = append(created, op.Record.ID)
+		}
+
+		if previous, ok := archived[index]; ok {
+			revisions = append(revisions, mongo.NewUpdateOneModel().
+				SetFilter(bson.M{"recordId": previous.ID, "rev": previous.Rev}).
+				SetUpdate(revisionInsert(previous)).
+				SetUpsert(true))
+		}
+		if op.Kind == models.BulkRemove {
+			removed = append(removed, op.Record.ID)
+			removedSeqs = append(removedSeqs, seq+int64(index))
+		}
+	}
+
+	if len(revisions) > 0 {
+		_, err := m.getRevisionsCollection().BulkWrite(ctx, revisions)
+		if err != nil {
+			return err
+		}
+	}
+	if len(removed) > 0 {
+		_, err := m.getRevisionsCollection().DeleteMany(ctx, scoped(ctx, bson.M{"recordId": bson.M{"$in": removed}}))
+		if err != nil {
+			return err
+		}
+	}
+
+	err := m.unbury(ctx, created)
+	if err != nil {
+		return err
+	}
+	return m.bury(ctx, removed, removedSeqs)
+}
@@ -0,0 +1,431 @@
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/analytics"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.opentelemetry.io/otel/trace/noop"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"testing"
+	"time"
+)
+
+// The tests run against the MongoDB of MONGO_TEST_DSN, in a database of
+// their own which is dropped, and are skipped without one:
+//
+//	MONGO_TEST_DSN=mongodb://localhost:27017 go test ./pkg/models/mongodb
+//
+// Atomic batches need a replica set, their test is skipped otherwise.
+const testDatabaseName = "simple-peak-flowmeter-test"
+
+func newTestRecordModel(t *testing.T) (*RecordModel, *mongo.Client) {
+	dsn := os.Getenv("MONGO_TEST_DSN")
+	if dsn == "" {
+		t.Skip("MONGO_TEST_DSN is not set")
+	}
+	client, err := OpenDB(dsn, noop.NewTracerProvider())
+	if err != nil {
+		t.Skipf("MongoDB is not available: %v", err)
+	}
+
+	databaseName = testDatabaseName
+	ctx := context.Background()
+	if err := client.Database(databaseName).Drop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Database(databaseName).Drop(ctx)
+		client.Disconnect(ctx)
+	})
+
+	m := NewRecordModel(client, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err := m.PrepareChanges(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.CreateIndexes(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return m, client
+}
+
+func utc(value string) time.Time {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// aggregateFixture has readings around the start of summer time in Berlin
+// on 2024-03-31 and the end of it on 2024-10-27, taken in Berlin, in India
+// at +05:30 and without a time zone.
+var aggregateFixture = []*models.Record{
+	{ID: "0", CreatedAt: utc("2024-03-30T06:30:00Z"), Value: 400, Timezone: "Europe/Berlin"},  // 07:30 CET
+	{ID: "1", CreatedAt: utc("2024-03-30T19:00:00Z"), Value: 440, Timezone: "Europe/Berlin"},  // 20:00 CET
+	{ID: "2", CreatedAt: utc("2024-03-30T23:30:00Z"), Value: 420, Timezone: "Europe/Berlin"},  // 00:30 CET on the 31st
+	{ID: "3", CreatedAt: utc("2024-03-31T05:30:00Z"), Value: 410, Timezone: "Europe/Berlin"},  // 07:30 CEST
+	{ID: "4", CreatedAt: utc("2024-03-31T13:00:00Z"), Value: 430},                             // no time zone
+	{ID: "5", CreatedAt: utc("2024-03-31T22:30:00Z"), Value: 450, Timezone: "Europe/Berlin"},  // 00:30 CEST on April 1st
+	{ID: "6", CreatedAt: utc("2024-03-31T19:00:00Z"), Value: 390, Timezone: "+05:30"},         // 00:30 on April 1st
+	{ID: "7", CreatedAt: utc("2024-03-31T02:00:00Z"), Value: 405, Timezone: "+05:30"},         // 07:30
+	{ID: "8", CreatedAt: utc("2024-03-31T13:15:00Z"), Value: 415, Timezone: "+05:30"},         // 18:45
+	{ID: "9", CreatedAt: utc("2024-10-27T00:30:00Z"), Value: 460, Timezone: "Europe/Berlin"},  // 02:30 CEST
+	{ID: "10", CreatedAt: utc("2024-10-27T01:30:00Z"), Value: 470, Timezone: "Europe/Berlin"}, // 02:30 CET, again
+	{ID: "11", CreatedAt: utc("2024-10-27T22:45:00Z"), Value: 480},                            // no time zone
+}
+
+func TestAggregateMatchesAnalytics(t *testing.T) {
+	//given
+	m, _ := newTestRecordModel(t)
+	ctx := models.WithPatient(context.Background(), "patient-aggregate")
+	for _, record := range aggregateFixture {
+		copied := *record
+		if _, err := m.Update(ctx, &copied); err != nil {
+			t.Fatal(err)
+		}
+	}
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	india, err := models.LoadTimezone("+05:30")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, bucket := range []string{models.BucketDay, models.BucketWeek, models.BucketMonth} {
+		for _, location := range []*time.Location{time.UTC, berlin, india} {
+			t.Run(bucket+" in "+location.String(), func(t *testing.T) {
+				query := &models.AggregateQuery{Bucket: bucket, Location: location}
+
+				//when
+				got, err := m.Aggregate(ctx, query)
+
+				//then
+				if err != nil {
+					t.Fatal(err)
+				}
+				want := analytics.Aggregate(aggregateFixture, query)
+				if len(got) != len(want) {
+					t.Fatalf("want %d buckets, got %d", len(want), len(got))
+				}
+				for index := range want {
+					if !sameBucket(got[index], want[index]) {
+						t.Errorf("bucket %d: want %+v, got %+v", index, want[index], got[index])
+					}
+				}
+			})
+		}
+	}
+}
+
+func sameBucket(a, b *models.Bucket) bool {
+	return a.Start.Equal(b.Start) && a.End.Equal(b.End) && a.Count == b.Count &&
+		closeTo(a.Min, b.Min) && closeTo(a.Max, b.Max) && closeTo(a.Mean, b.Mean) &&
+		sameMean(a.MorningMean, b.MorningMean) && sameMean(a.EveningMean, b.EveningMean)
+}
+
+func sameMean(a, b *float64) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return closeTo(*a, *b)
+}
+
+func closeTo(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestBulkWriteNumbersChanges(t *testing.T) {
+	//given
+	m, _ := newTestRecordModel(t)
+	ctx := context.Background()
+	takenAt := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+	if _, err := m.Update(ctx, &models.Record{ID: "existing", CreatedAt: takenAt, Value: 400}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Update(ctx, &models.Record{ID: "removed", CreatedAt: takenAt, Value: 410}); err != nil {
+		t.Fatal(err)
+	}
+	before, err := m.Changes(ctx, 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	since := before[len(before)-1].Seq
+
+	//when
+	errs, err := m.BulkWrite(ctx, []*models.BulkOperation{
+		{Kind: models.BulkCreate, Record: &models.Record{ID: "created", CreatedAt: takenAt, Value: 420}},
+		{Kind: models.BulkCreate, Record: &models.Record{ID: "existing", CreatedAt: takenAt, Value: 430}},
+		{Kind: models.BulkUpdate, Record: &models.Record{ID: "existing", CreatedAt: takenAt, Value: 440}},
+		{Kind: models.BulkRemove, Record: &models.Record{ID: "removed"}},
+		{Kind: models.BulkUpdate, Record: &models.Record{ID: "missing", CreatedAt: takenAt, Value: 450}},
+	}, false)
+
+	//then
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantErrs := []error{nil, models.ErrRecordExists, nil, nil, models.ErrNoRecord}
+	for index, want := range wantErrs {
+		if !errors.Is(errs[index], want) {
+			t.Errorf("operation %d: want %v, got %v", index, want, errs[index])
+		}
+	}
+
+	changes, err := m.Changes(ctx, since, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		id      string
+		deleted bool
+	}{{"created", false}, {"existing", false}, {"removed", true}}
+	if len(changes) != len(want) {
+		t.Fatalf("want %d changes, got %+v", len(want), changes)
+	}
+	for index, change := range changes {
+		if change.RecordID != want[index].id || change.Deleted != want[index].deleted {
+			t.Errorf("change %d: want %+v, got %+v", index, want[index], change)
+		}
+		if index > 0 && change.Seq <= changes[index-1].Seq {
+			t.Errorf("want changes numbered in the order of the batch, got %d after %d", change.Seq, changes[index-1].Seq)
+		}
+	}
+	if changes[1].Record.Value != 440 || changes[1].Record.Rev != 2 {
+		t.Errorf("want the updated version in the feed, got %+v", changes[1].Record)
+	}
+}
+
+func TestBulkWriteAtomicAborted(t *testing.T) {
+	//given
+	m, client := newTestRecordModel(t)
+	requireReplicaSet(t, client)
+	ctx := context.Background()
+	takenAt := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+	if _, err := m.Update(ctx, &models.Record{ID: "existing", CreatedAt: takenAt, Value: 400}); err != nil {
+		t.Fatal(err)
+	}
+	before, err := m.Changes(ctx, 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	since := before[len(before)-1].Seq
+
+	//when
+	errs, err := m.BulkWrite(ctx, []*models.BulkOperation{
+		{Kind: models.BulkCreate, Record: &models.Record{ID: "created", CreatedAt: takenAt, Value: 420}},
+		{Kind: models.BulkUpdate, Record: &models.Record{ID: "existing", CreatedAt: takenAt, Value: 440}},
+		{Kind: models.BulkCreate, Record: &models.Record{ID: "existing", CreatedAt: takenAt, Value: 430}},
+	}, true)
+
+	//then
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantErrs := []error{models.ErrBatchAborted, models.ErrBatchAborted, models.ErrRecordExists}
+	for index, want := range wantErrs {
+		if !errors.Is(errs[index], want) {
+			t.Errorf("operation %d: want %v, got %v", index, want, errs[index])
+		}
+	}
+	if _, err := m.Get(ctx, "created"); !errors.Is(err, models.ErrNoRecord) {
+		t.Errorf("want nothing of the aborted batch stored, got %v", err)
+	}
+
+	//when
+	if _, err := m.Update(ctx, &models.Record{ID: "after", CreatedAt: takenAt, Value: 450}); err != nil {
+		t.Fatal(err)
+	}
+	changes, err := m.Changes(ctx, since, 100)
+
+	//then
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].RecordID != "after" {
+		t.Errorf("want the feed to go on past the aborted batch, got %+v", changes)
+	}
+}
+
+func requireReplicaSet(t *testing.T, client *mongo.Client) {
+	var hello struct {
+		SetName string `bson:"setName"`
+	}
+	err := client.Database("admin").RunCommand(context.Background(), bson.M{"hello": 1}).Decode(&hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hello.SetName == "" {
+		t.Skip("MongoDB doesn't run as a replica set, which transactions need")
+	}
+}
+
+func TestChangesFeed(t *testing.T) {
+	//given
+	m, _ := newTestRecordModel(t)
+	ctx := context.Background()
+	other := models.WithPatient(ctx, "patient-other")
+	takenAt := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+	for _, id := range []string{"a", "b", "c"} {
+		if _, err := m.Update(ctx, &models.Record{ID: id, CreatedAt: takenAt, Value: 400}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := m.Update(other, &models.Record{ID: "other", CreatedAt: takenAt, Value: 300}); err != nil {
+		t.Fatal(err)
+	}
+
+	//when
+	if _, err := m.Update(ctx, &models.Record{ID: "a", CreatedAt: takenAt, Value: 410}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Remove(ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+	first, err := m.Changes(ctx, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rest, err := m.Changes(ctx, first[len(first)-1].Seq, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//then
+	changes := append(first, rest...)
+	want := []struct {
+		id      string
+		deleted bool
+	}{{"c", false}, {"a", false}, {"b", true}}
+	if len(first) != 2 || len(changes) != len(want) {
+		t.Fatalf("want %d changes in pages of 2, got %+v and %+v", len(want), first, rest)
+	}
+	for index, change := range changes {
+		if change.RecordID != want[index].id || change.Deleted != want[index].deleted {
+			t.Errorf("change %d: want %+v, got %+v", index, want[index], change)
+		}
+	}
+	if changes[1].Record.Value != 410 || changes[1].Record.Rev != 2 {
+		t.Errorf("want the latest version of a only, got %+v", changes[1].Record)
+	}
+
+	otherChanges, err := m.Changes(other, 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(otherChanges) != 1 || otherChanges[0].RecordID != "other" {
+		t.Errorf("want the changes of the other patient only, got %+v", otherChanges)
+	}
+}
+
+func TestRevisionsScoped(t *testing.T) {
+	//given
+	m, _ := newTestRecordModel(t)
+	owner := models.WithPatient(context.Background(), "patient-owner")
+	other := models.WithPatient(context.Background(), "patient-other")
+	takenAt := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+	for _, value := range []float32{400, 410} {
+		if _, err := m.Update(owner, &models.Record{ID: "owned", CreatedAt: takenAt, Value: value}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//when
+	history, err := m.History(other, "owned")
+
+	//then
+	if err != nil || len(history) != 0 {
+		t.Errorf("want no history of a record of another patient, got %+v, %v", history, err)
+	}
+	if _, err := m.Revert(other, "owned", 1); !errors.Is(err, models.ErrNoRecord) {
+		t.Errorf("want no revert of a record of another patient, got %v", err)
+	}
+	history, err = m.History(owner, "owned")
+	if err != nil || len(history) != 1 || history[0].Record.Value != 400 {
+		t.Errorf("want the first version in the history of the owner, got %+v, %v", history, err)
+	}
+
+	//when
+	errs, err := m.BulkWrite(other, []*models.BulkOperation{
+		{Kind: models.BulkCreate, Record: &models.Record{ID: "owned", CreatedAt: takenAt, Value: 300}},
+		{Kind: models.BulkUpdate, Record: &models.Record{ID: "owned", CreatedAt: takenAt, Value: 310}},
+		{Kind: models.BulkRemove, Record: &models.Record{ID: "owned"}},
+	}, false)
+
+	//then
+	if err != nil {
+		t.Fatal(err)
+	}
+	for index, want := range []error{models.ErrRecordExists, models.ErrNoRecord, models.ErrNoRecord} {
+		if !errors.Is(errs[index], want) {
+			t.Errorf("operation %d: want %v, got %v", index, want, errs[index])
+		}
+	}
+	stored, err := m.Get(owner, "owned")
+	if err != nil || stored.Value != 410 {
+		t.Errorf("want the record of the owner kept, got %+v, %v", stored, err)
+	}
+}
+
+func TestActionPlansAndMedicationsScoped(t *testing.T) {
+	//given
+	_, client := newTestRecordModel(t)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	plans := NewActionPlanModel(client, logger)
+	medications := NewMedicationModel(client, logger)
+	owner := models.WithPatient(context.Background(), "patient-owner")
+	other := models.WithPatient(context.Background(), models.DefaultPatient)
+
+	if err := plans.Save(owner, &models.ActionPlan{ID: "plan", EffectiveFrom: utc("2024-03-01T00:00:00Z")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := medications.Update(owner, &models.Medication{ID: "inhaler", Name: "Salbutamol"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := medications.AddDose(owner, &models.Dose{ID: "dose", MedicationID: "inhaler", TakenAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	//when
+	otherPlans, err := plans.GetAll(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherMedications, err := medications.GetAll(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherDoses, err := medications.Doses(other, &models.DoseQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ownerPlans, err := plans.GetAll(owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//then
+	if len(otherPlans) != 0 || len(otherMedications) != 0 || len(otherDoses) != 0 {
+		t.Errorf("want nothing of another patient, got %d plans, %d medications and %d doses",
+			len(otherPlans), len(otherMedications), len(otherDoses))
+	}
+	if len(ownerPlans) != 1 || ownerPlans[0].PatientID != "patient-owner" {
+		t.Errorf("want the plan of the owner, got %+v", ownerPlans)
+	}
+	if _, err := plans.Get(other, "plan"); !errors.Is(err, models.ErrNoActionPlan) {
+		t.Errorf("want no plan of another patient, got %v", err)
+	}
+	if err := medications.Remove(other, "inhaler"); !errors.Is(err, models.ErrNoMedication) {
+		t.Errorf("want no removal of a medication of another patient, got %v", err)
+	}
+	if _, err := medications.RemoveDose(other, "inhaler", "dose"); !errors.Is(err, models.ErrNoDose) {
+		t.Errorf("want no removal of a dose of another patient, got %v", err)
+	}
+}
@@ -0,0 +1,111 @@
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log/slog"
+)
+
+const collectionShares = "shares"
+const collectionShareAccesses = "share_accesses"
+
+// ShareModel stores shares and their access log in collections of their
+// own, accesses refer to their share by id.
+type ShareModel struct {
+	client *mongo.Client
+	logger *slog.Logger
+}
+
+func NewShareModel(client *mongo.Client, logger *slog.Logger) *ShareModel {
+	return &ShareModel{client, logger}
+}
+
+func (m *ShareModel) getSharesCollection() *mongo.Collection {
+	return m.client.Database(databaseName).Collection(collectionShares)
+}
+
+func (m *ShareModel) getAccessesCollection() *mongo.Collection {
+	return m.client.Database(databaseName).Collection(collectionShareAccesses)
+}
+
+// CreateIndexes makes ids unique and indexes the access log by share.
+func (m *ShareModel) CreateIndexes(ctx context.Context) error {
+	_, err := m.getSharesCollection().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.M{"id": 1},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = m.getAccessesCollection().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "shareid", Value: 1}, {Key: "at", Value: 1}},
+	})
+	return err
+}
+
+func (m *ShareModel) Update(ctx context.Context, share *models.Share) error {
+	_, err := m.getSharesCollection().ReplaceOne(ctx, bson.M{"id": share.ID}, share,
+		options.Replace().SetUpsert(true))
+	if err != nil {
+		return failed(ctx, m.logger, "ShareModel.Update", err)
+	}
+	return nil
+}
+
+func (m *ShareModel) Get(ctx context.Context, id string) (*models.Share, error) {
+	result := m.getSharesCollection().FindOne(ctx, bson.M{"id": id})
+
+	var share *models.Share
+	err := result.Decode(&share)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, models.ErrNoShare
+	}
+	if err != nil {
+		return nil, failed(ctx, m.logger, "ShareModel.Get", err)
+	}
+	return share, nil
+}
+
+func (m *ShareModel) GetAll(ctx context.Context) ([]*models.Share, error) {
+	cur, err := m.getSharesCollection().Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"createdat": -1}))
+	if err != nil {
+		return nil, failed(ctx, m.logger, "ShareModel.GetAll", err)
+	}
+	defer cur.Close(ctx)
+
+	shares := []*models.Share{}
+	err = cur.All(ctx, &shares)
+	if err != nil {
+		return nil, failed(ctx, m.logger, "ShareModel.GetAll", err)
+	}
+	return shares, nil
+}
+
+func (m *ShareModel) LogAccess(ctx context.Context, access *models.ShareAccess) error {
+	_, err := m.getAccessesCollection().InsertOne(ctx, access)
+	if err != nil {
+		return failed(ctx, m.logger, "ShareModel.LogAccess", err)
+	}
+	return nil
+}
+
+func (m *ShareModel) Accesses(ctx context.Context, shareID string) ([]*models.ShareAccess, error) {
+	cur, err := m.getAccessesCollection().Find(ctx, bson.M{"shareid": shareID},
+		options.Find().SetSort(bson.M{"at": 1}))
+	if err != nil {
+		return nil, failed(ctx, m.logger, "ShareModel.Accesses", err)
+	}
+	defer cur.Close(ctx)
+
+	accesses := []*models.ShareAccess{}
+	err = cur.All(ctx, &accesses)
+	if err != nil {
+		return nil, failed(ctx, m.logger, "ShareModel.Accesses", err)
+	}
+	return accesses, nil
+}
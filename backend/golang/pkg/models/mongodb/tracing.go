@@ -0,0 +1,81 @@
+package mongodb
+
+import (
+	"context"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/tracing"
+	"go.mongodb.org/mongo-driver/event"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// NewCommandMonitor creates a span for every command sent to MongoDB, as a
+// child of the span on the context of the operation. Command documents are
+// not recorded, they contain the readings.
+func NewCommandMonitor(provider trace.TracerProvider) *event.CommandMonitor {
+	tracer := tracing.Tracer(provider)
+	var spans sync.Map
+
+	return &event.CommandMonitor{
+		Started: func(ctx context.Context, evt *event.CommandStartedEvent) {
+			attributes := commandAttributes(evt)
+			name := evt.CommandName
+
+			if collection := commandCollection(evt); collection != "" {
+				attributes = append(attributes, semconv.DBCollectionName(collection))
+				name = collection + "." + evt.CommandName
+			}
+
+			_, span := tracer.Start(ctx, name,
+				trace.WithSpanKind(trace.SpanKindClient),
+				trace.WithAttributes(attributes...))
+			spans.Store(evt.RequestID, span)
+		},
+		Succeeded: func(ctx context.Context, evt *event.CommandSucceededEvent) {
+			if span, ok := spans.LoadAndDelete(evt.RequestID); ok {
+				span.(trace.Span).End()
+			}
+		},
+		Failed: func(ctx context.Context, evt *event.CommandFailedEvent) {
+			if span, ok := spans.LoadAndDelete(evt.RequestID); ok {
+				span.(trace.Span).SetStatus(codes.Error, evt.Failure)
+				span.(trace.Span).End()
+			}
+		},
+	}
+}
+
+// commandCollection returns the collection a command works on, named by its
+// first element. Sensitive commands are redacted to empty documents.
+func commandCollection(evt *event.CommandStartedEvent) string {
+	elements, err := evt.Command.Elements()
+	if err != nil || len(elements) == 0 {
+		return ""
+	}
+
+	collection, _ := elements[0].Value().StringValueOK()
+	return collection
+}
+
+func commandAttributes(evt *event.CommandStartedEvent) []attribute.KeyValue {
+	attributes := []attribute.KeyValue{
+		semconv.DBSystemMongoDB,
+		semconv.DBNamespace(evt.DatabaseName),
+		semconv.DBOperationName(evt.CommandName),
+	}
+
+	// connection IDs look like "host:port[-N]"
+	address, _, _ := strings.Cut(evt.ConnectionID, "[")
+	if host, port, err := net.SplitHostPort(address); err == nil {
+		attributes = append(attributes, semconv.ServerAddress(host))
+		if port, err := strconv.Atoi(port); err == nil {
+			attributes = append(attributes, semconv.ServerPort(port))
+		}
+	}
+	return attributes
+}
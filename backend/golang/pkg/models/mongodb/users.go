@@ -0,0 +1,92 @@
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log/slog"
+)
+
+const collectionUsers = "users"
+
+// UserModel stores users, looked up by the hash of their token on every
+// authenticated request.
+type UserModel struct {
+	client *mongo.Client
+	logger *slog.Logger
+}
+
+func NewUserModel(client *mongo.Client, logger *slog.Logger) *UserModel {
+	return &UserModel{client, logger}
+}
+
+func (m *UserModel) getUsersCollection() *mongo.Collection {
+	return m.client.Database(databaseName).Collection(collectionUsers)
+}
+
+// CreateIndexes makes ids and token hashes unique.
+func (m *UserModel) CreateIndexes(ctx context.Context) error {
+	_, err := m.getUsersCollection().Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.M{"id": 1},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys:    bson.M{"tokenhash": 1},
+			Options: options.Index().SetUnique(true),
+		},
+	})
+	return err
+}
+
+func (m *UserModel) Update(ctx context.Context, user *models.User) error {
+	_, err := m.getUsersCollection().ReplaceOne(ctx, bson.M{"id": user.ID}, user,
+		options.Replace().SetUpsert(true))
+	if err != nil {
+		return failed(ctx, m.logger, "UserModel.Update", err)
+	}
+	return nil
+}
+
+func (m *UserModel) Get(ctx context.Context, id string) (*models.User, error) {
+	return m.findOne(ctx, "UserModel.Get", bson.M{"id": id})
+}
+
+func (m *UserModel) GetAll(ctx context.Context) ([]*models.User, error) {
+	cur, err := m.getUsersCollection().Find(ctx, bson.M{}, options.Find().SetSort(bson.D{
+		{Key: "createdat", Value: 1},
+		{Key: "id", Value: 1},
+	}))
+	if err != nil {
+		return nil, failed(ctx, m.logger, "UserModel.GetAll", err)
+	}
+	defer cur.Close(ctx)
+
+	users := []*models.User{}
+	err = cur.All(ctx, &users)
+	if err != nil {
+		return nil, failed(ctx, m.logger, "UserModel.GetAll", err)
+	}
+	return users, nil
+}
+
+func (m *UserModel) GetByTokenHash(ctx context.Context, tokenHash string) (*models.User, error) {
+	return m.findOne(ctx, "UserModel.GetByTokenHash", bson.M{"tokenhash": tokenHash})
+}
+
+func (m *UserModel) findOne(ctx context.Context, operation string, filter bson.M) (*models.User, error) {
+	result := m.getUsersCollection().FindOne(ctx, filter)
+
+	var user *models.User
+	err := result.Decode(&user)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, models.ErrNoUser
+	}
+	if err != nil {
+		return nil, failed(ctx, m.logger, operation, err)
+	}
+	return user, nil
+}
@@ -0,0 +1,106 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var ErrNoUser = errors.New("models: no matching user found")
+var ErrNoPatient = errors.New("models: no matching patient found")
+var ErrNoMembership = errors.New("models: no matching membership found")
+
+// DefaultPatient is the patient of readings stored before there were
+// patients and of the routes without one, like /records.
+const DefaultPatient = ""
+
+type patientKey struct{}
+
+// WithPatient scopes every RecordModel call made with the returned context
+// to the Records of a patient: only those are read, written ones are
+// assigned to it.
+func WithPatient(ctx context.Context, patientID string) context.Context {
+	return context.WithValue(ctx, patientKey{}, patientID)
+}
+
+// PatientID returns the patient the context is scoped to, DefaultPatient
+// if it isn't.
+func PatientID(ctx context.Context) string {
+	patientID, _ := ctx.Value(patientKey{}).(string)
+	return patientID
+}
+
+// User is an account, authenticated by the bearer token hashed to TokenHash
+// unless it was disabled at DisabledAt.
+type User struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Role of the account in the access policy, user or admin.
+	Role       string     `json:"role"`
+	TokenHash  string     `json:"-"`
+	CreatedAt  time.Time  `json:"created_at"`
+	DisabledAt *time.Time `json:"disabled_at,omitempty"`
+}
+
+// UserModel defines model/DAO methods for User
+type UserModel interface {
+	// Update creates or replaces a user.
+	Update(ctx context.Context, user *User) error
+	Get(ctx context.Context, id string) (*User, error)
+	// GetAll returns every user, oldest first.
+	GetAll(ctx context.Context) ([]*User, error)
+	GetByTokenHash(ctx context.Context, tokenHash string) (*User, error)
+}
+
+// Patient is someone readings are taken of, like a child of the user.
+// Users get access to patients by a Membership
+type Patient struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Roles of a Membership, each one allows what the ones after it do
+const (
+	RoleOwner     = "owner"     // manages the patient and who has access
+	RoleCaregiver = "caregiver" // writes readings, like a parent or a nurse
+	RoleViewer    = "viewer"    // reads readings only
+)
+
+var roleRanks = map[string]int{RoleViewer: 1, RoleCaregiver: 2, RoleOwner: 3}
+
+// ValidRole reports whether role is one of the roles of a Membership.
+func ValidRole(role string) bool {
+	return roleRanks[role] > 0
+}
+
+// RoleAllows reports whether role allows what required does.
+func RoleAllows(role, required string) bool {
+	return ValidRole(role) && roleRanks[role] >= roleRanks[required]
+}
+
+// Membership grants a User access to a Patient in a Role
+type Membership struct {
+	PatientID string    `json:"patient_id"`
+	UserID    string    `json:"user_id"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// PatientModel defines model/DAO methods for Patient and its Memberships
+type PatientModel interface {
+	// Update creates or replaces a patient.
+	Update(ctx context.Context, patient *Patient) error
+	Get(ctx context.Context, id string) (*Patient, error)
+	// GetAll returns every patient, oldest first.
+	GetAll(ctx context.Context) ([]*Patient, error)
+
+	// SetMembership creates or replaces the membership of a user.
+	SetMembership(ctx context.Context, membership *Membership) error
+	Membership(ctx context.Context, patientID, userID string) (*Membership, error)
+	RemoveMembership(ctx context.Context, patientID, userID string) error
+	// Memberships returns the memberships of a patient, oldest first.
+	Memberships(ctx context.Context, patientID string) ([]*Membership, error)
+	// MembershipsOf returns the memberships of a user, oldest first.
+	MembershipsOf(ctx context.Context, userID string) ([]*Membership, error)
+}
@@ -0,0 +1,75 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var ErrInvalidTimezone = errors.New("models: time zone must be an IANA time zone like Europe/Berlin or an offset like +05:30")
+
+var offsetPattern = regexp.MustCompile(`^([+-])(\d{2}):(\d{2})$`)
+
+// timezones caches loaded locations by name, every Record carries one and
+// loading reads the time zone database.
+var timezones sync.Map
+
+// LoadTimezone returns the location of an IANA time zone like Europe/Berlin,
+// or of a UTC offset like +05:30 for clients which only know the offset.
+// The name of the location is the given one, so it can be stored and loaded
+// again. Local is rejected as it depends on the server.
+func LoadTimezone(name string) (*time.Location, error) {
+	if location, ok := timezones.Load(name); ok {
+		return location.(*time.Location), nil
+	}
+
+	location, err := loadTimezone(name)
+	if err != nil {
+		return nil, fmt.Errorf("%w, got %q", ErrInvalidTimezone, name)
+	}
+	timezones.Store(name, location)
+	return location, nil
+}
+
+func loadTimezone(name string) (*time.Location, error) {
+	if match := offsetPattern.FindStringSubmatch(name); match != nil {
+		hours, _ := strconv.Atoi(match[2])
+		minutes, _ := strconv.Atoi(match[3])
+		if hours > 14 || minutes > 59 {
+			return nil, ErrInvalidTimezone
+		}
+
+		offset := (hours*60 + minutes) * 60
+		if match[1] == "-" {
+			offset = -offset
+		}
+		return time.FixedZone(name, offset), nil
+	}
+
+	if name == "" || name == "Local" {
+		return nil, ErrInvalidTimezone
+	}
+	return time.LoadLocation(name)
+}
+
+// Location returns the time zone the Record was taken in, fallback for
+// Records without a valid one.
+func (r *Record) Location(fallback *time.Location) *time.Location {
+	if r.Timezone == "" {
+		return fallback
+	}
+	location, err := LoadTimezone(r.Timezone)
+	if err != nil {
+		return fallback
+	}
+	return location
+}
+
+// LocalTime returns CreatedAt on the clock of the time zone the Record
+// was taken in, see Location.
+func (r *Record) LocalTime(fallback *time.Location) time.Time {
+	return r.CreatedAt.In(r.Location(fallback))
+}
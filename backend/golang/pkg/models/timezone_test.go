@@ -0,0 +1,67 @@
+package models
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLoadTimezone(t *testing.T) {
+	tests := []struct {
+		name       string
+		wantOffset int
+		wantErr    bool
+	}{
+		{"Europe/Berlin", 60 * 60, false},
+		{"UTC", 0, false},
+		{"+05:30", (5*60 + 30) * 60, false},
+		{"-04:00", -4 * 60 * 60, false},
+		{"+15:00", 0, true},
+		{"+5:30", 0, true},
+		{"Local", 0, true},
+		{"", 0, true},
+		{"Mars/Olympus", 0, true},
+	}
+
+	for _, tt := range tests {
+		location, err := LoadTimezone(tt.name)
+
+		if tt.wantErr {
+			if !errors.Is(err, ErrInvalidTimezone) {
+				t.Errorf("%q: want ErrInvalidTimezone, got %v", tt.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: want no error, got %v", tt.name, err)
+			continue
+		}
+		// winter time for Berlin
+		if _, offset := time.Date(2024, 1, 1, 12, 0, 0, 0, location).Zone(); offset != tt.wantOffset || location.String() != tt.name {
+			t.Errorf("%q: want offset %d, got %s with %d", tt.name, tt.wantOffset, location, offset)
+		}
+	}
+}
+
+func TestRecordLocalTime(t *testing.T) {
+	createdAt := time.Date(2024, 3, 31, 22, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		timezone string
+		want     string
+	}{
+		{"Asia/Tokyo", "2024-04-01T07:30:00+09:00"},
+		{"Europe/Berlin", "2024-04-01T00:30:00+02:00"}, // summer time since the morning of the 31st
+		{"-04:00", "2024-03-31T18:30:00-04:00"},
+		{"", "2024-03-31T22:30:00Z"},
+		{"Invalid/Zone", "2024-03-31T22:30:00Z"},
+	}
+
+	for _, tt := range tests {
+		record := &Record{CreatedAt: createdAt, Timezone: tt.timezone}
+
+		if got := record.LocalTime(time.UTC).Format(time.RFC3339); got != tt.want {
+			t.Errorf("%q: want %s, got %s", tt.timezone, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+// Package openapi builds OpenAPI 3 documents, with component schemas
+// generated from Go payload types.
+package openapi
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const Version = "3.0.3"
+
+type Document struct {
+	OpenAPI    string               `json:"openapi"`
+	Info       Info                 `json:"info"`
+	Paths      map[string]*PathItem `json:"paths"`
+	Components Components           `json:"components"`
+
+	schemas *schemaRegistry
+}
+
+type Info struct {
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Version     string `json:"version"`
+}
+
+// PathItem holds the operations of a path, keyed by lower case HTTP method.
+type PathItem map[string]*Operation
+
+type Operation struct {
+	OperationID string               `json:"operationId,omitempty"`
+	Summary     string               `json:"summary,omitempty"`
+	Description string               `json:"description,omitempty"`
+	Tags        []string             `json:"tags,omitempty"`
+	Deprecated  bool                 `json:"deprecated,omitempty"`
+	Parameters  []*Parameter         `json:"parameters,omitempty"`
+	RequestBody *RequestBody         `json:"requestBody,omitempty"`
+	Responses   map[string]*Response `json:"responses"`
+}
+
+type Parameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required,omitempty"`
+	Schema      *Schema `json:"schema"`
+}
+
+type RequestBody struct {
+	Description string                `json:"description,omitempty"`
+	Required    bool                  `json:"required,omitempty"`
+	Content     map[string]*MediaType `json:"content"`
+}
+
+type Response struct {
+	Description string                `json:"description"`
+	Content     map[string]*MediaType `json:"content,omitempty"`
+}
+
+type MediaType struct {
+	Schema *Schema `json:"schema,omitempty"`
+}
+
+type Components struct {
+	Schemas map[string]*Schema `json:"schemas,omitempty"`
+}
+
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Enum                 []string           `json:"enum,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+}
+
+func NewDocument(title, description, version string) *Document {
+	schemas := newSchemaRegistry()
+
+	return &Document{
+		OpenAPI: Version,
+		Info: Info{
+			Title:       title,
+			Description: description,
+			Version:     version,
+		},
+		Paths:      map[string]*PathItem{},
+		Components: Components{Schemas: schemas.components},
+		schemas:    schemas,
+	}
+}
+
+// Schema returns the schema of the Go type of v, struct types are
+// added to the components and referenced.
+func (d *Document) Schema(v interface{}) *Schema {
+	return d.schemas.schemaOf(v)
+}
+
+// ArrayOf returns the schema of a list of the Go type of v.
+func (d *Document) ArrayOf(v interface{}) *Schema {
+	return &Schema{Type: "array", Items: d.Schema(v)}
+}
+
+// JSON returns JSON content with the given schema.
+func JSON(schema *Schema) map[string]*MediaType {
+	return map[string]*MediaType{"application/json": {Schema: schema}}
+}
+
+var pathParameterPattern = regexp.MustCompile(`{([^}:]+)(:[^}]*)?}`)
+
+// AddOperation adds an operation for a chi route pattern, its path
+// parameters are documented as required strings unless described already.
+func (d *Document) AddOperation(method, pattern string, operation *Operation) {
+	path := pathParameterPattern.ReplaceAllString(pattern, "{$1}")
+
+	for _, match := range pathParameterPattern.FindAllStringSubmatch(pattern, -1) {
+		if !hasParameter(operation, match[1], "path") {
+			operation.Parameters = append(operation.Parameters, &Parameter{
+				Name:     match[1],
+				In:       "path",
+				Required: true,
+				Schema:   &Schema{Type: "string"},
+			})
+		}
+	}
+
+	item, ok := d.Paths[path]
+	if !ok {
+		item = &PathItem{}
+		d.Paths[path] = item
+	}
+	(*item)[strings.ToLower(method)] = operation
+}
+
+func hasParameter(operation *Operation, name, in string) bool {
+	for _, parameter := range operation.Parameters {
+		if parameter.Name == name && parameter.In == in {
+			return true
+		}
+	}
+	return false
+}
+
+// Status formats an HTTP status code as a responses key.
+func Status(code int) string {
+	return strconv.Itoa(code)
+}
@@ -0,0 +1,104 @@
+// Package origin matches request origins against a list of allowed ones,
+// for the CORS policy.
+package origin
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Any is the pattern allowing every origin.
+const Any = "*"
+
+// Matcher allows origins equal to one of its patterns, or matching one of its
+// wildcard patterns like "https://*.example.com", which allow any subdomain
+// of example.com with the same scheme and port, but not example.com itself.
+type Matcher struct {
+	any       bool
+	exact     map[string]bool
+	wildcards []*wildcard
+}
+
+type wildcard struct {
+	scheme string
+	suffix string // ".example.com"
+	port   string
+}
+
+// NewMatcher parses origin patterns, an origin is a scheme, a host and an
+// optional port, without any path.
+func NewMatcher(patterns []string) (*Matcher, error) {
+	m := &Matcher{exact: map[string]bool{}}
+
+	for _, pattern := range patterns {
+		if pattern == Any {
+			m.any = true
+			continue
+		}
+
+		scheme, host, port, err := parse(pattern)
+		if err != nil {
+			return nil, err
+		}
+
+		if domain, ok := strings.CutPrefix(host, "*."); ok {
+			if domain == "" || strings.Contains(domain, "*") {
+				return nil, fmt.Errorf("origin: invalid wildcard origin %q", pattern)
+			}
+			m.wildcards = append(m.wildcards, &wildcard{scheme: scheme, suffix: "." + domain, port: port})
+			continue
+		}
+		if strings.Contains(host, "*") {
+			return nil, fmt.Errorf("origin: wildcards are only allowed as the first label in %q", pattern)
+		}
+		m.exact[join(scheme, host, port)] = true
+	}
+
+	return m, nil
+}
+
+// AllowsAny reports whether every origin is allowed.
+func (m *Matcher) AllowsAny() bool {
+	return m.any
+}
+
+// Allowed reports whether the value of an Origin header is allowed.
+func (m *Matcher) Allowed(origin string) bool {
+	if m.any {
+		return true
+	}
+
+	scheme, host, port, err := parse(origin)
+	if err != nil || strings.Contains(host, "*") {
+		return false
+	}
+	if m.exact[join(scheme, host, port)] {
+		return true
+	}
+
+	for _, w := range m.wildcards {
+		if w.scheme == scheme && w.port == port &&
+			strings.HasSuffix(host, w.suffix) && len(host) > len(w.suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+func parse(origin string) (scheme, host, port string, err error) {
+	parsed, err := url.Parse(origin)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" ||
+		parsed.User != nil || (parsed.Path != "" && parsed.Path != "/") || parsed.RawQuery != "" || parsed.Fragment != "" {
+		return "", "", "", fmt.Errorf("origin: %q is not an http(s) origin like https://example.com", origin)
+	}
+
+	return parsed.Scheme, strings.ToLower(parsed.Hostname()), parsed.Port(), nil
+}
+
+func join(scheme, host, port string) string {
+	if port == "" {
+		return scheme + "://" + host
+	}
+	return scheme + "://" + host + ":" + port
+}
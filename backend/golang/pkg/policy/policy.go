@@ -0,0 +1,105 @@
+// Package policy decides what a caller may do: every request has a Role,
+// every route group requires a Permission, and a Policy grants roles their
+// permissions.
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+)
+
+var ErrDenied = errors.New("policy: permission denied")
+
+// Role of a caller, the role of an account for authenticated requests.
+type Role string
+
+const (
+	RoleAnonymous Role = "anonymous" // requests without a token
+	RoleUser      Role = "user"      // accounts, see their own data only
+	RoleAdmin     Role = "admin"     // manages accounts and sees the system stats
+)
+
+// Roles are every role, the least privileged first.
+var Roles = []Role{RoleAnonymous, RoleUser, RoleAdmin}
+
+// RoleOf returns the role of the account of an authenticated request,
+// Anonymous for nil. Accounts without a role are users.
+func RoleOf(user *models.User) Role {
+	switch {
+	case user == nil:
+		return RoleAnonymous
+	case Role(user.Role) == RoleAdmin:
+		return RoleAdmin
+	default:
+		return RoleUser
+	}
+}
+
+// Permission to use a group of routes.
+type Permission string
+
+const (
+	// Household covers the Records, action plans, medications, reports,
+	// share links and sync of the default patient, and the dashboard.
+	Household Permission = "household"
+	// SignUp covers creating accounts.
+	SignUp Permission = "sign_up"
+	// Account covers the account of the caller.
+	Account Permission = "account"
+	// Patients covers the patients of the caller, what it may do with each
+	// one is up to its Membership.
+	Patients Permission = "patients"
+	// Admin covers every account and the system stats.
+	Admin Permission = "admin"
+)
+
+// Permissions are every permission.
+var Permissions = []Permission{Household, SignUp, Account, Patients, Admin}
+
+// Policy grants roles their permissions.
+type Policy struct {
+	grants map[Role]map[Permission]bool
+}
+
+// New creates a policy granting each role the permissions listed for it,
+// roles not listed have none.
+func New(grants map[Role][]Permission) *Policy {
+	p := &Policy{grants: map[Role]map[Permission]bool{}}
+	for role, permissions := range grants {
+		p.grants[role] = map[Permission]bool{}
+		for _, permission := range permissions {
+			p.grants[role][permission] = true
+		}
+	}
+	return p
+}
+
+// Default returns the policy of the server. Admins may do anything, users
+// use their account and patients. An open policy grants everyone, without
+// a token as well, the household and sign up like before there were
+// accounts, a closed one leaves them to admins.
+func Default(open bool) *Policy {
+	shared := []Permission{}
+	if open {
+		shared = []Permission{Household, SignUp}
+	}
+	return New(map[Role][]Permission{
+		RoleAnonymous: shared,
+		RoleUser:      append([]Permission{Account, Patients}, shared...),
+		RoleAdmin:     Permissions,
+	})
+}
+
+// Allows reports whether role has permission.
+func (p *Policy) Allows(role Role, permission Permission) bool {
+	return p.grants[role][permission]
+}
+
+// Check returns an error wrapping ErrDenied unless role has permission.
+func (p *Policy) Check(role Role, permission Permission) error {
+	if !p.Allows(role, permission) {
+		return fmt.Errorf("%w: role %s lacks %s", ErrDenied, role, permission)
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package policy
+
+import (
+	"errors"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+	"testing"
+)
+
+func TestDefault(t *testing.T) {
+	tests := []struct {
+		role       Role
+		permission Permission
+		open       bool
+		closed     bool
+	}{
+		{RoleAnonymous, Household, true, false},
+		{RoleAnonymous, SignUp, true, false},
+		{RoleAnonymous, Account, false, false},
+		{RoleAnonymous, Patients, false, false},
+		{RoleAnonymous, Admin, false, false},
+		{RoleUser, Household, true, false},
+		{RoleUser, SignUp, true, false},
+		{RoleUser, Account, true, true},
+		{RoleUser, Patients, true, true},
+		{RoleUser, Admin, false, false},
+		{RoleAdmin, Household, true, true},
+		{RoleAdmin, SignUp, true, true},
+		{RoleAdmin, Account, true, true},
+		{RoleAdmin, Patients, true, true},
+		{RoleAdmin, Admin, true, true},
+	}
+	if len(tests) != len(Roles)*len(Permissions) {
+		t.Fatalf("want every role and permission, got %d combinations", len(tests))
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.role)+" "+string(tt.permission), func(t *testing.T) {
+			if got := Default(true).Allows(tt.role, tt.permission); got != tt.open {
+				t.Errorf("open: want %v, got %v", tt.open, got)
+			}
+			err := Default(false).Check(tt.role, tt.permission)
+			if (err == nil) != tt.closed || (err != nil && !errors.Is(err, ErrDenied)) {
+				t.Errorf("closed: want allowed %v, got %v", tt.closed, err)
+			}
+		})
+	}
+}
+
+func TestRoleOf(t *testing.T) {
+	tests := []struct {
+		user *models.User
+		want Role
+	}{
+		{nil, RoleAnonymous},
+		{&models.User{}, RoleUser},
+		{&models.User{Role: "user"}, RoleUser},
+		{&models.User{Role: "admin"}, RoleAdmin},
+		{&models.User{Role: "unknown"}, RoleUser},
+	}
+
+	for _, tt := range tests {
+		if got := RoleOf(tt.user); got != tt.want {
+			t.Errorf("%+v: want %s, got %s", tt.user, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package services
+
+import (
+	"context"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+	"time"
+)
+
+// ZoneAdvice is the zone of a reading with what to do in it, by the action
+// plan in effect when the reading was taken. Without a plan the zone is
+// relative to the personal best and there are no instructions.
+type ZoneAdvice struct {
+	Zone         Zone   `json:"zone"`
+	Instructions string `json:"instructions,omitempty"`
+	PlanID       string `json:"plan_id,omitempty"`
+	PlanVersion  int    `json:"plan_version,omitempty"`
+}
+
+// ActionPlanService sorts readings into zones by the action plans of the
+// doctor, falling back to the generic zones of ZonesService.
+type ActionPlanService struct {
+	plans   models.ActionPlanModel
+	records models.RecordModel
+	zones   *ZonesService
+}
+
+func NewActionPlanService(plans models.ActionPlanModel, records models.RecordModel, zones *ZonesService) *ActionPlanService {
+	return &ActionPlanService{plans: plans, records: records, zones: zones}
+}
+
+// ActivePlan returns the plan in effect at t, the one which took effect
+// last if several do, nil if none does.
+func ActivePlan(plans []*models.ActionPlan, t time.Time) *models.ActionPlan {
+	var active *models.ActionPlan
+	for _, plan := range plans {
+		if plan.Covers(t) && (active == nil || plan.EffectiveFrom.After(active.EffectiveFrom)) {
+			active = plan
+		}
+	}
+	return active
+}
+
+// PlanThresholds returns the zone thresholds of plan.
+func PlanThresholds(plan *models.ActionPlan) Thresholds {
+	return Thresholds{GreenFrom: plan.GreenFrom, YellowFrom: plan.YellowFrom}
+}
+
+// Advise returns the ZoneAdvice of every record, in the same order.
+func (s *ActionPlanService) Advise(ctx context.Context, records []*models.Record) ([]*ZoneAdvice, error) {
+	advice := make([]*ZoneAdvice, len(records))
+	if len(records) == 0 {
+		return advice, nil
+	}
+
+	plans, err := s.plans.GetAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var fallback *Thresholds
+	for index, record := range records {
+		if plan := ActivePlan(plans, record.CreatedAt); plan != nil {
+			advice[index] = NewZoneAdvice(plan, record.Value)
+			continue
+		}
+
+		if fallback == nil {
+			personalBest, err := s.PersonalBest(ctx)
+			if err != nil {
+				return nil, err
+			}
+			thresholds := s.zones.Thresholds(personalBest)
+			fallback = &thresholds
+		}
+		advice[index] = &ZoneAdvice{Zone: fallback.Zone(record.Value)}
+	}
+	return advice, nil
+}
+
+// NewZoneAdvice returns the zone of value by plan and the instructions for it.
+func NewZoneAdvice(plan *models.ActionPlan, value float32) *ZoneAdvice {
+	advice := &ZoneAdvice{
+		Zone:        PlanThresholds(plan).Zone(value),
+		PlanID:      plan.ID,
+		PlanVersion: plan.Version,
+	}
+	switch advice.Zone {
+	case ZoneGreen:
+		advice.Instructions = plan.Instructions.Green
+	case ZoneYellow:
+		advice.Instructions = plan.Instructions.Yellow
+	case ZoneRed:
+		advice.Instructions = plan.Instructions.Red
+	}
+	return advice
+}
+
+// PersonalBest returns the configured personal best, loading the records
+// for the best reading only if there is none.
+func (s *ActionPlanService) PersonalBest(ctx context.Context) (float32, error) {
+	if personalBest := s.zones.PersonalBest(nil); personalBest > 0 {
+		return personalBest, nil
+	}
+
+	records, err := s.records.GetAll(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return s.zones.PersonalBest(records), nil
+}
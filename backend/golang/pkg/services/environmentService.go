@@ -0,0 +1,68 @@
+package services
+
+import (
+	"context"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/analytics"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/environment"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/logging"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+	"log/slog"
+)
+
+// maxEnvironmentLookups bounds the observations looked up for a single
+// report, readings written since the provider was set up have theirs stored.
+const maxEnvironmentLookups = 50
+
+// EnvironmentService relates readings to the environment at location.
+type EnvironmentService struct {
+	records  models.RecordModel
+	provider environment.Provider
+	location string
+	logger   *slog.Logger
+}
+
+// NewEnvironmentService looks up observations missing from records with
+// provider, which may be nil to only use the stored ones.
+func NewEnvironmentService(records models.RecordModel, provider environment.Provider, location string, logger *slog.Logger) *EnvironmentService {
+	return &EnvironmentService{records: records, provider: provider, location: location, logger: logger}
+}
+
+// Correlation of all readings with the environment. Readings stored
+// before the provider was set up are looked up, but not updated. At most
+// maxEnvironmentLookups of them are, and none after a lookup failed, the
+// others count as not observed.
+func (s *EnvironmentService) Correlation(ctx context.Context) (*analytics.EnvironmentReport, error) {
+	records, err := s.records.GetAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.provider != nil {
+		lookups := 0
+		for index, record := range records {
+			if record.Environment != nil {
+				continue
+			}
+			if lookups == maxEnvironmentLookups {
+				logging.FromContext(ctx, s.logger).Info("leaving out readings without an observation",
+					"max_lookups", maxEnvironmentLookups)
+				break
+			}
+			lookups++
+
+			observed := *record
+			err = environment.Attach(ctx, s.provider, s.location, &observed)
+			if err != nil {
+				// the provider is likely down, don't wait for it again
+				logging.FromContext(ctx, s.logger).Warn("looking up the environment of readings failed",
+					"record_id", record.ID, "error", err)
+				break
+			}
+			records[index] = &observed
+		}
+	}
+
+	report := analytics.CorrelateEnvironment(records)
+	report.Location = s.location
+	return report, nil
+}
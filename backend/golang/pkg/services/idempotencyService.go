@@ -0,0 +1,121 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+	"sync"
+	"time"
+)
+
+var ErrIdempotencyKeyReused = errors.New("services: idempotency key was already used for a different request")
+var ErrIdempotencyInProgress = errors.New("services: request with this idempotency key is still in progress")
+
+// IdempotencyService makes sure a request sent with an Idempotency-Key
+// is processed once per TTL, retries get the stored response instead.
+type IdempotencyService struct {
+	entries models.IdempotencyModel
+	ttl     time.Duration
+
+	mu       sync.Mutex
+	inflight map[string]chan struct{}
+}
+
+func NewIdempotencyService(entries models.IdempotencyModel, ttl time.Duration) *IdempotencyService {
+	return &IdempotencyService{
+		entries:  entries,
+		ttl:      ttl,
+		inflight: map[string]chan struct{}{},
+	}
+}
+
+// Begin reserves the key for a request identified by fingerprint. If the key
+// was already used for a completed request, its entry is returned and the
+// stored response must be replayed. Otherwise the caller must finish the
+// request with Complete or Abort.
+//
+// Concurrent requests with the same key wait for the first one to finish,
+// until ctx is done, requests on other instances get
+// ErrIdempotencyInProgress instead.
+func (s *IdempotencyService) Begin(ctx context.Context, key, fingerprint string) (*models.IdempotencyEntry, error) {
+	for {
+		s.mu.Lock()
+		wait, busy := s.inflight[key]
+		if !busy {
+			s.inflight[key] = make(chan struct{})
+		}
+		s.mu.Unlock()
+
+		if busy {
+			select {
+			case <-wait:
+				continue
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+
+		entry, err := s.begin(ctx, key, fingerprint)
+		if entry != nil || err != nil {
+			s.release(key)
+		}
+		return entry, err
+	}
+}
+
+func (s *IdempotencyService) begin(ctx context.Context, key, fingerprint string) (*models.IdempotencyEntry, error) {
+	for {
+		err := s.entries.Reserve(ctx, &models.IdempotencyEntry{
+			Key:         key,
+			Fingerprint: fingerprint,
+			ExpiresAt:   time.Now().Add(s.ttl),
+		})
+		if err == nil {
+			return nil, nil
+		}
+		if !errors.Is(err, models.ErrIdempotencyKeyExists) {
+			return nil, err
+		}
+
+		entry, err := s.entries.Get(ctx, key)
+		if errors.Is(err, models.ErrNoRecord) {
+			// expired or aborted in the meantime, try to reserve it again
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if entry.Fingerprint != fingerprint {
+			return nil, ErrIdempotencyKeyReused
+		}
+		if !entry.Completed {
+			return nil, ErrIdempotencyInProgress
+		}
+		return entry, nil
+	}
+}
+
+// Complete stores the response of a request started with Begin.
+func (s *IdempotencyService) Complete(ctx context.Context, entry *models.IdempotencyEntry) error {
+	defer s.release(entry.Key)
+
+	return s.entries.Complete(ctx, entry)
+}
+
+// Abort forgets the key of a failed request, so it can be retried.
+func (s *IdempotencyService) Abort(ctx context.Context, key string) error {
+	defer s.release(key)
+
+	return s.entries.Remove(ctx, key)
+}
+
+func (s *IdempotencyService) release(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if wait, ok := s.inflight[key]; ok {
+		close(wait)
+		delete(s.inflight, key)
+	}
+}
@@ -0,0 +1,117 @@
+package services
+
+import (
+	"context"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+	"time"
+)
+
+// DefaultReorderBelow is the number of doses left at which a new inhaler
+// should be ordered, for medications created without one.
+const DefaultReorderBelow = 20
+
+// Inventory estimates what is left in the current inhaler of a Medication.
+type Inventory struct {
+	PuffsLeft int  `json:"puffs_left"`
+	DosesLeft int  `json:"doses_left"`
+	Reorder   bool `json:"reorder"` // fewer than ReorderBelow doses left
+}
+
+// NewInventory counts the puffs of doses against the capacity of the
+// inhaler, doses are expected to be taken since it was refilled.
+func NewInventory(medication *models.Medication, doses []*models.Dose) *Inventory {
+	puffs := medication.Capacity
+	for _, dose := range doses {
+		puffs -= dose.Puffs
+	}
+
+	inventory := &Inventory{PuffsLeft: max(puffs, 0)}
+	if medication.PuffsPerDose > 0 {
+		inventory.DosesLeft = inventory.PuffsLeft / medication.PuffsPerDose
+	}
+	inventory.Reorder = inventory.DosesLeft < medication.ReorderBelow
+	return inventory
+}
+
+// DoseNearReading is a dose taken around a reading, a reliever dose
+// shortly before explains a reading higher than usual.
+type DoseNearReading struct {
+	*models.Dose
+	MedicationName string `json:"medication_name"`
+	MedicationType string `json:"medication_type"`
+	// MinutesFromReading is negative for doses taken before the reading
+	MinutesFromReading int `json:"minutes_from_reading"`
+}
+
+// MedicationService tracks the inhalers in use and the doses taken.
+type MedicationService struct {
+	medications models.MedicationModel
+}
+
+func NewMedicationService(medications models.MedicationModel) *MedicationService {
+	return &MedicationService{medications: medications}
+}
+
+// Inventory returns what is left in the current inhaler of medication.
+func (s *MedicationService) Inventory(ctx context.Context, medication *models.Medication) (*Inventory, error) {
+	doses, err := s.medications.Doses(ctx, &models.DoseQuery{MedicationID: medication.ID, From: medication.RefilledAt})
+	if err != nil {
+		return nil, err
+	}
+	return NewInventory(medication, doses), nil
+}
+
+// LogDose saves a dose of medication and returns the inventory after it.
+// alert reports whether the dose made it drop below the reorder threshold.
+func (s *MedicationService) LogDose(ctx context.Context, medication *models.Medication, dose *models.Dose) (inventory *Inventory, alert bool, err error) {
+	before, err := s.Inventory(ctx, medication)
+	if err != nil {
+		return nil, false, err
+	}
+
+	err = s.medications.AddDose(ctx, dose)
+	if err != nil {
+		return nil, false, err
+	}
+
+	inventory, err = s.Inventory(ctx, medication)
+	if err != nil {
+		return nil, false, err
+	}
+	return inventory, inventory.Reorder && !before.Reorder, nil
+}
+
+// DosesAround returns the doses of any medication taken from before ahead
+// of record until after it, oldest first.
+func (s *MedicationService) DosesAround(ctx context.Context, record *models.Record, before, after time.Duration) ([]*DoseNearReading, error) {
+	doses, err := s.medications.Doses(ctx, &models.DoseQuery{
+		From:  record.CreatedAt.Add(-before),
+		Until: record.CreatedAt.Add(after + time.Nanosecond), // a dose at the end is included
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	medications, err := s.medications.GetAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[string]*models.Medication, len(medications))
+	for _, medication := range medications {
+		byID[medication.ID] = medication
+	}
+
+	near := make([]*DoseNearReading, 0, len(doses))
+	for _, dose := range doses {
+		dn := &DoseNearReading{
+			Dose:               dose,
+			MinutesFromReading: int(dose.TakenAt.Sub(record.CreatedAt).Round(time.Minute).Minutes()),
+		}
+		if medication, ok := byID[dose.MedicationID]; ok {
+			dn.MedicationName = medication.Name
+			dn.MedicationType = medication.Type
+		}
+		near = append(near, dn)
+	}
+	return near, nil
+}
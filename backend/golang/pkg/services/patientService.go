@@ -0,0 +1,118 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+	"strings"
+	"time"
+)
+
+var ErrLastOwner = errors.New("services: a patient must keep an owner")
+
+// PatientService creates patients and manages who has access to them,
+// a patient always keeps at least one owner.
+type PatientService struct {
+	patients models.PatientModel
+	users    models.UserModel
+}
+
+func NewPatientService(patients models.PatientModel, users models.UserModel) *PatientService {
+	return &PatientService{patients: patients, users: users}
+}
+
+// Create stores patient under a new ID with owner as its owner.
+func (s *PatientService) Create(ctx context.Context, patient *models.Patient, owner *models.User) error {
+	patient.Name = strings.TrimSpace(patient.Name)
+	if patient.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+
+	now := time.Now().Truncate(time.Second)
+	patient.ID = uuid.New().String()
+	patient.CreatedAt = now
+	err := s.patients.Update(ctx, patient)
+	if err != nil {
+		return err
+	}
+
+	return s.patients.SetMembership(ctx, &models.Membership{
+		PatientID: patient.ID,
+		UserID:    owner.ID,
+		Role:      models.RoleOwner,
+		CreatedAt: now,
+	})
+}
+
+// Grant gives the user userID role for the patient, replacing the role it
+// had. ErrNoUser if there is no such user, ErrLastOwner if it would leave
+// the patient without an owner.
+func (s *PatientService) Grant(ctx context.Context, patientID, userID, role string) (*models.Membership, error) {
+	if !models.ValidRole(role) {
+		return nil, fmt.Errorf("role must be one of %s, %s or %s",
+			models.RoleOwner, models.RoleCaregiver, models.RoleViewer)
+	}
+	if _, err := s.users.Get(ctx, userID); err != nil {
+		return nil, err
+	}
+
+	membership, err := s.patients.Membership(ctx, patientID, userID)
+	switch {
+	case errors.Is(err, models.ErrNoMembership):
+		membership = &models.Membership{
+			PatientID: patientID,
+			UserID:    userID,
+			CreatedAt: time.Now().Truncate(time.Second),
+		}
+	case err != nil:
+		return nil, err
+	case membership.Role == models.RoleOwner && role != models.RoleOwner:
+		if err := s.keepOwner(ctx, patientID); err != nil {
+			return nil, err
+		}
+	}
+
+	membership.Role = role
+	err = s.patients.SetMembership(ctx, membership)
+	if err != nil {
+		return nil, err
+	}
+	return membership, nil
+}
+
+// Revoke removes the access of the user userID to the patient and returns
+// the membership it had, ErrLastOwner if it is its only owner.
+func (s *PatientService) Revoke(ctx context.Context, patientID, userID string) (*models.Membership, error) {
+	membership, err := s.patients.Membership(ctx, patientID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if membership.Role == models.RoleOwner {
+		if err := s.keepOwner(ctx, patientID); err != nil {
+			return nil, err
+		}
+	}
+	return membership, s.patients.RemoveMembership(ctx, patientID, userID)
+}
+
+// keepOwner returns ErrLastOwner unless the patient has another owner
+// than the one about to lose the role.
+func (s *PatientService) keepOwner(ctx context.Context, patientID string) error {
+	memberships, err := s.patients.Memberships(ctx, patientID)
+	if err != nil {
+		return err
+	}
+
+	owners := 0
+	for _, membership := range memberships {
+		if membership.Role == models.RoleOwner {
+			owners++
+		}
+	}
+	if owners < 2 {
+		return ErrLastOwner
+	}
+	return nil
+}
@@ -6,11 +6,14 @@ import (
 )
 import "github.com/google/uuid"
 
+// RecordsService creates Records in the time zone of the user, unless a
+// client tells the one a reading was taken in.
 type RecordsService struct {
+	location *time.Location
 }
 
-func NewRecordsService() *RecordsService {
-	return &RecordsService{}
+func NewRecordsService(location *time.Location) *RecordsService {
+	return &RecordsService{location: location}
 }
 
 func (r *RecordsService) NewRecordByValue(value float32) *models.Record {
@@ -18,7 +21,21 @@ func (r *RecordsService) NewRecordByValue(value float32) *models.Record {
 
 	record.ID = uuid.New().String()
 	record.Value = value
-	record.CreatedAt = time.Now()
+	record.CreatedAt = time.Now().In(r.location)
+	record.Timezone = r.location.String()
 
 	return record
-}
\ No newline at end of file
+}
+
+// Localize gives a Record sent without a time zone the one of the user.
+func (r *RecordsService) Localize(record *models.Record) {
+	if record.Timezone == "" {
+		record.Timezone = r.location.String()
+	}
+}
+
+// Location is the time zone of the user, days of Records without one of
+// their own are counted in it.
+func (r *RecordsService) Location() *time.Location {
+	return r.location
+}
@@ -0,0 +1,41 @@
+package services
+
+import (
+	"context"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/analytics"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+	"time"
+)
+
+// ReportService puts readings and doses together for reviews with the doctor.
+type ReportService struct {
+	records     models.RecordModel
+	medications models.MedicationModel
+	now         func() time.Time
+}
+
+func NewReportService(records models.RecordModel, medications models.MedicationModel) *ReportService {
+	return &ReportService{records: records, medications: medications, now: time.Now}
+}
+
+// Adherence reports on the number of weeks up to the current one, in the
+// calendar of location.
+func (s *ReportService) Adherence(ctx context.Context, weeks int, location *time.Location) (*analytics.Adherence, error) {
+	now := s.now()
+	from := analytics.BucketStart(now.In(location), models.BucketWeek).AddDate(0, 0, -7*(weeks-1))
+
+	medications, err := s.medications.GetAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	doses, err := s.medications.Doses(ctx, &models.DoseQuery{From: from})
+	if err != nil {
+		return nil, err
+	}
+	records, err := s.records.GetAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return analytics.NewAdherence(medications, doses, records, now, location, weeks), nil
+}
@@ -0,0 +1,92 @@
+package services
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+	"strings"
+	"time"
+)
+
+// sessionToken is the content of a signed session cookie.
+type sessionToken struct {
+	UserID    string    `json:"uid"`
+	ExpiresAt time.Time `json:"exp"`
+}
+
+// SessionService issues and verifies the HMAC signed session cookies of
+// browsers, which can't send a bearer token with plain links and forms.
+// The signature covers the token hash of the user as well, so resetting
+// the token of an account ends its sessions.
+type SessionService struct {
+	users  models.UserModel
+	secret []byte
+	ttl    time.Duration
+}
+
+// NewSessionService creates sessions valid for ttl.
+func NewSessionService(users models.UserModel, secret []byte, ttl time.Duration) *SessionService {
+	return &SessionService{users: users, secret: secret, ttl: ttl}
+}
+
+// Issue returns the cookie value of a new session of user and its expiry.
+func (s *SessionService) Issue(user *models.User) (string, time.Time, error) {
+	expiresAt := time.Now().Add(s.ttl).Truncate(time.Second)
+	payload, err := json.Marshal(&sessionToken{UserID: user.ID, ExpiresAt: expiresAt})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "~" + s.sign(encoded, user), expiresAt, nil
+}
+
+// Verify returns the user of a session cookie value, ErrUnauthenticated if
+// it is invalid or has ended and ErrAccountDisabled if the account was
+// disabled.
+func (s *SessionService) Verify(ctx context.Context, value string) (*models.User, error) {
+	encoded, signature, found := strings.Cut(value, "~")
+	if !found {
+		return nil, ErrUnauthenticated
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrUnauthenticated
+	}
+	var content *sessionToken
+	err = json.Unmarshal(payload, &content)
+	if err != nil || content == nil {
+		return nil, ErrUnauthenticated
+	}
+
+	user, err := s.users.Get(ctx, content.UserID)
+	if errors.Is(err, models.ErrNoUser) {
+		return nil, ErrUnauthenticated
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal([]byte(signature), []byte(s.sign(encoded, user))) {
+		return nil, ErrUnauthenticated
+	}
+	if !time.Now().Before(content.ExpiresAt) {
+		return nil, ErrUnauthenticated
+	}
+	if user.DisabledAt != nil {
+		return nil, ErrAccountDisabled
+	}
+	return user, nil
+}
+
+func (s *SessionService) sign(encoded string, user *models.User) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(encoded))
+	mac.Write([]byte{0})
+	mac.Write([]byte(user.TokenHash))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
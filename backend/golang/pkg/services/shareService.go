@@ -0,0 +1,132 @@
+package services
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+	"strings"
+	"time"
+)
+
+var ErrShareInvalid = errors.New("services: share link is invalid")
+var ErrShareExpired = errors.New("services: share link has expired")
+var ErrShareRevoked = errors.New("services: share link was revoked")
+
+// shareToken is the content of a signed share link token, the share
+// itself is looked up so it can be revoked.
+type shareToken struct {
+	ID        string    `json:"id"`
+	ExpiresAt time.Time `json:"exp"`
+}
+
+// ShareService creates shares and issues and verifies the HMAC signed
+// tokens of their links.
+type ShareService struct {
+	shares models.ShareModel
+	secret []byte
+	ttl    time.Duration
+	maxTTL time.Duration
+}
+
+// NewShareService creates shares valid for ttl unless they expire earlier,
+// at most for maxTTL.
+func NewShareService(shares models.ShareModel, secret []byte, ttl, maxTTL time.Duration) *ShareService {
+	return &ShareService{shares: shares, secret: secret, ttl: ttl, maxTTL: maxTTL}
+}
+
+// Create stores share under a new ID and returns the token of its link.
+func (s *ShareService) Create(ctx context.Context, share *models.Share) (string, error) {
+	now := time.Now()
+	if share.ExpiresAt.IsZero() {
+		share.ExpiresAt = now.Add(s.ttl)
+	}
+	share.ExpiresAt = share.ExpiresAt.Truncate(time.Second)
+	if !share.ExpiresAt.After(now) {
+		return "", fmt.Errorf("expires_at must be in the future")
+	}
+	if share.ExpiresAt.After(now.Add(s.maxTTL)) {
+		return "", fmt.Errorf("expires_at must be within %s", s.maxTTL)
+	}
+
+	share.ID = uuid.New().String()
+	share.CreatedAt = now.Truncate(time.Second)
+	share.RevokedAt = nil
+	err := s.shares.Update(ctx, share)
+	if err != nil {
+		return "", err
+	}
+	return s.Token(share)
+}
+
+// Token returns the token of the link of share.
+func (s *ShareService) Token(share *models.Share) (string, error) {
+	payload, err := json.Marshal(&shareToken{ID: share.ID, ExpiresAt: share.ExpiresAt})
+	if err != nil {
+		return "", err
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	// not a dot, which would be taken for a format extension in URLs
+	return encoded + "~" + s.sign(encoded), nil
+}
+
+// Verify checks the token signature and returns its share, unless it has
+// expired or was revoked.
+func (s *ShareService) Verify(ctx context.Context, token string) (*models.Share, error) {
+	encoded, signature, found := strings.Cut(token, "~")
+	if !found || !hmac.Equal([]byte(signature), []byte(s.sign(encoded))) {
+		return nil, ErrShareInvalid
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrShareInvalid
+	}
+	var content *shareToken
+	err = json.Unmarshal(payload, &content)
+	if err != nil {
+		return nil, ErrShareInvalid
+	}
+	if !time.Now().Before(content.ExpiresAt) {
+		return nil, ErrShareExpired
+	}
+
+	share, err := s.shares.Get(ctx, content.ID)
+	if errors.Is(err, models.ErrNoShare) {
+		return nil, ErrShareInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	if share.RevokedAt != nil {
+		return nil, ErrShareRevoked
+	}
+	if !time.Now().Before(share.ExpiresAt) {
+		return nil, ErrShareExpired
+	}
+	return share, nil
+}
+
+// Revoke stops the link of share from working, a revoked share stays
+// revoked since the first time.
+func (s *ShareService) Revoke(ctx context.Context, share *models.Share) error {
+	if share.RevokedAt != nil {
+		return nil
+	}
+
+	now := time.Now().Truncate(time.Second)
+	share.RevokedAt = &now
+	return s.shares.Update(ctx, share)
+}
+
+func (s *ShareService) sign(encoded string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(encoded))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
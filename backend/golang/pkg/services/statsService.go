@@ -0,0 +1,104 @@
+package services
+
+import (
+	"context"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/policy"
+	"time"
+)
+
+// SystemStats are counts over every account and patient, for admins.
+type SystemStats struct {
+	Users         int `json:"users"`
+	Admins        int `json:"admins"`
+	DisabledUsers int `json:"disabled_users"`
+	Patients      int `json:"patients"`
+	Memberships   int `json:"memberships"`
+	// Records of every patient, the default one included.
+	Records       int       `json:"records"`
+	Shares        int       `json:"shares"`
+	ActiveShares  int       `json:"active_shares"`
+	StartedAt     time.Time `json:"started_at"`
+	UptimeSeconds int64     `json:"uptime_seconds"`
+}
+
+// StatsService counts what the server stores.
+type StatsService struct {
+	users     models.UserModel
+	patients  models.PatientModel
+	records   models.RecordModel
+	shares    models.ShareModel
+	startedAt time.Time
+	now       func() time.Time
+}
+
+func NewStatsService(users models.UserModel, patients models.PatientModel, records models.RecordModel,
+	shares models.ShareModel) *StatsService {
+	return &StatsService{
+		users:     users,
+		patients:  patients,
+		records:   records,
+		shares:    shares,
+		startedAt: time.Now(),
+		now:       time.Now,
+	}
+}
+
+// Stats counts every user, patient, record and share.
+func (s *StatsService) Stats(ctx context.Context) (*SystemStats, error) {
+	now := s.now()
+	stats := &SystemStats{
+		StartedAt:     s.startedAt.Truncate(time.Second),
+		UptimeSeconds: int64(now.Sub(s.startedAt).Seconds()),
+	}
+
+	users, err := s.users.GetAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stats.Users = len(users)
+	for _, user := range users {
+		if policy.RoleOf(user) == policy.RoleAdmin {
+			stats.Admins++
+		}
+		if user.DisabledAt != nil {
+			stats.DisabledUsers++
+		}
+	}
+
+	patients, err := s.patients.GetAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stats.Patients = len(patients)
+
+	patientIDs := []string{models.DefaultPatient}
+	for _, patient := range patients {
+		patientIDs = append(patientIDs, patient.ID)
+
+		memberships, err := s.patients.Memberships(ctx, patient.ID)
+		if err != nil {
+			return nil, err
+		}
+		stats.Memberships += len(memberships)
+	}
+	for _, patientID := range patientIDs {
+		records, err := s.records.GetAll(models.WithPatient(ctx, patientID))
+		if err != nil {
+			return nil, err
+		}
+		stats.Records += len(records)
+	}
+
+	shares, err := s.shares.GetAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stats.Shares = len(shares)
+	for _, share := range shares {
+		if share.RevokedAt == nil && now.Before(share.ExpiresAt) {
+			stats.ActiveShares++
+		}
+	}
+	return stats, nil
+}
@@ -0,0 +1,243 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+	"strconv"
+	"time"
+)
+
+var ErrInvalidCursor = errors.New("services: invalid sync cursor")
+
+// SyncStatus is the outcome of a change pushed by a client.
+type SyncStatus string
+
+const (
+	SyncApplied   SyncStatus = "applied"   // written, the result holds the new version
+	SyncUnchanged SyncStatus = "unchanged" // the server has this version already
+	SyncConflict  SyncStatus = "conflict"  // the server version won, the result holds it
+	SyncRejected  SyncStatus = "rejected"  // invalid change, see the error
+	SyncFailed    SyncStatus = "failed"    // not applied for a server problem, push it again later
+)
+
+// maxClockSkew is how far in the future a reading may be taken, by the
+// clock of a phone.
+const maxClockSkew = 24 * time.Hour
+
+const maxSyncIDLength = 128
+
+// SyncChange is a change made by a client while offline. Clients create
+// records with their own IDs, and send the Rev they last saw as BaseRev,
+// which is 0 for records they created.
+type SyncChange struct {
+	ID        string    `json:"id"`
+	BaseRev   int       `json:"base_rev"`
+	Deleted   bool      `json:"deleted,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	Value     float32   `json:"value"`
+	Context   string    `json:"context,omitempty"`
+	Timezone  string    `json:"tz,omitempty"`
+}
+
+// SyncResult tells a client what became of a SyncChange and the version
+// of the record on the server afterwards.
+type SyncResult struct {
+	ID      string         `json:"id"`
+	Status  SyncStatus     `json:"status"`
+	Deleted bool           `json:"deleted,omitempty"`
+	Record  *models.Record `json:"record,omitempty"`
+	Error   string         `json:"error,omitempty"`
+}
+
+// ChangeSet is a page of the change feed, Cursor continues after it.
+type ChangeSet struct {
+	Changes []*models.Change
+	Cursor  string
+	HasMore bool
+}
+
+// SyncService lets offline clients catch up with the change feed of the
+// records and push their own changes, resolving conflicts in favour of the
+// server: a change applies only to the version the client last saw.
+type SyncService struct {
+	records  models.RecordModel
+	location *time.Location
+	now      func() time.Time
+}
+
+// NewSyncService stores readings pushed without a time zone in the one of
+// the user at location.
+func NewSyncService(records models.RecordModel, location *time.Location) *SyncService {
+	return &SyncService{records: records, location: location, now: time.Now}
+}
+
+// Changes returns up to limit changes after the cursor, all changes for an
+// empty cursor. Cursors are issued by the server and opaque to clients.
+func (s *SyncService) Changes(ctx context.Context, cursor string, limit int) (*ChangeSet, error) {
+	since, err := parseCursor(cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	changes, err := s.records.Changes(ctx, since, limit+1)
+	if err != nil {
+		return nil, err
+	}
+
+	set := &ChangeSet{Changes: changes, Cursor: cursor}
+	if len(changes) > limit {
+		set.Changes, set.HasMore = changes[:limit], true
+	}
+	if len(set.Changes) > 0 {
+		set.Cursor = formatCursor(set.Changes[len(set.Changes)-1].Seq)
+	}
+	if set.Cursor == "" {
+		set.Cursor = formatCursor(0)
+	}
+	return set, nil
+}
+
+func parseCursor(cursor string) (int64, error) {
+	if cursor == "" {
+		return 0, nil
+	}
+	seq, err := strconv.ParseInt(cursor, 10, 64)
+	if err != nil || seq < 0 {
+		return 0, ErrInvalidCursor
+	}
+	return seq, nil
+}
+
+func formatCursor(seq int64) string {
+	return strconv.FormatInt(seq, 10)
+}
+
+// Push applies the changes of a client in order. The rules are:
+//
+//   - a record unknown to the server is created with the ID of the client
+//   - a change based on the current Rev of the record is applied
+//   - a change based on an older Rev is a conflict, the server version wins
+//   - a change to a record removed on the server is a conflict, removal wins
+//   - a change equal to the server version is unchanged, so retries are safe
+//
+// A change is checked against the current version right before it is
+// written, concurrent writes to the same record in between are not detected.
+//
+// Every change gets a result, a change failing to be stored doesn't stop
+// the others: an id taken by a record of another patient is rejected, any
+// other storage error makes the change fail, so the client pushes it again.
+func (s *SyncService) Push(ctx context.Context, changes []*SyncChange) []*SyncResult {
+	results := make([]*SyncResult, 0, len(changes))
+	for _, change := range changes {
+		result, err := s.push(ctx, change)
+		switch {
+		case errors.Is(err, models.ErrRecordExists):
+			result = &SyncResult{ID: change.ID, Status: SyncRejected, Error: "id is taken"}
+		case err != nil:
+			result = &SyncResult{ID: change.ID, Status: SyncFailed, Error: "storing the change failed"}
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+func (s *SyncService) push(ctx context.Context, change *SyncChange) (*SyncResult, error) {
+	if change == nil {
+		return &SyncResult{Status: SyncRejected, Error: "missing change"}, nil
+	}
+	result := &SyncResult{ID: change.ID}
+	if err := s.validate(change); err != nil {
+		result.Status, result.Error = SyncRejected, err.Error()
+		return result, nil
+	}
+
+	current, err := s.records.Get(ctx, change.ID)
+	if errors.Is(err, models.ErrNoRecord) {
+		current = nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case current == nil && change.Deleted:
+		result.Status, result.Deleted = SyncUnchanged, true
+		return result, nil
+	case current == nil && change.BaseRev > 0:
+		result.Status, result.Deleted = SyncConflict, true
+		return result, nil
+	case current == nil:
+		return s.write(ctx, result, change)
+	case !change.Deleted && sameReading(current, change):
+		result.Status, result.Record = SyncUnchanged, current
+		return result, nil
+	case change.BaseRev != current.Rev:
+		result.Status, result.Record = SyncConflict, current
+		return result, nil
+	case change.Deleted:
+		removed, err := s.records.Remove(ctx, change.ID)
+		if err != nil {
+			return nil, err
+		}
+		result.Status, result.Deleted = SyncApplied, true
+		if removed == 0 {
+			result.Status = SyncUnchanged
+		}
+		return result, nil
+	default:
+		return s.write(ctx, result, change)
+	}
+}
+
+func (s *SyncService) write(ctx context.Context, result *SyncResult, change *SyncChange) (*SyncResult, error) {
+	record := &models.Record{
+		ID:        change.ID,
+		CreatedAt: change.CreatedAt,
+		Value:     change.Value,
+		Context:   change.Context,
+		Timezone:  change.Timezone,
+	}
+	if record.Timezone == "" {
+		record.Timezone = s.location.String()
+	}
+	_, err := s.records.Update(ctx, record)
+	if err != nil {
+		return nil, err
+	}
+
+	result.Status, result.Record = SyncApplied, record
+	return result, nil
+}
+
+func (s *SyncService) validate(change *SyncChange) error {
+	switch {
+	case change.ID == "":
+		return errors.New("missing id")
+	case len(change.ID) > maxSyncIDLength:
+		return fmt.Errorf("id is longer than %d bytes", maxSyncIDLength)
+	case change.BaseRev < 0:
+		return errors.New("base_rev must not be negative")
+	case change.Deleted:
+		return nil
+	case change.Value <= 0:
+		return errors.New("value must be positive")
+	case change.CreatedAt.IsZero():
+		return errors.New("missing created_at")
+	case change.CreatedAt.After(s.now().Add(maxClockSkew)):
+		return errors.New("created_at is in the future")
+	case change.Timezone != "":
+		_, err := models.LoadTimezone(change.Timezone)
+		return err
+	}
+	return nil
+}
+
+// sameReading compares times in milliseconds, as precise as MongoDB stores
+// them. A change without a time zone got the one of the user.
+func sameReading(record *models.Record, change *SyncChange) bool {
+	return record.Value == change.Value &&
+		record.Context == change.Context &&
+		(change.Timezone == "" || record.Timezone == change.Timezone) &&
+		record.CreatedAt.Truncate(time.Millisecond).Equal(change.CreatedAt.Truncate(time.Millisecond))
+}
@@ -0,0 +1,32 @@
+package services
+
+import (
+	"context"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/analytics"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+	"time"
+)
+
+// TrendService detects trends in the stored readings, with parameters set
+// by the server rather than by clients.
+type TrendService struct {
+	records  models.RecordModel
+	params   analytics.TrendParams
+	location *time.Location
+	now      func() time.Time
+}
+
+// NewTrendService counts days in the calendar of location.
+func NewTrendService(records models.RecordModel, params analytics.TrendParams, location *time.Location) *TrendService {
+	return &TrendService{records: records, params: params, location: location, now: time.Now}
+}
+
+// Trend of the readings up to today.
+func (s *TrendService) Trend(ctx context.Context) (*analytics.Trend, error) {
+	records, err := s.records.GetAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return analytics.NewTrend(records, s.now(), s.location, s.params), nil
+}
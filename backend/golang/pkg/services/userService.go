@@ -0,0 +1,143 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/policy"
+	"strings"
+	"time"
+)
+
+var ErrUnauthenticated = errors.New("services: invalid or missing token")
+var ErrAccountDisabled = errors.New("services: account is disabled")
+
+// UserService creates users and authenticates them by their bearer token.
+// Only the hash of a token is stored, it is shown once on creation.
+type UserService struct {
+	users models.UserModel
+}
+
+func NewUserService(users models.UserModel) *UserService {
+	return &UserService{users: users}
+}
+
+// Create stores a user named name and returns it with its token.
+func (s *UserService) Create(ctx context.Context, name string) (*models.User, string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, "", fmt.Errorf("name is required")
+	}
+
+	token, err := newToken()
+	if err != nil {
+		return nil, "", err
+	}
+
+	user := &models.User{
+		ID:        uuid.New().String(),
+		Name:      name,
+		Role:      string(policy.RoleUser),
+		TokenHash: HashToken(token),
+		CreatedAt: time.Now().Truncate(time.Second),
+	}
+	err = s.users.Update(ctx, user)
+	if err != nil {
+		return nil, "", err
+	}
+	return user, token, nil
+}
+
+// EnsureAdmin makes the user of token an enabled admin, creating one named
+// admin if there is none. It lets the first admin in, who can't be created
+// by another one.
+func (s *UserService) EnsureAdmin(ctx context.Context, token string) (*models.User, error) {
+	user, err := s.users.GetByTokenHash(ctx, HashToken(token))
+	if errors.Is(err, models.ErrNoUser) {
+		user = &models.User{
+			ID:        uuid.New().String(),
+			Name:      "admin",
+			TokenHash: HashToken(token),
+			CreatedAt: time.Now().Truncate(time.Second),
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	user.Role = string(policy.RoleAdmin)
+	user.DisabledAt = nil
+	return user, s.users.Update(ctx, user)
+}
+
+// Authenticate returns the user of token, ErrUnauthenticated if there is
+// none and ErrAccountDisabled if it was disabled.
+func (s *UserService) Authenticate(ctx context.Context, token string) (*models.User, error) {
+	if token == "" {
+		return nil, ErrUnauthenticated
+	}
+
+	user, err := s.users.GetByTokenHash(ctx, HashToken(token))
+	if errors.Is(err, models.ErrNoUser) {
+		return nil, ErrUnauthenticated
+	}
+	if err != nil {
+		return nil, err
+	}
+	if user.DisabledAt != nil {
+		return nil, ErrAccountDisabled
+	}
+	return user, nil
+}
+
+// ResetToken gives user a new token and returns it, the previous one stops
+// working.
+func (s *UserService) ResetToken(ctx context.Context, user *models.User) (string, error) {
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+
+	user.TokenHash = HashToken(token)
+	err = s.users.Update(ctx, user)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Disable keeps user from authenticating until it is enabled again, its
+// data is kept.
+func (s *UserService) Disable(ctx context.Context, user *models.User) error {
+	if user.DisabledAt == nil {
+		disabledAt := time.Now().Truncate(time.Second)
+		user.DisabledAt = &disabledAt
+	}
+	return s.users.Update(ctx, user)
+}
+
+// Enable lets a disabled user authenticate again.
+func (s *UserService) Enable(ctx context.Context, user *models.User) error {
+	user.DisabledAt = nil
+	return s.users.Update(ctx, user)
+}
+
+// HashToken returns the hex encoded SHA-256 hash a token is stored as.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func newToken() (string, error) {
+	random := make([]byte, 32)
+	_, err := rand.Read(random)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(random), nil
+}
@@ -0,0 +1,67 @@
+package services
+
+import "github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+
+// Zone of a peak flow reading, relative to the personal best.
+type Zone string
+
+const (
+	ZoneGreen  Zone = "green"  // 80% of the personal best or more
+	ZoneYellow Zone = "yellow" // 50% up to 80%
+	ZoneRed    Zone = "red"    // below 50%
+)
+
+// ZonesService sorts readings into the green, yellow and red zones.
+type ZonesService struct {
+	personalBest float32
+}
+
+// NewZonesService uses personalBest for zones, or the best recorded
+// reading if it is zero.
+func NewZonesService(personalBest float32) *ZonesService {
+	return &ZonesService{personalBest: personalBest}
+}
+
+// PersonalBest returns the configured personal best, or the highest of records.
+func (s *ZonesService) PersonalBest(records []*models.Record) float32 {
+	if s.personalBest > 0 {
+		return s.personalBest
+	}
+
+	var best float32
+	for _, record := range records {
+		if record.Value > best {
+			best = record.Value
+		}
+	}
+	return best
+}
+
+// Zone returns the zone of value for personalBest, green if there is none yet.
+func (s *ZonesService) Zone(value, personalBest float32) Zone {
+	return s.Thresholds(personalBest).Zone(value)
+}
+
+// Thresholds returns the generic zones relative to personalBest, action
+// plans override them with thresholds of their own.
+func (s *ZonesService) Thresholds(personalBest float32) Thresholds {
+	return Thresholds{GreenFrom: personalBest * 0.8, YellowFrom: personalBest * 0.5}
+}
+
+// Thresholds are the lowest readings of the green and the yellow zone in
+// L/min, readings below YellowFrom are red.
+type Thresholds struct {
+	GreenFrom, YellowFrom float32
+}
+
+// Zone returns the zone of value, green if there are no thresholds yet.
+func (t Thresholds) Zone(value float32) Zone {
+	switch {
+	case t.GreenFrom <= 0 || value >= t.GreenFrom:
+		return ZoneGreen
+	case value >= t.YellowFrom:
+		return ZoneYellow
+	default:
+		return ZoneRed
+	}
+}
@@ -0,0 +1,73 @@
+package sharing
+
+import (
+	"context"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+)
+
+// MedicationModel decorates any models.MedicationModel, within a Share
+// only the Doses taken at times it covers are seen and nothing can be
+// written. Medications themselves are seen, the doses are what is private.
+type MedicationModel struct {
+	next models.MedicationModel
+}
+
+func NewMedicationModel(next models.MedicationModel) *MedicationModel {
+	return &MedicationModel{next: next}
+}
+
+func (m *MedicationModel) Update(ctx context.Context, medication *models.Medication) error {
+	if FromContext(ctx) != nil {
+		return ErrReadOnly
+	}
+	return m.next.Update(ctx, medication)
+}
+
+func (m *MedicationModel) Get(ctx context.Context, id string) (*models.Medication, error) {
+	return m.next.Get(ctx, id)
+}
+
+func (m *MedicationModel) GetAll(ctx context.Context) ([]*models.Medication, error) {
+	return m.next.GetAll(ctx)
+}
+
+func (m *MedicationModel) Remove(ctx context.Context, id string) error {
+	if FromContext(ctx) != nil {
+		return ErrReadOnly
+	}
+	return m.next.Remove(ctx, id)
+}
+
+func (m *MedicationModel) AddDose(ctx context.Context, dose *models.Dose) error {
+	if FromContext(ctx) != nil {
+		return ErrReadOnly
+	}
+	return m.next.AddDose(ctx, dose)
+}
+
+func (m *MedicationModel) RemoveDose(ctx context.Context, medicationID, id string) (*models.Dose, error) {
+	if FromContext(ctx) != nil {
+		return nil, ErrReadOnly
+	}
+	return m.next.RemoveDose(ctx, medicationID, id)
+}
+
+// Doses within a Share narrows the query to the range of the share.
+func (m *MedicationModel) Doses(ctx context.Context, query *models.DoseQuery) ([]*models.Dose, error) {
+	share := FromContext(ctx)
+	if share == nil {
+		return m.next.Doses(ctx, query)
+	}
+
+	narrowed := *query
+	if narrowed.From.IsZero() || narrowed.From.Before(share.From) {
+		narrowed.From = share.From
+	}
+	if narrowed.Until.IsZero() || narrowed.Until.After(share.Until) {
+		narrowed.Until = share.Until
+	}
+	if !narrowed.From.Before(narrowed.Until) {
+		return []*models.Dose{}, nil
+	}
+	return m.next.Doses(ctx, &narrowed)
+}
@@ -0,0 +1,149 @@
+package sharing
+
+import (
+	"context"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/analytics"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+	"time"
+)
+
+// RecordModel decorates any models.RecordModel, within a Share only the
+// Records it covers are seen and nothing can be written. Outside of
+// shares every call is passed on as is.
+type RecordModel struct {
+	next models.RecordModel
+}
+
+func NewRecordModel(next models.RecordModel) *RecordModel {
+	return &RecordModel{next: next}
+}
+
+func (m *RecordModel) Update(ctx context.Context, record *models.Record) (string, error) {
+	if FromContext(ctx) != nil {
+		return "", ErrReadOnly
+	}
+	return m.next.Update(ctx, record)
+}
+
+func (m *RecordModel) Get(ctx context.Context, id string) (*models.Record, error) {
+	record, err := m.next.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if share := FromContext(ctx); share != nil && !share.Covers(record.CreatedAt) {
+		return nil, models.ErrNoRecord
+	}
+	return record, nil
+}
+
+func (m *RecordModel) Remove(ctx context.Context, id string) (int64, error) {
+	if FromContext(ctx) != nil {
+		return 0, ErrReadOnly
+	}
+	return m.next.Remove(ctx, id)
+}
+
+func (m *RecordModel) GetAll(ctx context.Context) ([]*models.Record, error) {
+	records, err := m.next.GetAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	share := FromContext(ctx)
+	if share == nil {
+		return records, nil
+	}
+	shared := []*models.Record{}
+	for _, record := range records {
+		if share.Covers(record.CreatedAt) {
+			shared = append(shared, record)
+		}
+	}
+	return shared, nil
+}
+
+// History of a shared Record, revisions taken at times not shared are
+// left out.
+func (m *RecordModel) History(ctx context.Context, id string) ([]*models.Revision, error) {
+	share := FromContext(ctx)
+	if share == nil {
+		return m.next.History(ctx, id)
+	}
+
+	if _, err := m.Get(ctx, id); err != nil {
+		return nil, err
+	}
+	revisions, err := m.next.History(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	shared := []*models.Revision{}
+	for _, revision := range revisions {
+		if share.Covers(revision.Record.CreatedAt) {
+			shared = append(shared, revision)
+		}
+	}
+	return shared, nil
+}
+
+func (m *RecordModel) Revert(ctx context.Context, id string, rev int) (*models.Record, error) {
+	if FromContext(ctx) != nil {
+		return nil, ErrReadOnly
+	}
+	return m.next.Revert(ctx, id, rev)
+}
+
+func (m *RecordModel) BulkWrite(ctx context.Context, ops []*models.BulkOperation, atomic bool) ([]error, error) {
+	if FromContext(ctx) != nil {
+		return nil, ErrReadOnly
+	}
+	return m.next.BulkWrite(ctx, ops, atomic)
+}
+
+// Changes within a Share are the ones of shared Records, tombstones don't
+// tell whether the Record was shared and are left out.
+func (m *RecordModel) Changes(ctx context.Context, since int64, limit int) ([]*models.Change, error) {
+	changes, err := m.next.Changes(ctx, since, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	share := FromContext(ctx)
+	if share == nil {
+		return changes, nil
+	}
+	shared := []*models.Change{}
+	for _, change := range changes {
+		if change.Record != nil && share.Covers(change.Record.CreatedAt) {
+			shared = append(shared, change)
+		}
+	}
+	return shared, nil
+}
+
+// Summarize within a Share summarizes the shared Records in Go.
+func (m *RecordModel) Summarize(ctx context.Context, since time.Time) (*models.Summary, error) {
+	if FromContext(ctx) == nil {
+		return m.next.Summarize(ctx, since)
+	}
+
+	records, err := m.GetAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return analytics.Summarize(records, since), nil
+}
+
+// Aggregate within a Share summarizes the shared Records in Go, the
+// storage aggregates all of them.
+func (m *RecordModel) Aggregate(ctx context.Context, query *models.AggregateQuery) ([]*models.Bucket, error) {
+	if FromContext(ctx) == nil {
+		return m.next.Aggregate(ctx, query)
+	}
+
+	records, err := m.GetAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return analytics.Aggregate(records, query), nil
+}
@@ -0,0 +1,25 @@
+// Package sharing scopes the models to the Share of a request, so the
+// read-only views of share links run through the same handlers and
+// services as the API of the owner, seeing only what is shared.
+package sharing
+
+import (
+	"context"
+	"errors"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+)
+
+var ErrReadOnly = errors.New("sharing: shared data is read-only")
+
+type contextKey struct{}
+
+// WithShare returns a context scoping the models to share.
+func WithShare(ctx context.Context, share *models.Share) context.Context {
+	return context.WithValue(ctx, contextKey{}, share)
+}
+
+// FromContext returns the Share of the context, nil outside of shares.
+func FromContext(ctx context.Context) *models.Share {
+	share, _ := ctx.Value(contextKey{}).(*models.Share)
+	return share
+}
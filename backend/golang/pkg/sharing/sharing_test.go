@@ -0,0 +1,118 @@
+package sharing
+
+import (
+	"context"
+	"errors"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/models/mock"
+	"testing"
+	"time"
+)
+
+// sharedContext shares the fixture records 1 to 3.
+func sharedContext() context.Context {
+	now := time.Now()
+	return WithShare(context.Background(), &models.Share{
+		Resources: []string{models.ShareRecords},
+		From:      now.Add(-50 * time.Hour),
+		Until:     now.Add(-22 * time.Hour),
+	})
+}
+
+func TestRecordModel(t *testing.T) {
+	//given
+	records := NewRecordModel(mock.NewRecordsModel())
+	ctx := sharedContext()
+
+	//when
+	shared, err := records.GetAll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, err := records.GetAll(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, notShared := records.Get(ctx, "4")
+	buckets, err := records.Aggregate(ctx, &models.AggregateQuery{Bucket: models.BucketMonth, Location: time.UTC})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//then
+	if len(shared) != 3 || len(all) != 6 {
+		t.Errorf("want 3 of 6 records shared, got %d of %d", len(shared), len(all))
+	}
+	if !errors.Is(notShared, models.ErrNoRecord) {
+		t.Errorf("want ErrNoRecord for a record out of the range, got %v", notShared)
+	}
+	count := 0
+	for _, bucket := range buckets {
+		count += bucket.Count
+	}
+	if count != 3 {
+		t.Errorf("want the shared records aggregated, got %d", count)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	//given
+	records := NewRecordModel(mock.NewRecordsModel())
+	medications := NewMedicationModel(mock.NewMedicationModel())
+	ctx := sharedContext()
+
+	//when
+	_, updateErr := records.Update(ctx, &models.Record{ID: "2", Value: 100})
+	_, removeErr := records.Remove(ctx, "2")
+	_, bulkErr := records.BulkWrite(ctx, []*models.BulkOperation{{Kind: models.BulkRemove, Record: &models.Record{ID: "2"}}}, false)
+	doseErr := medications.AddDose(ctx, &models.Dose{ID: "1", MedicationID: "1", TakenAt: time.Now()})
+
+	//then
+	for _, err := range []error{updateErr, removeErr, bulkErr, doseErr} {
+		if !errors.Is(err, ErrReadOnly) {
+			t.Errorf("want ErrReadOnly, got %v", err)
+		}
+	}
+	record, err := records.Get(context.Background(), "2")
+	if err != nil || record.Value != 480 {
+		t.Errorf("want record 2 unchanged, got %+v, %v", record, err)
+	}
+}
+
+func TestMedicationModelDoses(t *testing.T) {
+	//given
+	medications := NewMedicationModel(mock.NewMedicationModel())
+	now := time.Now()
+	for i, hours := range []int{60, 48, 30, 10} {
+		err := medications.AddDose(context.Background(), &models.Dose{
+			ID: string(rune('a' + i)), MedicationID: "1", TakenAt: now.Add(-time.Duration(hours) * time.Hour)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		query *models.DoseQuery
+		want  int
+	}{
+		{"open range", &models.DoseQuery{}, 2},
+		{"within the share", &models.DoseQuery{From: now.Add(-40 * time.Hour)}, 1},
+		{"outside of the share", &models.DoseQuery{Until: now.Add(-55 * time.Hour)}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			//when
+			doses, err := medications.Doses(sharedContext(), tt.query)
+
+			//then
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(doses) != tt.want {
+				t.Errorf("want %d doses, got %d", tt.want, len(doses))
+			}
+		})
+	}
+}
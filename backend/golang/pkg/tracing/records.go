@@ -0,0 +1,129 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"github.com/romanthekat/simple-peak-flowmeter/pkg/models"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"time"
+)
+
+var (
+	requestIDKey   = attribute.Key("http.request_id")
+	jobNameKey     = attribute.Key("peakflow.job.name")
+	recordIDKey    = attribute.Key("peakflow.record.id")
+	recordRevKey   = attribute.Key("peakflow.record.rev")
+	recordCountKey = attribute.Key("peakflow.records.count")
+	batchSizeKey   = attribute.Key("peakflow.batch.size")
+	batchAtomicKey = attribute.Key("peakflow.batch.atomic")
+	changeSeqKey   = attribute.Key("peakflow.change.seq")
+	bucketKey      = attribute.Key("peakflow.aggregate.bucket")
+	timezoneKey    = attribute.Key("peakflow.aggregate.timezone")
+)
+
+// RecordModel decorates any models.RecordModel with a span per method call,
+// storage implementations add spans for their own commands beneath.
+type RecordModel struct {
+	next   models.RecordModel
+	tracer trace.Tracer
+}
+
+func NewRecordModel(next models.RecordModel, provider trace.TracerProvider) *RecordModel {
+	return &RecordModel{next: next, tracer: Tracer(provider)}
+}
+
+func (m *RecordModel) start(ctx context.Context, operation string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	return m.tracer.Start(ctx, "RecordModel."+operation,
+		trace.WithSpanKind(trace.SpanKindInternal),
+		trace.WithAttributes(attributes...))
+}
+
+// end records the error on the span, missing records are expected outcomes.
+func end(span trace.Span, err error) {
+	if err != nil && !errors.Is(err, models.ErrNoRecord) && !errors.Is(err, models.ErrNoRevision) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func (m *RecordModel) Update(ctx context.Context, record *models.Record) (string, error) {
+	ctx, span := m.start(ctx, "Update", recordIDKey.String(record.ID))
+	id, err := m.next.Update(ctx, record)
+	span.SetAttributes(recordRevKey.Int(record.Rev))
+	end(span, err)
+	return id, err
+}
+
+func (m *RecordModel) Get(ctx context.Context, id string) (*models.Record, error) {
+	ctx, span := m.start(ctx, "Get", recordIDKey.String(id))
+	record, err := m.next.Get(ctx, id)
+	end(span, err)
+	return record, err
+}
+
+func (m *RecordModel) Remove(ctx context.Context, id string) (int64, error) {
+	ctx, span := m.start(ctx, "Remove", recordIDKey.String(id))
+	removed, err := m.next.Remove(ctx, id)
+	span.SetAttributes(recordCountKey.Int64(removed))
+	end(span, err)
+	return removed, err
+}
+
+func (m *RecordModel) GetAll(ctx context.Context) ([]*models.Record, error) {
+	ctx, span := m.start(ctx, "GetAll")
+	records, err := m.next.GetAll(ctx)
+	span.SetAttributes(recordCountKey.Int(len(records)))
+	end(span, err)
+	return records, err
+}
+
+func (m *RecordModel) History(ctx context.Context, id string) ([]*models.Revision, error) {
+	ctx, span := m.start(ctx, "History", recordIDKey.String(id))
+	revisions, err := m.next.History(ctx, id)
+	span.SetAttributes(recordCountKey.Int(len(revisions)))
+	end(span, err)
+	return revisions, err
+}
+
+func (m *RecordModel) Revert(ctx context.Context, id string, rev int) (*models.Record, error) {
+	ctx, span := m.start(ctx, "Revert", recordIDKey.String(id), recordRevKey.Int(rev))
+	record, err := m.next.Revert(ctx, id, rev)
+	end(span, err)
+	return record, err
+}
+
+func (m *RecordModel) BulkWrite(ctx context.Context, ops []*models.BulkOperation, atomic bool) ([]error, error) {
+	ctx, span := m.start(ctx, "BulkWrite", batchSizeKey.Int(len(ops)), batchAtomicKey.Bool(atomic))
+	errs, err := m.next.BulkWrite(ctx, ops, atomic)
+	end(span, err)
+	return errs, err
+}
+
+func (m *RecordModel) Changes(ctx context.Context, since int64, limit int) ([]*models.Change, error) {
+	ctx, span := m.start(ctx, "Changes", changeSeqKey.Int64(since))
+	changes, err := m.next.Changes(ctx, since, limit)
+	span.SetAttributes(recordCountKey.Int(len(changes)))
+	end(span, err)
+	return changes, err
+}
+
+func (m *RecordModel) Summarize(ctx context.Context, since time.Time) (*models.Summary, error) {
+	ctx, span := m.start(ctx, "Summarize")
+	summary, err := m.next.Summarize(ctx, since)
+	if summary != nil {
+		span.SetAttributes(recordCountKey.Int(summary.Since))
+	}
+	end(span, err)
+	return summary, err
+}
+
+func (m *RecordModel) Aggregate(ctx context.Context, query *models.AggregateQuery) ([]*models.Bucket, error) {
+	ctx, span := m.start(ctx, "Aggregate", bucketKey.String(query.Bucket), timezoneKey.String(query.Location.String()))
+	buckets, err := m.next.Aggregate(ctx, query)
+	span.SetAttributes(recordCountKey.Int(len(buckets)))
+	end(span, err)
+	return buckets, err
+}
@@ -3,7 +3,10 @@ var chart_height = 400
 var padding = 50
 
 
-d3.json('http://romangaranin.dev:3333/records').then(function(data) {
+// injected by the server, empty for the same origin
+var api_base_url = document.querySelector('meta[name="api-base-url"]').content
+
+d3.json(api_base_url + '/records').then(function(data) {
 	console.log(data)
 	generate(data)
 })
@@ -0,0 +1,144 @@
+// Package ui serves the web UI, embedded into the binary. The index page is
+// an html/template, rendered once with the API base URL and links to the
+// other files carrying their content hash, so those can be cached forever.
+package ui
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+const indexFile = "index.html"
+
+//go:embed static
+var embedded embed.FS
+
+// Static returns the embedded UI files.
+func Static() fs.FS {
+	files, err := fs.Sub(embedded, "static")
+	if err != nil {
+		panic(err)
+	}
+	return files
+}
+
+type file struct {
+	content     []byte
+	contentType string
+	hash        string
+}
+
+// Handler serves the files of a UI directory, the index for the root path.
+type Handler struct {
+	files map[string]*file
+}
+
+// NewHandler loads all files of the UI and renders the index page, API
+// requests of the UI go to apiBaseURL, the same origin if it is empty.
+func NewHandler(files fs.FS, apiBaseURL string) (*Handler, error) {
+	h := &Handler{files: map[string]*file{}}
+
+	err := fs.WalkDir(files, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || name == indexFile {
+			return err
+		}
+
+		content, err := fs.ReadFile(files, name)
+		if err != nil {
+			return err
+		}
+		h.files[name] = newFile(name, content)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	index, err := h.renderIndex(files, apiBaseURL)
+	if err != nil {
+		return nil, err
+	}
+	h.files[indexFile] = newFile(indexFile, index)
+
+	return h, nil
+}
+
+func newFile(name string, content []byte) *file {
+	sum := sha256.Sum256(content)
+
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = http.DetectContentType(content)
+	}
+
+	return &file{
+		content:     content,
+		contentType: contentType,
+		hash:        hex.EncodeToString(sum[:8]),
+	}
+}
+
+func (h *Handler) renderIndex(files fs.FS, apiBaseURL string) ([]byte, error) {
+	page, err := template.New(indexFile).Funcs(template.FuncMap{
+		// asset links a file with its content hash
+		"asset": func(name string) (string, error) {
+			f, ok := h.files[name]
+			if !ok {
+				return "", fmt.Errorf("ui: %s links missing file %s", indexFile, name)
+			}
+			return name + "?v=" + f.hash, nil
+		},
+	}).ParseFS(files, indexFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var index bytes.Buffer
+	err = page.Execute(&index, struct{ APIBaseURL string }{apiBaseURL})
+	if err != nil {
+		return nil, err
+	}
+	return index.Bytes(), nil
+}
+
+// ServeHTTP serves a file by its path, with its content hash as ETag. Files
+// requested with their current hash are immutable, anything else must be
+// revalidated, including the index which links the current hashes.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	if name == "" {
+		name = indexFile
+	}
+
+	f, ok := h.files[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", f.contentType)
+	w.Header().Set("ETag", `"`+f.hash+`"`)
+	if name != indexFile && r.URL.Query().Get("v") == f.hash {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+
+	http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(f.content))
+}